@@ -47,6 +47,30 @@ func parseBaseConfig(baseConfPath string) {
 	}
 }
 
+// Merge configuration files in to base configuration, in order. Keys in later
+// files override keys in earlier files. Nested maps are merged recursively, i.e.
+// an overlay only needs to specify the keys it changes within a module map.
+// Arrays and scalar values are replaced as a whole.
+func Merge(paths ...string) error {
+	if Base.v == nil {
+		Base.v = viper.New()
+		Base.v.SetConfigType("json")
+	}
+
+	for _, path := range paths {
+		ctx, err := Read(path)
+		if err != nil {
+			return fmt.Errorf("Failed to read config %s: %s", path, err)
+		}
+
+		if err = Base.v.MergeConfigMap(ctx.v.AllSettings()); err != nil {
+			return fmt.Errorf("Failed to merge config %s: %s", path, err)
+		}
+	}
+
+	return nil
+}
+
 // Initialize configuration.
 func Init(baseConfPath string) {
 	// Initialize base configuration.
@@ -55,6 +79,10 @@ func Init(baseConfPath string) {
 	}
 }
 
+func (cc *ConfigCtx) Get(key string) interface{} {
+	return cc.v.Get(key)
+}
+
 func (cc *ConfigCtx) GetInt(module, key string, dflt int) int {
 	if val := cc.v.GetStringMap(module)[key]; val != nil {
 		return cast.ToInt(val)
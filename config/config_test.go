@@ -1,6 +1,7 @@
 package config
 
 import (
+	"os"
 	"testing"
 )
 
@@ -9,3 +10,36 @@ func TestLoglevel(t *testing.T) {
 		t.Errorf("Loglevel test failed")
 	}
 }
+
+func TestMerge(t *testing.T) {
+	if err := Merge("testdata/base.json", "testdata/overlay.json"); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	defer Merge("testdata/base.json")
+
+	// Overridden keys.
+	if Base.GetString("db-couch", "spec", "") != "couchbase://db.staging" {
+		t.Errorf("Nested key not overridden: %s", Base.GetString("db-couch", "spec", ""))
+	}
+	if Base.Get("loglevel") != "debug" {
+		t.Errorf("Top level key not overridden: %v", Base.Get("loglevel"))
+	}
+
+	// Keys only in base are preserved.
+	if Base.GetInt("db-couch", "op-timeout-ms", 0) != 2500 {
+		t.Errorf("Nested base key lost")
+	}
+	if len(Base.GetStringSlice("push-nats", "servers", nil)) != 1 {
+		t.Errorf("Base module lost")
+	}
+
+	if err := Merge("testdata/missing.json"); err == nil {
+		t.Errorf("Merge of missing file should fail")
+	}
+}
+
+func TestMain(m *testing.M) {
+	Init("testdata/base.json")
+
+	os.Exit(m.Run())
+}
@@ -0,0 +1,182 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/couchbaselabs/gocb"
+	"github.com/sath33sh/infra/config"
+	"github.com/sath33sh/infra/log"
+	"github.com/sath33sh/infra/metrics"
+	"github.com/sath33sh/infra/sched"
+	"github.com/sath33sh/infra/util"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Change feed defaults.
+const (
+	CHANGE_FIELD                 = "modified" // Mutation timestamp field, in Unix milliseconds.
+	CHANGE_POLL_INTERVAL_SECONDS = 5          // Poll interval.
+)
+
+// Change feed metrics.
+const METRIC_CHANGES = "db_changes_total" // Changes observed by change feed, by bucket.
+
+// Number of changes read per query by the change feed.
+var ChangePageSize = 500
+
+// Document change, observed by the change feed.
+type Change struct {
+	Bucket   BucketIndex     // Bucket.
+	Key      string          // Document key, without bucket key prefix, e.g. "type:id".
+	Modified int64           // Mutation timestamp, in Unix milliseconds.
+	Doc      json.RawMessage // Document.
+}
+
+// Handler of document changes, e.g. publishing them to push. Registering the
+// handler keeps db independent of the push system.
+type ChangeHandler func(c Change)
+
+// Registered change handler.
+var changeHandler atomic.Pointer[ChangeHandler]
+
+// Register handler of changes observed by the change feed.
+func SetChangeHandler(f ChangeHandler) {
+	changeHandler.Store(&f)
+}
+
+// Read raw change rows, with request plus consistency, so that changes indexed
+// late are not skipped.
+var readChangeRows = func(bIndex BucketIndex, queryStmt string, params []interface{}) ([][]byte, error) {
+	return readRows(bIndex, gocb.NewN1qlQuery(queryStmt).Consistency(gocb.RequestPlus), queryStmt, params)
+}
+
+// Change feed of bucket, polling documents by mutation timestamp.
+type changeFeed struct {
+	sync.Mutex             // Serializes polls.
+	bIndex     BucketIndex // Bucket.
+	stmt       string      // Change query.
+	limit      int         // Rows per query.
+	modified   int64       // Mutation timestamp of last change seen.
+	key        string      // Full key of last change seen, for changes with equal timestamps.
+}
+
+// Create change feed of bucket on mutation timestamp field, starting from now.
+func newChangeFeed(bIndex BucketIndex, field string) (*changeFeed, error) {
+	if int(bIndex) >= len(Buckets) || !validField(field) {
+		log.Errorf("Invalid change feed: bucket %d, field %q", bIndex, field)
+		return nil, util.ErrInvalidInput
+	}
+
+	stmt := fmt.Sprintf("SELECT meta(b).id AS `key`, b.`%[2]s` AS modified, b AS doc FROM `%[1]s` b "+
+		"WHERE b.`%[2]s` > $1 OR (b.`%[2]s` = $1 AND meta(b).id > $2) "+
+		"ORDER BY b.`%[2]s`, meta(b).id LIMIT %[3]d",
+		BucketName(bIndex), field, ChangePageSize)
+
+	return &changeFeed{bIndex: bIndex, stmt: stmt, limit: ChangePageSize, modified: util.NowMilli()}, nil
+}
+
+// Check whether field name is a plain N1QL identifier.
+func validField(field string) bool {
+	if field == "" {
+		return false
+	}
+
+	for i := 0; i < len(field); i++ {
+		c := field[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Poll changes since the last change seen, passing them to the change handler
+// in mutation order. Pages are read until caught up or ctx is done.
+func (cf *changeFeed) poll(ctx context.Context) {
+	cf.Lock()
+	defer cf.Unlock()
+
+	prefix := KeyPrefix(cf.bIndex)
+
+	for ctx.Err() == nil {
+		rows, err := readChangeRows(cf.bIndex, cf.stmt, []interface{}{cf.modified, cf.key})
+		if err != nil {
+			log.Errorf("Change feed: bucket %d, since %d: %v", cf.bIndex, cf.modified, err)
+			return
+		}
+
+		f := changeHandler.Load()
+		for _, row := range rows {
+			var c struct {
+				Key      string          `json:"key"`
+				Modified int64           `json:"modified"`
+				Doc      json.RawMessage `json:"doc"`
+			}
+			if err := json.Unmarshal(row, &c); err != nil {
+				log.Errorf("Change feed: invalid row %s: %v", row, err)
+				continue
+			}
+
+			cf.modified, cf.key = c.Modified, c.Key
+
+			// Skip documents of other environments sharing the bucket.
+			if !strings.HasPrefix(c.Key, prefix) {
+				continue
+			}
+			key := strings.TrimPrefix(c.Key, prefix)
+			metrics.Add(METRIC_CHANGES, 1, "bucket", BucketName(cf.bIndex))
+
+			if f == nil || *f == nil {
+				log.Errorf("No change handler registered: key %s dropped", key)
+				continue
+			}
+			(*f)(Change{Bucket: cf.bIndex, Key: key, Modified: c.Modified, Doc: c.Doc})
+		}
+
+		if len(rows) < cf.limit {
+			return
+		}
+	}
+}
+
+// Start change feed of bucket, polling every interval for documents whose
+// mutation timestamp field, in Unix milliseconds, is past the last change seen.
+// Changes are passed to the change handler (see SetChangeHandler), e.g. to
+// react to writes not published by their writer. Writers must set the
+// field on every write; changes stamped behind the feed, e.g. by writers with
+// skewed clocks, are missed. Changes made before start, and removals, are not
+// observed.
+// Creates an index on the field. The feed stops with the scheduler (see
+// sched.Stop).
+func StartChangeFeed(bIndex BucketIndex, field string, interval time.Duration) error {
+	cf, err := newChangeFeed(bIndex, field)
+	if err != nil {
+		return err
+	}
+
+	if err = EnsureIndex(bIndex, "idx_"+field, field); err != nil {
+		return err
+	}
+
+	log.Infof("%s change feed on %s every %v", BucketName(bIndex), field, interval)
+
+	return sched.Schedule("db-changes-"+BucketName(bIndex), interval, cf.poll)
+}
+
+// Start change feed of default bucket, if enabled in config.
+func initChangeFeed() {
+	if !config.Base.GetBool("db-couch", "change-feed", false) {
+		return
+	}
+
+	field := config.Base.GetString("db-couch", "change-feed-field", CHANGE_FIELD)
+	interval := time.Duration(config.Base.GetInt("db-couch", "change-feed-interval-seconds", CHANGE_POLL_INTERVAL_SECONDS)) * time.Second
+	if err := StartChangeFeed(DEFAULT_BUCKET, field, interval); err != nil {
+		log.Fatalf("Failed to start change feed: %v", err)
+	}
+}
@@ -29,11 +29,27 @@ const (
 
 // Bucket.
 type bucket struct {
-	index BucketIndex  // Bucket index.
-	name  string       // Bucket name.
-	couch *gocb.Bucket // Couchbase bucket.
+	index  BucketIndex  // Bucket index.
+	name   string       // Bucket name.
+	prefix string       // Key prefix, including separator.
+	couch  *gocb.Bucket // Couchbase bucket.
 }
 
+// Client settings.
+type settings struct {
+	opTimeout   time.Duration // Key-value operation timeout.
+	n1qlTimeout time.Duration // N1QL query timeout.
+	viewTimeout time.Duration // View query timeout.
+	duraTimeout time.Duration // Durability requirement timeout.
+	replicateTo uint          // Default number of replicas a write must reach.
+	persistTo   uint          // Default number of nodes a write must be persisted to.
+}
+
+// Settings limits.
+const (
+	DURABILITY_MAX = 3 // Maximum replicate-to and persist-to.
+)
+
 // Array of buckets.
 var Buckets = [...]bucket{
 	bucket{index: DEFAULT_BUCKET},
@@ -43,8 +59,93 @@ var Buckets = [...]bucket{
 var (
 	spec    string        // Connection spec.
 	cluster *gocb.Cluster // Couchbase cluster.
+	cfg     settings      // Client settings.
+	creds   credentials   // Cluster credentials.
 )
 
+// Cluster credentials for role-based access control (Couchbase 5+). Without a
+// username, buckets are opened with their legacy bucket passwords.
+type credentials struct {
+	username string
+	password string
+}
+
+// Authenticate to cluster with RBAC credentials from config, if configured.
+func authenticate() {
+	creds.username = config.Base.GetString("db-couch", "username", "")
+	creds.password = config.Base.GetString("db-couch", "password", "")
+	if creds.username == "" {
+		log.Infoln("Couchbase RBAC username not configured: using bucket passwords")
+		return
+	}
+
+	err := cluster.Authenticate(gocb.PasswordAuthenticator{
+		Username: creds.username,
+		Password: creds.password,
+	})
+	if err != nil {
+		log.Fatalf("Couchbase authentication failed: host %s, user %s: %v", spec, creds.username, err)
+	}
+
+	log.Infof("Couchbase authenticated as %s", creds.username)
+}
+
+// Get legacy password of bucket. RBAC authentication ignores bucket passwords.
+func bucketPassword(name string) string {
+	if creds.username != "" {
+		return ""
+	}
+
+	return config.Base.GetString("db-couch", "bucket-password-"+name,
+		config.Base.GetString("db-couch", "bucket-password", ""))
+}
+
+// Read client settings from config. Zero timeouts keep gocb defaults.
+func readSettings() {
+	readTimeout := func(key string) time.Duration {
+		ms := config.Base.GetInt("db-couch", key, 0)
+		if ms < 0 {
+			log.Fatalf("Invalid %s %d", key, ms)
+		}
+		return time.Duration(ms) * time.Millisecond
+	}
+
+	readDurability := func(key string) uint {
+		n := config.Base.GetInt("db-couch", key, 0)
+		if n < 0 || n > DURABILITY_MAX {
+			log.Fatalf("Invalid %s %d: must be between 0 and %d", key, n, DURABILITY_MAX)
+		}
+		return uint(n)
+	}
+
+	cfg.opTimeout = readTimeout("op-timeout-ms")
+	cfg.n1qlTimeout = readTimeout("n1ql-timeout-ms")
+	cfg.viewTimeout = readTimeout("view-timeout-ms")
+	cfg.duraTimeout = readTimeout("durability-timeout-ms")
+	cfg.replicateTo = readDurability("replicate-to")
+	cfg.persistTo = readDurability("persist-to")
+}
+
+// Apply client settings to bucket.
+func (b *bucket) applySettings() {
+	if cfg.opTimeout > 0 {
+		b.couch.SetOperationTimeout(cfg.opTimeout)
+	}
+	if cfg.n1qlTimeout > 0 {
+		b.couch.SetN1qlTimeout(cfg.n1qlTimeout)
+	}
+	if cfg.viewTimeout > 0 {
+		b.couch.SetViewTimeout(cfg.viewTimeout)
+	}
+	if cfg.duraTimeout > 0 {
+		b.couch.SetDurabilityTimeout(cfg.duraTimeout)
+	}
+
+	log.Infof("%s settings: op timeout %v, N1QL timeout %v, view timeout %v, replicate-to %d, persist-to %d",
+		b.name, b.couch.OperationTimeout(), b.couch.N1qlTimeout(), b.couch.ViewTimeout(),
+		cfg.replicateTo, cfg.persistTo)
+}
+
 func Init() {
 	// Debug enable.
 	log.EnableDebug(MODULE)
@@ -57,27 +158,112 @@ func Init() {
 		log.Fatalf("Couchbase connection spec not found")
 	}
 
+	// Read client settings.
+	readSettings()
+
 	var err error
 	cluster, err = gocb.Connect(spec)
 	if err != nil {
 		log.Fatalf("Couchbase Connect() error: host %s: %v", spec, err)
 	}
 
+	// Authenticate before opening buckets.
+	authenticate()
+
 	// Open buckets.
 	Buckets[DEFAULT_BUCKET].open("default")
+
+	// Start change feed, if enabled.
+	initChangeFeed()
+}
+
+// Set key prefix of bucket. Empty prefix disables prefixing.
+func (b *bucket) setPrefix(prefix string) {
+	if prefix != "" {
+		b.prefix = prefix + ":"
+	} else {
+		b.prefix = ""
+	}
+}
+
+// Get key prefix of bucket, including separator. Use it when building keys or
+// N1QL statements that match keys, e.g. "meta().id LIKE 'prefix:type:%'".
+func KeyPrefix(index BucketIndex) string {
+	if int(index) >= len(Buckets) {
+		return ""
+	}
+
+	return Buckets[index].prefix
 }
 
 // Open bucket.
 func (b *bucket) open(name string) (err error) {
 	b.name = name
-	b.couch, err = cluster.OpenBucket(b.name, "")
+
+	// Key prefix namespaces keys of tenants or environments sharing a bucket.
+	// A bucket specific prefix overrides the global prefix.
+	b.setPrefix(config.Base.GetString("db-couch", "key-prefix-"+name,
+		config.Base.GetString("db-couch", "key-prefix", "")))
+	if b.prefix != "" {
+		log.Infof("%s key prefix %s", b.name, b.prefix)
+	}
+	b.couch, err = cluster.OpenBucket(b.name, bucketPassword(b.name))
 	if err != nil {
-		log.Fatalf("%s OpenBucket() error: host %s: %v", b.name, spec, err)
+		if creds.username != "" {
+			log.Fatalf("%s OpenBucket() error: host %s, user %s: %v: check the user's bucket roles", b.name, spec, creds.username, err)
+		}
+		log.Fatalf("%s OpenBucket() error: host %s: %v: secured clusters require db-couch username and password", b.name, spec, err)
 	}
 
+	b.applySettings()
+
+	// Dispatch to transcoders registered per object type.
+	b.couch.SetTranscoder(objTranscoder{})
+
 	return err
 }
 
+// Close buckets. Db functions must not be called after close.
+func Close() {
+	for i := range Buckets {
+		b := &Buckets[i]
+		if b.couch == nil {
+			continue
+		}
+
+		b.couch.Close()
+		b.couch = nil
+		log.Infof("%s closed", b.name)
+	}
+}
+
+// Ping key-value service of all buckets. Returns util.ErrDbAccess if a bucket
+// is unreachable.
+func PingBuckets() error {
+	for i := range Buckets {
+		b := &Buckets[i]
+		if b.couch == nil {
+			log.Errorf("%s not open", b.name)
+			return util.ErrDbAccess
+		}
+
+		report, err := b.couch.Ping([]gocb.ServiceType{gocb.MemdService})
+		if err != nil {
+			log.Errorf("%s Ping() error: %v", b.name, err)
+			return util.ErrDbAccess
+		}
+
+		for _, s := range report.Services {
+			if !s.Success {
+				log.Errorf("%s ping failed: endpoint %s", b.name, s.Endpoint)
+				return util.ErrDbAccess
+			}
+		}
+	}
+
+	return nil
+}
+
 // Get bucket name given the bucket index.
 func BucketName(index BucketIndex) string {
 	return Buckets[index].name
@@ -85,7 +271,7 @@ func BucketName(index BucketIndex) string {
 
 // Counter.
 func (b *bucket) Counter(key string, delta, initial int64, expiry uint32) (uint64, error) {
-	newval, _, err := b.couch.Counter(key, delta, initial, expiry)
+	newval, _, err := b.couch.Counter(b.prefix+key, delta, initial, expiry)
 	if err != nil {
 		log.Errorf("%s Counter() error: key %s: %v", b.name, key, err)
 		return 0, util.ErrDbAccess
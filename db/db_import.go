@@ -0,0 +1,129 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/couchbaselabs/gocb"
+	"github.com/sath33sh/infra/log"
+	"github.com/sath33sh/infra/util"
+	"io"
+)
+
+// Import constants.
+const (
+	IMPORT_BATCH_SIZE    = 100              // Number of documents upserted per bulk operation.
+	IMPORT_PROGRESS_STEP = 10000            // Log progress every so many documents.
+	IMPORT_LINE_MAX      = 16 * 1024 * 1024 // Maximum length of a JSON line.
+)
+
+// Upsert a batch of documents. Returns number of successful upserts.
+func importBatch(b *bucket, ops []gocb.UpsertOp) (nUpserts int, err error) {
+	opPtrs := make([]gocb.BulkOp, len(ops))
+	for i := range ops {
+		opPtrs[i] = &ops[i]
+	}
+
+	// Perform bulk ops.
+	if doErr := b.couch.Do(opPtrs); doErr != nil {
+		log.Errorf("%s Do() error: batch of %d: %v", b.name, len(ops), doErr)
+		err = util.ErrDbAccess
+	}
+
+	for i := range ops {
+		if ops[i].Err != nil {
+			log.Errorf("%s Upsert() error: key %s: %v", b.name, ops[i].Key, ops[i].Err)
+			err = util.ErrDbAccess
+		} else {
+			nUpserts++
+		}
+	}
+
+	return nUpserts, err
+}
+
+// Import documents from a JSON-lines stream. Each non-empty line is a JSON document,
+// keyed by keyFn. The bucket key prefix is prepended to the key. Individual
+// failures are logged and skipped. Returns number of documents imported and an
+// error if any line or upsert failed.
+func ImportJSONL(bIndex BucketIndex, r io.Reader, keyFn func(json.RawMessage) (string, error)) (count int, err error) {
+	if int(bIndex) >= len(Buckets) {
+		log.Errorf("Invalid bucket %d", bIndex)
+		return 0, util.ErrInvalidInput
+	}
+
+	b := &Buckets[bIndex]
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), IMPORT_LINE_MAX)
+
+	var (
+		ops      = make([]gocb.UpsertOp, 0, IMPORT_BATCH_SIZE)
+		lineNum  int
+		failures int
+	)
+
+	flush := func() {
+		if len(ops) == 0 {
+			return
+		}
+
+		n, batchErr := importBatch(b, ops)
+		count += n
+		failures += len(ops) - n
+		if batchErr != nil {
+			err = batchErr
+		}
+
+		if count/IMPORT_PROGRESS_STEP != (count-n)/IMPORT_PROGRESS_STEP {
+			log.Infof("%s import: %d documents imported, %d failed", b.name, count, failures)
+		}
+
+		ops = ops[:0]
+	}
+
+	for scanner.Scan() {
+		lineNum++
+
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		if !json.Valid(line) {
+			log.Errorf("%s import: invalid JSON at line %d", b.name, lineNum)
+			failures++
+			err = util.ErrJsonDecode
+			continue
+		}
+
+		// Copy line since scanner reuses its buffer.
+		doc := make(json.RawMessage, len(line))
+		copy(doc, line)
+
+		key, keyErr := keyFn(doc)
+		if keyErr != nil || len(key) == 0 {
+			log.Errorf("%s import: no key at line %d: %v", b.name, lineNum, keyErr)
+			failures++
+			err = util.ErrInvalidObject
+			continue
+		}
+
+		ops = append(ops, gocb.UpsertOp{Key: b.prefix + key, Value: doc})
+		if len(ops) == IMPORT_BATCH_SIZE {
+			flush()
+		}
+	}
+
+	// Flush remaining documents.
+	flush()
+
+	if scanErr := scanner.Err(); scanErr != nil {
+		log.Errorf("%s import: read error after line %d: %v", b.name, lineNum, scanErr)
+		err = util.ErrFileAccess
+	}
+
+	log.Infof("%s import done: %d documents imported, %d failed", b.name, count, failures)
+
+	return count, err
+}
@@ -0,0 +1,71 @@
+package db
+
+import (
+	"github.com/couchbaselabs/gocb"
+	"github.com/sath33sh/infra/log"
+	"github.com/sath33sh/infra/util"
+	"strings"
+)
+
+// Get index manager of bucket, with cluster credentials, or bucket credentials
+// of clusters without RBAC.
+func (b *bucket) manager() *gocb.BucketManager {
+	if creds.username != "" {
+		return b.couch.Manager(creds.username, creds.password)
+	}
+
+	return b.couch.Manager(b.name, bucketPassword(b.name))
+}
+
+// Quote field path, e.g. "address.city", as N1QL identifiers, "`address`.`city`".
+// Returns false if a path segment is empty or contains a backtick.
+func quoteFieldPath(field string) (string, bool) {
+	segments := strings.Split(field, ".")
+	for i, s := range segments {
+		if s == "" || strings.Contains(s, "`") {
+			return "", false
+		}
+		segments[i] = "`" + s + "`"
+	}
+
+	return strings.Join(segments, "."), true
+}
+
+// Create GSI index on field of bucket documents, if it does not exist. Nested
+// fields are given as dot-separated paths, e.g. "address.city". Call at startup
+// to provision indexes needed by queries.
+func EnsureIndex(bIndex BucketIndex, name, field string) error {
+	quoted, ok := quoteFieldPath(field)
+	if int(bIndex) >= len(Buckets) || name == "" || !ok {
+		log.Errorf("Invalid index: bucket %d, name %q, field %q", bIndex, name, field)
+		return util.ErrInvalidInput
+	}
+
+	b := &Buckets[bIndex]
+	if err := b.manager().CreateIndex(name, []string{quoted}, true, false); err != nil {
+		log.Errorf("%s CreateIndex() error: index %s on %s: %v", b.name, name, field, err)
+		return util.ErrDbAccess
+	}
+
+	log.Debugf(MODULE, "%s index %s on %s ensured", b.name, name, field)
+
+	return nil
+}
+
+// Create primary index of bucket, if it does not exist.
+func EnsurePrimaryIndex(bIndex BucketIndex) error {
+	if int(bIndex) >= len(Buckets) {
+		log.Errorf("Invalid bucket %d", bIndex)
+		return util.ErrInvalidInput
+	}
+
+	b := &Buckets[bIndex]
+	if err := b.manager().CreatePrimaryIndex("", true, false); err != nil {
+		log.Errorf("%s CreatePrimaryIndex() error: %v", b.name, err)
+		return util.ErrDbAccess
+	}
+
+	log.Debugf(MODULE, "%s primary index ensured", b.name)
+
+	return nil
+}
@@ -5,6 +5,9 @@ import (
 	"github.com/couchbaselabs/gocb"
 	"github.com/sath33sh/infra/log"
 	"github.com/sath33sh/infra/util"
+	"strconv"
+	"sync"
+	"time"
 )
 
 // Object type.
@@ -15,10 +18,16 @@ type ObjMeta struct {
 	Bucket BucketIndex
 	Type   ObjType
 	Id     string
+	Tenant string // Tenant owning the object, empty if not tenant scoped. See TenantMeta.
 }
 
+// Get document key: "[prefix:][tenant:]type:id", where prefix is the key prefix
+// of the bucket.
 func (meta ObjMeta) Key() string {
-	return string(meta.Type) + ":" + meta.Id
+	if meta.Tenant != "" {
+		return KeyPrefix(meta.Bucket) + meta.Tenant + ":" + string(meta.Type) + ":" + meta.Id
+	}
+	return KeyPrefix(meta.Bucket) + string(meta.Type) + ":" + meta.Id
 }
 
 // Object interface.
@@ -28,6 +37,88 @@ type Object interface {
 	SetType()         // Set object type.
 }
 
+// Held lock information.
+type LockInfo struct {
+	Meta     ObjMeta   // Locked object metadata.
+	Lock     Lock      // Lock.
+	Acquired time.Time // Time when lock was acquired.
+}
+
+// Locks held by this process. Couchbase can only unlock a document given its lock
+// CAS, which the server hides from other clients, so locks are tracked here to let
+// operators release locks left by a caller of this process that failed between
+// lock and unlock. Locks of a crashed process cannot be released by any client;
+// the server-side lock expiry (LOCK_INTERVAL) is the only safety net for those.
+var locks struct {
+	sync.Mutex                      // Mutex for accessing held locks.
+	held       map[ObjMeta]LockInfo // Map of object metadata to held lock.
+}
+
+func trackLock(meta ObjMeta, lock Lock) {
+	locks.Lock()
+	if locks.held == nil {
+		locks.held = make(map[ObjMeta]LockInfo)
+	}
+	locks.held[meta] = LockInfo{Meta: meta, Lock: lock, Acquired: time.Now()}
+	locks.Unlock()
+}
+
+func untrackLock(meta ObjMeta) {
+	locks.Lock()
+	delete(locks.held, meta)
+	locks.Unlock()
+}
+
+// Remove locks that have already expired on the server. Caller must hold the mutex.
+func expireLocks() {
+	for meta, li := range locks.held {
+		if time.Since(li.Acquired) >= LOCK_INTERVAL*time.Second {
+			delete(locks.held, meta)
+		}
+	}
+}
+
+// List locks held by this process.
+func ListLocks() []LockInfo {
+	locks.Lock()
+	defer locks.Unlock()
+
+	expireLocks()
+
+	list := make([]LockInfo, 0, len(locks.held))
+	for _, li := range locks.held {
+		list = append(list, li)
+	}
+
+	return list
+}
+
+// Release lock of a document held by this process, see ListLocks.
+// Returns util.ErrNotFound if the lock is not held or has already expired.
+func ReleaseLock(meta ObjMeta) error {
+	locks.Lock()
+	expireLocks()
+	li, ok := locks.held[meta]
+	locks.Unlock()
+
+	if !ok {
+		return util.ErrNotFound
+	}
+
+	key := meta.Key()
+
+	_, err := Buckets[meta.Bucket].couch.Unlock(key, gocb.Cas(li.Lock))
+	if err != nil {
+		log.Errorf("%s Unlock() error: key %s: %v", Buckets[meta.Bucket].name, key, err)
+		return util.ErrDbAccess
+	}
+
+	untrackLock(meta)
+	log.Infof("%s released lock of key %s, held for %v", Buckets[meta.Bucket].name, key, time.Since(li.Acquired))
+
+	return nil
+}
+
 // Validate object metadata.
 func getValidMeta(obj Object) (meta ObjMeta, err error) {
 	// Get metadata.
@@ -61,6 +152,42 @@ func Get(obj Object) error {
 	return err
 }
 
+// Get object from database along with its CAS, without locking it. The CAS
+// can be used as lock for optimistic concurrency, e.g. with RemoveCas.
+func GetCas(obj Object) (Lock, error) {
+	// Validate metadata.
+	meta, err := getValidMeta(obj)
+	if err != nil {
+		return Lock(0), err
+	}
+
+	// Get document from couchbase.
+	cas, err := Buckets[meta.Bucket].couch.Get(meta.Key(), obj)
+	if err != nil {
+		return Lock(0), util.ErrNotFound
+	}
+
+	return Lock(cas), nil
+}
+
+// Get opaque version token of object from its CAS, e.g. to return to clients
+// that send it back with updates, for optimistic concurrency (see ReplaceCas).
+func (l Lock) Token() string {
+	return strconv.FormatUint(uint64(l), 36)
+}
+
+// Parse version token of Lock.Token. Returns util.ErrInvalidInput if token is
+// missing or invalid.
+func ParseLockToken(token string) (Lock, error) {
+	cas, err := strconv.ParseUint(token, 36, 64)
+	if err != nil || cas == 0 {
+		log.Debugf(MODULE, "Invalid version token %q", token)
+		return Lock(0), util.ErrInvalidInput
+	}
+
+	return Lock(cas), nil
+}
+
 // Upsert object in to database.
 func Upsert(obj Object, expiry uint32) error {
 	// Set object type.
@@ -75,7 +202,11 @@ func Upsert(obj Object, expiry uint32) error {
 	key := meta.Key()
 
 	// Upsert document in couchbase.
-	_, err = Buckets[meta.Bucket].couch.Upsert(key, obj, expiry)
+	if cfg.replicateTo > 0 || cfg.persistTo > 0 {
+		_, err = Buckets[meta.Bucket].couch.UpsertDura(key, obj, expiry, cfg.replicateTo, cfg.persistTo)
+	} else {
+		_, err = Buckets[meta.Bucket].couch.Upsert(key, obj, expiry)
+	}
 	if err != nil {
 		log.Errorf("%s Upsert() error: key %s: %v", Buckets[meta.Bucket].name, key, err)
 		return util.ErrDbAccess
@@ -84,6 +215,58 @@ func Upsert(obj Object, expiry uint32) error {
 	return err
 }
 
+// Insert object in to database. Fails if the object already exists.
+func Insert(obj Object, expiry uint32) error {
+	// Set object type.
+	obj.SetType()
+
+	// Validate metadata.
+	meta, err := getValidMeta(obj)
+	if err != nil {
+		return err
+	}
+
+	key := meta.Key()
+
+	// Insert document in couchbase.
+	if cfg.replicateTo > 0 || cfg.persistTo > 0 {
+		_, err = Buckets[meta.Bucket].couch.InsertDura(key, obj, expiry, cfg.replicateTo, cfg.persistTo)
+	} else {
+		_, err = Buckets[meta.Bucket].couch.Insert(key, obj, expiry)
+	}
+	if err != nil {
+		if gocb.IsKeyExistsError(err) {
+			log.Debugf(MODULE, "%s Insert(): key %s exists", Buckets[meta.Bucket].name, key)
+			return util.ErrAlreadyExists
+		}
+		log.Errorf("%s Insert() error: key %s: %v", Buckets[meta.Bucket].name, key, err)
+		return util.ErrDbAccess
+	}
+
+	return err
+}
+
+// Get object, or create it if it does not exist. On create, factory populates obj
+// before it is inserted. If a concurrent creator wins the race, obj is populated
+// from the winner's object. Returns whether the object was created.
+func GetOrCreate(obj Object, factory func() error, expiry uint32) (created bool, err error) {
+	if err = Get(obj); err != util.ErrNotFound {
+		return false, err
+	}
+
+	// Create.
+	if err = factory(); err != nil {
+		return false, err
+	}
+
+	if err = Insert(obj, expiry); err != util.ErrAlreadyExists {
+		return err == nil, err
+	}
+
+	// Lost the race to a concurrent creator. Get the winner's object.
+	return false, Get(obj)
+}
+
 // Remove object from database.
 func Remove(obj Object) error {
 	// Validate metadata.
@@ -112,6 +295,73 @@ func Remove(obj Object) error {
 	return err
 }
 
+// Remove object from database only if it is unchanged since lock was obtained.
+// Returns util.ErrAlreadyExists if the object has been modified (CAS mismatch).
+func RemoveCas(obj Object, lock Lock) error {
+	// Validate metadata.
+	meta, err := getValidMeta(obj)
+	if err != nil {
+		return err
+	}
+
+	key := meta.Key()
+
+	// Remove document from couchbase.
+	_, err = Buckets[meta.Bucket].couch.Remove(key, gocb.Cas(lock))
+	if err != nil {
+		if gocb.IsKeyExistsError(err) {
+			log.Debugf(MODULE, "%s Remove(): key %s: CAS mismatch", Buckets[meta.Bucket].name, key)
+			return util.ErrAlreadyExists
+		}
+		if gocb.IsKeyNotFoundError(err) {
+			return util.ErrNotFound
+		}
+		log.Errorf("%s Remove() error: key %s: %v", Buckets[meta.Bucket].name, key, err)
+		return util.ErrDbAccess
+	}
+
+	untrackLock(meta)
+
+	return err
+}
+
+// Replace object in database only if it is unchanged since its CAS was obtained,
+// e.g. by GetCas, without locking. Returns the new CAS, and util.ErrAlreadyExists
+// if the object has been modified (CAS mismatch).
+func ReplaceCas(obj Object, lock Lock, expiry uint32) (Lock, error) {
+	// Set object type just in case.
+	obj.SetType()
+
+	// Validate metadata.
+	meta, err := getValidMeta(obj)
+	if err != nil {
+		return Lock(0), err
+	}
+
+	key := meta.Key()
+
+	// Replace document in couchbase.
+	var cas gocb.Cas
+	if cfg.replicateTo > 0 || cfg.persistTo > 0 {
+		cas, err = Buckets[meta.Bucket].couch.ReplaceDura(key, obj, gocb.Cas(lock), expiry, cfg.replicateTo, cfg.persistTo)
+	} else {
+		cas, err = Buckets[meta.Bucket].couch.Replace(key, obj, gocb.Cas(lock), expiry)
+	}
+	if err != nil {
+		if gocb.IsKeyExistsError(err) {
+			log.Debugf(MODULE, "%s Replace(): key %s: CAS mismatch", Buckets[meta.Bucket].name, key)
+			return Lock(0), util.ErrAlreadyExists
+		}
+		if gocb.IsKeyNotFoundError(err) {
+			return Lock(0), util.ErrNotFound
+		}
+		log.Errorf("%s Replace() error: key %s: %v", Buckets[meta.Bucket].name, key, err)
+		return Lock(0), util.ErrDbAccess
+	}
+
+	return Lock(cas), nil
+}
+
 // Get and lock document.
 func GetLock(obj Object) (Lock, error) {
 	// Validate metadata.
@@ -130,6 +380,8 @@ func GetLock(obj Object) (Lock, error) {
 		return Lock(cas), util.ErrNotFound
 	}
 
+	trackLock(meta, Lock(cas))
+
 	return Lock(cas), err
 }
 
@@ -150,6 +402,8 @@ func Unlock(obj Object, lock Lock) error {
 		return util.ErrDbAccess
 	}
 
+	untrackLock(meta)
+
 	return err
 }
 
@@ -167,12 +421,18 @@ func WriteUnlock(obj Object, lock Lock, expiry uint32) error {
 	key := meta.Key()
 
 	// Write and unlock in couchbase.
-	_, err = Buckets[meta.Bucket].couch.Replace(key, obj, gocb.Cas(lock), expiry)
+	if cfg.replicateTo > 0 || cfg.persistTo > 0 {
+		_, err = Buckets[meta.Bucket].couch.ReplaceDura(key, obj, gocb.Cas(lock), expiry, cfg.replicateTo, cfg.persistTo)
+	} else {
+		_, err = Buckets[meta.Bucket].couch.Replace(key, obj, gocb.Cas(lock), expiry)
+	}
 	if err != nil {
 		log.Errorf("%s Replace() error: key %s: %v", Buckets[meta.Bucket].name, key, err)
 		return util.ErrDbAccess
 	}
 
+	untrackLock(meta)
+
 	return err
 }
 
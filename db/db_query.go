@@ -4,8 +4,10 @@ import (
 	"fmt"
 	"github.com/couchbaselabs/gocb"
 	"github.com/sath33sh/infra/log"
+	"github.com/sath33sh/infra/metrics"
 	"github.com/sath33sh/infra/util"
 	"strconv"
+	"time"
 )
 
 // Query result interface.
@@ -19,8 +21,34 @@ const (
 	QUERY_LIMIT_MAX     = 200
 )
 
-// Parse query page arguments limit and offset.
+// Query metrics.
+const (
+	METRIC_QUERY_DURATION = "db_query_duration_seconds"
+	METRIC_QUERY_ERRORS   = "db_query_errors_total"
+)
+
+// Record query duration and error, per query function.
+func recordQuery(fn string, start time.Time, err error) {
+	metrics.Since(METRIC_QUERY_DURATION, start, "fn", fn)
+	if err != nil {
+		metrics.Add(METRIC_QUERY_ERRORS, 1, "fn", fn)
+	}
+}
+
+// Parse query page arguments limit and offset, with global default and maximum limit.
 func ParsePageArgs(limitStr, offsetStr string) (limit, offset int, err error) {
+	return ParsePageArgsWithLimits(limitStr, offsetStr, QUERY_LIMIT_DEFAULT, QUERY_LIMIT_MAX)
+}
+
+// Parse query page arguments limit and offset, with default and maximum limit of
+// endpoint. Missing or zero limit is set to dflt, and limit beyond max is clamped.
+func ParsePageArgsWithLimits(limitStr, offsetStr string, dflt, max int) (limit, offset int, err error) {
+	// Validate limits.
+	if dflt <= 0 || dflt > max {
+		log.Errorf("Invalid page limits: default %d, max %d", dflt, max)
+		return 0, 0, util.ErrInvalidInput
+	}
+
 	// Parse limit.
 	if limitStr != "" {
 		limit, err = strconv.Atoi(limitStr)
@@ -31,9 +59,9 @@ func ParsePageArgs(limitStr, offsetStr string) (limit, offset int, err error) {
 	}
 
 	if limit == 0 {
-		limit = QUERY_LIMIT_DEFAULT
-	} else if limit > QUERY_LIMIT_MAX {
-		limit = QUERY_LIMIT_MAX
+		limit = dflt
+	} else if limit > max {
+		limit = max
 	}
 
 	// Parse offset.
@@ -50,6 +78,8 @@ func ParsePageArgs(limitStr, offsetStr string) (limit, offset int, err error) {
 
 // Execute N1QL query.
 func ExecQuery(bIndex BucketIndex, qr QueryResult, queryStmt string) (size int, err error) {
+	defer func(start time.Time) { recordQuery("ExecQuery", start, err) }(time.Now())
+
 	log.Debugf(MODULE, "Bucket %d, Query {%s}", bIndex, queryStmt)
 
 	// Execute query.
@@ -74,8 +104,43 @@ func ExecQuery(bIndex BucketIndex, qr QueryResult, queryStmt string) (size int,
 	return size, nil
 }
 
+// Execute N1QL query, passing each result row as raw JSON to fn as it is read,
+// without buffering the result. An error returned by fn stops the query and is
+// returned. Returns number of rows passed to fn.
+func ExecQueryStream(bIndex BucketIndex, queryStmt string, fn func(row []byte) error) (size int, err error) {
+	defer func(start time.Time) { recordQuery("ExecQueryStream", start, err) }(time.Now())
+
+	log.Debugf(MODULE, "Bucket %d, Query {%s}", bIndex, queryStmt)
+
+	// Execute query.
+	q := gocb.NewN1qlQuery(queryStmt)
+	r, err := Buckets[bIndex].couch.ExecuteN1qlQuery(q, nil)
+	if err != nil {
+		log.Errorf("N1QL query error: stmt %s: %v", queryStmt, err)
+		return size, util.ErrDbAccess
+	}
+
+	// Pass results.
+	for row := r.NextBytes(); row != nil; row = r.NextBytes() {
+		if err = fn(row); err != nil {
+			r.Close()
+			return size, err
+		}
+		size++
+	}
+
+	err = r.Close()
+	if err != nil {
+		log.Errorf("N1QL query close error: stmt %s: %v", queryStmt, err)
+		return size, util.ErrDbAccess
+	}
+
+	return size, nil
+}
+
 // Execute N1QL query with pagination.
 func ExecPagedQuery(bIndex BucketIndex, qr QueryResult, queryStmt string, limit, offset int) (size int, err error) {
+	defer func(start time.Time) { recordQuery("ExecPagedQuery", start, err) }(time.Now())
 
 	log.Debugf(MODULE, "Bucket %d, Query {%s}, limit %d, offset %d", bIndex, queryStmt, limit, offset)
 
@@ -113,7 +178,9 @@ type CountResult struct {
 }
 
 // Execute count N1QL query.
-func ExecCount(bIndex BucketIndex, queryStmt string) (int, error) {
+func ExecCount(bIndex BucketIndex, queryStmt string) (count int, err error) {
+	defer func(start time.Time) { recordQuery("ExecCount", start, err) }(time.Now())
+
 	log.Debugf(MODULE, "Bucket %d, Query {%s}", bIndex, queryStmt)
 
 	// Execute query.
@@ -144,7 +211,8 @@ const (
 )
 
 type ViewResult struct {
-	Id string `json:"id"` // Document ID.
+	Id  string      `json:"id"`            // Document ID.
+	Key interface{} `json:"key,omitempty"` // Emitted key.
 }
 
 type ViewQueryResult struct {
@@ -175,6 +243,36 @@ func (qr *ViewQueryResult) GetRowPtr(index int) interface{} {
 	}
 }
 
+// View index staleness.
+//
+// Views are indexed asynchronously, so by default a query may miss a document
+// written just before it. VIEW_STALE_FALSE updates the index before querying,
+// giving read-after-write consistency at the cost of query latency: the query
+// waits for all pending writes to be indexed, which can take long under heavy
+// write load. Use it only where a list must reflect the caller's own writes.
+type ViewStale int
+
+const (
+	VIEW_STALE_DEFAULT      ViewStale = iota // Server default, same as VIEW_STALE_UPDATE_AFTER.
+	VIEW_STALE_OK                            // Query index as is.
+	VIEW_STALE_UPDATE_AFTER                  // Query index as is, then update it.
+	VIEW_STALE_FALSE                         // Update index, then query it.
+)
+
+// Map staleness to gocb stale mode. Returns false for server default.
+func (vs ViewStale) staleMode() (gocb.StaleMode, bool) {
+	switch vs {
+	case VIEW_STALE_OK:
+		return gocb.None, true
+	case VIEW_STALE_UPDATE_AFTER:
+		return gocb.After, true
+	case VIEW_STALE_FALSE:
+		return gocb.Before, true
+	default:
+		return 0, false
+	}
+}
+
 // Execute view query.
 func ExecPagedViewQuery(
 	bIndex BucketIndex,
@@ -182,65 +280,91 @@ func ExecPagedViewQuery(
 	designDoc, viewName,
 	key,
 	limitStr, offsetStr string) (size, offset int, err error) {
-	var limit int
-
-	log.Debugf(MODULE, "Bucket %d, view %s:%s, key %s, limit %s, offset %s",
-		bIndex, designDoc, viewName, key, limitStr, offsetStr)
+	return execPagedViewQuery("ExecPagedViewQuery", bIndex, qr, designDoc, viewName, limitStr, offsetStr,
+		viewKey(key, VIEW_STALE_DEFAULT))
+}
 
-	// Validate limit.
-	if len(limitStr) > 0 {
-		limit, err = strconv.Atoi(limitStr)
-		if err != nil {
-			log.Errorf("Invalid limit %s", limitStr)
-			return 0, 0, util.ErrInvalidInput
-		}
-	}
+// Execute view query with given index staleness.
+func ExecPagedViewQueryStale(
+	bIndex BucketIndex,
+	qr QueryResult,
+	designDoc, viewName,
+	key string,
+	stale ViewStale,
+	limitStr, offsetStr string) (size, offset int, err error) {
+	return execPagedViewQuery("ExecPagedViewQueryStale", bIndex, qr, designDoc, viewName, limitStr, offsetStr,
+		viewKey(key, stale))
+}
 
-	// Validate offset.
-	if len(offsetStr) > 0 {
-		offset, err = strconv.Atoi(offsetStr)
-		if err != nil {
-			log.Errorf("Invalid offset %s", offsetStr)
-			return 0, 0, util.ErrInvalidInput
-		}
-	}
+// Execute view query with start and end keys.
+func ExecPagedViewQueryInRange(
+	bIndex BucketIndex,
+	qr QueryResult,
+	designDoc, viewName string,
+	startKey, endKey interface{},
+	limitStr, offsetStr string) (size, offset int, err error) {
+	return execPagedViewQuery("ExecPagedViewQueryInRange", bIndex, qr, designDoc, viewName, limitStr, offsetStr,
+		viewRange(startKey, endKey, "", true))
+}
 
-	// Execute query.
-	q := gocb.NewViewQuery(designDoc, viewName).Skip(uint(offset)).Limit(uint(limit)).Order(gocb.Descending)
-	if key != "" {
-		q = q.Key(key)
-	}
-	r, err := Buckets[bIndex].couch.ExecuteViewQuery(q)
-	if err != nil {
-		log.Errorf("View query error: %s:%s: %v", designDoc, viewName, err)
-		return size, offset, util.ErrDbAccess
-	}
+// Execute view query with start and end keys, resuming from a document ID.
+//
+// Offset based paging gets slower with depth and is unstable when rows are
+// added or removed between pages. For deep or tie-heavy paging, resume from the
+// last row of the previous page instead: pass its key as startKey and its ID as
+// startKeyDocId, with offset "1" to skip that row itself. The document ID breaks
+// ties between rows sharing the same key, so no rows are skipped or repeated.
+func ExecPagedViewQueryFromDoc(
+	bIndex BucketIndex,
+	qr QueryResult,
+	designDoc, viewName string,
+	startKey, endKey interface{},
+	startKeyDocId string,
+	inclusiveEnd bool,
+	limitStr, offsetStr string) (size, offset int, err error) {
+	return execPagedViewQuery("ExecPagedViewQueryFromDoc", bIndex, qr, designDoc, viewName, limitStr, offsetStr,
+		viewRange(startKey, endKey, startKeyDocId, inclusiveEnd))
+}
 
-	// Save results.
-	for r.Next(qr.GetRowPtr(size)) {
-		size++
+// Scope view query to a key with given index staleness.
+func viewKey(key string, stale ViewStale) func(*gocb.ViewQuery) *gocb.ViewQuery {
+	return func(q *gocb.ViewQuery) *gocb.ViewQuery {
+		if key != "" {
+			q = q.Key(key)
+		}
+		if mode, ok := stale.staleMode(); ok {
+			q = q.Stale(mode)
+		}
+		return q
 	}
+}
 
-	err = r.Close()
-	if err != nil {
-		log.Errorf("View query close error: %s:%s: %v", designDoc, viewName, err)
-		return size, offset, util.ErrDbAccess
+// Scope view query to a key range, optionally starting from a document ID.
+func viewRange(startKey, endKey interface{}, startKeyDocId string, inclusiveEnd bool) func(*gocb.ViewQuery) *gocb.ViewQuery {
+	return func(q *gocb.ViewQuery) *gocb.ViewQuery {
+		q = q.Range(startKey, endKey, inclusiveEnd)
+		if startKeyDocId != "" {
+			q = q.IdRange(startKeyDocId, "")
+		}
+		return q
 	}
-
-	return size, offset, nil
 }
 
-// Execute view query with start and end keys.
-func ExecPagedViewQueryInRange(
+// Execute view query scoped by the given function, recording metrics under
+// function name fn.
+func execPagedViewQuery(
+	fn string,
 	bIndex BucketIndex,
 	qr QueryResult,
-	designDoc, viewName string,
-	startKey, endKey interface{},
-	limitStr, offsetStr string) (size, offset int, err error) {
+	designDoc, viewName,
+	limitStr, offsetStr string,
+	scope func(*gocb.ViewQuery) *gocb.ViewQuery) (size, offset int, err error) {
+	defer func(start time.Time) { recordQuery(fn, start, err) }(time.Now())
+
 	var limit int
 
-	log.Debugf(MODULE, "Bucket %d, view %s:%s, limit %s, offset %s",
-		bIndex, designDoc, viewName, limitStr, offsetStr)
+	log.Debugf(MODULE, "%s: bucket %d, view %s:%s, limit %s, offset %s",
+		fn, bIndex, designDoc, viewName, limitStr, offsetStr)
 
 	// Validate limit.
 	if len(limitStr) > 0 {
@@ -261,9 +385,8 @@ func ExecPagedViewQueryInRange(
 	}
 
 	// Execute query.
-	q := gocb.NewViewQuery(designDoc, viewName).Skip(uint(offset)).
-		Range(startKey, endKey, true).
-		Limit(uint(limit)).Order(gocb.Descending)
+	q := scope(gocb.NewViewQuery(designDoc, viewName).Skip(uint(offset)).
+		Limit(uint(limit)).Order(gocb.Descending))
 	r, err := Buckets[bIndex].couch.ExecuteViewQuery(q)
 	if err != nil {
 		log.Errorf("View query error: %s:%s: %v", designDoc, viewName, err)
@@ -0,0 +1,77 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/couchbaselabs/gocb"
+	"github.com/sath33sh/infra/log"
+	"github.com/sath33sh/infra/util"
+	"strings"
+	"time"
+)
+
+// Number of ids fetched per page by ScanType.
+var ScanPageSize = 500
+
+// Iterate ids of all objects of type in bucket, e.g. for migrations, reindexing
+// or bulk notifications. Ids are read by N1QL on document keys, in key order,
+// paging by the last key seen, so objects written during the scan may or may
+// not be visited. Requires a primary index (see EnsurePrimaryIndex).
+//
+// An error returned by fn does not stop the scan: it is logged, and the first
+// one is returned after all ids are visited. A database error stops the scan
+// and is returned.
+func ScanType(bIndex BucketIndex, t ObjType, fn func(id string) error) (err error) {
+	defer func(start time.Time) { recordQuery("ScanType", start, err) }(time.Now())
+
+	if int(bIndex) >= len(Buckets) || t == "" {
+		log.Errorf("Invalid scan: bucket %d, type %q", bIndex, t)
+		return util.ErrInvalidInput
+	}
+
+	prefix := KeyPrefix(bIndex) + string(t) + ":"
+	stmt := fmt.Sprintf("SELECT RAW meta().id FROM `%s` WHERE meta().id LIKE $1 AND meta().id > $2 ORDER BY meta().id LIMIT %d",
+		BucketName(bIndex), ScanPageSize)
+	pattern := strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(prefix) + "%"
+
+	log.Debugf(MODULE, "Bucket %d, scan type %s", bIndex, t)
+
+	var fnErr error
+	last := prefix
+	for {
+		// Read page of keys.
+		q := gocb.NewN1qlQuery(stmt).Consistency(gocb.RequestPlus)
+		r, qerr := Buckets[bIndex].couch.ExecuteN1qlQuery(q, []interface{}{pattern, last})
+		if qerr != nil {
+			log.Errorf("Scan query error: type %s, after %s: %v", t, last, qerr)
+			return util.ErrDbAccess
+		}
+
+		var keys []string
+		for row := r.NextBytes(); row != nil; row = r.NextBytes() {
+			var key string
+			if json.Unmarshal(row, &key) == nil {
+				keys = append(keys, key)
+			}
+		}
+		if cerr := r.Close(); cerr != nil {
+			log.Errorf("Scan query close error: type %s, after %s: %v", t, last, cerr)
+			return util.ErrDbAccess
+		}
+
+		// Visit ids.
+		for _, key := range keys {
+			if err := fn(strings.TrimPrefix(key, prefix)); err != nil {
+				log.Errorf("Scan type %s: id %s: %v", t, strings.TrimPrefix(key, prefix), err)
+				if fnErr == nil {
+					fnErr = err
+				}
+			}
+		}
+
+		if len(keys) < ScanPageSize {
+			return fnErr
+		}
+		last = keys[len(keys)-1]
+	}
+}
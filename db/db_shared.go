@@ -0,0 +1,109 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/couchbaselabs/gocb"
+	"github.com/sath33sh/infra/log"
+	"github.com/sath33sh/infra/metrics"
+	"github.com/sath33sh/infra/util"
+	"sync"
+	"time"
+)
+
+// Shared query metrics.
+const METRIC_QUERY_SHARED = "db_query_shared_total" // Queries served by an in-flight query.
+
+// In-flight shared query.
+type sharedQuery struct {
+	wg   sync.WaitGroup // Done when rows are read.
+	rows [][]byte       // Raw result rows. Read only once done.
+	err  error          // Query error.
+}
+
+// In-flight shared queries by key.
+var sharedQueries = struct {
+	sync.Mutex
+	queries map[string]*sharedQuery
+}{queries: make(map[string]*sharedQuery)}
+
+// Read raw result rows of N1QL query.
+var readQueryRows = func(bIndex BucketIndex, queryStmt string, params []interface{}) ([][]byte, error) {
+	return readRows(bIndex, gocb.NewN1qlQuery(queryStmt), queryStmt, params)
+}
+
+// Read raw result rows of prepared N1QL query.
+func readRows(bIndex BucketIndex, q *gocb.N1qlQuery, queryStmt string, params []interface{}) ([][]byte, error) {
+	r, err := Buckets[bIndex].couch.ExecuteN1qlQuery(q, params)
+	if err != nil {
+		log.Errorf("N1QL query error: stmt %s: %v", queryStmt, err)
+		return nil, util.ErrDbAccess
+	}
+
+	var rows [][]byte
+	for row := r.NextBytes(); row != nil; row = r.NextBytes() {
+		rows = append(rows, row)
+	}
+
+	if err = r.Close(); err != nil {
+		log.Errorf("N1QL query close error: stmt %s: %v", queryStmt, err)
+		return nil, util.ErrDbAccess
+	}
+
+	return rows, nil
+}
+
+// Execute N1QL query with positional parameters, sharing execution with
+// identical concurrent queries: of callers with the same bucket, statement and
+// parameters, only the first executes the query and the others wait for its
+// rows. Each caller decodes the rows into its own query result, so results do
+// not share memory. Use for cacheable reads only, as a caller may get rows of
+// a query that started before it.
+func ExecQueryShared(bIndex BucketIndex, qr QueryResult, queryStmt string, params ...interface{}) (size int, err error) {
+	defer func(start time.Time) { recordQuery("ExecQueryShared", start, err) }(time.Now())
+
+	log.Debugf(MODULE, "Bucket %d, Query {%s}, params %v", bIndex, queryStmt, params)
+
+	p, err := json.Marshal(params)
+	if err != nil {
+		log.Errorf("Invalid query params %v: %v", params, err)
+		return 0, util.ErrInvalidInput
+	}
+	key := fmt.Sprintf("%d|%s|%s", bIndex, queryStmt, p)
+
+	// Join in-flight query, or start one.
+	sharedQueries.Lock()
+	sq, ok := sharedQueries.queries[key]
+	if ok {
+		sharedQueries.Unlock()
+		metrics.Add(METRIC_QUERY_SHARED, 1)
+		sq.wg.Wait()
+	} else {
+		sq = &sharedQuery{}
+		sq.wg.Add(1)
+		sharedQueries.queries[key] = sq
+		sharedQueries.Unlock()
+
+		sq.rows, sq.err = readQueryRows(bIndex, queryStmt, params)
+
+		sharedQueries.Lock()
+		delete(sharedQueries.queries, key)
+		sharedQueries.Unlock()
+		sq.wg.Done()
+	}
+
+	if sq.err != nil {
+		return 0, sq.err
+	}
+
+	// Decode own copy of rows.
+	for _, row := range sq.rows {
+		if err = json.Unmarshal(row, qr.GetRowPtr(size)); err != nil {
+			log.Errorf("N1QL row decode error: stmt %s: %v", queryStmt, err)
+			return size, util.ErrJsonDecode
+		}
+		size++
+	}
+
+	return size, nil
+}
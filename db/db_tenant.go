@@ -0,0 +1,60 @@
+package db
+
+import (
+	"context"
+	"github.com/sath33sh/infra/log"
+	"github.com/sath33sh/infra/util"
+)
+
+// Maximum length of tenant ID.
+const MAX_TENANT_LEN = 128
+
+// Context key of tenant. Unexported type avoids collisions with other packages.
+type tenantKey struct{}
+
+// Get context carrying tenant, for building tenant scoped keys with TenantMeta.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// Get tenant carried by context.
+func TenantOf(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(tenantKey{}).(string)
+	return tenant, ok && tenant != ""
+}
+
+// Validate tenant ID. Tenant IDs are part of document keys, so they are limited
+// to letters, digits, '-', '_' and '.', which excludes the key separator ':'.
+func ValidateTenant(tenant string) error {
+	if len(tenant) == 0 || len(tenant) > MAX_TENANT_LEN {
+		return util.ErrInvalidInput
+	}
+
+	for i := 0; i < len(tenant); i++ {
+		c := tenant[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '_' || c == '.') {
+			return util.ErrInvalidInput
+		}
+	}
+
+	return nil
+}
+
+// Build metadata of object scoped to the tenant carried by ctx, so its key is
+// "[prefix:]tenant:type:id" and objects of different tenants never collide.
+// Returns util.ErrInvalidInput if ctx carries no valid tenant.
+func TenantMeta(ctx context.Context, bIndex BucketIndex, t ObjType, id string) (ObjMeta, error) {
+	tenant, ok := TenantOf(ctx)
+	if !ok {
+		log.Errorf("No tenant in context for %s:%s", t, id)
+		return ObjMeta{}, util.ErrInvalidInput
+	}
+
+	if err := ValidateTenant(tenant); err != nil {
+		log.Errorf("Invalid tenant %q for %s:%s", tenant, t, id)
+		return ObjMeta{}, err
+	}
+
+	return ObjMeta{Bucket: bIndex, Type: t, Id: id, Tenant: tenant}, nil
+}
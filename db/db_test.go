@@ -0,0 +1,870 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/couchbaselabs/gocb"
+	"github.com/sath33sh/infra/config"
+	"github.com/sath33sh/infra/log"
+	"github.com/sath33sh/infra/metrics"
+	"github.com/sath33sh/infra/util"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Test object.
+type testObject struct {
+	Type  ObjType `json:"type"`
+	Id    string  `json:"id"`
+	Value string  `json:"value,omitempty"`
+}
+
+func (obj *testObject) GetMeta() ObjMeta {
+	return ObjMeta{Bucket: DEFAULT_BUCKET, Type: obj.Type, Id: obj.Id}
+}
+
+func (obj *testObject) SetType() {
+	obj.Type = "test"
+}
+
+func newTestObject(id string) *testObject {
+	return &testObject{Type: "test", Id: id}
+}
+
+// Open buckets once, for tests needing a live Couchbase cluster. Other tests
+// run without one.
+var bucketOnce sync.Once
+
+func requireBucket(t *testing.T) {
+	t.Helper()
+	bucketOnce.Do(Init)
+}
+
+func TestReleaseLock(t *testing.T) {
+	requireBucket(t)
+
+	obj := newTestObject("releaselock")
+	if err := Upsert(obj, 0); err != nil {
+		t.Fatalf("Upsert failed: %v", err)
+	}
+	defer Remove(obj)
+
+	if _, err := GetLock(obj); err != nil {
+		t.Fatalf("GetLock failed: %v", err)
+	}
+
+	found := false
+	for _, li := range ListLocks() {
+		if li.Meta == obj.GetMeta() {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("Lock not listed")
+	}
+
+	if err := ReleaseLock(obj.GetMeta()); err != nil {
+		t.Fatalf("ReleaseLock failed: %v", err)
+	}
+
+	if err := ReleaseLock(obj.GetMeta()); err == nil {
+		t.Errorf("Second ReleaseLock should fail")
+	}
+
+	// Document must be writable again.
+	obj.Value = "unlocked"
+	if err := Upsert(obj, 0); err != nil {
+		t.Errorf("Upsert after ReleaseLock failed: %v", err)
+	}
+}
+
+func TestInsert(t *testing.T) {
+	requireBucket(t)
+
+	obj := newTestObject("insert")
+	Remove(obj)
+	defer Remove(obj)
+
+	if err := Insert(obj, 0); err != nil {
+		t.Fatalf("First insert failed: %v", err)
+	}
+
+	if err := Insert(newTestObject("insert"), 0); err != util.ErrAlreadyExists {
+		t.Errorf("Second insert: expected %v, got %v", util.ErrAlreadyExists, err)
+	}
+}
+
+func TestGetOrCreate(t *testing.T) {
+	requireBucket(t)
+
+	const numCreators = 10
+
+	Remove(newTestObject("getorcreate"))
+	defer Remove(newTestObject("getorcreate"))
+
+	var wg sync.WaitGroup
+	var numCreated int32
+	values := make([]string, numCreators)
+
+	for i := 0; i < numCreators; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			obj := newTestObject("getorcreate")
+			created, err := GetOrCreate(obj, func() error {
+				obj.Value = fmt.Sprintf("creator%d", i)
+				return nil
+			}, 0)
+			if err != nil {
+				t.Errorf("Creator %d: %v", i, err)
+				return
+			}
+
+			if created {
+				atomic.AddInt32(&numCreated, 1)
+			}
+			values[i] = obj.Value
+		}(i)
+	}
+	wg.Wait()
+
+	if numCreated != 1 {
+		t.Fatalf("Expected exactly one creation, got %d", numCreated)
+	}
+
+	// Every caller must see the winner's object.
+	for i := 1; i < numCreators; i++ {
+		if values[i] != values[0] {
+			t.Errorf("Creator %d saw %q, creator 0 saw %q", i, values[i], values[0])
+		}
+	}
+}
+
+func TestRemoveCas(t *testing.T) {
+	requireBucket(t)
+
+	obj := newTestObject("removecas")
+	if err := Upsert(obj, 0); err != nil {
+		t.Fatalf("Upsert failed: %v", err)
+	}
+	defer Remove(obj)
+
+	staleLock, err := GetLock(obj)
+	if err != nil {
+		t.Fatalf("GetLock failed: %v", err)
+	}
+	Unlock(obj, staleLock)
+
+	// Modify object so that the lock becomes stale.
+	obj.Value = "modified"
+	if err = Upsert(obj, 0); err != nil {
+		t.Fatalf("Upsert failed: %v", err)
+	}
+
+	if err = RemoveCas(obj, staleLock); err != util.ErrAlreadyExists {
+		t.Errorf("Mismatching CAS: expected %v, got %v", util.ErrAlreadyExists, err)
+	}
+
+	lock, err := GetLock(obj)
+	if err != nil {
+		t.Fatalf("GetLock failed: %v", err)
+	}
+
+	if err = RemoveCas(obj, lock); err != nil {
+		t.Errorf("Matching CAS: remove failed: %v", err)
+	}
+
+	if err = Get(obj); err != util.ErrNotFound {
+		t.Errorf("Object not removed: %v", err)
+	}
+}
+
+func TestReplaceCas(t *testing.T) {
+	requireBucket(t)
+
+	obj := newTestObject("replacecas")
+	if err := Upsert(obj, 0); err != nil {
+		t.Fatalf("Upsert failed: %v", err)
+	}
+	defer Remove(obj)
+
+	// Two clients read the object, and get its version token.
+	var tokens [2]string
+	for i := range tokens {
+		lock, err := GetCas(newTestObject("replacecas"))
+		if err != nil {
+			t.Fatalf("GetCas failed: %v", err)
+		}
+		tokens[i] = lock.Token()
+	}
+
+	// First update wins.
+	lock, err := ParseLockToken(tokens[0])
+	if err != nil {
+		t.Fatalf("ParseLockToken failed: %v", err)
+	}
+	obj.Value = "first"
+	newLock, err := ReplaceCas(obj, lock, 0)
+	if err != nil || newLock == lock {
+		t.Fatalf("First update failed: lock %v, error %v", newLock, err)
+	}
+
+	// Second update conflicts.
+	lock, _ = ParseLockToken(tokens[1])
+	obj.Value = "second"
+	if _, err = ReplaceCas(obj, lock, 0); err != util.ErrAlreadyExists {
+		t.Errorf("Conflicting update: expected %v, got %v", util.ErrAlreadyExists, err)
+	}
+
+	stored := newTestObject("replacecas")
+	if err = Get(stored); err != nil || stored.Value != "first" {
+		t.Errorf("Expected value first, got %s, error %v", stored.Value, err)
+	}
+
+	// Update with new token succeeds.
+	lock, _ = ParseLockToken(newLock.Token())
+	if _, err = ReplaceCas(obj, lock, 0); err != nil {
+		t.Errorf("Update with new token failed: %v", err)
+	}
+
+	for _, token := range []string{"", "0", "not a token"} {
+		if _, err = ParseLockToken(token); err != util.ErrInvalidInput {
+			t.Errorf("Token %q: expected %v, got %v", token, util.ErrInvalidInput, err)
+		}
+	}
+}
+
+func TestGetCas(t *testing.T) {
+	requireBucket(t)
+
+	obj := newTestObject("getcas")
+	if err := Upsert(obj, 0); err != nil {
+		t.Fatalf("Upsert failed: %v", err)
+	}
+	defer Remove(obj)
+
+	cas, err := GetCas(obj)
+	if err != nil || cas == 0 {
+		t.Fatalf("GetCas failed: CAS %d, error %v", cas, err)
+	}
+
+	obj.Value = "modified"
+	if err = Upsert(obj, 0); err != nil {
+		t.Fatalf("Upsert failed: %v", err)
+	}
+
+	read := newTestObject("getcas")
+	newCas, err := GetCas(read)
+	if err != nil || newCas == cas || read.Value != "modified" {
+		t.Errorf("Expected new CAS and value, got CAS %d (old %d), value %q, error %v", newCas, cas, read.Value, err)
+	}
+
+	if _, err = GetCas(newTestObject("getcas-missing")); err != util.ErrNotFound {
+		t.Errorf("Missing object: expected %v, got %v", util.ErrNotFound, err)
+	}
+}
+
+// Seed documents with duplicate view keys.
+func seedViewDocs(t *testing.T, n int) {
+	ddoc := &gocb.DesignDocument{
+		Name: "test",
+		Views: map[string]gocb.View{
+			"by_value": gocb.View{
+				Map: `function (doc, meta) { if (doc.type == "test" && doc.value) { emit(doc.value, null); } }`,
+			},
+		},
+	}
+	if err := Buckets[DEFAULT_BUCKET].couch.Manager("", "").UpsertDesignDocument(ddoc); err != nil {
+		t.Fatalf("Failed to create design doc: %v", err)
+	}
+
+	for i := 0; i < n; i++ {
+		obj := newTestObject(fmt.Sprintf("view%02d", i))
+		obj.Value = fmt.Sprintf("key%d", i/3) // Three documents per key.
+		if err := Upsert(obj, 0); err != nil {
+			t.Fatalf("Upsert failed: %v", err)
+		}
+	}
+}
+
+func TestExecPagedViewQueryFromDoc(t *testing.T) {
+	requireBucket(t)
+
+	const numDocs = 12
+
+	seedViewDocs(t, numDocs)
+
+	// Page through all rows, two at a time, resuming from last document.
+	seen := make(map[string]bool)
+	var startKey interface{} = "key~"
+	startDocId, offset := "", "0"
+	for page := 0; page < numDocs; page++ {
+		var qr ViewQueryResult
+		qr.MakeRows(2)
+
+		size, _, err := ExecPagedViewQueryFromDoc(DEFAULT_BUCKET, &qr, "test", "by_value",
+			startKey, "key", startDocId, true, "2", offset)
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+		if size == 0 {
+			break
+		}
+
+		for _, row := range qr.Results[:size] {
+			if seen[row.Id] {
+				t.Errorf("Row %s repeated", row.Id)
+			}
+			seen[row.Id] = true
+		}
+
+		last := qr.Results[size-1]
+		startKey, startDocId, offset = last.Key, last.Id, "1"
+	}
+
+	if len(seen) != numDocs {
+		t.Errorf("Expected %d rows, got %d", numDocs, len(seen))
+	}
+}
+
+func TestViewStale(t *testing.T) {
+	requireBucket(t)
+
+	seedViewDocs(t, 3)
+
+	// Fresh mode sees a document written just before the query.
+	obj := newTestObject("viewfresh")
+	obj.Value = "fresh"
+	if err := Upsert(obj, 0); err != nil {
+		t.Fatalf("Upsert failed: %v", err)
+	}
+
+	var qr ViewQueryResult
+	qr.MakeRows(10)
+	size, _, err := ExecPagedViewQueryStale(DEFAULT_BUCKET, &qr, "test", "by_value", "fresh", VIEW_STALE_FALSE, "10", "0")
+	if err != nil || size != 1 || qr.Results[0].Id != obj.GetMeta().Key() {
+		t.Errorf("Fresh query: expected %s, got %d rows %v, error %v", obj.GetMeta().Key(), size, qr.Results[:size], err)
+	}
+
+	// Stale modes query the index as is.
+	for _, stale := range []ViewStale{VIEW_STALE_DEFAULT, VIEW_STALE_OK, VIEW_STALE_UPDATE_AFTER} {
+		qr.MakeRows(10)
+		if _, _, err := ExecPagedViewQueryStale(DEFAULT_BUCKET, &qr, "test", "by_value", "key0", stale, "10", "0"); err != nil {
+			t.Errorf("Stale %d query failed: %v", stale, err)
+		}
+	}
+}
+
+func TestViewStaleMode(t *testing.T) {
+	for stale, expected := range map[ViewStale]gocb.StaleMode{
+		VIEW_STALE_OK:           gocb.None,
+		VIEW_STALE_UPDATE_AFTER: gocb.After,
+		VIEW_STALE_FALSE:        gocb.Before,
+	} {
+		if mode, ok := stale.staleMode(); !ok || mode != expected {
+			t.Errorf("Stale %d: expected mode %v, got %v", stale, expected, mode)
+		}
+	}
+
+	if _, ok := VIEW_STALE_DEFAULT.staleMode(); ok {
+		t.Errorf("Default staleness sets stale mode")
+	}
+}
+
+func TestTranscoder(t *testing.T) {
+	requireBucket(t)
+
+	RegisterTranscoder("gztest", GzipJSONTranscoder{})
+	defer RegisterTranscoder("gztest", nil)
+
+	// Encode and decode through bucket transcoder.
+	obj := &testObject{Type: "gztest", Id: "1", Value: strings.Repeat("compress me ", 100)}
+	data, flags, err := objTranscoder{}.Encode(obj)
+	if err != nil || flags != FLAGS_BINARY {
+		t.Fatalf("Encode: flags %x, error %v", flags, err)
+	}
+	if len(data) >= len(obj.Value) {
+		t.Errorf("Data not compressed: %d bytes", len(data))
+	}
+
+	out := &testObject{Type: "gztest", Id: "1"}
+	if err = (objTranscoder{}).Decode(data, flags, out); err != nil || out.Value != obj.Value {
+		t.Errorf("Decode: error %v", err)
+	}
+
+	// Round trip through database.
+	if err = Upsert(&gzTestObject{*obj}, 0); err != nil {
+		t.Fatalf("Upsert failed: %v", err)
+	}
+	defer Remove(&gzTestObject{*obj})
+
+	got := &gzTestObject{testObject{Type: "gztest", Id: "1"}}
+	if err = Get(got); err != nil || got.Value != obj.Value {
+		t.Errorf("Get: error %v", err)
+	}
+}
+
+// Test object stored with gzip transcoder.
+type gzTestObject struct {
+	testObject
+}
+
+func (obj *gzTestObject) SetType() {
+	obj.Type = "gztest"
+}
+
+func TestKeyPrefix(t *testing.T) {
+	requireBucket(t)
+
+	meta := ObjMeta{Bucket: DEFAULT_BUCKET, Type: "user", Id: "1"}
+
+	defer Buckets[DEFAULT_BUCKET].setPrefix("")
+
+	Buckets[DEFAULT_BUCKET].setPrefix("")
+	if meta.Key() != "user:1" {
+		t.Errorf("Unprefixed: unexpected key %s", meta.Key())
+	}
+
+	Buckets[DEFAULT_BUCKET].setPrefix("staging")
+	if meta.Key() != "staging:user:1" {
+		t.Errorf("Prefixed: unexpected key %s", meta.Key())
+	}
+
+	// Prefixed object round trip.
+	obj := newTestObject("prefixed")
+	if err := Upsert(obj, 0); err != nil {
+		t.Fatalf("Upsert failed: %v", err)
+	}
+	defer Remove(obj)
+
+	if err := Get(newTestObject("prefixed")); err != nil {
+		t.Errorf("Get failed: %v", err)
+	}
+}
+
+// Tenant scoped test object.
+type tenantObject struct {
+	testObject
+	meta ObjMeta
+}
+
+func (obj *tenantObject) GetMeta() ObjMeta {
+	return obj.meta
+}
+
+func newTenantObject(t *testing.T, ctx context.Context, id, value string) *tenantObject {
+	meta, err := TenantMeta(ctx, DEFAULT_BUCKET, "test", id)
+	if err != nil {
+		t.Fatalf("TenantMeta failed: %v", err)
+	}
+	return &tenantObject{testObject: testObject{Type: "test", Id: id, Value: value}, meta: meta}
+}
+
+func TestTenantMeta(t *testing.T) {
+	requireBucket(t)
+
+	ctxA := WithTenant(context.Background(), "acme")
+	ctxB := WithTenant(context.Background(), "globex")
+
+	metaA, _ := TenantMeta(ctxA, DEFAULT_BUCKET, "user", "1")
+	metaB, _ := TenantMeta(ctxB, DEFAULT_BUCKET, "user", "1")
+	if metaA.Key() != "acme:user:1" || metaB.Key() != "globex:user:1" {
+		t.Errorf("Unexpected keys %s, %s", metaA.Key(), metaB.Key())
+	}
+
+	// Missing and invalid tenants.
+	for _, ctx := range []context.Context{
+		context.Background(),
+		WithTenant(context.Background(), ""),
+		WithTenant(context.Background(), "a:b"),
+	} {
+		if _, err := TenantMeta(ctx, DEFAULT_BUCKET, "user", "1"); err != util.ErrInvalidInput {
+			t.Errorf("Expected ErrInvalidInput, got %v", err)
+		}
+	}
+
+	// Same ID in two tenants does not collide.
+	objA := newTenantObject(t, ctxA, "tenant", "a")
+	objB := newTenantObject(t, ctxB, "tenant", "b")
+	if err := Upsert(objA, 0); err != nil {
+		t.Fatalf("Upsert failed: %v", err)
+	}
+	defer Remove(objA)
+	if err := Upsert(objB, 0); err != nil {
+		t.Fatalf("Upsert failed: %v", err)
+	}
+	defer Remove(objB)
+
+	gotA := newTenantObject(t, ctxA, "tenant", "")
+	gotB := newTenantObject(t, ctxB, "tenant", "")
+	if err := Get(gotA); err != nil || gotA.Value != "a" {
+		t.Errorf("Tenant acme: unexpected value %q, error %v", gotA.Value, err)
+	}
+	if err := Get(gotB); err != nil || gotB.Value != "b" {
+		t.Errorf("Tenant globex: unexpected value %q, error %v", gotB.Value, err)
+	}
+
+	// Unscoped object is distinct from tenant objects.
+	if err := Get(newTestObject("tenant")); err != util.ErrNotFound {
+		t.Errorf("Expected ErrNotFound for unscoped object, got %v", err)
+	}
+}
+
+func TestBucketPassword(t *testing.T) {
+	defer func(c credentials) { creds = c }(creds)
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, []byte(`{"db-couch": {"bucket-password": "global", "bucket-password-legacy": "legacy"}}`), 0600)
+	if err := config.Merge(path); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+
+	// Legacy bucket passwords, bucket specific one overriding global one.
+	creds = credentials{}
+	if p := bucketPassword("legacy"); p != "legacy" {
+		t.Errorf("Expected bucket password %q, got %q", "legacy", p)
+	}
+	if p := bucketPassword("other"); p != "global" {
+		t.Errorf("Expected bucket password %q, got %q", "global", p)
+	}
+
+	// RBAC ignores bucket passwords.
+	creds = credentials{username: "app", password: "secret"}
+	if p := bucketPassword("legacy"); p != "" {
+		t.Errorf("Expected no bucket password with RBAC, got %q", p)
+	}
+}
+
+func TestQuoteFieldPath(t *testing.T) {
+	for field, expected := range map[string]string{
+		"value":        "`value`",
+		"address.city": "`address`.`city`",
+		"a-b.c d":      "`a-b`.`c d`",
+	} {
+		if quoted, ok := quoteFieldPath(field); !ok || quoted != expected {
+			t.Errorf("Field %q: expected %s, got %s", field, expected, quoted)
+		}
+	}
+
+	for _, field := range []string{"", "a..b", ".a", "a.", "a`b"} {
+		if _, ok := quoteFieldPath(field); ok {
+			t.Errorf("Field %q: expected invalid", field)
+		}
+	}
+}
+
+func TestEnsureIndex(t *testing.T) {
+	requireBucket(t)
+
+	// Creation is idempotent.
+	for i := 0; i < 2; i++ {
+		if err := EnsurePrimaryIndex(DEFAULT_BUCKET); err != nil {
+			t.Fatalf("EnsurePrimaryIndex %d failed: %v", i, err)
+		}
+		if err := EnsureIndex(DEFAULT_BUCKET, "test_value_idx", "value"); err != nil {
+			t.Fatalf("EnsureIndex %d failed: %v", i, err)
+		}
+	}
+
+	if err := EnsureIndex(DEFAULT_BUCKET, "", "value"); err != util.ErrInvalidInput {
+		t.Errorf("Expected error %v, got %v", util.ErrInvalidInput, err)
+	}
+	if err := EnsurePrimaryIndex(BucketIndex(len(Buckets))); err != util.ErrInvalidInput {
+		t.Errorf("Expected error %v, got %v", util.ErrInvalidInput, err)
+	}
+}
+
+func TestParsePageArgsWithLimits(t *testing.T) {
+	tests := []struct {
+		limitStr, offsetStr string
+		dflt, max           int
+		limit, offset       int
+		err                 error
+	}{
+		{"", "", 10, 50, 10, 0, nil},
+		{"0", "5", 10, 50, 10, 5, nil},
+		{"30", "", 10, 50, 30, 0, nil},
+		{"50", "", 10, 50, 50, 0, nil},
+		{"51", "", 10, 50, 50, 0, nil},
+		{"200", "100", 10, 50, 50, 100, nil},
+		{"x", "", 10, 50, 0, 0, util.ErrInvalidInput},
+		{"10", "x", 10, 50, 0, 0, util.ErrInvalidInput},
+		{"", "", 60, 50, 0, 0, util.ErrInvalidInput},
+		{"", "", 0, 50, 0, 0, util.ErrInvalidInput},
+	}
+
+	for _, tt := range tests {
+		limit, offset, err := ParsePageArgsWithLimits(tt.limitStr, tt.offsetStr, tt.dflt, tt.max)
+		if limit != tt.limit || offset != tt.offset || err != tt.err {
+			t.Errorf("(%q, %q, %d, %d): expected (%d, %d, %v), got (%d, %d, %v)", tt.limitStr, tt.offsetStr, tt.dflt, tt.max,
+				tt.limit, tt.offset, tt.err, limit, offset, err)
+		}
+	}
+
+	// Global limits.
+	if limit, _, _ := ParsePageArgs("", ""); limit != QUERY_LIMIT_DEFAULT {
+		t.Errorf("Expected default limit %d, got %d", QUERY_LIMIT_DEFAULT, limit)
+	}
+	if limit, _, _ := ParsePageArgs("1000", ""); limit != QUERY_LIMIT_MAX {
+		t.Errorf("Expected max limit %d, got %d", QUERY_LIMIT_MAX, limit)
+	}
+}
+
+func TestExecQueryStream(t *testing.T) {
+	requireBucket(t)
+
+	const numDocs = 300
+
+	for i := 0; i < numDocs; i++ {
+		obj := newTestObject(fmt.Sprintf("stream%03d", i))
+		obj.Value = "stream"
+		if err := Upsert(obj, 0); err != nil {
+			t.Fatalf("Upsert failed: %v", err)
+		}
+	}
+	if err := EnsurePrimaryIndex(DEFAULT_BUCKET); err != nil {
+		t.Fatalf("EnsurePrimaryIndex failed: %v", err)
+	}
+
+	stmt := fmt.Sprintf("SELECT id FROM `%s` WHERE type = 'test' AND `value` = 'stream'", BucketName(DEFAULT_BUCKET))
+	rows := 0
+	size, err := ExecQueryStream(DEFAULT_BUCKET, stmt, func(row []byte) error {
+		rows++
+		return nil
+	})
+	if err != nil || size != numDocs || rows != numDocs {
+		t.Errorf("Expected %d rows, got %d (%d), error %v", numDocs, size, rows, err)
+	}
+
+	// Error stops query.
+	size, err = ExecQueryStream(DEFAULT_BUCKET, stmt, func(row []byte) error {
+		return util.ErrNetAccess
+	})
+	if err != util.ErrNetAccess || size != 0 {
+		t.Errorf("Expected error %v after 0 rows, got %v after %d", util.ErrNetAccess, err, size)
+	}
+}
+
+func TestScanType(t *testing.T) {
+	requireBucket(t)
+
+	const numDocs = 25
+
+	defer func(size int) { ScanPageSize = size }(ScanPageSize)
+	ScanPageSize = 10
+
+	expected := make(map[string]bool)
+	for i := 0; i < numDocs; i++ {
+		obj := &testObject{Type: "scantest", Id: fmt.Sprintf("scan%02d", i)}
+		if err := Upsert(obj, 0); err != nil {
+			t.Fatalf("Upsert failed: %v", err)
+		}
+		defer Remove(obj)
+		expected[obj.Id] = true
+	}
+	if err := EnsurePrimaryIndex(DEFAULT_BUCKET); err != nil {
+		t.Fatalf("EnsurePrimaryIndex failed: %v", err)
+	}
+
+	// Every id is visited once, across pages.
+	seen := make(map[string]int)
+	if err := ScanType(DEFAULT_BUCKET, "scantest", func(id string) error {
+		seen[id]++
+		return nil
+	}); err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if len(seen) != numDocs {
+		t.Errorf("Expected %d ids, got %d", numDocs, len(seen))
+	}
+	for id, n := range seen {
+		if !expected[id] || n != 1 {
+			t.Errorf("Id %s visited %d times", id, n)
+		}
+	}
+
+	// Scan continues past errors of fn, returning the first.
+	visited := 0
+	err := ScanType(DEFAULT_BUCKET, "scantest", func(id string) error {
+		visited++
+		if id == "scan03" {
+			return util.ErrInvalidObject
+		}
+		if id == "scan07" {
+			return util.ErrNotFound
+		}
+		return nil
+	})
+	if err != util.ErrInvalidObject || visited != numDocs {
+		t.Errorf("Expected error %v after %d ids, got %v after %d", util.ErrInvalidObject, numDocs, err, visited)
+	}
+
+	if err := ScanType(DEFAULT_BUCKET, "", func(string) error { return nil }); err != util.ErrInvalidInput {
+		t.Errorf("Expected error %v, got %v", util.ErrInvalidInput, err)
+	}
+}
+
+// Query result of test objects.
+type testQueryResult struct {
+	Rows []testObject
+}
+
+func (qr *testQueryResult) GetRowPtr(i int) interface{} {
+	if i >= len(qr.Rows) {
+		qr.Rows = append(qr.Rows, make([]testObject, i+1-len(qr.Rows))...)
+	}
+	return &qr.Rows[i]
+}
+
+// Get number of queries served by an in-flight query, from metrics.
+func sharedQueryCount(t *testing.T) int64 {
+	var buf bytes.Buffer
+	metrics.WritePrometheus(&buf)
+
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, METRIC_QUERY_SHARED+" ") {
+			n, err := strconv.ParseInt(strings.TrimPrefix(line, METRIC_QUERY_SHARED+" "), 10, 64)
+			if err != nil {
+				t.Fatalf("Invalid metric %s", line)
+			}
+			return n
+		}
+	}
+
+	return 0
+}
+
+func TestExecQueryShared(t *testing.T) {
+	const numCallers = 10
+
+	var execs int32
+	release := make(chan struct{})
+	defer func(read func(BucketIndex, string, []interface{}) ([][]byte, error)) { readQueryRows = read }(readQueryRows)
+	readQueryRows = func(bIndex BucketIndex, queryStmt string, params []interface{}) ([][]byte, error) {
+		atomic.AddInt32(&execs, 1)
+		<-release
+		return [][]byte{[]byte(`{"type": "test", "id": "a"}`), []byte(`{"type": "test", "id": "b"}`)}, nil
+	}
+
+	shared := sharedQueryCount(t)
+
+	var wg sync.WaitGroup
+	results := make([]testQueryResult, numCallers)
+	errs := make([]error, numCallers)
+	for i := 0; i < numCallers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = ExecQueryShared(DEFAULT_BUCKET, &results[i], "SELECT * FROM test WHERE id > $1", "0")
+		}(i)
+	}
+
+	// Release query once all other callers joined it.
+	for sharedQueryCount(t) < shared+numCallers-1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if execs != 1 {
+		t.Errorf("Expected 1 query execution, got %d", execs)
+	}
+	for i := range results {
+		if errs[i] != nil || len(results[i].Rows) != 2 || results[i].Rows[1].Id != "b" {
+			t.Errorf("Caller %d: unexpected rows %v, error %v", i, results[i].Rows, errs[i])
+		}
+	}
+
+	// Results are not shared.
+	results[0].Rows[0].Id = "changed"
+	if results[1].Rows[0].Id != "a" {
+		t.Errorf("Result of caller 1 changed by caller 0")
+	}
+
+	// Queries with other params, or after completion, execute again.
+	ExecQueryShared(DEFAULT_BUCKET, &testQueryResult{}, "SELECT * FROM test WHERE id > $1", "1")
+	ExecQueryShared(DEFAULT_BUCKET, &testQueryResult{}, "SELECT * FROM test WHERE id > $1", "0")
+	if execs != 3 {
+		t.Errorf("Expected 3 query executions, got %d", execs)
+	}
+}
+
+func TestChangeFeed(t *testing.T) {
+	defer func(size int) { ChangePageSize = size }(ChangePageSize)
+	ChangePageSize = 2
+
+	if _, err := newChangeFeed(DEFAULT_BUCKET, "modified`"); err != util.ErrInvalidInput {
+		t.Errorf("Expected ErrInvalidInput for invalid field, got %v", err)
+	}
+
+	cf, err := newChangeFeed(DEFAULT_BUCKET, "modified")
+	if err != nil {
+		t.Fatalf("newChangeFeed failed: %v", err)
+	}
+
+	// Seeded changes, in mutation order. The first predates the feed.
+	type change struct {
+		Key      string          `json:"key"`
+		Modified int64           `json:"modified"`
+		Doc      json.RawMessage `json:"doc"`
+	}
+	now := cf.modified
+	var seeded []change
+	seed := func(key string, modified int64) {
+		seeded = append(seeded, change{key, modified, json.RawMessage(`{"id":"` + key + `"}`)})
+	}
+	seed("user:0", now-1)
+	seed("user:1", now+1)
+	seed("user:2", now+1)
+	seed("item:1", now+2)
+
+	defer func(read func(BucketIndex, string, []interface{}) ([][]byte, error)) { readChangeRows = read }(readChangeRows)
+	readChangeRows = func(bIndex BucketIndex, queryStmt string, params []interface{}) ([][]byte, error) {
+		since, key := params[0].(int64), params[1].(string)
+		var rows [][]byte
+		for _, c := range seeded {
+			if (c.Modified > since || c.Modified == since && c.Key > key) && len(rows) < ChangePageSize {
+				row, _ := json.Marshal(c)
+				rows = append(rows, row)
+			}
+		}
+		return rows, nil
+	}
+
+	var got []string
+	defer SetChangeHandler(nil)
+	SetChangeHandler(func(c Change) {
+		got = append(got, fmt.Sprintf("%s@%d %s", c.Key, c.Modified-now, c.Doc))
+	})
+
+	cf.poll(context.Background())
+	expected := `[user:1@1 {"id":"user:1"} user:2@1 {"id":"user:2"} item:1@2 {"id":"item:1"}]`
+	if fmt.Sprint(got) != expected {
+		t.Errorf("Expected changes %s, got %v", expected, got)
+	}
+
+	// Only new changes are emitted.
+	got = nil
+	seed("item:2", now+3)
+	cf.poll(context.Background())
+	if fmt.Sprint(got) != `[item:2@3 {"id":"item:2"}]` {
+		t.Errorf("Unexpected changes %v", got)
+	}
+}
+
+func TestMain(m *testing.M) {
+	// Init.
+	config.Init("testdata/config.json")
+	log.Init("", "error", false)
+
+	os.Exit(m.Run())
+}
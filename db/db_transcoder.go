@@ -0,0 +1,121 @@
+package db
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"github.com/couchbaselabs/gocb"
+	"io/ioutil"
+	"sync"
+)
+
+// Transcoder converts objects to and from stored documents. It has the same
+// signature as gocb.Transcoder.
+//
+// Objects stored with a non-JSON transcoder are opaque to the server: they
+// cannot be indexed by views or queried with N1QL, and every reader must use
+// the same transcoder. Use a custom transcoder only for objects accessed by key.
+type Transcoder interface {
+	Decode([]byte, uint32, interface{}) error
+	Encode(interface{}) ([]byte, uint32, error)
+}
+
+// Common flags for binary documents.
+const FLAGS_BINARY = 0x03000000
+
+// Registered transcoders.
+var transcoders struct {
+	sync.RWMutex                        // Mutex for accessing transcoders.
+	byType       map[ObjType]Transcoder // Map of object type to transcoder.
+	dflt         Transcoder             // Default transcoder.
+}
+
+func init() {
+	transcoders.byType = make(map[ObjType]Transcoder)
+	transcoders.dflt = gocb.DefaultTranscoder{}
+}
+
+// Register transcoder for an object type. Nil transcoder restores the default.
+func RegisterTranscoder(t ObjType, tc Transcoder) {
+	transcoders.Lock()
+	if tc == nil {
+		delete(transcoders.byType, t)
+	} else {
+		transcoders.byType[t] = tc
+	}
+	transcoders.Unlock()
+}
+
+// Set default transcoder for object types without a registered transcoder.
+// Nil restores JSON.
+func SetDefaultTranscoder(tc Transcoder) {
+	transcoders.Lock()
+	if tc == nil {
+		transcoders.dflt = gocb.DefaultTranscoder{}
+	} else {
+		transcoders.dflt = tc
+	}
+	transcoders.Unlock()
+}
+
+// Get transcoder for a value.
+func lookupTranscoder(v interface{}) Transcoder {
+	transcoders.RLock()
+	defer transcoders.RUnlock()
+
+	if obj, ok := v.(Object); ok {
+		if tc, ok := transcoders.byType[obj.GetMeta().Type]; ok {
+			return tc
+		}
+	}
+
+	return transcoders.dflt
+}
+
+// Bucket transcoder which dispatches to the transcoder registered for the object type.
+type objTranscoder struct{}
+
+func (objTranscoder) Decode(data []byte, flags uint32, out interface{}) error {
+	return lookupTranscoder(out).Decode(data, flags, out)
+}
+
+func (objTranscoder) Encode(value interface{}) ([]byte, uint32, error) {
+	return lookupTranscoder(value).Encode(value)
+}
+
+// Transcoder storing objects as gzip compressed JSON. Suitable for large objects
+// accessed only by key.
+type GzipJSONTranscoder struct{}
+
+func (GzipJSONTranscoder) Decode(data []byte, flags uint32, out interface{}) error {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	js, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(js, out)
+}
+
+func (GzipJSONTranscoder) Encode(value interface{}) ([]byte, uint32, error) {
+	js, err := json.Marshal(value)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err = zw.Write(js); err != nil {
+		return nil, 0, err
+	}
+	if err = zw.Close(); err != nil {
+		return nil, 0, err
+	}
+
+	return buf.Bytes(), FLAGS_BINARY, nil
+}
@@ -8,6 +8,7 @@ import (
 	"io/ioutil"
 	stdlog "log"
 	"os"
+	"sort"
 	"sync"
 )
 
@@ -36,32 +37,46 @@ var (
 	infoLogger  *stdlog.Logger
 )
 
+// Logging functions. The *Output variants take the call depth for reporting
+// file and line, for use in wrappers. A calldepth of 2 reports the caller of
+// the *Output function, 3 the caller of its wrapper, and so on.
+
 func Fatalln(v ...interface{}) {
+	FatallnOutput(3, v...)
+}
+
+func FatallnOutput(calldepth int, v ...interface{}) {
 	if level >= FATAL {
 		s := fmt.Sprintln(v...)
-		fatalLogger.Output(2, s)
+		fatalLogger.Output(calldepth, s)
 		panic(s)
 	}
 }
 
 func Fatalf(format string, v ...interface{}) {
+	FatalfOutput(3, format, v...)
+}
+
+func FatalfOutput(calldepth int, format string, v ...interface{}) {
 	if level >= FATAL {
 		s := fmt.Sprintf(format, v...)
-		fatalLogger.Output(2, s)
+		fatalLogger.Output(calldepth, s)
 		panic(s)
 	}
 }
 
 func Errorln(v ...interface{}) {
+	ErrorlnOutput(3, v...)
+}
+
+func ErrorlnOutput(calldepth int, v ...interface{}) {
 	if level >= ERROR {
-		errorLogger.Output(2, fmt.Sprintln(v...))
+		errorLogger.Output(calldepth, fmt.Sprintln(v...))
 	}
 }
 
 func Errorf(format string, v ...interface{}) {
-	if level >= ERROR {
-		errorLogger.Output(2, fmt.Sprintf(format, v...))
-	}
+	ErrorfOutput(3, format, v...)
 }
 
 func ErrorfOutput(calldepth int, format string, v ...interface{}) {
@@ -71,19 +86,19 @@ func ErrorfOutput(calldepth int, format string, v ...interface{}) {
 }
 
 func Debugln(module string, v ...interface{}) {
+	DebuglnOutput(3, module, v...)
+}
+
+func DebuglnOutput(calldepth int, module string, v ...interface{}) {
 	if level >= DEBUG {
 		if debugEnable[module] {
-			debugLogger.Output(2, fmt.Sprintln(v...))
+			debugLogger.Output(calldepth, fmt.Sprintln(v...))
 		}
 	}
 }
 
 func Debugf(module, format string, v ...interface{}) {
-	if level >= DEBUG {
-		if debugEnable[module] {
-			debugLogger.Output(2, fmt.Sprintf(format, v...))
-		}
-	}
+	DebugfOutput(3, module, format, v...)
 }
 
 func DebugfOutput(calldepth int, module, format string, v ...interface{}) {
@@ -97,11 +112,15 @@ func DebugfOutput(calldepth int, module, format string, v ...interface{}) {
 // NOTE: log.Info routines do not check for log level. They should be used sparingly in production code.
 // It should be used only for informational purpose. Please do NOT use it for debug purposes.
 func Infoln(v ...interface{}) {
-	infoLogger.Output(2, fmt.Sprintln(v...))
+	InfolnOutput(3, v...)
+}
+
+func InfolnOutput(calldepth int, v ...interface{}) {
+	infoLogger.Output(calldepth, fmt.Sprintln(v...))
 }
 
 func Infof(format string, v ...interface{}) {
-	infoLogger.Output(2, fmt.Sprintf(format, v...))
+	InfofOutput(3, format, v...)
 }
 
 func InfofOutput(calldepth int, format string, v ...interface{}) {
@@ -120,6 +139,30 @@ func DisableDebug(module string) {
 	lock.Unlock()
 }
 
+func IsDebugEnabled(module string) bool {
+	lock.Lock()
+	enabled := debugEnable[module]
+	lock.Unlock()
+
+	return enabled
+}
+
+// Get modules with debug enabled, in sorted order.
+func DebugModules() []string {
+	lock.Lock()
+	modules := make([]string, 0, len(debugEnable))
+	for module, enabled := range debugEnable {
+		if enabled {
+			modules = append(modules, module)
+		}
+	}
+	lock.Unlock()
+
+	sort.Strings(modules)
+
+	return modules
+}
+
 func initLoggers(writer io.Writer) {
 	fatalLogger = stdlog.New(writer, "FATAL: ", stdlog.Ldate|stdlog.Lmicroseconds|stdlog.Lshortfile)
 	errorLogger = stdlog.New(writer, "ERROR: ", stdlog.Ldate|stdlog.Lmicroseconds|stdlog.Lshortfile)
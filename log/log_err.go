@@ -0,0 +1,81 @@
+package log
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// Error with numeric code, e.g. util.Err.
+type codedError interface {
+	error
+	Code() int
+}
+
+// Log errors of Err in JSON form.
+var jsonErrors atomic.Bool
+
+// Enable logging errors of Err as JSON objects, for log processors that alert
+// on error codes.
+func EnableJSON(enable bool) {
+	jsonErrors.Store(enable)
+}
+
+// Structured error log entry.
+type errEntry struct {
+	Module  string `json:"module"`           // Module.
+	Code    *int   `json:"code,omitempty"`   // Error code, if error is coded.
+	Message string `json:"message"`          // Error message.
+	Detail  string `json:"detail,omitempty"` // Wrapping error message, if any.
+}
+
+// Build log entry of error. Coded errors, possibly wrapped, contribute their
+// code and message. The message of the wrapping error is the detail.
+func newErrEntry(module string, e error) errEntry {
+	entry := errEntry{Module: module, Message: e.Error()}
+
+	var ce codedError
+	if errors.As(e, &ce) {
+		code := ce.Code()
+		entry.Code = &code
+		entry.Message = ce.Error()
+		if error(ce) != e {
+			entry.Detail = e.Error()
+		}
+	}
+
+	return entry
+}
+
+// Format log entry, as JSON if enabled.
+func (entry errEntry) String() string {
+	if jsonErrors.Load() {
+		if b, err := json.Marshal(entry); err == nil {
+			return string(b)
+		}
+	}
+
+	s := entry.Module + ": "
+	if entry.Code != nil {
+		s += fmt.Sprintf("error %d: ", *entry.Code)
+	}
+	s += entry.Message
+	if entry.Detail != "" {
+		s += " (" + entry.Detail + ")"
+	}
+
+	return s
+}
+
+// Log error of module. Errors with codes, e.g. util.Err, are logged with code
+// and message, so that alerts can match specific codes.
+func Err(module string, e error) {
+	ErrOutput(3, module, e)
+}
+
+func ErrOutput(calldepth int, module string, e error) {
+	if level >= ERROR && e != nil {
+		errorLogger.Output(calldepth, newErrEntry(module, e).String())
+	}
+}
@@ -0,0 +1,69 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Coded test error, like util.Err.
+type testErr int
+
+func (e testErr) Error() string { return "Object not found" }
+func (e testErr) Code() int     { return int(e) }
+
+func TestErr(t *testing.T) {
+	var buf bytes.Buffer
+	initLoggers(&buf)
+	defer initLoggers(&bytes.Buffer{})
+
+	tests := []struct {
+		err      error
+		expected string
+	}{
+		{testErr(8), "test: error 8: Object not found\n"},
+		{fmt.Errorf("user 42: %w", testErr(8)), "test: error 8: Object not found (user 42: Object not found)\n"},
+		{errors.New("plain"), "test: plain\n"},
+	}
+
+	for _, tt := range tests {
+		buf.Reset()
+		Err("test", tt.err)
+		if !strings.HasSuffix(buf.String(), tt.expected) {
+			t.Errorf("Expected %q, got %q", tt.expected, buf.String())
+		}
+	}
+
+	// Nil errors are not logged.
+	buf.Reset()
+	Err("test", nil)
+	if buf.Len() > 0 {
+		t.Errorf("Unexpected output %q", buf.String())
+	}
+}
+
+func TestErrJSON(t *testing.T) {
+	var buf bytes.Buffer
+	initLoggers(&buf)
+	EnableJSON(true)
+	defer func() {
+		initLoggers(&bytes.Buffer{})
+		EnableJSON(false)
+	}()
+
+	Err("test", fmt.Errorf("user 42: %w", testErr(8)))
+
+	line := buf.String()
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(line[strings.Index(line, "{"):]), &entry); err != nil {
+		t.Fatalf("Invalid JSON %q: %v", line, err)
+	}
+
+	if entry["module"] != "test" || entry["code"] != float64(8) ||
+		entry["message"] != "Object not found" || entry["detail"] != "user 42: Object not found" {
+		t.Errorf("Unexpected entry %v", entry)
+	}
+}
@@ -0,0 +1,54 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// Logging wrapper, reporting its caller.
+func wrapInfof(format string, v ...interface{}) {
+	InfofOutput(3, "wrapped: "+format, v...)
+}
+
+func wrapErrorln(v ...interface{}) {
+	ErrorlnOutput(3, v...)
+}
+
+func wrapDebugln(v ...interface{}) {
+	DebuglnOutput(3, "logtest", v...)
+}
+
+// Get file:line of caller.
+func callerLine() string {
+	_, file, line, _ := runtime.Caller(1)
+	return fmt.Sprintf("%s:%d", file[strings.LastIndex(file, "/")+1:], line)
+}
+
+func TestOutputCalldepth(t *testing.T) {
+	var buf bytes.Buffer
+	initLoggers(&buf)
+	level = DEBUG
+	EnableDebug("logtest")
+	defer func() {
+		initLoggers(&bytes.Buffer{})
+		level = ERROR
+		DisableDebug("logtest")
+	}()
+
+	for _, log := range []func() string{
+		func() string { l := callerLine(); Infof("direct"); return l },
+		func() string { l := callerLine(); wrapInfof("x"); return l },
+		func() string { l := callerLine(); Errorln("direct"); return l },
+		func() string { l := callerLine(); wrapErrorln("x"); return l },
+		func() string { l := callerLine(); wrapDebugln("x"); return l },
+	} {
+		buf.Reset()
+		expected := log()
+		if !strings.Contains(buf.String(), expected+":") {
+			t.Errorf("Expected caller %s in %q", expected, buf.String())
+		}
+	}
+}
@@ -0,0 +1,216 @@
+// This package provides light-weight instrumentation counters, gauges and
+// timers. Metrics are collected in a registry, independent of the backend
+// exporting them: Prometheus scrapes them in text format (see Handler), and
+// StatsD receives them periodically over UDP.
+//
+// Metrics are identified by name and an optional list of label name/value pairs,
+// e.g. metrics.Add("db_query_errors_total", 1, "fn", "ExecQuery").
+// Label values should have bounded cardinality.
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"github.com/sath33sh/infra/config"
+	"github.com/sath33sh/infra/log"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Module name.
+const MODULE = "metrics"
+
+// Metric backends.
+const (
+	BACKEND_PROMETHEUS = "prometheus" // Scraped with Handler.
+	BACKEND_STATSD     = "statsd"     // Sent to StatsD server.
+	BACKEND_NONE       = "none"       // Metrics disabled.
+)
+
+// Metrics disabled. Recording functions are no-ops.
+var disabled atomic.Bool
+
+// Initialize metrics backend from config. Defaults to Prometheus, which only
+// collects metrics until scraped.
+func Init() {
+	switch backend := config.Base.GetString(MODULE, "backend", BACKEND_PROMETHEUS); backend {
+	case BACKEND_PROMETHEUS:
+	case BACKEND_NONE:
+		disabled.Store(true)
+	case BACKEND_STATSD:
+		addr := config.Base.GetString(MODULE, "statsd-address", STATSD_ADDRESS)
+		prefix := config.Base.GetString(MODULE, "statsd-prefix", "")
+		interval := time.Duration(config.Base.GetInt(MODULE, "statsd-interval-seconds", STATSD_INTERVAL_SECONDS)) * time.Second
+		if err := startStatsD(addr, prefix, interval); err != nil {
+			log.Fatalf("Failed to start StatsD emitter: %v", err)
+		}
+	default:
+		log.Fatalf("Invalid metrics backend %s", backend)
+	}
+}
+
+// Shut down metrics backend, flushing pending metrics.
+func Shutdown(ctx context.Context) error {
+	return stopStatsD(ctx)
+}
+
+// Metric kinds.
+type Kind int
+
+const (
+	COUNTER Kind = iota // Monotonic counter.
+	GAUGE               // Gauge.
+	SUMMARY             // Duration summary: count and sum of observations.
+)
+
+var kindNames = map[Kind]string{
+	COUNTER: "counter",
+	GAUGE:   "gauge",
+	SUMMARY: "summary",
+}
+
+// Metric series.
+type series struct {
+	name   string   // Metric name.
+	labels string   // Formatted labels.
+	pairs  []string // Label name/value pairs.
+	kind   Kind     // Metric kind.
+	value  int64    // Counter or gauge value.
+	count  uint64   // Number of observations.
+	sum    float64  // Sum of observations in seconds.
+}
+
+// Registry of metric series.
+var registry struct {
+	sync.Mutex                    // Mutex for accessing registry.
+	series     map[string]*series // Map of series key to series.
+}
+
+func init() {
+	registry.series = make(map[string]*series)
+}
+
+// Format label pairs as name="value" list.
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		fmt.Fprintf(&sb, "%s=%q", labels[i], labels[i+1])
+	}
+
+	return sb.String()
+}
+
+// Get series, creating it if it does not exist. Caller must hold the mutex.
+func getSeries(name string, kind Kind, labels []string) *series {
+	fl := formatLabels(labels)
+	key := name + "{" + fl + "}"
+
+	s, ok := registry.series[key]
+	if !ok {
+		s = &series{name: name, labels: fl, pairs: labels, kind: kind}
+		registry.series[key] = s
+	}
+
+	return s
+}
+
+// Add delta to counter.
+func Add(name string, delta int64, labels ...string) {
+	if disabled.Load() {
+		return
+	}
+
+	registry.Lock()
+	getSeries(name, COUNTER, labels).value += delta
+	registry.Unlock()
+}
+
+// Set gauge value.
+func Set(name string, value int64, labels ...string) {
+	if disabled.Load() {
+		return
+	}
+
+	registry.Lock()
+	getSeries(name, GAUGE, labels).value = value
+	registry.Unlock()
+}
+
+// Observe duration.
+func Observe(name string, d time.Duration, labels ...string) {
+	if disabled.Load() {
+		return
+	}
+
+	registry.Lock()
+	s := getSeries(name, SUMMARY, labels)
+	s.count++
+	s.sum += d.Seconds()
+	registry.Unlock()
+}
+
+// Observe duration since start. Convenient with defer.
+func Since(name string, start time.Time, labels ...string) {
+	Observe(name, time.Since(start), labels...)
+}
+
+// Get snapshot of all series, sorted by name and labels.
+func snapshot() []series {
+	registry.Lock()
+	list := make([]series, 0, len(registry.series))
+	for _, s := range registry.series {
+		list = append(list, *s)
+	}
+	registry.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].name != list[j].name {
+			return list[i].name < list[j].name
+		}
+		return list[i].labels < list[j].labels
+	})
+
+	return list
+}
+
+// Write all metrics in Prometheus text exposition format.
+func WritePrometheus(w io.Writer) {
+	list := snapshot()
+
+	for i, s := range list {
+		if i == 0 || list[i-1].name != s.name {
+			fmt.Fprintf(w, "# TYPE %s %s\n", s.name, kindNames[s.kind])
+		}
+
+		labels := ""
+		if s.labels != "" {
+			labels = "{" + s.labels + "}"
+		}
+
+		switch s.kind {
+		case SUMMARY:
+			fmt.Fprintf(w, "%s_count%s %d\n", s.name, labels, s.count)
+			fmt.Fprintf(w, "%s_sum%s %g\n", s.name, labels, s.sum)
+		default:
+			fmt.Fprintf(w, "%s%s %d\n", s.name, labels, s.value)
+		}
+	}
+}
+
+// HTTP handler serving metrics in Prometheus text format.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	WritePrometheus(w)
+}
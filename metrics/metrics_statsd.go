@@ -0,0 +1,166 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"github.com/sath33sh/infra/log"
+	"github.com/sath33sh/infra/util"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StatsD defaults.
+const (
+	STATSD_ADDRESS          = "localhost:8125"
+	STATSD_INTERVAL_SECONDS = 10
+	STATSD_MAX_PACKET       = 1432 // Fits in Ethernet MTU.
+)
+
+// StatsD emitter. Every interval, changes of the registry since the previous
+// flush are sent over UDP:
+//   - counters as deltas ("|c"),
+//   - gauges as values ("|g"),
+//   - summaries as the mean of new observations in milliseconds ("|ms"), with
+//     sample rate 1/count so that the server counts every observation.
+//
+// Labels are sent as tags in Telegraf format, e.g. "name,fn=Get:1|c".
+var statsd struct {
+	sync.Mutex                   // Mutex serializing flushes.
+	conn       net.Conn          // UDP connection.
+	prefix     string            // Metric name prefix.
+	last       map[string]series // Series as of previous flush.
+	stop       chan struct{}     // Closed to stop emitter loop.
+	done       chan struct{}     // Closed when emitter loop exits.
+}
+
+// Start StatsD emitter.
+func startStatsD(addr, prefix string, interval time.Duration) (err error) {
+	if interval <= 0 {
+		interval = STATSD_INTERVAL_SECONDS * time.Second
+	}
+
+	if statsd.conn, err = net.Dial("udp", addr); err != nil {
+		log.Errorf("Failed to dial StatsD %s: %v", addr, err)
+		return util.ErrNetAccess
+	}
+	statsd.prefix = prefix
+	statsd.last = make(map[string]series)
+	statsd.stop = make(chan struct{})
+	statsd.done = make(chan struct{})
+
+	log.Infof("StatsD emitter: address %s, interval %v", addr, interval)
+
+	go func() {
+		defer close(statsd.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				flushStatsD()
+			case <-statsd.stop:
+				flushStatsD()
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop StatsD emitter, if started, after a final flush.
+func stopStatsD(ctx context.Context) error {
+	if statsd.stop == nil {
+		return nil
+	}
+
+	close(statsd.stop)
+
+	select {
+	case <-statsd.done:
+	case <-ctx.Done():
+		return util.ErrTimeout
+	}
+
+	statsd.stop = nil
+	return statsd.conn.Close()
+}
+
+// Send changes since previous flush.
+func flushStatsD() {
+	statsd.Lock()
+	defer statsd.Unlock()
+
+	lines := formatStatsD(statsd.prefix, snapshot(), statsd.last)
+
+	// Send lines, batched into packets.
+	var packet []byte
+	for _, line := range lines {
+		if len(packet) > 0 && len(packet)+1+len(line) > STATSD_MAX_PACKET {
+			sendStatsD(packet)
+			packet = packet[:0]
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	if len(packet) > 0 {
+		sendStatsD(packet)
+	}
+}
+
+// Send packet. Errors are logged only, since StatsD is best effort.
+func sendStatsD(packet []byte) {
+	if _, err := statsd.conn.Write(packet); err != nil {
+		log.Errorf("StatsD send failed: %v", err)
+	}
+}
+
+// Characters separating StatsD name, tags, value and type, replaced in tags.
+var statsDTagReplacer = strings.NewReplacer(",", "_", ":", "_", "|", "_", "=", "_", "@", "_",
+	" ", "_", "\t", "_", "\n", "_", "\r", "_")
+
+// Make tag key or value safe for StatsD lines, e.g. route "GET /a/:id" becomes
+// "GET_/a/_id".
+func statsDTag(s string) string {
+	return statsDTagReplacer.Replace(s)
+}
+
+// Format StatsD lines of series changed since last, and update last.
+func formatStatsD(prefix string, list []series, last map[string]series) (lines []string) {
+	for _, s := range list {
+		key := s.name + "{" + s.labels + "}"
+		prev := last[key]
+		last[key] = s
+
+		name := prefix + s.name
+		for i := 0; i+1 < len(s.pairs); i += 2 {
+			name += "," + statsDTag(s.pairs[i]) + "=" + statsDTag(s.pairs[i+1])
+		}
+
+		switch s.kind {
+		case COUNTER:
+			if delta := s.value - prev.value; delta != 0 {
+				lines = append(lines, fmt.Sprintf("%s:%d|c", name, delta))
+			}
+		case GAUGE:
+			lines = append(lines, fmt.Sprintf("%s:%d|g", name, s.value))
+		case SUMMARY:
+			if count := s.count - prev.count; count > 0 {
+				mean := (s.sum - prev.sum) / float64(count) * 1000
+				if count == 1 {
+					lines = append(lines, fmt.Sprintf("%s:%g|ms", name, mean))
+				} else {
+					lines = append(lines, fmt.Sprintf("%s:%g|ms|@%g", name, mean, 1/float64(count)))
+				}
+			}
+		}
+	}
+
+	return lines
+}
@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsD(t *testing.T) {
+	// Mock StatsD server.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer pc.Close()
+
+	if err := startStatsD(pc.LocalAddr().String(), "app.", 50*time.Millisecond); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	Add("statsd_sessions_total", 2, "fn", "Open")
+	Set("statsd_topics", 5)
+	Observe("statsd_duration_seconds", 100*time.Millisecond)
+	Observe("statsd_duration_seconds", 300*time.Millisecond)
+
+	// Read until all expected lines are received.
+	expected := map[string]bool{
+		"app.statsd_sessions_total,fn=Open:2|c":   false,
+		"app.statsd_topics:5|g":                   false,
+		"app.statsd_duration_seconds:200|ms|@0.5": false,
+	}
+	buf := make([]byte, STATSD_MAX_PACKET)
+	pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for missing := len(expected); missing > 0; {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Read failed: %v, received %v", err, expected)
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			if received, ok := expected[line]; ok && !received {
+				expected[line] = true
+				missing--
+			}
+		}
+	}
+
+	// Counters are sent as deltas.
+	Add("statsd_sessions_total", 3, "fn", "Open")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+
+	for found := false; !found; {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Delta not received: %v", err)
+		}
+		found = strings.Contains(string(buf[:n]), "app.statsd_sessions_total,fn=Open:3|c")
+	}
+}
+
+func TestFormatStatsD(t *testing.T) {
+	last := make(map[string]series)
+	s := series{name: "c_total", kind: COUNTER, value: 4}
+
+	if lines := formatStatsD("", []series{s}, last); len(lines) != 1 || lines[0] != "c_total:4|c" {
+		t.Errorf("Unexpected lines %v", lines)
+	}
+
+	// Unchanged counters are not sent.
+	if lines := formatStatsD("", []series{s}, last); len(lines) != 0 {
+		t.Errorf("Unexpected lines %v", lines)
+	}
+}
+
+func TestFormatStatsDTags(t *testing.T) {
+	s := series{name: "slow_total", kind: COUNTER, value: 1, pairs: []string{"route", "GET /a/:id", "k=v", "x|y,z@w"}}
+
+	lines := formatStatsD("", []series{s}, make(map[string]series))
+	if len(lines) != 1 || lines[0] != "slow_total,route=GET_/a/_id,k_v=x_y_z_w:1|c" {
+		t.Errorf("Unexpected lines %v", lines)
+	}
+}
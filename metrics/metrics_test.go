@@ -0,0 +1,42 @@
+package metrics
+
+import (
+	"bytes"
+	"github.com/sath33sh/infra/log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	Add("test_errors_total", 1, "fn", "Get")
+	Add("test_errors_total", 2, "fn", "Get")
+	Set("test_sessions", 7)
+	Observe("test_duration_seconds", 500*time.Millisecond, "fn", "Query")
+	Observe("test_duration_seconds", 1500*time.Millisecond, "fn", "Query")
+
+	var buf bytes.Buffer
+	WritePrometheus(&buf)
+	out := buf.String()
+
+	for _, line := range []string{
+		"# TYPE test_errors_total counter",
+		`test_errors_total{fn="Get"} 3`,
+		"# TYPE test_sessions gauge",
+		"test_sessions 7",
+		"# TYPE test_duration_seconds summary",
+		`test_duration_seconds_count{fn="Query"} 2`,
+		`test_duration_seconds_sum{fn="Query"} 2`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("Missing line %q in output:\n%s", line, out)
+		}
+	}
+}
+
+func TestMain(m *testing.M) {
+	log.Init("", "error", false)
+
+	os.Exit(m.Run())
+}
@@ -1,13 +1,26 @@
 package push
 
 import (
+	"context"
 	"encoding/json"
+	"github.com/sath33sh/infra/config"
 	"github.com/sath33sh/infra/log"
+	"github.com/sath33sh/infra/util"
+	"sync"
+	"time"
 )
 
 // Module name.
 const MODULE = "push"
 
+// Push metrics.
+const (
+	METRIC_SESSIONS = "push_sessions"       // Open sessions.
+	METRIC_TOPICS   = "push_topics"         // Active topics.
+	METRIC_MESSAGES = "push_messages_total" // Payloads delivered to topics and users.
+	METRIC_DROPPED  = "push_dropped_total"  // Payloads dropped, session ducts being full.
+)
+
 // Push operations.
 type Op string
 
@@ -17,11 +30,55 @@ const (
 )
 
 // Push payload.
+//
+// Key is an optional ordering key. Payloads published to a topic with the same
+// key are delivered to each subscriber in publish order. Payloads with different keys
+// carry no ordering guarantee relative to each other, which leaves room for
+// delivery to be parallelized (e.g. per-subscriber workers or priority ducts):
+// any such parallel path must pin all payloads of a key to the same worker.
+// An empty key orders by URI, i.e. one topic is one ordering domain.
+//
+// Binary payloads (images, audio, protobuf, etc) set ContentType and carry
+// their data in Binary instead of Data. Binary data is sent as is through the
+// broker and to websocket clients, without base64 encoding.
+//
+// TTL is an optional time to live, for payloads that are worthless once stale
+// (live scores, ephemeral status). A payload waiting in a subscriber's buffer
+// longer than its TTL is dropped instead of sent. Zero never expires.
+//
+// Coalesce marks an upsert carrying the full state of an object, identified by
+// kind, URI and Key, so that it supersedes earlier upserts of the object. A
+// slow subscriber may then skip the superseded upserts. Payloads without it,
+// e.g. chat messages, are always delivered.
 type Payload struct {
-	Kind string          `json:"kind,omitempty"` // Kind (aka type) of payload.
-	Op   Op              `json:"op:omitempty"`   // Operation.
-	Uri  string          `json:"uri,omitempty"`  // Push topic URI.
-	Data json.RawMessage `json:"data,omitempty"` // Data.
+	Kind        string          `json:"kind,omitempty"`        // Kind (aka type) of payload.
+	Op          Op              `json:"op:omitempty"`          // Operation.
+	Uri         string          `json:"uri,omitempty"`         // Push topic URI.
+	Key         string          `json:"key,omitempty"`         // Ordering key.
+	ContentType util.MediaType  `json:"contentType,omitempty"` // Content type of binary data.
+	Data        json.RawMessage `json:"data,omitempty"`        // Data.
+	Binary      []byte          `json:"-"`                     // Binary data.
+	TTL         time.Duration   `json:"ttl,omitempty"`         // Time to live in buffers.
+	Enqueued    time.Time       `json:"-"`                     // Time of delivery to buffers.
+	Compressed  bool            `json:"compressed,omitempty"`  // Data is gzip compressed in Binary, through broker.
+	Coalesce    bool            `json:"coalesce,omitempty"`    // Upsert supersedes earlier upserts of the object.
+}
+
+// Check whether payload carries binary data.
+func (p *Payload) IsBinary() bool {
+	return len(p.ContentType) > 0
+}
+
+// Stamp payload with enqueue time.
+func (p *Payload) stamp() {
+	if p.TTL > 0 {
+		p.Enqueued = time.Now()
+	}
+}
+
+// Check whether payload outlived its TTL.
+func (p *Payload) Expired() bool {
+	return p.TTL > 0 && !p.Enqueued.IsZero() && time.Since(p.Enqueued) > p.TTL
 }
 
 // Pushable interface. Structs that can be pushed should implement this interface.
@@ -33,6 +90,10 @@ type Pushable interface {
 var (
 	CasMode       = false
 	DisableBroker = false
+	MaxTopics     = 0     // Maximum number of active topics. Zero is unlimited.
+	MaxSubs       = 0     // Maximum number of subscriptions per session. Zero is unlimited.
+	TopicShards   = 1     // Number of topic manager shards.
+	RetainLast    = false // Topics retain their last payload for new subscribers, until the last one leaves.
 )
 
 func Init(casMode bool) {
@@ -42,18 +103,73 @@ func Init(casMode bool) {
 	// Set CAS mode.
 	CasMode = casMode
 
+	// Read topic limit.
+	MaxTopics = config.Base.GetInt(MODULE, "max-topics", 0)
+
+	// Read subscription limit per session.
+	MaxSubs = config.Base.GetInt(MODULE, "max-subscriptions", 0)
+
+	// Read presence debounce window.
+	initPresence()
+
+	// Read broker compression threshold.
+	initCompress()
+
+	// Read whether topics retain their last payload.
+	RetainLast = config.Base.GetBool(MODULE, "retain-last", false)
+
+	// Read routing of payload kinds.
+	initKindRoutes()
+
+	// Read number of topic manager shards.
+	TopicShards = config.Base.GetInt(MODULE, "topic-shards", 1)
+
 	// CAS mode specific initialization.
 	if CasMode {
 		// Start topic manager.
-		startTopicMgr()
+		startTopicMgr(TopicShards)
 
 		// Start session manager.
 		startSessionMgr()
 	}
 
-	// Initialize NATS push broker.
-	if err := initNats(); err != nil {
+	// Initialize push broker transport.
+	if err := initTransport(); err != nil {
 		log.Fatalf("Failed to initialize push broker: %v", err)
 		return
 	}
 }
+
+// Shut down push system: stop the topic and session managers, then flush and
+// close the broker connection. Sessions should be closed before, i.e. after
+// websocket connections are closed. Push functions must not be called after
+// shutdown. Returns util.ErrTimeout if ctx expires first.
+func Shutdown(ctx context.Context) error {
+	if CasMode {
+		// Stop topic manager and topics, then session manager.
+		if err := stopTopicMgr(ctx); err != nil {
+			return err
+		}
+		if err := stopSessionMgr(ctx); err != nil {
+			return err
+		}
+	}
+
+	return closeTransport(ctx)
+}
+
+// Wait for waitgroup or context expiry.
+func waitCtx(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return util.ErrTimeout
+	}
+}
@@ -0,0 +1,176 @@
+package push
+
+import (
+	"github.com/sath33sh/infra/log"
+	"github.com/sath33sh/infra/util"
+	"sort"
+	"strings"
+)
+
+// Topic details.
+type TopicDetail struct {
+	Uri         string   `json:"uri"`         // Topic URI.
+	Subscribers []string `json:"subscribers"` // Subscribed sessions, as "userId:sessionId".
+}
+
+// Topic statistics.
+type TopicStat struct {
+	Uri         string `json:"uri"`         // Topic URI.
+	Subscribers int    `json:"subscribers"` // Current subscribers.
+	Delivered   uint64 `json:"delivered"`   // Payloads delivered to subscribers.
+	Dropped     uint64 `json:"dropped"`     // Payloads dropped, subscriber not keeping up.
+}
+
+// Counts of online users, sessions and topics.
+type OnlineStat struct {
+	Users    int `json:"users"`    // Online users.
+	Sessions int `json:"sessions"` // Open sessions.
+	Topics   int `json:"topics"`   // Active topics.
+}
+
+// Online session.
+type SessionInfo struct {
+	UserId    string `json:"userId"`    // User ID.
+	SessionId string `json:"sessionId"` // Session ID.
+	Dropped   uint   `json:"dropped"`   // Payloads dropped, client not keeping up.
+}
+
+// List URIs of active topics, sorted.
+func ActiveTopics() []string {
+	uris := []string{}
+
+	for _, ts := range topicShards {
+		ts.RLock()
+		for uri := range ts.topics {
+			uris = append(uris, uri)
+		}
+		ts.RUnlock()
+	}
+
+	sort.Strings(uris)
+
+	return uris
+}
+
+// Get details of active topic. Returns util.ErrNotFound if topic is not active.
+func TopicInfo(uri string) (*TopicDetail, error) {
+	ts := shardOf(uri)
+	ts.RLock()
+	topic, ok := ts.topics[uri]
+	ts.RUnlock()
+
+	if !ok {
+		return nil, util.ErrNotFound
+	}
+
+	td := &TopicDetail{Uri: uri, Subscribers: []string{}}
+
+	topic.RLock()
+	for skey := range topic.subscribers {
+		td.Subscribers = append(td.Subscribers, string(skey))
+	}
+	topic.RUnlock()
+
+	sort.Strings(td.Subscribers)
+
+	return td, nil
+}
+
+// Get statistics of active topics, sorted by URI. Payload counts are per
+// subscriber: a payload delivered to two subscribers counts twice.
+func TopicStats() []TopicStat {
+	stats := []TopicStat{}
+
+	for _, ts := range topicShards {
+		ts.RLock()
+		for uri, topic := range ts.topics {
+			topic.RLock()
+			stat := TopicStat{
+				Uri:         uri,
+				Subscribers: len(topic.subscribers),
+				Delivered:   topic.delivered.Load(),
+				Dropped:     topic.dropped.Load(),
+			}
+			topic.RUnlock()
+			stats = append(stats, stat)
+		}
+		ts.RUnlock()
+	}
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Uri < stats[j].Uri })
+
+	return stats
+}
+
+// Get counts of online users, sessions and topics.
+func OnlineStats() OnlineStat {
+	sessions.RLock()
+	stat := OnlineStat{
+		Users:  len(sessions.users),
+		Topics: int(numTopics.Load()),
+	}
+	for _, us := range sessions.users {
+		stat.Sessions += len(us)
+	}
+	sessions.RUnlock()
+
+	return stat
+}
+
+// List online sessions of user, or of all users if userId is empty. Sorted by
+// user and session ID.
+func Sessions(userId string) []SessionInfo {
+	list := []SessionInfo{}
+
+	sessions.RLock()
+	for uid, us := range sessions.users {
+		if userId != "" && uid != userId {
+			continue
+		}
+		for skey, s := range us {
+			list = append(list, SessionInfo{
+				UserId:    uid,
+				SessionId: strings.TrimPrefix(string(skey), uid+":"),
+				Dropped:   s.Dropped(),
+			})
+		}
+	}
+	sessions.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].UserId != list[j].UserId {
+			return list[i].UserId < list[j].UserId
+		}
+		return list[i].SessionId < list[j].SessionId
+	})
+
+	return list
+}
+
+// Kick online session. The session's connection is expected to watch the
+// channel returned by Kicked and close, which closes the session. Returns
+// util.ErrNotFound if session is not online.
+func KickSession(userId string, sessionId string) error {
+	s := lookupSession(userId, sessionId)
+	if s == nil {
+		return util.ErrNotFound
+	}
+
+	log.Debugf(MODULE, "Kick session %s:%s", userId, sessionId)
+
+	s.kickOnce.Do(func() {
+		close(s.kicked)
+	})
+
+	return nil
+}
+
+// Get channel closed when session is kicked. Nil if session is not online,
+// which never fires.
+func Kicked(userId string, sessionId string) <-chan struct{} {
+	if s := lookupSession(userId, sessionId); s != nil {
+		return s.kicked
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+package push
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/sath33sh/infra/config"
+	"github.com/sath33sh/infra/log"
+	"github.com/sath33sh/infra/util"
+	"io/ioutil"
+)
+
+// Size of payload data above which payloads are gzip compressed on the way to
+// the broker, cutting bandwidth between nodes. Zero disables compression.
+var CompressThreshold = 0
+
+// Read compression threshold from config.
+func initCompress() {
+	CompressThreshold = config.Base.GetInt("push-nats", "compress-threshold-bytes", 0)
+}
+
+// Compress payload for broker, if its data exceeds CompressThreshold. Compressed
+// data is carried in Binary, and the payload is flagged Compressed. Binary
+// payloads are left as is. Returns a copy: the payload itself is not modified.
+func compressPayload(p *Payload) (*Payload, error) {
+	if CompressThreshold <= 0 || p.IsBinary() || len(p.Data) <= CompressThreshold {
+		return p, nil
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(p.Data); err != nil {
+		log.Errorf("Payload compression error: %v", err)
+		return nil, util.ErrInvalidInput
+	}
+	if err := zw.Close(); err != nil {
+		log.Errorf("Payload compression error: %v", err)
+		return nil, util.ErrInvalidInput
+	}
+
+	cp := *p
+	cp.Data = nil
+	cp.Binary = buf.Bytes()
+	cp.Compressed = true
+
+	return &cp, nil
+}
+
+// Decompress payload received from broker, if flagged Compressed. Returns a copy,
+// as the transport may pass the payload to other handlers too.
+func decompressPayload(p *Payload) (*Payload, error) {
+	if !p.Compressed {
+		return p, nil
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(p.Binary))
+	if err != nil {
+		log.Errorf("Payload decompression error: %v", err)
+		return nil, util.ErrJsonDecode
+	}
+	defer zr.Close()
+
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		log.Errorf("Payload decompression error: %v", err)
+		return nil, util.ErrJsonDecode
+	}
+
+	dp := *p
+	dp.Data = data
+	dp.Binary = nil
+	dp.Compressed = false
+
+	return &dp, nil
+}
@@ -1,91 +1,296 @@
 package push
 
 import (
+	"encoding/json"
 	"github.com/nats-io/nats"
 	"github.com/sath33sh/infra/config"
 	"github.com/sath33sh/infra/log"
+	"github.com/sath33sh/infra/metrics"
 	"github.com/sath33sh/infra/util"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// Nats client.
-type NatsClient struct {
-	opts  nats.Options
-	conn  *nats.Conn
-	econn *nats.EncodedConn
-}
+// Timeout for flushing pending messages on close.
+const NATS_FLUSH_TIMEOUT = 5 * time.Second
+
+// Default pending limits of broker subscriptions.
+const (
+	NATS_PENDING_MSGS_LIMIT  = 65536
+	NATS_PENDING_BYTES_LIMIT = 64 * 1024 * 1024
+)
 
-// Global variables.
+// Metric of messages dropped by broker subscriptions, by subject.
+const METRIC_BROKER_DROPPED = "push_broker_dropped_total"
+
+// Pending limits of broker subscriptions: messages received from the broker but
+// not yet processed. Beyond either limit, the subscription is a slow consumer
+// and further messages are dropped, until it catches up. Drops are logged and
+// counted in METRIC_BROKER_DROPPED.
+//
+// Tuning: sustained drops mean this node cannot process the publish rate of its
+// subjects; raising limits then only delays drops, at the cost of memory
+// (bytes limit) and latency. Raise the limits to absorb bursts: e.g. the
+// messages limit to the expected burst size, and the bytes limit to burst size
+// times the typical payload size (see also CompressThreshold). Configured by
+// push-nats pending-msgs-limit and pending-bytes-limit.
 var (
-	natsClient = NatsClient{opts: nats.DefaultOptions}
+	PendingMsgsLimit  = NATS_PENDING_MSGS_LIMIT
+	PendingBytesLimit = NATS_PENDING_BYTES_LIMIT
 )
 
-func initNats() error {
-	// Check whether broker is disabled.
-	DisableBroker = config.Base.GetBool("push-nats", "disable", false)
-	if DisableBroker {
-		log.Infoln("Push broker disabled")
-		return nil
+// NATS transport.
+type natsTransport struct {
+	opts    nats.Options
+	conn    *nats.Conn
+	dropped droppedCounts // Messages dropped by subscriptions.
+	conns   connStats     // Connection flaps.
+	subs    struct {
+		sync.Mutex                                 // Mutex for accessing subscriptions.
+		subjects   map[string][]*nats.Subscription // Map of subject to subscriptions.
+	}
+}
+
+// Messages dropped by subscriptions, as last reported.
+type droppedCounts struct {
+	sync.Mutex                // Mutex for accessing counts.
+	counts     map[string]int // Map of subject to number of dropped messages.
+	total      atomic.Int64   // Total dropped messages.
+}
+
+// Connection flaps, maintained by connection callbacks.
+type connStats struct {
+	reconnects atomic.Uint64          // Number of reconnects.
+	lastError  atomic.Pointer[string] // Last connection error.
+}
+
+// Record connection error.
+func (cs *connStats) setError(err error) {
+	msg := err.Error()
+	cs.lastError.Store(&msg)
+}
+
+// Account messages dropped by subscription of subject, dropped being its
+// cumulative count. Returns number of new drops.
+func (dc *droppedCounts) add(subject string, dropped int) int {
+	dc.Lock()
+	defer dc.Unlock()
+
+	if dc.counts == nil {
+		dc.counts = make(map[string]int)
+	}
+
+	n := dropped - dc.counts[subject]
+	if n <= 0 {
+		return 0
+	}
+	dc.counts[subject] = dropped
+	dc.total.Add(int64(n))
+	metrics.Add(METRIC_BROKER_DROPPED, int64(n), "subject", subject)
+
+	return n
+}
+
+// Handle asynchronous error of broker connection, e.g. slow consumer.
+func (t *natsTransport) asyncError(_ *nats.Conn, sub *nats.Subscription, err error) {
+	if err != nats.ErrSlowConsumer || sub == nil {
+		log.Errorf("Push broker error: %v", err)
+		t.conns.setError(err)
+		return
+	}
+
+	dropped, derr := sub.Dropped()
+	if derr != nil {
+		log.Errorf("Push broker slow consumer on %s: %v", sub.Subject, derr)
+		return
+	}
+
+	if n := t.dropped.add(sub.Subject, dropped); n > 0 {
+		log.Errorf("Push broker slow consumer on %s: %d messages dropped (%d total)", sub.Subject, n, dropped)
 	}
+}
+
+// Read pending limits from config.
+func initPendingLimits() {
+	PendingMsgsLimit = config.Base.GetInt("push-nats", "pending-msgs-limit", NATS_PENDING_MSGS_LIMIT)
+	PendingBytesLimit = config.Base.GetInt("push-nats", "pending-bytes-limit", NATS_PENDING_BYTES_LIMIT)
+}
 
-	// Read server URLs from config.
-	natsClient.opts.Servers = config.Base.GetStringSlice("push-nats", "servers", []string{"nats://localhost:4222"})
+func newNatsTransport() (*natsTransport, error) {
+	t := &natsTransport{opts: nats.DefaultOptions}
+
+	// Read server URLs and pending limits from config.
+	t.opts.Servers = config.Base.GetStringSlice("push-nats", "servers", []string{"nats://localhost:4222"})
+	initPendingLimits()
+
+	// Slow consumer and connection callbacks.
+	t.opts.AsyncErrorCB = t.asyncError
+	t.opts.DisconnectedCB = t.disconnected
+	t.opts.ReconnectedCB = t.reconnected
 
 	// Connect to broker.
 	var err error
-	natsClient.conn, err = natsClient.opts.Connect()
+	t.conn, err = t.opts.Connect()
 	if err != nil {
 		log.Errorf("Failed to connect to push broker: %v", err)
-		return util.ErrNetAccess
+		return nil, util.ErrNetAccess
 	}
 
-	natsClient.econn, err = nats.NewEncodedConn(natsClient.conn, nats.JSON_ENCODER)
-	if err != nil {
-		log.Errorf("Failed to attach JSON encoder: %v", err)
-		return util.ErrNetAccess
+	return t, nil
+}
+
+// Handle disconnect from broker.
+func (t *natsTransport) disconnected(nc *nats.Conn) {
+	err := nc.LastError()
+	if err == nil {
+		err = nats.ErrConnectionClosed
+	}
+	log.Errorf("Disconnected from push broker: %v", err)
+	t.conns.setError(err)
+}
+
+// Handle reconnect to broker.
+func (t *natsTransport) reconnected(nc *nats.Conn) {
+	n := t.conns.reconnects.Add(1)
+	log.Errorf("Reconnected to push broker: %d reconnects", n)
+}
+
+// Encode payload for broker. Binary and compressed payloads are framed with a
+// JSON header, others are plain JSON.
+func encodeBrokerMsg(p *Payload) ([]byte, error) {
+	if p.IsBinary() || p.Compressed {
+		return util.EncodeFrame(p, p.Binary)
 	}
 
-	// Disconnect callback.
-	natsClient.conn.Opts.DisconnectedCB = func(_ *nats.Conn) {
-		log.Errorf("Disconnected from push broker")
+	return json.Marshal(p)
+}
+
+// Decode payload from broker.
+func decodeBrokerMsg(data []byte) (*Payload, error) {
+	p := &Payload{}
+
+	if util.IsFrame(data) {
+		body, err := util.DecodeFrame(data, p)
+		if err != nil {
+			return nil, err
+		}
+		p.Binary = body
+	} else if err := json.Unmarshal(data, p); err != nil {
+		return nil, util.ErrJsonDecode
 	}
 
-	// Reconnect callback.
-	natsClient.conn.Opts.ReconnectedCB = func(nc *nats.Conn) {
-		log.Errorf("Reconnected to push broker")
+	return p, nil
+}
+
+// Make NATS message handler delivering decoded payloads to handler.
+func natsMsgHandler(handler func(*Payload)) nats.MsgHandler {
+	return func(m *nats.Msg) {
+		p, err := decodeBrokerMsg(m.Data)
+		if err != nil {
+			log.Errorf("Invalid message from broker on %s: %v", m.Subject, err)
+			return
+		}
+
+		handler(p)
+	}
+}
+
+func (t *natsTransport) Publish(subject string, p *Payload) error {
+	// Encode.
+	data, err := encodeBrokerMsg(p)
+	if err != nil {
+		log.Errorf("Failed to encode payload: Kind %s, Uri %s: %v", p.Kind, p.Uri, err)
+		return util.ErrInvalidObject
+	}
+
+	// Publish.
+	if err = t.conn.Publish(subject, data); err != nil {
+		log.Errorf("Failed to publish to %s: %v", subject, err)
+		return util.ErrNetAccess
 	}
 
 	return nil
 }
 
-func processPayloadFromBroker(p *Payload) {
-	// log.Debugf(MODULE, "Rx from broker: Kind %s, Uri %s, Op %s", p.Kind, p.Uri, p.Op)
+func (t *natsTransport) Subscribe(subjects []string, handler func(*Payload)) error {
+	for _, subject := range subjects {
+		sub, err := t.conn.Subscribe(subject, natsMsgHandler(handler))
+		if err != nil {
+			log.Errorf("Failed to subscribe to %s: %v", subject, err)
+			return util.ErrNetAccess
+		}
+
+		if err = sub.SetPendingLimits(PendingMsgsLimit, PendingBytesLimit); err != nil {
+			log.Errorf("Failed to set pending limits of %s: %v", subject, err)
+			return util.ErrInvalidInput
+		}
+
+		t.subs.Lock()
+		if t.subs.subjects == nil {
+			t.subs.subjects = make(map[string][]*nats.Subscription)
+		}
+		t.subs.subjects[subject] = append(t.subs.subjects[subject], sub)
+		t.subs.Unlock()
+	}
 
-	// Process.
-	processEgress(p)
+	return nil
 }
 
-func SubscribeFromBroker(kinds []string) {
-	if DisableBroker {
-		return
+// Remove subscriptions of subjects.
+func (t *natsTransport) Unsubscribe(subjects []string) error {
+	t.subs.Lock()
+	defer t.subs.Unlock()
+
+	for _, subject := range subjects {
+		for _, sub := range t.subs.subjects[subject] {
+			if err := sub.Unsubscribe(); err != nil {
+				log.Errorf("Failed to unsubscribe from %s: %v", subject, err)
+				return util.ErrNetAccess
+			}
+		}
+		delete(t.subs.subjects, subject)
 	}
 
-	for _, kind := range kinds {
-		natsClient.econn.Subscribe(kind, processPayloadFromBroker)
+	return nil
+}
+
+// Get number of messages dropped by subscriptions.
+func (t *natsTransport) Dropped() int64 {
+	return t.dropped.total.Load()
+}
+
+// Get number of reconnects and last connection error, if any.
+func (t *natsTransport) Stats() (reconnects uint64, lastError string) {
+	if msg := t.conns.lastError.Load(); msg != nil {
+		lastError = *msg
 	}
+
+	return t.conns.reconnects.Load(), lastError
 }
 
-func doPublishToBroker(p *Payload) error {
-	// Publish.
-	natsClient.econn.Publish(p.Kind, p)
+// Get connection status.
+func (t *natsTransport) Status() error {
+	if !t.conn.IsConnected() {
+		return util.ErrNetAccess
+	}
 
 	return nil
 }
 
-func PublishToBroker(p *Payload) error {
-	if DisableBroker {
-		// Broker is disabled. Mock success.
-		return nil
+// Flush pending messages to broker and close connection.
+func (t *natsTransport) Close() error {
+	err := t.conn.FlushTimeout(NATS_FLUSH_TIMEOUT)
+	if err != nil {
+		log.Errorf("Push broker flush error: %v", err)
 	}
 
-	return doPublishToBroker(p)
+	t.conn.Close()
+	log.Infoln("Push broker connection closed")
+
+	if err != nil {
+		return util.ErrTimeout
+	}
+
+	return nil
 }
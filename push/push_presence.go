@@ -0,0 +1,141 @@
+package push
+
+import (
+	"github.com/sath33sh/infra/config"
+	"github.com/sath33sh/infra/log"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Presence handler, called with net presence changes of users. A user is online
+// while any of its sessions is open. The handler runs in the session manager:
+// it must not block nor call session functions, e.g. OpenSession.
+type PresenceHandler func(userId string, online bool)
+
+// Registered presence handler.
+var presenceHandler atomic.Pointer[PresenceHandler]
+
+// Presence debounce window. Transitions of a user within the window, e.g. during
+// reconnect storms of a flaky client, are coalesced into a single net change.
+// Zero reports every change immediately.
+var PresenceDebounce time.Duration
+
+// Register presence handler. Nil disables presence notifications.
+func SetPresenceHandler(h PresenceHandler) {
+	presenceHandler.Store(&h)
+}
+
+// Presence state of user. Accessed by session manager only.
+type userPresence struct {
+	online bool        // Last reported presence.
+	timer  *time.Timer // Pending debounce timer.
+}
+
+// Read presence debounce window from config.
+func initPresence() {
+	if ms := config.Base.GetInt(MODULE, "presence-debounce-ms", 0); ms > 0 {
+		PresenceDebounce = time.Duration(ms) * time.Millisecond
+	}
+}
+
+// Note possible presence change of user, after its sessions changed.
+func presenceChanged(presence map[string]*userPresence, userId string) {
+	if h := presenceHandler.Load(); h == nil || *h == nil {
+		return
+	}
+
+	p, ok := presence[userId]
+	if !ok {
+		p = &userPresence{}
+		presence[userId] = p
+	}
+
+	if PresenceDebounce <= 0 {
+		reportPresence(presence, userId)
+		return
+	}
+
+	if p.timer == nil {
+		// Start debounce window. Report is processed by session manager,
+		// unless it stops meanwhile.
+		cmdDuct, done := sessions.cmdDuct, sessions.done
+		p.timer = time.AfterFunc(PresenceDebounce, func() {
+			select {
+			case cmdDuct <- &SessionCmd{cmd: PRESENCE, userId: userId}:
+			case <-done:
+			}
+		})
+	}
+}
+
+// Report net presence change of user, if any.
+func reportPresence(presence map[string]*userPresence, userId string) {
+	p, ok := presence[userId]
+	if !ok {
+		return
+	}
+	p.timer = nil
+
+	online := len(sessions.users[userId]) > 0
+	if online != p.online {
+		p.online = online
+		if h := presenceHandler.Load(); h != nil && *h != nil {
+			log.Debugf(MODULE, "Presence: user %s online %v", userId, online)
+			(*h)(userId, online)
+		}
+	}
+
+	if !online {
+		// Offline is the initial state.
+		delete(presence, userId)
+	}
+}
+
+// Stop pending debounce timers.
+func stopPresence(presence map[string]*userPresence) {
+	for _, p := range presence {
+		if p.timer != nil {
+			p.timer.Stop()
+		}
+	}
+}
+
+// Check whether user is online, i.e. has an open session.
+func IsOnline(userId string) bool {
+	sessions.RLock()
+	defer sessions.RUnlock()
+
+	return len(sessions.users[userId]) > 0
+}
+
+// List IDs of open sessions of user, sorted. Empty if user is offline.
+func OnlineSessions(userId string) []string {
+	ids := []string{}
+
+	sessions.RLock()
+	for skey := range sessions.users[userId] {
+		ids = append(ids, strings.TrimPrefix(string(skey), userId+":"))
+	}
+	sessions.RUnlock()
+
+	sort.Strings(ids)
+
+	return ids
+}
+
+// Get number of online users.
+func OnlineUserCount() int {
+	sessions.RLock()
+	defer sessions.RUnlock()
+
+	n := 0
+	for _, us := range sessions.users {
+		if len(us) > 0 {
+			n++
+		}
+	}
+
+	return n
+}
@@ -0,0 +1,70 @@
+package push
+
+import (
+	"github.com/sath33sh/infra/config"
+	"github.com/sath33sh/infra/log"
+	"sync"
+)
+
+// Routing of payload kind.
+type Route int
+
+// Routes.
+const (
+	ROUTE_BOTH   Route = iota // Publish to broker, and fan out to local sessions in CAS mode. Default.
+	ROUTE_LOCAL               // Fan out to local sessions only, bypassing the broker.
+	ROUTE_BROKER              // Publish to broker only, e.g. for other consumers. Never fanned out locally.
+)
+
+func (r Route) String() string {
+	switch r {
+	case ROUTE_LOCAL:
+		return "local"
+	case ROUTE_BROKER:
+		return "broker"
+	default:
+		return "both"
+	}
+}
+
+// Routes by payload kind. Kinds not listed are routed to both.
+var kindRoutes struct {
+	sync.RWMutex
+	routes map[string]Route
+}
+
+// Set routing of payload kind, deciding whether Publish fans out to local
+// sessions, publishes to the broker, or both. Local fan-out of broker-only
+// kinds is skipped, including for payloads received from the broker.
+func SetKindRoute(kind string, r Route) {
+	kindRoutes.Lock()
+	defer kindRoutes.Unlock()
+
+	if r == ROUTE_BOTH {
+		delete(kindRoutes.routes, kind)
+		return
+	}
+
+	if kindRoutes.routes == nil {
+		kindRoutes.routes = make(map[string]Route)
+	}
+	kindRoutes.routes[kind] = r
+}
+
+// Get routing of payload kind.
+func kindRoute(kind string) Route {
+	kindRoutes.RLock()
+	defer kindRoutes.RUnlock()
+
+	return kindRoutes.routes[kind]
+}
+
+// Read kind routing from config.
+func initKindRoutes() {
+	for r, key := range map[Route]string{ROUTE_LOCAL: "local-only-kinds", ROUTE_BROKER: "broker-only-kinds"} {
+		for _, kind := range config.Base.GetStringSlice(MODULE, key, nil) {
+			SetKindRoute(kind, r)
+			log.Infof("Push kind %s routed to %v only", kind, r)
+		}
+	}
+}
@@ -1,8 +1,12 @@
 package push
 
 import (
+	"context"
 	"github.com/sath33sh/infra/log"
+	"github.com/sath33sh/infra/metrics"
+	"github.com/sath33sh/infra/util"
 	"sync"
+	"sync/atomic"
 )
 
 // Session command.
@@ -11,12 +15,15 @@ type SessionCmdType int
 const (
 	ONLINE SessionCmdType = iota
 	OFFLINE
+	SHUTDOWN
+	PRESENCE // Report debounced presence change.
 )
 
 // Constants.
 const (
 	CMD_DUCT_BUFFER_MAX  = 200
 	DATA_DUCT_BUFFER_MAX = 200
+	DROP_LOG_INTERVAL    = 100 // Log every this many payloads dropped of a session.
 )
 
 // Session Key.
@@ -24,8 +31,34 @@ type SessionKey string
 
 // Session.
 type Session struct {
+	key         SessionKey    // Session key.
 	payloadDuct chan *Payload // Channel for sending payload to client.
 	msgsSent    uint          // Number of messages sent to this session.
+	dropped     atomic.Uint64 // Number of payloads dropped, duct being full.
+	kicked      chan struct{} // Closed when session is kicked.
+	kickOnce    sync.Once     // Close kicked channel once.
+}
+
+// Send payload to session without blocking. If the duct is full, i.e. the client
+// does not keep up, the payload is dropped and counted. Returns true if sent.
+func (s *Session) send(p *Payload) bool {
+	select {
+	case s.payloadDuct <- p:
+		return true
+	default:
+	}
+
+	metrics.Add(METRIC_DROPPED, 1)
+	if n := s.dropped.Add(1); n%DROP_LOG_INTERVAL == 1 {
+		log.Errorf("Session %s overwhelmed: %d payloads dropped", s.key, n)
+	}
+
+	return false
+}
+
+// Get number of payloads dropped, the session's duct being full.
+func (s *Session) Dropped() uint {
+	return uint(s.dropped.Load())
 }
 
 // Session command.
@@ -43,9 +76,16 @@ var sessions struct {
 	sync.RWMutex                                    // Mutex for accessing online users.
 	users        map[string]map[SessionKey]*Session // Map of online user ID to set of session data.
 	cmdDuct      chan *SessionCmd                   // Channel for sending commands to session manager.
+	done         chan struct{}                      // Closed when session manager stops.
 }
 
 func sessionMgrLoop() {
+	// Presence state of users.
+	presence := make(map[string]*userPresence)
+
+	// Number of open sessions.
+	numSessions := 0
+
 	for {
 		select {
 		case sc := <-sessions.cmdDuct:
@@ -65,13 +105,21 @@ func sessionMgrLoop() {
 				}
 
 				// Add or update session.
+				if _, ok := sessions.users[sc.userId][skey]; !ok {
+					numSessions++
+				}
 				sessions.users[sc.userId][skey] = &Session{
+					key:         skey,
 					payloadDuct: sc.payloadDuct,
+					kicked:      make(chan struct{}),
 				}
 
 				// Unlock sessions.
 				sessions.Unlock()
 
+				metrics.Set(METRIC_SESSIONS, int64(numSessions))
+				presenceChanged(presence, sc.userId)
+
 				// Signal done.
 				if sc.signalDone {
 					sc.wg.Done()
@@ -88,6 +136,7 @@ func sessionMgrLoop() {
 						// Otherwise we are deleting the wrong session.
 						if sc.payloadDuct == es.payloadDuct {
 							delete(sessions.users[sc.userId], skey)
+							numSessions--
 						}
 					}
 
@@ -100,6 +149,27 @@ func sessionMgrLoop() {
 				// Unlock sessions.
 				sessions.Unlock()
 
+				metrics.Set(METRIC_SESSIONS, int64(numSessions))
+				presenceChanged(presence, sc.userId)
+
+				// Signal done.
+				if sc.signalDone {
+					sc.wg.Done()
+				}
+
+			case PRESENCE:
+				reportPresence(presence, sc.userId)
+
+			case SHUTDOWN:
+				log.Debugf(MODULE, "Stop session manager: %d users online", len(sessions.users))
+
+				stopPresence(presence)
+				close(sessions.done)
+
+				// Signal done.
+				sc.wg.Done()
+				return
+
 			default:
 				log.Errorf("Invalid command %d", sc.cmd)
 			}
@@ -112,11 +182,29 @@ func startSessionMgr() {
 	// Initialize sessions.
 	sessions.users = make(map[string]map[SessionKey]*Session)
 	sessions.cmdDuct = make(chan *SessionCmd, CMD_DUCT_BUFFER_MAX)
+	sessions.done = make(chan struct{})
 
 	// Start session manager loop.
 	go sessionMgrLoop()
 }
 
+// Stop session manager.
+func stopSessionMgr(ctx context.Context) error {
+	cmd := &SessionCmd{
+		cmd:        SHUTDOWN,
+		signalDone: true,
+	}
+	cmd.wg.Add(1)
+
+	select {
+	case sessions.cmdDuct <- cmd:
+	case <-ctx.Done():
+		return util.ErrTimeout
+	}
+
+	return waitCtx(ctx, &cmd.wg)
+}
+
 func OpenSession(userId string, sessionId string, wait bool) chan *Payload {
 	// Make data duct for the client.
 	duct := make(chan *Payload, DATA_DUCT_BUFFER_MAX)
@@ -163,24 +251,51 @@ func lookupSession(userId string, sessionId string) (s *Session) {
 }
 
 func CloseSession(userId string, sessionId string, duct chan *Payload) {
-	// Unscribe session from all topics.
-	unsubscribeAll(userId, sessionId)
+	done := make(chan struct{})
+
+	go func() {
+		// Unscribe session from all topics.
+		unsubscribeAll(userId, sessionId, true)
+
+		// Send offline command to session manager.
+		cmd := &SessionCmd{
+			cmd:         OFFLINE,
+			userId:      userId,
+			sessionId:   sessionId,
+			payloadDuct: duct,
+			signalDone:  true,
+		}
+		cmd.wg.Add(1)
+		sessions.cmdDuct <- cmd
+		cmd.wg.Wait()
 
-	// Send offline command to session manager.
-	sessions.cmdDuct <- &SessionCmd{
-		cmd:         OFFLINE,
-		userId:      userId,
-		sessionId:   sessionId,
-		payloadDuct: duct,
-	}
+		close(done)
+	}()
 
-	// Close payload duct.
-	close(duct)
+	// Wait until session is removed, so that pushes no longer reach the duct.
+	// Meanwhile discard pushes.
+	for {
+		select {
+		case <-duct:
+		case <-done:
+			// Close payload duct.
+			close(duct)
+			return
+		}
+	}
+}
 
-	return
+// Push to sessions of user. See PushToUserN.
+func PushToUser(userId string, obj Pushable) error {
+	_, err := PushToUserN(userId, obj)
+	return err
 }
 
-func PushToUser(userId string, obj Pushable) (err error) {
+// Push to sessions of user. The payload is built only if the user is online.
+// Sends do not block: a session whose duct is full misses the payload. Returns
+// number of sessions the payload was delivered to, e.g. to fall back to offline
+// notification when zero.
+func PushToUserN(userId string, obj Pushable) (sent int, err error) {
 	// Acquire read lock.
 	sessions.RLock()
 
@@ -188,14 +303,80 @@ func PushToUser(userId string, obj Pushable) (err error) {
 		// Build payload and push it to user sessions.
 		var p *Payload
 		if p, err = obj.BuildPushPayload(); err == nil {
+			p.stamp()
 			for _, s := range sessions.users[userId] {
-				s.payloadDuct <- p
+				if s.send(p) {
+					sent++
+				}
 			}
+			metrics.Add(METRIC_MESSAGES, int64(sent))
 		}
 	}
 
 	// Release read lock.
 	sessions.RUnlock()
 
-	return err
+	return sent, err
+}
+
+// Push to sessions of many users. Payload is built once and delivered under a
+// single read lock. Sends do not block: a session whose duct is full misses the
+// payload. Returns number of sessions the payload was delivered to.
+func PushToUsers(userIds []string, obj Pushable) (delivered int, err error) {
+	// Build payload.
+	p, err := obj.BuildPushPayload()
+	if err != nil {
+		return 0, err
+	}
+	p.stamp()
+
+	// Acquire read lock.
+	sessions.RLock()
+
+	for _, userId := range userIds {
+		for _, s := range sessions.users[userId] {
+			if s.send(p) {
+				delivered++
+			}
+		}
+	}
+
+	// Release read lock.
+	sessions.RUnlock()
+
+	metrics.Add(METRIC_MESSAGES, int64(delivered))
+
+	return delivered, nil
+}
+
+// Push to every online session, regardless of topic subscriptions, e.g. for
+// maintenance notices. Reaches sessions of this instance only. Payload is built
+// once and delivered under a single read lock. Sends do not block: a session
+// whose duct is full misses the payload. Returns number of sessions the payload
+// was delivered to.
+func Broadcast(obj Pushable) (sent int, err error) {
+	// Build payload.
+	p, err := obj.BuildPushPayload()
+	if err != nil {
+		return 0, err
+	}
+	p.stamp()
+
+	// Acquire read lock.
+	sessions.RLock()
+
+	for _, us := range sessions.users {
+		for _, s := range us {
+			if s.send(p) {
+				sent++
+			}
+		}
+	}
+
+	// Release read lock.
+	sessions.RUnlock()
+
+	metrics.Add(METRIC_MESSAGES, int64(sent))
+
+	return sent, nil
 }
@@ -0,0 +1,46 @@
+package push
+
+import (
+	"github.com/sath33sh/infra/log"
+	"sync/atomic"
+)
+
+// Snapshot function, providing current state of topic as a payload, or nil if
+// there is none. Called on subscription, in the topic worker: it must not
+// block for long nor call topic functions, e.g. Subscribe.
+type SnapshotFunc func(uri string) (*Payload, error)
+
+// Registered snapshot function.
+var snapshotFunc atomic.Pointer[SnapshotFunc]
+
+// Register snapshot function. Each new subscriber of a topic then gets the
+// snapshot of the topic before live payloads, avoiding the gap between a
+// separate read of the state and subscription. Nil disables snapshots.
+func SetSnapshotFunc(fn SnapshotFunc) {
+	snapshotFunc.Store(&fn)
+}
+
+// Check whether snapshot function is registered.
+func hasSnapshotFunc() bool {
+	fn := snapshotFunc.Load()
+	return fn != nil && *fn != nil
+}
+
+// Build snapshot of topic. Returns nil if there is none.
+func buildSnapshot(uri string) *Payload {
+	fn := snapshotFunc.Load()
+	if fn == nil || *fn == nil {
+		return nil
+	}
+
+	p, err := (*fn)(uri)
+	if err != nil {
+		log.Errorf("Snapshot of %s failed: %v", uri, err)
+		return nil
+	}
+	if p != nil {
+		p.stamp()
+	}
+
+	return p
+}
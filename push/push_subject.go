@@ -0,0 +1,159 @@
+package push
+
+import (
+	"fmt"
+	"github.com/sath33sh/infra/log"
+	"strings"
+	"sync"
+)
+
+// Publish payloads to a subject per topic, "<kind>.<uri>", rather than per
+// kind, so that nodes receive payloads of topics they host only. Wildcard
+// topics subscribe to all topics of the kind, "<kind>.*". Requires a transport
+// able to unsubscribe. Configured by push-nats subject-per-topic.
+var SubjectPerTopic = false
+
+// Transport able to unsubscribe, e.g. when a topic stops.
+type Unsubscriber interface {
+	Unsubscribe(subjects []string) error // Stop receiving payloads of subjects.
+}
+
+// Broker subscriptions of hosted topics, with subject per topic.
+var topicSubs struct {
+	sync.Mutex          // Mutex for accessing subscriptions.
+	kinds      []string // Kinds subscribed from broker.
+	wildcards  int      // Number of hosted wildcard topics.
+}
+
+// Add kinds whose payloads topics starting on this node subscribe to.
+func addTopicKinds(kinds []string) {
+	topicSubs.Lock()
+	defer topicSubs.Unlock()
+
+	for _, kind := range kinds {
+		known := false
+		for _, k := range topicSubs.kinds {
+			known = known || k == kind
+		}
+		if !known {
+			topicSubs.kinds = append(topicSubs.kinds, kind)
+		}
+	}
+}
+
+// Get broker subject of topic.
+func topicSubject(kind, uri string) string {
+	return brokerSubject(kind) + "." + subjectToken(uri)
+}
+
+// Escape URI as a single subject token. Separators, wildcards, whitespace and
+// the escape character itself are percent-encoded.
+func subjectToken(uri string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(uri); i++ {
+		switch c := uri[i]; {
+		case c == '.' || c == '*' || c == '>' || c == '%' || c <= ' ' || c >= 0x7f:
+			fmt.Fprintf(&b, "%%%02X", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
+
+// Check whether transport supports subject per topic.
+func subjectPerTopic() bool {
+	if !SubjectPerTopic || DisableBroker {
+		return false
+	}
+
+	_, ok := transport.(Unsubscriber)
+	return ok
+}
+
+// Get broker subjects of topic, for each subscribed kind, and handler of
+// payloads received on them. Topic subscriptions must be locked.
+func topicSubjects(uri string) (subjects []string, handler func(*Payload)) {
+	for _, kind := range topicSubs.kinds {
+		if isWildcard(uri) {
+			subjects = append(subjects, brokerSubject(kind)+".*")
+		} else {
+			subjects = append(subjects, topicSubject(kind, uri))
+		}
+	}
+
+	if isWildcard(uri) {
+		return subjects, processWildcardPayloadFromBroker
+	}
+
+	return subjects, processTopicPayloadFromBroker
+}
+
+// Subscribe to broker subjects of topic starting on this node. Wildcard topics
+// share the subscription of all topics of their kinds.
+func subscribeTopic(uri string) {
+	if !subjectPerTopic() {
+		return
+	}
+
+	topicSubs.Lock()
+	defer topicSubs.Unlock()
+
+	if isWildcard(uri) {
+		if topicSubs.wildcards++; topicSubs.wildcards > 1 {
+			return
+		}
+	}
+
+	subjects, handler := topicSubjects(uri)
+	if len(subjects) == 0 {
+		return
+	}
+
+	if err := transport.Subscribe(subjects, handler); err != nil {
+		log.Errorf("Failed to subscribe topic %s to %v: %v", uri, subjects, err)
+	}
+}
+
+// Unsubscribe from broker subjects of topic stopping on this node.
+func unsubscribeTopic(uri string) {
+	if !subjectPerTopic() {
+		return
+	}
+
+	topicSubs.Lock()
+	defer topicSubs.Unlock()
+
+	if isWildcard(uri) {
+		if topicSubs.wildcards--; topicSubs.wildcards > 0 {
+			return
+		}
+	}
+
+	subjects, _ := topicSubjects(uri)
+	if len(subjects) == 0 {
+		return
+	}
+
+	if err := transport.(Unsubscriber).Unsubscribe(subjects); err != nil {
+		log.Errorf("Failed to unsubscribe topic %s from %v: %v", uri, subjects, err)
+	}
+}
+
+// Process payload received on subject of its topic. Wildcard topics receive
+// it on their own subscription, so it is delivered to the topic only.
+func processTopicPayloadFromBroker(p *Payload) {
+	if p = payloadFromBroker(p); p != nil {
+		egressTopics(p, true, false)
+	}
+}
+
+// Process payload received on subject of all topics of its kind, for wildcard
+// topics.
+func processWildcardPayloadFromBroker(p *Payload) {
+	if p = payloadFromBroker(p); p != nil {
+		egressTopics(p, false, true)
+	}
+}
@@ -1,12 +1,20 @@
 package push
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"github.com/nats-io/nats"
 	"github.com/sath33sh/infra/config"
 	"github.com/sath33sh/infra/log"
+	"github.com/sath33sh/infra/metrics"
+	"github.com/sath33sh/infra/util"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -36,6 +44,7 @@ type clientSpawner struct {
 	waitInterval time.Duration  // Time to wait for messages.
 	userId       string         // User ID.
 	topicUri     string         // Topic URI.
+	received     []atomic.Int64 // Number of messages received by each client.
 }
 
 func NewUserClientSpawner(userId string, numClients, numMsgs int, waitInterval time.Duration) *clientSpawner {
@@ -84,15 +93,18 @@ func (cs *clientSpawner) mockClient(t *testing.T, inst int) {
 	// Ready to receive.
 	cs.readyWg.Done()
 
+recvLoop:
 	for i := 0; i < cs.numMsgs; i++ {
 		// t.Logf("Expect %d\n", i)
 		select {
 		case <-duct:
 			// t.Logf("Receive %d\n", i)
+			cs.received[inst-1].Add(1)
 			continue
 
 		case <-timer.C:
-			t.Fatalf("Client %s:%s timed out", userId, sessionId)
+			t.Errorf("Client %s:%s timed out", userId, sessionId)
+			break recvLoop
 		}
 	}
 
@@ -100,14 +112,15 @@ func (cs *clientSpawner) mockClient(t *testing.T, inst int) {
 
 	// Cleanup
 	if subscribe {
-		Unsubscribe(cs.topicUri, userId, sessionId)
+		Unsubscribe(cs.topicUri, userId, sessionId, true)
 	}
 	CloseSession(userId, sessionId, duct)
 	cs.doneWg.Done()
 }
 
 func (cs *clientSpawner) Spawn(t *testing.T) {
-	// Initialize waitgroups.
+	// Initialize waitgroups and counters.
+	cs.received = make([]atomic.Int64, cs.numClients)
 	cs.readyWg.Add(cs.numClients)
 	cs.doneWg.Add(cs.numClients)
 
@@ -123,6 +136,16 @@ func (cs *clientSpawner) Wait(t *testing.T) {
 	cs.doneWg.Wait()
 }
 
+// Throttle sender to the pace of clients, after sent messages. Clients that
+// fall behind by a full duct miss messages.
+func (cs *clientSpawner) Throttle(sent int) {
+	for i := range cs.received {
+		for sent-int(cs.received[i].Load()) > DATA_DUCT_BUFFER_MAX/2 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
 func TestPushToUser(t *testing.T) {
 	testUserId := "100"
 	numMsgs := 1000
@@ -134,12 +157,67 @@ func TestPushToUser(t *testing.T) {
 	// Push messages.
 	for i := 0; i < numMsgs; i++ {
 		PushToUser(testUserId, &testObject{uri: "testuri", data: "This is a test"})
+		cs.Throttle(i + 1)
 	}
 
 	// Wait.
 	cs.Wait(t)
 }
 
+func TestPushToUserN(t *testing.T) {
+	obj := &testObject{uri: "testuri", data: "1"}
+
+	// Offline user.
+	if sent, err := PushToUserN("pushn", obj); sent != 0 || err != nil {
+		t.Errorf("Offline: expected 0 sent, got %d, error %v", sent, err)
+	}
+
+	// Stuck session misses payloads once its duct is full.
+	stuck := OpenSession("pushn", "stuck", true)
+	defer CloseSession("pushn", "stuck", stuck)
+	duct := OpenSession("pushn", "live", true)
+	defer CloseSession("pushn", "live", duct)
+
+	for i := 0; i < DATA_DUCT_BUFFER_MAX+1; i++ {
+		expected := 2
+		if i == DATA_DUCT_BUFFER_MAX {
+			expected = 1
+		}
+		if sent, err := PushToUserN("pushn", obj); sent != expected || err != nil {
+			t.Fatalf("Push %d: expected %d sent, got %d, error %v", i, expected, sent, err)
+		}
+		<-duct
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	ducts := map[string]chan *Payload{}
+	for _, user := range []string{"bcast1", "bcast2"} {
+		for _, sessionId := range []string{"s1", "s2"} {
+			duct := OpenSession(user, sessionId, true)
+			defer CloseSession(user, sessionId, duct)
+			ducts[user+":"+sessionId] = duct
+		}
+	}
+
+	// Sessions of other tests may be online too.
+	sent, err := Broadcast(&testObject{uri: "maintenance", data: `"banner"`})
+	if err != nil || sent < len(ducts) {
+		t.Fatalf("Expected at least %d sent, got %d, error %v", len(ducts), sent, err)
+	}
+
+	for skey, duct := range ducts {
+		select {
+		case p := <-duct:
+			if p.Uri != "maintenance" || string(p.Data) != `"banner"` {
+				t.Errorf("Session %s: unexpected payload %+v", skey, p)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Session %s: broadcast not delivered", skey)
+		}
+	}
+}
+
 func TestPublish(t *testing.T) {
 	testUri := "test:uri"
 	numMsgs := 1000
@@ -151,17 +229,1633 @@ func TestPublish(t *testing.T) {
 	// Push messages.
 	for i := 0; i < numMsgs; i++ {
 		Publish(&testObject{uri: testUri, data: "This is a test"})
+		cs.Throttle(i + 1)
 	}
 
 	// Wait.
 	cs.Wait(t)
 }
 
-func TestMain(m *testing.M) {
-	// Init.
-	config.Init()
-	log.Init("")
-	Init()
+// Pushable test object with ordering key.
+type keyedTestObject struct {
+	uri string
+	key string
+	seq int
+}
 
-	os.Exit(m.Run())
+func (obj *keyedTestObject) BuildPushPayload() (*Payload, error) {
+	p := &Payload{
+		Kind: "test",
+		Op:   UPSERT,
+		Uri:  obj.uri,
+		Key:  obj.key,
+		Data: json.RawMessage(fmt.Sprintf("%d", obj.seq)),
+	}
+
+	return p, nil
+}
+
+func TestPublishKeyOrder(t *testing.T) {
+	numTopics := 3
+	numKeys := 4
+	numMsgs := DATA_DUCT_BUFFER_MAX / (numTopics * numKeys) // Fits duct, none dropped.
+
+	duct := OpenSession("order", "1", true)
+	for u := 0; u < numTopics; u++ {
+		Subscribe(fmt.Sprintf("test:order%d", u), "order", "1", true)
+	}
+	defer func() {
+		for u := 0; u < numTopics; u++ {
+			Unsubscribe(fmt.Sprintf("test:order%d", u), "order", "1", true)
+		}
+		CloseSession("order", "1", duct)
+	}()
+
+	// Publish concurrently, one publisher per topic and key.
+	start := make(chan struct{})
+	for u := 0; u < numTopics; u++ {
+		for k := 0; k < numKeys; k++ {
+			go func(uri, key string) {
+				<-start
+				for i := 0; i < numMsgs; i++ {
+					Publish(&keyedTestObject{uri: uri, key: key, seq: i})
+				}
+			}(fmt.Sprintf("test:order%d", u), fmt.Sprintf("key%d", k))
+		}
+	}
+	close(start)
+
+	// Verify per-key order within each topic.
+	next := make(map[string]int)
+	timer := time.NewTimer(5 * time.Second)
+	for i := 0; i < numTopics*numKeys*numMsgs; i++ {
+		select {
+		case p := <-duct:
+			var seq int
+			json.Unmarshal(p.Data, &seq)
+			k := p.Uri + "/" + p.Key
+			if seq != next[k] {
+				t.Fatalf("Topic %s, key %s: expected seq %d, got %d", p.Uri, p.Key, next[k], seq)
+			}
+			next[k]++
+
+		case <-timer.C:
+			t.Fatalf("Timed out after %d messages", i)
+		}
+	}
+}
+
+func TestDuplicateSubscribe(t *testing.T) {
+	testUri := "test:dup"
+
+	// Retained payload is sent on every subscribe forwarded to the topic.
+	defer func() { RetainLast = false }()
+	RetainLast = true
+
+	duct := OpenSession("dup", "1", true)
+	Subscribe(testUri, "dup", "1", true)
+	defer func() {
+		Unsubscribe(testUri, "dup", "1", true)
+		CloseSession("dup", "1", duct)
+	}()
+
+	Publish(&testObject{uri: testUri, data: "1"})
+	select {
+	case <-duct:
+	case <-time.After(time.Second):
+		t.Fatalf("Payload not delivered")
+	}
+
+	// Duplicate subscribe returns, once, without being forwarded.
+	done := make(chan error)
+	go func() { done <- Subscribe(testUri, "dup", "1", true) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Duplicate subscribe failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Duplicate subscribe did not return")
+	}
+
+	select {
+	case p := <-duct:
+		t.Errorf("Duplicate subscribe forwarded: retained payload %s resent", p.Data)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Subscribe of a session not yet open is not taken as subscribed once open.
+	Subscribe(testUri, "dup", "2", true)
+	duct2 := OpenSession("dup", "2", true)
+	defer CloseSession("dup", "2", duct2)
+	Subscribe(testUri, "dup", "2", true)
+
+	select {
+	case p := <-duct2:
+		if string(p.Data) != "1" {
+			t.Errorf("Expected retained payload 1, got %s", p.Data)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Subscribe after open not forwarded")
+	}
+}
+
+func TestPushToUsers(t *testing.T) {
+	userIds := []string{"multi1", "multi2", "offline"}
+
+	ducts := make([]chan *Payload, 2)
+	for i := range ducts {
+		ducts[i] = OpenSession(userIds[i], "1", true)
+		defer CloseSession(userIds[i], "1", ducts[i])
+	}
+
+	delivered, err := PushToUsers(userIds, &testObject{uri: "testuri", data: "1"})
+	if err != nil || delivered != 2 {
+		t.Fatalf("Expected 2 deliveries, got %d, error %v", delivered, err)
+	}
+
+	for i, duct := range ducts {
+		select {
+		case <-duct:
+		case <-time.After(time.Second):
+			t.Errorf("User %s: payload not delivered", userIds[i])
+		}
+	}
+}
+
+func TestCopySubscriptions(t *testing.T) {
+	testUris := []string{"test:copy1", "test:copy2"}
+
+	oldDuct := OpenSession("copy", "old", true)
+	for _, uri := range testUris {
+		Subscribe(uri, "copy", "old", true)
+	}
+	defer CloseSession("copy", "old", oldDuct)
+
+	// Target session must be open.
+	if err := CopySubscriptions("copy", "old", "new"); err != util.ErrInvalidSession {
+		t.Errorf("Expected error %v, got %v", util.ErrInvalidSession, err)
+	}
+
+	newDuct := OpenSession("copy", "new", true)
+	defer CloseSession("copy", "new", newDuct)
+
+	if err := CopySubscriptions("copy", "old", "new"); err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+
+	for _, uri := range testUris {
+		Publish(&testObject{uri: uri, data: "1"})
+
+		select {
+		case p := <-newDuct:
+			if p.Uri != uri {
+				t.Errorf("Expected payload of %s, got %s", uri, p.Uri)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Payload of %s not delivered to new session", uri)
+		}
+	}
+}
+
+func TestMaxTopics(t *testing.T) {
+	duct := OpenSession("max", "1", true)
+	defer CloseSession("max", "1", duct)
+
+	// Allow two more topics.
+	MaxTopics = int(numTopics.Load()) + 2
+	defer func() { MaxTopics = 0 }()
+
+	for i, uri := range []string{"test:max1", "test:max2", "test:max3"} {
+		err := Subscribe(uri, "max", "1", true)
+		if i < 2 && err != nil {
+			t.Errorf("Subscribe %s failed: %v", uri, err)
+		} else if i == 2 && err != util.ErrResourceLimit {
+			t.Errorf("Subscribe %s: expected error %v, got %v", uri, util.ErrResourceLimit, err)
+		}
+	}
+
+	// Existing topics still accept subscribers.
+	other := OpenSession("max", "2", true)
+	defer CloseSession("max", "2", other)
+	if err := Subscribe("test:max1", "max", "2", true); err != nil {
+		t.Fatalf("Subscribe to existing topic failed: %v", err)
+	}
+
+	Publish(&testObject{uri: "test:max1", data: "1"})
+	for _, d := range []chan *Payload{duct, other} {
+		select {
+		case <-d:
+		case <-time.After(time.Second):
+			t.Errorf("Payload not delivered")
+		}
+	}
+}
+
+// Pushable binary test object.
+type binaryTestObject struct {
+	uri  string
+	data []byte
+}
+
+func (obj *binaryTestObject) BuildPushPayload() (*Payload, error) {
+	p := &Payload{
+		Kind:        "test",
+		Op:          UPSERT,
+		Uri:         obj.uri,
+		ContentType: "application/octet-stream",
+		Binary:      obj.data,
+	}
+
+	return p, nil
+}
+
+func TestBinaryFromBroker(t *testing.T) {
+	testUri := "test:binary"
+	data := []byte{0x00, 0x01, 0xfe, 0xff}
+
+	duct := OpenSession("binary", "1", true)
+	Subscribe(testUri, "binary", "1", true)
+	defer func() {
+		Unsubscribe(testUri, "binary", "1", true)
+		CloseSession("binary", "1", duct)
+	}()
+
+	// Encode as published to broker, and process as received from broker.
+	p, _ := (&binaryTestObject{uri: testUri, data: data}).BuildPushPayload()
+	msg, err := encodeBrokerMsg(p)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	natsMsgHandler(processPayloadFromBroker)(&nats.Msg{Subject: p.Kind, Data: msg})
+
+	select {
+	case rp := <-duct:
+		if rp.ContentType != p.ContentType || rp.Uri != testUri || !bytes.Equal(rp.Binary, data) {
+			t.Errorf("Unexpected payload %+v", rp)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Payload not delivered")
+	}
+
+	// JSON payloads are unaffected.
+	msg, _ = encodeBrokerMsg(&Payload{Kind: "test", Uri: testUri, Data: json.RawMessage(`{"a":1}`)})
+	if rp, err := decodeBrokerMsg(msg); err != nil || rp.IsBinary() || string(rp.Data) != `{"a":1}` {
+		t.Errorf("Unexpected JSON payload %+v, error %v", rp, err)
+	}
+}
+
+func TestSubjectPrefix(t *testing.T) {
+	for prefix, expected := range map[string]string{
+		"":           "",
+		"prod":       "prod.",
+		"prod.":      "prod.",
+		"eu-1.stage": "eu-1.stage.",
+	} {
+		if p, err := validateSubjectPrefix(prefix); err != nil || p != expected {
+			t.Errorf("Prefix %q: expected %q, got %q, error %v", prefix, expected, p, err)
+		}
+	}
+
+	for _, prefix := range []string{"prod.*", "prod.>", "a..b", ".prod", "pr od"} {
+		if _, err := validateSubjectPrefix(prefix); err != util.ErrInvalidInput {
+			t.Errorf("Prefix %q: expected error %v, got %v", prefix, util.ErrInvalidInput, err)
+		}
+	}
+
+	// Publish and subscribe subjects match within an environment only.
+	defer func(prefix string) { subjectPrefix = prefix }(subjectPrefix)
+	subjectPrefix = "prod."
+	prodSubject := brokerSubject("test")
+	subjectPrefix = "staging."
+	stagingSubject := brokerSubject("test")
+
+	if prodSubject != "prod.test" || stagingSubject != "staging.test" {
+		t.Errorf("Unexpected subjects %s, %s", prodSubject, stagingSubject)
+	}
+}
+
+func TestSubjectPrefixRoundTrip(t *testing.T) {
+	testUri := "test:prefix"
+
+	// Nodes of prod and staging share an in-memory broker.
+	defer func(t Transport, prefix string) {
+		SetTransport(t)
+		subjectPrefix = prefix
+	}(transport, subjectPrefix)
+	SetTransport(NewMemTransport())
+
+	// Prod node subscribes.
+	subjectPrefix = "prod."
+	SubscribeFromBroker([]string{"test"})
+
+	duct := OpenSession("prefix", "1", true)
+	Subscribe(testUri, "prefix", "1", true)
+	defer func() {
+		Unsubscribe(testUri, "prefix", "1", true)
+		CloseSession("prefix", "1", duct)
+	}()
+
+	// Staging node publishes: not delivered to prod.
+	subjectPrefix = "staging."
+	if err := Publish(&testObject{uri: testUri, data: `"staging"`}); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+
+	// Prod node publishes: delivered.
+	subjectPrefix = "prod."
+	if err := Publish(&testObject{uri: testUri, data: `"prod"`}); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+
+	select {
+	case p := <-duct:
+		if string(p.Data) != `"prod"` {
+			t.Errorf("Unexpected payload %+v", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Payload not delivered")
+	}
+
+	select {
+	case p := <-duct:
+		t.Errorf("Unexpected payload %+v", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMemTransport(t *testing.T) {
+	testUri := "test:transport"
+
+	// Route publishes through in-memory broker.
+	defer func(t Transport, prefix string) {
+		SetTransport(t)
+		subjectPrefix = prefix
+	}(transport, subjectPrefix)
+	mt := NewMemTransport()
+	SetTransport(mt)
+	subjectPrefix = "prod."
+	SubscribeFromBroker([]string{"test"})
+
+	duct := OpenSession("transport", "1", true)
+	Subscribe(testUri, "transport", "1", true)
+	defer func() {
+		Unsubscribe(testUri, "transport", "1", true)
+		CloseSession("transport", "1", duct)
+	}()
+
+	Publish(&testObject{uri: testUri, data: `"prod"`})
+
+	select {
+	case p := <-duct:
+		if p.Uri != testUri {
+			t.Errorf("Unexpected payload %+v", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Payload not delivered")
+	}
+
+	// Payloads of other environments are not delivered.
+	mt.Publish("staging.test", &Payload{Kind: "test", Op: UPSERT, Uri: testUri})
+
+	select {
+	case p := <-duct:
+		t.Errorf("Unexpected payload %+v", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Closed transport rejects publishes.
+	mt.Close()
+	if err := PublishToBroker(&Payload{Kind: "test", Uri: testUri}); err != util.ErrNetAccess {
+		t.Errorf("Expected error %v, got %v", util.ErrNetAccess, err)
+	}
+}
+
+func TestMemTransportCopies(t *testing.T) {
+	mt := NewMemTransport()
+
+	var received []*Payload
+	handler := func(p *Payload) { received = append(received, p) }
+	mt.Subscribe([]string{"test"}, handler)
+	mt.Subscribe([]string{"test"}, handler)
+
+	// Binary payloads are framed, and each handler decodes its own copy.
+	p := &Payload{Kind: "test", Op: UPSERT, Uri: "test:copies", ContentType: "application/octet-stream", Binary: []byte{0x00, 0xff}}
+	if err := mt.Publish("test", p); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+	if len(received) != 2 || received[0] == p || received[0] == received[1] {
+		t.Fatalf("Handlers share payloads: %v", received)
+	}
+	for _, rp := range received {
+		if rp.Uri != p.Uri || rp.ContentType != p.ContentType || !bytes.Equal(rp.Binary, p.Binary) {
+			t.Errorf("Unexpected payload %+v", rp)
+		}
+	}
+
+	// Payloads that cannot be encoded are rejected.
+	if err := mt.Publish("test", &Payload{Kind: "test", Data: json.RawMessage("invalid")}); err != util.ErrInvalidObject {
+		t.Errorf("Expected error %v, got %v", util.ErrInvalidObject, err)
+	}
+}
+
+func TestKindRoute(t *testing.T) {
+	testUri := "test:route"
+
+	// Route publishes through in-memory broker, counting payloads it carries.
+	defer func(t Transport) { SetTransport(t) }(transport)
+	defer SetKindRoute("test", ROUTE_BOTH)
+	mt := NewMemTransport()
+	SetTransport(mt)
+	SubscribeFromBroker([]string{"test"})
+	var brokered atomic.Int64
+	mt.Subscribe([]string{brokerSubject("test")}, func(*Payload) { brokered.Add(1) })
+
+	duct := OpenSession("route", "1", true)
+	Subscribe(testUri, "route", "1", true)
+	defer func() {
+		Unsubscribe(testUri, "route", "1", true)
+		CloseSession("route", "1", duct)
+	}()
+
+	for _, tt := range []struct {
+		route    Route
+		local    bool
+		brokered int64
+	}{
+		{ROUTE_BROKER, false, 1},
+		{ROUTE_LOCAL, true, 1},
+		{ROUTE_BOTH, true, 2},
+	} {
+		SetKindRoute("test", tt.route)
+		if err := Publish(&testObject{uri: testUri, data: `"` + tt.route.String() + `"`}); err != nil {
+			t.Fatalf("Route %v: publish failed: %v", tt.route, err)
+		}
+
+		select {
+		case p := <-duct:
+			if !tt.local {
+				t.Errorf("Route %v: unexpected local payload %+v", tt.route, p)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if tt.local {
+				t.Errorf("Route %v: payload not delivered locally", tt.route)
+			}
+		}
+
+		if n := brokered.Load(); n != tt.brokered {
+			t.Errorf("Route %v: expected %d brokered payloads, got %d", tt.route, tt.brokered, n)
+		}
+	}
+}
+
+func TestSubjectToken(t *testing.T) {
+	for uri, expected := range map[string]string{
+		"chat:room1":  "chat:room1",
+		"a.b*c>d e%f": "a%2Eb%2Ac%3Ed%20e%25f",
+		"caf\xc3\xa9": "caf%C3%A9",
+	} {
+		if token := subjectToken(uri); token != expected {
+			t.Errorf("URI %q: expected token %q, got %q", uri, expected, token)
+		}
+	}
+
+	for _, tt := range []struct {
+		pattern string
+		subject string
+		match   bool
+	}{
+		{"prod.test", "prod.test", true},
+		{"prod.test.*", "prod.test.a", true},
+		{"prod.test.*", "prod.test", false},
+		{"prod.test.*", "prod.test.a.b", false},
+		{"prod.>", "prod.test.a", true},
+		{"prod.>", "prod", false},
+		{"*.test.a", "prod.test.a", true},
+	} {
+		if match := matchSubject(tt.pattern, tt.subject); match != tt.match {
+			t.Errorf("Pattern %s, subject %s: expected match %v", tt.pattern, tt.subject, tt.match)
+		}
+	}
+}
+
+func TestSubjectPerTopic(t *testing.T) {
+	defer restartTopicMgr(t, 2)()
+
+	// Route publishes through in-memory broker, with subject per topic.
+	defer func(t Transport) {
+		SetTransport(t)
+		SubjectPerTopic = false
+		topicSubs.kinds = nil
+	}(transport)
+	mt := NewMemTransport()
+	SetTransport(mt)
+	SubjectPerTopic = true
+	SubscribeFromBroker([]string{"test"})
+
+	subscribed := func(subject string) bool {
+		mt.RLock()
+		defer mt.RUnlock()
+		return len(mt.handlers[subject]) > 0
+	}
+
+	duct := OpenSession("subject", "1", true)
+	defer CloseSession("subject", "1", duct)
+	SubscribeMulti([]string{"test:hosted", "test:wild:*"}, "subject", "1", true)
+
+	// Node subscribes to subjects of its topics only.
+	if !subscribed(topicSubject("test", "test:hosted")) || !subscribed(brokerSubject("test")+".*") {
+		t.Errorf("Topics not subscribed: %v", mt.handlers)
+	}
+	if subscribed(brokerSubject("test")) {
+		t.Errorf("Kind subscribed")
+	}
+
+	// Payloads are delivered once, whether of a topic or matching a wildcard.
+	for _, uri := range []string{"test:hosted", "test:wild:1", "test:other"} {
+		Publish(&testObject{uri: uri, data: "1"})
+
+		var n int
+		for done := false; !done; {
+			select {
+			case p := <-duct:
+				if p.Uri != uri {
+					t.Errorf("Expected payload of %s, got %s", uri, p.Uri)
+				}
+				n++
+			case <-time.After(100 * time.Millisecond):
+				done = true
+			}
+		}
+		expected := 1
+		if uri == "test:other" {
+			expected = 0
+		}
+		if n != expected {
+			t.Errorf("URI %s: expected %d payloads, got %d", uri, expected, n)
+		}
+	}
+
+	// Stopped topics unsubscribe.
+	Unsubscribe("test:hosted", "subject", "1", true)
+	Unsubscribe("test:wild:*", "subject", "1", true)
+	TriggerCleanup()
+	if subscribed(topicSubject("test", "test:hosted")) || subscribed(brokerSubject("test")+".*") {
+		t.Errorf("Topics still subscribed: %v", mt.handlers)
+	}
+}
+
+func TestPresenceDebounce(t *testing.T) {
+	defer func(d time.Duration) {
+		SetPresenceHandler(nil)
+		PresenceDebounce = d
+	}(PresenceDebounce)
+	PresenceDebounce = 100 * time.Millisecond
+
+	type update struct {
+		userId string
+		online bool
+	}
+	updates := make(chan update, 10)
+	SetPresenceHandler(func(userId string, online bool) {
+		if userId == "presence" {
+			updates <- update{userId, online}
+		}
+	})
+
+	expect := func(expected []update) {
+		t.Helper()
+		var got []update
+		timeout := time.After(3 * PresenceDebounce)
+		for done := false; !done; {
+			select {
+			case u := <-updates:
+				got = append(got, u)
+			case <-timeout:
+				done = true
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(expected) {
+			t.Errorf("Expected updates %v, got %v", expected, got)
+		}
+	}
+
+	// Rapid flaps ending online: single online update.
+	var duct chan *Payload
+	for i := 0; i < 10; i++ {
+		duct = OpenSession("presence", "1", true)
+		if i < 9 {
+			CloseSession("presence", "1", duct)
+		}
+	}
+	expect([]update{{"presence", true}})
+
+	// Rapid flaps returning online: no net change.
+	for i := 0; i < 5; i++ {
+		CloseSession("presence", "1", duct)
+		duct = OpenSession("presence", "1", true)
+	}
+	expect(nil)
+
+	// Second session does not change presence, closing both does.
+	other := OpenSession("presence", "2", true)
+	CloseSession("presence", "1", duct)
+	CloseSession("presence", "2", other)
+	expect([]update{{"presence", false}})
+}
+
+// Restart topic manager with given number of shards. Returns function restoring
+// configured shards.
+func restartTopicMgr(tb testing.TB, numShards int) (restore func()) {
+	if err := stopTopicMgr(context.Background()); err != nil {
+		tb.Fatalf("Stop topic manager failed: %v", err)
+	}
+	startTopicMgr(numShards)
+
+	return func() {
+		stopTopicMgr(context.Background())
+		startTopicMgr(TopicShards)
+	}
+}
+
+func TestTopicCountRestart(t *testing.T) {
+	duct := OpenSession("topiccount", "1", true)
+	defer CloseSession("topiccount", "1", duct)
+	if err := Subscribe("test:topiccount", "topiccount", "1", true); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	if n := OnlineStats().Topics; n == 0 {
+		t.Fatalf("Topic not counted")
+	}
+
+	// Stopped topics are not counted.
+	if err := stopTopicMgr(context.Background()); err != nil {
+		t.Fatalf("Stop topic manager failed: %v", err)
+	}
+	if n := OnlineStats().Topics; n != 0 {
+		t.Errorf("Expected no topics after stop, got %d", n)
+	}
+
+	startTopicMgr(TopicShards)
+	if n := OnlineStats().Topics; n != 0 {
+		t.Errorf("Expected no topics after restart, got %d", n)
+	}
+}
+
+func TestTopicShards(t *testing.T) {
+	defer restartTopicMgr(t, 4)()
+
+	duct := OpenSession("shards", "1", true)
+	other := OpenSession("shards", "2", true)
+	defer CloseSession("shards", "2", other)
+
+	var uris []string
+	for i := 0; i < 16; i++ {
+		uri := fmt.Sprintf("test:shard%d", i)
+		uris = append(uris, uri)
+		if err := Subscribe(uri, "shards", "1", true); err != nil {
+			t.Fatalf("Subscribe %s failed: %v", uri, err)
+		}
+	}
+
+	// Subscriptions span shards.
+	if err := CopySubscriptions("shards", "1", "2"); err != nil {
+		t.Fatalf("Copy subscriptions failed: %v", err)
+	}
+	if got := listSubscriptions("shards", "2"); len(got) != len(uris) {
+		t.Errorf("Expected %d subscriptions, got %d", len(uris), len(got))
+	}
+
+	for _, uri := range uris {
+		Publish(&testObject{uri: uri, data: "1"})
+		for _, d := range []chan *Payload{duct, other} {
+			select {
+			case p := <-d:
+				if p.Uri != uri {
+					t.Errorf("Expected payload of %s, got %s", uri, p.Uri)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("Payload of %s not delivered", uri)
+			}
+		}
+	}
+
+	// Closing session clears its subscriptions in all shards.
+	CloseSession("shards", "1", duct)
+	if got := listSubscriptions("shards", "1"); len(got) != 0 {
+		t.Errorf("Expected no subscriptions, got %v", got)
+	}
+}
+
+// Benchmark subscribe and unsubscribe churn across topics.
+func BenchmarkTopicShards(b *testing.B) {
+	for _, numShards := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("shards-%d", numShards), func(b *testing.B) {
+			defer restartTopicMgr(b, numShards)()
+
+			duct := OpenSession("bench", "shards", true)
+			defer CloseSession("bench", "shards", duct)
+
+			var seq atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				uri := fmt.Sprintf("bench:shard%d", seq.Add(1))
+				for pb.Next() {
+					Subscribe(uri, "bench", "shards", true)
+					Unsubscribe(uri, "bench", "shards", true)
+				}
+			})
+		})
+	}
+}
+
+// Open sessions for benchmark users and drain their ducts.
+func openBenchSessions(b *testing.B, numUsers int) (userIds []string, closeAll func()) {
+	ducts := make([]chan *Payload, numUsers)
+	for i := 0; i < numUsers; i++ {
+		userIds = append(userIds, fmt.Sprintf("bench%d", i))
+		ducts[i] = OpenSession(userIds[i], "1", true)
+		go func(duct chan *Payload) {
+			for range duct {
+			}
+		}(ducts[i])
+	}
+
+	return userIds, func() {
+		for i, duct := range ducts {
+			CloseSession(userIds[i], "1", duct)
+		}
+	}
+}
+
+func BenchmarkPushToUserLoop(b *testing.B) {
+	userIds, closeAll := openBenchSessions(b, 1000)
+	defer closeAll()
+
+	obj := &testObject{uri: "testuri", data: "1"}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, userId := range userIds {
+			PushToUser(userId, obj)
+		}
+	}
+}
+
+func BenchmarkPushToUsers(b *testing.B) {
+	userIds, closeAll := openBenchSessions(b, 1000)
+	defer closeAll()
+
+	obj := &testObject{uri: "testuri", data: "1"}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		PushToUsers(userIds, obj)
+	}
+}
+
+func TestOpenSessionStorm(t *testing.T) {
+	const numSessions = 500
+
+	// Sessions opened at once are online as each open returns.
+	var wg sync.WaitGroup
+	ducts := make([]chan *Payload, numSessions)
+	for i := 0; i < numSessions; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			userId := fmt.Sprintf("storm%d", i)
+			ducts[i] = OpenSession(userId, "1", true)
+			if lookupSession(userId, "1") == nil {
+				t.Errorf("Session %s:1 not online", userId)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Sessions closed in turn are offline as each close returns.
+	for i, duct := range ducts {
+		userId := fmt.Sprintf("storm%d", i)
+		CloseSession(userId, "1", duct)
+		if lookupSession(userId, "1") != nil {
+			t.Errorf("Session %s:1 still online", userId)
+		}
+	}
+}
+
+// Benchmark sessions opening concurrently, e.g. clients reconnecting after a
+// deploy. Reports mean and worst latency of an open.
+func BenchmarkOpenSessionStorm(b *testing.B) {
+	const numSessions = 2000
+
+	var total, worst time.Duration
+	for n := 0; n < b.N; n++ {
+		ducts := make([]chan *Payload, numSessions)
+		latencies := make([]time.Duration, numSessions)
+
+		var wg sync.WaitGroup
+		wg.Add(numSessions)
+		for i := 0; i < numSessions; i++ {
+			go func(i int) {
+				defer wg.Done()
+				start := time.Now()
+				ducts[i] = OpenSession(fmt.Sprintf("storm%d", i), "1", true)
+				latencies[i] = time.Since(start)
+			}(i)
+		}
+		wg.Wait()
+
+		for _, d := range latencies {
+			total += d
+			if d > worst {
+				worst = d
+			}
+		}
+
+		b.StopTimer()
+		for i, duct := range ducts {
+			CloseSession(fmt.Sprintf("storm%d", i), "1", duct)
+		}
+		b.StartTimer()
+	}
+
+	b.ReportMetric(float64(total.Nanoseconds())/float64(b.N*numSessions), "ns/open")
+	b.ReportMetric(float64(worst.Nanoseconds()), "worst-ns/open")
+}
+
+func TestMain(m *testing.M) {
+	// Init.
+	config.Init("testdata/config.json")
+	log.Init("", "error", false)
+	Init(true)
+
+	os.Exit(m.Run())
+}
+
+func TestSubscribeMulti(t *testing.T) {
+	defer restartTopicMgr(t, 4)()
+
+	duct := OpenSession("multi", "1", true)
+	defer CloseSession("multi", "1", duct)
+
+	var uris []string
+	for i := 0; i < 16; i++ {
+		uris = append(uris, fmt.Sprintf("test:multi%d", i))
+	}
+
+	// Repeated URIs subscribe once.
+	if err := SubscribeMulti(append(uris, uris[0]), "multi", "1", true); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	if got := listSubscriptions("multi", "1"); len(got) != len(uris) {
+		t.Errorf("Expected %d subscriptions, got %d", len(uris), len(got))
+	}
+
+	for _, uri := range uris {
+		Publish(&testObject{uri: uri, data: "1"})
+		select {
+		case p := <-duct:
+			if p.Uri != uri {
+				t.Errorf("Expected payload of %s, got %s", uri, p.Uri)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Payload of %s not delivered", uri)
+		}
+	}
+
+	// Subscriptions within the limit are made, others are rejected.
+	other := OpenSession("multi", "2", true)
+	defer CloseSession("multi", "2", other)
+
+	MaxSubs = 4
+	defer func() { MaxSubs = 0 }()
+
+	if err := SubscribeMulti(uris, "multi", "2", true); err != util.ErrResourceLimit {
+		t.Errorf("Expected error %v, got %v", util.ErrResourceLimit, err)
+	}
+	if got := listSubscriptions("multi", "2"); len(got) != MaxSubs {
+		t.Errorf("Expected %d subscriptions, got %v", MaxSubs, got)
+	}
+}
+
+func TestMaxSubs(t *testing.T) {
+	defer restartTopicMgr(t, 4)()
+
+	duct := OpenSession("maxsubs", "1", true)
+	defer CloseSession("maxsubs", "1", duct)
+
+	MaxSubs = 2
+	defer func() { MaxSubs = 0 }()
+
+	for i, uri := range []string{"test:subs1", "test:subs2", "test:subs3"} {
+		err := Subscribe(uri, "maxsubs", "1", true)
+		if i < 2 && err != nil {
+			t.Errorf("Subscribe %s failed: %v", uri, err)
+		} else if i == 2 && err != util.ErrResourceLimit {
+			t.Errorf("Subscribe %s: expected error %v, got %v", uri, util.ErrResourceLimit, err)
+		}
+	}
+
+	// Repeated subscription does not count.
+	if err := Subscribe("test:subs1", "maxsubs", "1", true); err != nil {
+		t.Errorf("Repeated subscribe failed: %v", err)
+	}
+
+	// Existing subscriptions keep working.
+	Publish(&testObject{uri: "test:subs2", data: "1"})
+	select {
+	case <-duct:
+	case <-time.After(time.Second):
+		t.Errorf("Payload not delivered")
+	}
+
+	// Other sessions have their own limit.
+	other := OpenSession("maxsubs", "2", true)
+	defer CloseSession("maxsubs", "2", other)
+	if err := Subscribe("test:subs3", "maxsubs", "2", true); err != nil {
+		t.Errorf("Subscribe of other session failed: %v", err)
+	}
+
+	// Unsubscribing frees a slot.
+	Unsubscribe("test:subs1", "maxsubs", "1", true)
+	if err := Subscribe("test:subs3", "maxsubs", "1", true); err != nil {
+		t.Errorf("Subscribe after unsubscribe failed: %v", err)
+	}
+}
+
+// Pushable test object with TTL.
+type ttlTestObject struct {
+	seq int
+	ttl time.Duration
+}
+
+func (obj *ttlTestObject) BuildPushPayload() (*Payload, error) {
+	p := &Payload{
+		Kind: "test",
+		Op:   UPSERT,
+		Uri:  "test:ttl",
+		Data: json.RawMessage(fmt.Sprintf("%d", obj.seq)),
+		TTL:  obj.ttl,
+	}
+
+	return p, nil
+}
+
+func TestPayloadTTL(t *testing.T) {
+	duct := OpenSession("ttl", "1", true)
+	defer CloseSession("ttl", "1", duct)
+
+	PushToUser("ttl", &ttlTestObject{seq: 1, ttl: 20 * time.Millisecond})
+	PushToUser("ttl", &ttlTestObject{seq: 2})
+	PushToUser("ttl", &ttlTestObject{seq: 3, ttl: time.Minute})
+
+	// Delayed reader.
+	time.Sleep(50 * time.Millisecond)
+
+	for _, expired := range []bool{true, false, false} {
+		p := <-duct
+		if p.Expired() != expired {
+			t.Errorf("Payload %s: expected expired %v", p.Data, expired)
+		}
+	}
+
+	// TTL is carried through broker.
+	p, _ := (&ttlTestObject{seq: 4, ttl: time.Second}).BuildPushPayload()
+	data, _ := encodeBrokerMsg(p)
+	if decoded, err := decodeBrokerMsg(data); err != nil || decoded.TTL != time.Second {
+		t.Errorf("Expected TTL %v, got %+v, error %v", time.Second, decoded, err)
+	}
+}
+
+func TestSubscribeSnapshot(t *testing.T) {
+	const testUri = "test:snapshot"
+	const numMsgs = 2000
+
+	// State of topic, updated before publishing.
+	var state atomic.Int64
+	SetSnapshotFunc(func(uri string) (*Payload, error) {
+		if uri != testUri {
+			return nil, nil
+		}
+		return &Payload{Kind: "snapshot", Op: UPSERT, Uri: uri, Data: json.RawMessage(fmt.Sprintf("%d", state.Load()))}, nil
+	})
+	defer SetSnapshotFunc(nil)
+
+	duct := OpenSession("snapshot", "1", true)
+	defer CloseSession("snapshot", "1", duct)
+
+	// Publish while subscribing, throttled to the pace of the reader once
+	// subscribed, so that no payload is dropped.
+	var received atomic.Int64
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for i := 1; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			for r := received.Load(); r > 0 && int64(i)-r > DATA_DUCT_BUFFER_MAX/4; r = received.Load() {
+				time.Sleep(time.Millisecond)
+			}
+			state.Store(int64(i))
+			Publish(&keyedTestObject{uri: testUri, seq: i})
+		}
+	}()
+	for state.Load() < 100 {
+		time.Sleep(time.Millisecond)
+	}
+	received.Store(state.Load())
+	go func() {
+		if err := Subscribe(testUri, "snapshot", "1", true); err != nil {
+			t.Errorf("Subscribe failed: %v", err)
+		}
+	}()
+
+	// Snapshot comes first, then live payloads without gap.
+	var snapshot, last int
+	for last == 0 || last < snapshot+numMsgs {
+		select {
+		case p := <-duct:
+			var seq int
+			json.Unmarshal(p.Data, &seq)
+			switch {
+			case p.Kind == "snapshot":
+				if snapshot != 0 || last != 0 {
+					t.Fatalf("Unexpected snapshot %d after %d", seq, last)
+				}
+				snapshot = seq
+			case snapshot == 0:
+				t.Fatalf("Live payload %d before snapshot", seq)
+			case last == 0 && seq > snapshot+1:
+				t.Fatalf("Gap between snapshot %d and live payload %d", snapshot, seq)
+			case last != 0 && seq != last+1:
+				t.Fatalf("Expected live payload %d, got %d", last+1, seq)
+			}
+			if p.Kind != "snapshot" {
+				last = seq
+			}
+			received.Store(int64(seq))
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out after snapshot %d, payload %d", snapshot, last)
+		}
+	}
+}
+
+func TestUnsubscribeWait(t *testing.T) {
+	const testUri = "test:unsubscribe"
+
+	duct := OpenSession("unsub", "1", true)
+	defer CloseSession("unsub", "1", duct)
+	Subscribe(testUri, "unsub", "1", true)
+
+	// Publish while unsubscribing.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			Publish(&testObject{uri: testUri, data: "1"})
+		}
+	}()
+	<-duct
+
+	// Unsubscribe, reading payloads sent until then.
+	done := make(chan struct{})
+	go func() {
+		Unsubscribe(testUri, "unsub", "1", true)
+		close(done)
+	}()
+drain:
+	for {
+		select {
+		case <-duct:
+		case <-done:
+			break drain
+		}
+	}
+	for len(duct) > 0 {
+		<-duct
+	}
+
+	// None follow.
+	select {
+	case <-duct:
+		t.Errorf("Payload received after unsubscribe")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Unsubscribing from unknown topic returns too.
+	Unsubscribe("test:unknown", "unsub", "1", true)
+}
+
+func TestBrokerCompression(t *testing.T) {
+	testUri := "test:compress"
+
+	defer func(t Transport, threshold int) {
+		SetTransport(t)
+		CompressThreshold = threshold
+	}(transport, CompressThreshold)
+	mt := NewMemTransport()
+	SetTransport(mt)
+	CompressThreshold = 64
+
+	// Capture payloads as carried by broker, and encoded for NATS.
+	var carried []*Payload
+	mt.Subscribe([]string{brokerSubject("test")}, func(p *Payload) {
+		msg, err := encodeBrokerMsg(p)
+		if err != nil {
+			t.Errorf("Encode failed: %v", err)
+		}
+		if p, err = decodeBrokerMsg(msg); err != nil {
+			t.Errorf("Decode failed: %v", err)
+		}
+		carried = append(carried, p)
+	})
+	SubscribeFromBroker([]string{"test"})
+
+	duct := OpenSession("compress", "1", true)
+	defer CloseSession("compress", "1", duct)
+	Subscribe(testUri, "compress", "1", true)
+
+	large := `"` + strings.Repeat("x", 1000) + `"`
+	for _, data := range []string{`"small"`, large} {
+		Publish(&testObject{uri: testUri, data: data})
+
+		select {
+		case p := <-duct:
+			if string(p.Data) != data || p.Compressed || len(p.Binary) > 0 {
+				t.Errorf("Unexpected payload %+v", p)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Payload not delivered")
+		}
+	}
+
+	// Only payloads above threshold are compressed.
+	if len(carried) != 2 {
+		t.Fatalf("Expected 2 payloads through broker, got %d", len(carried))
+	}
+	if p := carried[0]; p.Compressed || string(p.Data) != `"small"` {
+		t.Errorf("Small payload: unexpected %+v", p)
+	}
+	if p := carried[1]; !p.Compressed || len(p.Data) > 0 || len(p.Binary) == 0 || len(p.Binary) >= len(large) {
+		t.Errorf("Large payload: expected compressed, got %d data, %d binary bytes", len(p.Data), len(p.Binary))
+	}
+}
+
+func TestDroppedPayloads(t *testing.T) {
+	const testUri = "test:dropped"
+
+	// Stuck session never reads.
+	stuck := OpenSession("dropped", "stuck", true)
+	defer CloseSession("dropped", "stuck", stuck)
+	Subscribe(testUri, "dropped", "stuck", true)
+
+	duct := OpenSession("dropped", "live", true)
+	defer CloseSession("dropped", "live", duct)
+	Subscribe(testUri, "dropped", "live", true)
+
+	// Topic keeps delivering to live session.
+	for i := 0; i < DATA_DUCT_BUFFER_MAX+10; i++ {
+		Publish(&testObject{uri: testUri, data: "1"})
+
+		select {
+		case <-duct:
+		case <-time.After(time.Second):
+			t.Fatalf("Payload %d not delivered: topic blocked", i)
+		}
+	}
+
+	if n := lookupSession("dropped", "stuck").Dropped(); n != 10 {
+		t.Errorf("Expected 10 dropped, got %d", n)
+	}
+	if n := lookupSession("dropped", "live").Dropped(); n != 0 {
+		t.Errorf("Expected 0 dropped, got %d", n)
+	}
+
+	// Pushes to users drop too.
+	PushToUser("dropped", &testObject{uri: testUri, data: "1"})
+	<-duct
+	for _, si := range Sessions("dropped") {
+		if expected := map[string]uint{"stuck": 11, "live": 0}[si.SessionId]; si.Dropped != expected {
+			t.Errorf("Session %s: expected %d dropped, got %d", si.SessionId, expected, si.Dropped)
+		}
+	}
+}
+
+func TestTopicStats(t *testing.T) {
+	const testUri = "test:stats"
+	const n = DATA_DUCT_BUFFER_MAX + 5
+
+	stuck := OpenSession("stats", "stuck", true)
+	defer CloseSession("stats", "stuck", stuck)
+	Subscribe(testUri, "stats", "stuck", true)
+
+	duct := OpenSession("stats", "live", true)
+	defer CloseSession("stats", "live", duct)
+	Subscribe(testUri, "stats", "live", true)
+
+	for i := 0; i < n; i++ {
+		Publish(&testObject{uri: testUri, data: "1"})
+		<-duct
+	}
+
+	var stat *TopicStat
+	for _, ts := range TopicStats() {
+		if ts.Uri == testUri {
+			stat = &ts
+		}
+	}
+	if stat == nil {
+		t.Fatalf("Topic %s not in stats", testUri)
+	}
+
+	// Stuck session misses payloads beyond its duct.
+	expected := TopicStat{Uri: testUri, Subscribers: 2, Delivered: 2*n - 5, Dropped: 5}
+	if *stat != expected {
+		t.Errorf("Expected %+v, got %+v", expected, *stat)
+	}
+}
+
+func TestRetainLast(t *testing.T) {
+	const testUri = "test:retain"
+
+	defer func() { RetainLast = false }()
+	RetainLast = true
+
+	first := OpenSession("retain", "first", true)
+	defer CloseSession("retain", "first", first)
+	Subscribe(testUri, "retain", "first", true)
+
+	for _, data := range []string{"1", "2"} {
+		Publish(&testObject{uri: testUri, data: data})
+		if p := <-first; string(p.Data) != data {
+			t.Fatalf("Expected %s, got %s", data, p.Data)
+		}
+	}
+
+	// New subscriber gets retained payload right away.
+	second := OpenSession("retain", "second", true)
+	defer CloseSession("retain", "second", second)
+	Subscribe(testUri, "retain", "second", true)
+	select {
+	case p := <-second:
+		if string(p.Data) != "2" {
+			t.Errorf("Expected retained payload 2, got %s", p.Data)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Retained payload not delivered")
+	}
+
+	// Live payloads follow.
+	Publish(&testObject{uri: testUri, data: "3"})
+	if p := <-second; string(p.Data) != "3" {
+		t.Errorf("Expected 3, got %s", p.Data)
+	}
+	<-first
+
+	// Retained payload is cleared with the last subscriber.
+	unsubscribeAll("retain", "first", true)
+	unsubscribeAll("retain", "second", true)
+	Subscribe(testUri, "retain", "first", true)
+	select {
+	case p := <-first:
+		t.Errorf("Unexpected retained payload %s", p.Data)
+	case <-time.After(100 * time.Millisecond):
+	}
+	Unsubscribe(testUri, "retain", "first", true)
+
+	// Without retention, new subscribers wait for the next payload.
+	RetainLast = false
+	Subscribe("test:noretain", "retain", "first", true)
+	Publish(&testObject{uri: "test:noretain", data: "1"})
+	<-first
+	Subscribe("test:noretain", "retain", "second", true)
+	Publish(&testObject{uri: "test:noretain", data: "2"})
+	if p := <-second; string(p.Data) != "2" {
+		t.Errorf("Expected 2, got %s", p.Data)
+	}
+}
+
+func TestTriggerCleanup(t *testing.T) {
+	duct := OpenSession("cleanup", "s1", true)
+	defer CloseSession("cleanup", "s1", duct)
+
+	for _, uri := range []string{"test:cleanup:empty", "test:cleanup:busy"} {
+		if err := Subscribe(uri, "cleanup", "s1", true); err != nil {
+			t.Fatalf("Subscribe %s failed: %v", uri, err)
+		}
+	}
+	Unsubscribe("test:cleanup:empty", "cleanup", "s1", true)
+
+	active := func(uri string) bool {
+		_, err := TopicInfo(uri)
+		return err == nil
+	}
+	if !active("test:cleanup:empty") {
+		t.Fatalf("Topic stopped before cleanup")
+	}
+
+	// Only topics without subscribers are stopped.
+	TriggerCleanup()
+	if active("test:cleanup:empty") {
+		t.Errorf("Empty topic not stopped by cleanup")
+	}
+	if !active("test:cleanup:busy") {
+		t.Errorf("Busy topic stopped by cleanup")
+	}
+}
+
+func TestCleanupRace(t *testing.T) {
+	duct := OpenSession("cleanuprace", "s1", true)
+	defer CloseSession("cleanuprace", "s1", duct)
+
+	subscribed := func(uri string) bool {
+		td, err := TopicInfo(uri)
+		return err == nil && len(td.Subscribers) == 1
+	}
+
+	// Subscriptions racing cleanup are kept.
+	for i := 0; i < 200; i++ {
+		uri := fmt.Sprintf("test:cleanuprace:%d", i)
+
+		done := make(chan error)
+		go func() {
+			done <- Subscribe(uri, "cleanuprace", "s1", true)
+		}()
+		TriggerCleanup()
+		if err := <-done; err != nil {
+			t.Fatalf("Subscribe %s failed: %v", uri, err)
+		}
+
+		if !subscribed(uri) {
+			t.Fatalf("Subscription to %s lost to cleanup", uri)
+		}
+		Unsubscribe(uri, "cleanuprace", "s1", true)
+	}
+
+	// Subscriptions of sessions not found are not recorded, so that the
+	// session can subscribe once open, without waiting for cleanup.
+	uri := "test:cleanuprace:early"
+	Subscribe(uri, "cleanuprace", "s2", true)
+
+	duct2 := OpenSession("cleanuprace", "s2", true)
+	defer CloseSession("cleanuprace", "s2", duct2)
+	if err := Subscribe(uri, "cleanuprace", "s2", true); err != nil || !subscribed(uri) {
+		t.Errorf("Subscription to %s after cleanup failed: %v", uri, err)
+	}
+	Unsubscribe(uri, "cleanuprace", "s2", true)
+}
+
+func TestPublishCleanupRace(t *testing.T) {
+	duct := OpenSession("publishrace", "s1", true)
+	defer CloseSession("publishrace", "s1", duct)
+
+	// Publish to topics, exact and wildcard, while cleanup stops them.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				Publish(&testObject{uri: fmt.Sprintf("test:publishrace:%d", i), data: "1"})
+			}
+		}(i)
+	}
+
+	deadline := time.Now().Add(300 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		for i := 0; i < 4; i++ {
+			uri := fmt.Sprintf("test:publishrace:%d", i)
+			Subscribe(uri, "publishrace", "s1", true)
+			Unsubscribe(uri, "publishrace", "s1", true)
+		}
+		Subscribe("test:publishrace:*", "publishrace", "s1", true)
+		Unsubscribe("test:publishrace:*", "publishrace", "s1", true)
+		TriggerCleanup()
+
+		// Drain session.
+		for n := len(duct); n > 0; n-- {
+			<-duct
+		}
+	}
+
+	close(stop)
+	wg.Wait()
+}
+
+func TestSlowConsumer(t *testing.T) {
+	defer SetTransport(transport)
+	nt := &natsTransport{}
+	SetTransport(nt)
+
+	// Slow consumer callbacks report cumulative drops of subscriptions.
+	for _, report := range []struct {
+		subject  string
+		dropped  int
+		expected int
+	}{
+		{"test", 10, 10},
+		{"test", 10, 0},
+		{"test", 25, 15},
+		{"other", 5, 5},
+	} {
+		if n := nt.dropped.add(report.subject, report.dropped); n != report.expected {
+			t.Errorf("%s dropped %d: expected %d new drops, got %d", report.subject, report.dropped, report.expected, n)
+		}
+	}
+
+	if n := BrokerDropped(); n != 30 {
+		t.Errorf("Expected 30 dropped, got %d", n)
+	}
+
+	// Other errors are not drops.
+	nt.asyncError(nil, nil, nats.ErrSlowConsumer)
+	nt.asyncError(nil, &nats.Subscription{Subject: "test"}, nats.ErrTimeout)
+	if n := BrokerDropped(); n != 30 {
+		t.Errorf("Expected 30 dropped, got %d", n)
+	}
+}
+
+// NATS server for tests needing a live broker. Skipped if not set.
+var natsServer = flag.String("nats", "", "NATS server URL for live broker tests, e.g. nats://localhost:4222")
+
+func TestSlowConsumerBroker(t *testing.T) {
+	if *natsServer == "" {
+		t.Skip("No NATS server, set -nats")
+	}
+
+	defer func(limit int) { PendingMsgsLimit = limit }(PendingMsgsLimit)
+	PendingMsgsLimit = 10
+
+	// Transport connected to live broker.
+	nt := &natsTransport{opts: nats.DefaultOptions}
+	nt.opts.Servers = []string{*natsServer}
+	nt.opts.AsyncErrorCB = nt.asyncError
+	var err error
+	if nt.conn, err = nt.opts.Connect(); err != nil {
+		t.Fatalf("Failed to connect to %s: %v", *natsServer, err)
+	}
+	defer nt.conn.Close()
+
+	defer SetTransport(transport)
+	SetTransport(nt)
+
+	// Slow handler, blocked until test ends.
+	release := make(chan struct{})
+	defer close(release)
+	subject := fmt.Sprintf("test.slow.%d", time.Now().UnixNano())
+	if err = nt.Subscribe([]string{subject}, func(*Payload) { <-release }); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	defer nt.Unsubscribe([]string{subject})
+
+	// Publish past pending limit.
+	for i := 0; i < 10*PendingMsgsLimit; i++ {
+		if err = nt.Publish(subject, &Payload{Kind: "test", Op: UPSERT, Uri: "test:slow", Data: json.RawMessage(`1`)}); err != nil {
+			t.Fatalf("Publish failed: %v", err)
+		}
+	}
+	nt.conn.Flush()
+
+	// Slow consumer callback accounts drops.
+	timeout := time.After(5 * time.Second)
+	for BrokerDropped() == 0 {
+		select {
+		case <-timeout:
+			t.Fatalf("No drops reported")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	var buf bytes.Buffer
+	metrics.WritePrometheus(&buf)
+	if out := buf.String(); !strings.Contains(out, METRIC_BROKER_DROPPED+`{subject="`+subject+`"}`) {
+		t.Errorf("Metric %s of %s not emitted", METRIC_BROKER_DROPPED, subject)
+	}
+}
+
+func TestBrokerStats(t *testing.T) {
+	// Disabled broker is connected, without flaps.
+	if reconnects, lastError := BrokerStats(); !BrokerConnected() || reconnects != 0 || lastError != "" {
+		t.Errorf("Unexpected disabled broker stats: %d, %q", reconnects, lastError)
+	}
+
+	// Transport not connected to a broker, driven through its callbacks.
+	defer SetTransport(transport)
+	nt := &natsTransport{}
+	SetTransport(nt)
+	nc := &nats.Conn{}
+
+	// Connection callbacks count flaps.
+	nt.disconnected(nc)
+	nt.reconnected(nc)
+	nt.disconnected(nc)
+	nt.reconnected(nc)
+
+	if reconnects, lastError := BrokerStats(); reconnects != 2 || lastError != nats.ErrConnectionClosed.Error() {
+		t.Errorf("Unexpected stats: %d, %q", reconnects, lastError)
+	}
+
+	// Asynchronous errors are recorded too.
+	nt.asyncError(nil, nil, nats.ErrTimeout)
+	if _, lastError := BrokerStats(); lastError != nats.ErrTimeout.Error() {
+		t.Errorf("Expected last error %q, got %q", nats.ErrTimeout.Error(), lastError)
+	}
+}
+
+func TestWildcardSubscribe(t *testing.T) {
+	duct := OpenSession("wildcard", "1", true)
+	defer CloseSession("wildcard", "1", duct)
+	if err := Subscribe("user:7:*", "wildcard", "1", true); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	expect := func(uris ...string) {
+		t.Helper()
+		for _, uri := range uris {
+			select {
+			case p := <-duct:
+				if p.Uri != uri {
+					t.Errorf("Expected payload of %s, got %s", uri, p.Uri)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("Payload of %s not delivered", uri)
+			}
+		}
+		select {
+		case p := <-duct:
+			t.Errorf("Unexpected payload of %s", p.Uri)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	// Only URIs with prefix match.
+	for _, uri := range []string{"user:7:notifications", "user:8:messages", "user:7", "user:7:messages"} {
+		Publish(&testObject{uri: uri, data: "1"})
+	}
+	expect("user:7:notifications", "user:7:messages")
+
+	// Exact and wildcard subscriptions both deliver.
+	Subscribe("user:7:messages", "wildcard", "1", true)
+	Publish(&testObject{uri: "user:7:messages", data: "1"})
+	expect("user:7:messages", "user:7:messages")
+
+	// Unsubscribing wildcard keeps exact subscription.
+	Unsubscribe("user:7:*", "wildcard", "1", true)
+	Publish(&testObject{uri: "user:7:notifications", data: "1"})
+	Publish(&testObject{uri: "user:7:messages", data: "1"})
+	expect("user:7:messages")
+}
+
+func TestOnlineSessions(t *testing.T) {
+	if IsOnline("devices") || len(OnlineSessions("devices")) != 0 {
+		t.Fatalf("User online before opening sessions")
+	}
+	users := OnlineUserCount()
+
+	ducts := map[string]chan *Payload{}
+	for _, sessionId := range []string{"phone", "laptop"} {
+		ducts[sessionId] = OpenSession("devices", sessionId, true)
+	}
+
+	if !IsOnline("devices") || fmt.Sprint(OnlineSessions("devices")) != "[laptop phone]" {
+		t.Errorf("Unexpected sessions %v", OnlineSessions("devices"))
+	}
+	if n := OnlineUserCount(); n != users+1 {
+		t.Errorf("Expected %d online users, got %d", users+1, n)
+	}
+
+	// Concurrent with session manager.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			IsOnline("devices")
+			OnlineSessions("devices")
+			OnlineUserCount()
+		}
+	}()
+	CloseSession("devices", "phone", ducts["phone"])
+	wg.Wait()
+
+	if fmt.Sprint(OnlineSessions("devices")) != "[laptop]" {
+		t.Errorf("Unexpected sessions %v", OnlineSessions("devices"))
+	}
+
+	CloseSession("devices", "laptop", ducts["laptop"])
+	if IsOnline("devices") || OnlineUserCount() != users {
+		t.Errorf("User online after closing sessions")
+	}
 }
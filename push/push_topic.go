@@ -1,8 +1,14 @@
 package push
 
 import (
+	"context"
+	"github.com/sath33sh/infra/config"
 	"github.com/sath33sh/infra/log"
+	"github.com/sath33sh/infra/metrics"
+	"github.com/sath33sh/infra/util"
+	"hash/fnv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -10,12 +16,18 @@ import (
 type TopicCmdType int
 
 const (
-	SUBSCRIBE   TopicCmdType = iota // Subscribe to a topic.
-	UNSUBSCRIBE                     // Unsubscribe from a topic.
-	CLEAR                           // Unsubscribe from all subscribed topics.
-	STOP                            // Stop topic loop.
+	SUBSCRIBE       TopicCmdType = iota // Subscribe to a topic.
+	UNSUBSCRIBE                         // Unsubscribe from a topic.
+	CLEAR                               // Unsubscribe from all subscribed topics.
+	STOP                                // Stop topic loop.
+	LIST                                // List subscribed topics.
+	CLEANUP                             // Stop topics without subscribers.
+	SUBSCRIBE_MULTI                     // Subscribe to several topics.
 )
 
+// Interval of cleanup of topics without subscribers.
+var CleanupInterval = 24 * time.Hour
+
 // Topic command.
 type TopicCmd struct {
 	cmd        TopicCmdType   // Command.
@@ -24,6 +36,8 @@ type TopicCmd struct {
 	sessionId  string         // Session ID.
 	signalDone bool           // Signal command completion.
 	wg         sync.WaitGroup // Waitgroup for signaling completion.
+	uris       []string       // Topic URIs to subscribe by SUBSCRIBE_MULTI, or subscribed, returned by LIST.
+	err        error          // Command error, valid after completion is signaled.
 }
 
 // Topic.
@@ -31,17 +45,68 @@ type Topic struct {
 	sync.RWMutex                         // Mutex for accessing topic structure.
 	subscribers  map[SessionKey]*Session // Set of subscribers.
 	payloadDuct  chan *Payload           // Channel for sending payload to topic.
+	done         chan struct{}           // Closed when topic loop stops.
 	cmdDuct      chan *TopicCmd          // Channel for sending topic commands.
+	pending      atomic.Int64            // Subscribe commands forwarded, not yet processed.
+	delivered    atomic.Uint64           // Payloads delivered to subscribers.
+	dropped      atomic.Uint64           // Payloads dropped, subscriber not keeping up.
+	retained     *Payload                // Last payload delivered, if RetainLast. Topic loop only.
 }
 
-// Online topics.
-var topics struct {
+// Shard of online topics, managed by its own topic manager loop.
+type topicShard struct {
 	sync.RWMutex                                 // Mutex for accessing online topics.
 	topics        map[string]*Topic              // Set of topic pointers.
 	subscriptions map[SessionKey]map[string]bool // Topic subscriptions.
 	cmdDuct       chan *TopicCmd                 // Channel for sending commands to topic manager.
 }
 
+// Online topics, partitioned into shards by URI hash.
+var (
+	topicShards []*topicShard // Topic shards.
+	numTopics   atomic.Int64  // Number of online topics across shards.
+)
+
+// Number of subscriptions per session across shards, for enforcing MaxSubs.
+var subCounts struct {
+	sync.Mutex                    // Mutex for accessing counts.
+	counts     map[SessionKey]int // Map of session key to number of subscriptions.
+}
+
+// Reserve a subscription of session. Returns false if session reached MaxSubs.
+func reserveSub(skey SessionKey) bool {
+	subCounts.Lock()
+	defer subCounts.Unlock()
+
+	if MaxSubs > 0 && subCounts.counts[skey] >= MaxSubs {
+		return false
+	}
+	subCounts.counts[skey]++
+
+	return true
+}
+
+// Release n subscriptions of session.
+func releaseSubs(skey SessionKey, n int) {
+	subCounts.Lock()
+	if subCounts.counts[skey] -= n; subCounts.counts[skey] <= 0 {
+		delete(subCounts.counts, skey)
+	}
+	subCounts.Unlock()
+}
+
+// Get shard of topic URI.
+func shardOf(uri string) *topicShard {
+	if len(topicShards) == 1 {
+		return topicShards[0]
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(uri))
+
+	return topicShards[h.Sum32()%uint32(len(topicShards))]
+}
+
 func (t *Topic) Loop(uri string) {
 	log.Debugf(MODULE, "Enter topic loop %s", uri)
 
@@ -54,19 +119,40 @@ func (t *Topic) Loop(uri string) {
 			log.Debugf(MODULE, "Topic %s: command %d: session %s", uri, tc.cmd, skey)
 
 			switch tc.cmd {
-			case SUBSCRIBE:
+			case SUBSCRIBE, SUBSCRIBE_MULTI:
+				s := lookupSession(tc.userId, tc.sessionId)
+
+				// Take snapshot for new subscriber. Payloads queued before
+				// are delivered to present subscribers only: the snapshot
+				// reflects them.
+				var snapshot *Payload
+				if s != nil && hasSnapshotFunc() {
+					for n := len(t.payloadDuct); n > 0; n-- {
+						t.deliver(<-t.payloadDuct)
+					}
+					snapshot = buildSnapshot(uri)
+				}
+
 				// Lock topic.
 				t.Lock()
 
-				// Add subscriber.
-				if s := lookupSession(tc.userId, tc.sessionId); s != nil {
+				// Add subscriber, sending snapshot or else retained payload
+				// ahead of live payloads. Retained payload is older than the
+				// snapshot, so it is not sent along.
+				if s != nil {
 					t.subscribers[skey] = s
+					if snapshot != nil {
+						s.send(snapshot)
+					} else if t.retained != nil && !t.retained.Expired() {
+						s.send(t.retained)
+					}
 				} else {
 					log.Errorf("Session %s not found", skey)
 				}
 
 				// Unlock topic.
 				t.Unlock()
+				t.pending.Add(-1)
 
 				// Signal done.
 				if tc.signalDone {
@@ -79,17 +165,29 @@ func (t *Topic) Loop(uri string) {
 				// Lock topic.
 				t.Lock()
 
-				// Remove subscriber.
+				// Remove subscriber. Retained payload goes with the last one.
 				delete(t.subscribers, skey)
+				if len(t.subscribers) == 0 {
+					t.retained = nil
+				}
 
 				// Unlock topic.
 				t.Unlock()
 
+				// Signal done.
+				if tc.signalDone {
+					tc.wg.Done()
+				}
+
 			case STOP:
 				log.Debugf(MODULE, "Stop topic loop %s", uri)
 
-				// Close channels and return.
-				close(t.payloadDuct)
+				// Drop retained payload.
+				t.retained = nil
+
+				// Signal senders and return. Payload channel is left open, as
+				// publishers may still hold the topic.
+				close(t.done)
 				close(t.cmdDuct)
 
 				return
@@ -101,24 +199,46 @@ func (t *Topic) Loop(uri string) {
 		case payload := <-t.payloadDuct:
 			// Process data.
 			//log.Debugf(MODULE, "Topic %s, data %s", payload.Uri, payload.Data)
+			t.deliver(payload)
+		}
+	}
+}
+
+// Send payload to topic loop. Dropped if the topic has stopped.
+func (t *Topic) send(p *Payload) {
+	select {
+	case t.payloadDuct <- p:
+	case <-t.done:
+	}
+}
 
-			// Acquire read lock.
-			t.RLock()
+// Deliver payload to subscribers. Subscribers that do not keep up miss it,
+// rather than block others.
+func (t *Topic) deliver(payload *Payload) {
+	if RetainLast {
+		t.retained = payload
+	}
 
-			for _, s := range t.subscribers {
-				s.payloadDuct <- payload
-			}
+	// Acquire read lock.
+	t.RLock()
 
-			// Release read lock.
-			t.RUnlock()
+	for _, s := range t.subscribers {
+		if s.send(payload) {
+			t.delivered.Add(1)
+		} else {
+			t.dropped.Add(1)
 		}
 	}
+
+	// Release read lock.
+	t.RUnlock()
 }
 
 func startTopic(uri string) *Topic {
 	t := &Topic{
 		subscribers: make(map[SessionKey]*Session),
 		payloadDuct: make(chan *Payload, DATA_DUCT_BUFFER_MAX),
+		done:        make(chan struct{}),
 		cmdDuct:     make(chan *TopicCmd, CMD_DUCT_BUFFER_MAX),
 	}
 
@@ -127,126 +247,360 @@ func startTopic(uri string) *Topic {
 	return t
 }
 
-func topicMgrLoop() {
-	const CleanupTime = 24 * time.Hour
-
-	cleanupTicker := time.NewTicker(CleanupTime)
+func (ts *topicShard) mgrLoop() {
+	cleanupTicker := time.NewTicker(CleanupInterval)
+	defer cleanupTicker.Stop()
 
 	for {
 		select {
-		case tc := <-topics.cmdDuct:
+		case tc := <-ts.cmdDuct:
 			skey := SessionKey(tc.userId + ":" + tc.sessionId)
 
 			log.Debugf(MODULE, "Command %d: uri %s, session %s", tc.cmd, tc.uri, skey)
 
 			switch tc.cmd {
 			case SUBSCRIBE:
-				// Lock topics.
-				topics.Lock()
+				// Lock ts.
+				ts.Lock()
+
+				// Forward subscribe command to topic, if subscription is added.
+				// Topic signals done.
+				topic, err := ts.addSubscription(tc.uri, tc.userId, tc.sessionId)
+				if topic != nil {
+					topic.pending.Add(1)
+					topic.cmdDuct <- tc
+				}
 
-				// Start topic worker if it doesn't exist.
-				topic, exists := topics.topics[tc.uri]
-				if !exists {
-					topic = startTopic(tc.uri)
+				// Unlock ts.
+				ts.Unlock()
 
-					topics.topics[tc.uri] = topic
+				// Signal done, or failure.
+				if topic == nil && tc.signalDone {
+					tc.err = err
+					tc.wg.Done()
 				}
 
-				// Forward subscribe command to topic.
-				topic.cmdDuct <- tc
+			case SUBSCRIBE_MULTI:
+				// Lock ts.
+				ts.Lock()
 
-				// Update subscriptions.
-				if _, ok := topics.subscriptions[skey]; !ok {
-					topics.subscriptions[skey] = make(map[string]bool)
+				for _, uri := range tc.uris {
+					topic, err := ts.addSubscription(uri, tc.userId, tc.sessionId)
+					if err != nil && tc.err == nil {
+						tc.err = err
+					}
+
+					// Forward subscribe command to topic. Each topic signals done.
+					if topic != nil {
+						if tc.signalDone {
+							tc.wg.Add(1)
+						}
+						topic.pending.Add(1)
+						topic.cmdDuct <- tc
+					}
 				}
-				topics.subscriptions[skey][tc.uri] = true
 
-				// Unlock topics.
-				topics.Unlock()
+				// Unlock ts.
+				ts.Unlock()
+
+				// Signal done.
+				if tc.signalDone {
+					tc.wg.Done()
+				}
 
 			case UNSUBSCRIBE:
-				// Lock topics.
-				topics.Lock()
+				// Lock ts.
+				ts.Lock()
 
 				// Forward unsubscribe command to topic, if it exists.
-				if topic, exists := topics.topics[tc.uri]; exists {
-					// Forward unsubscribe command to topic.
+				if topic, exists := ts.topics[tc.uri]; exists {
+					// Forward unsubscribe command to topic. Topic signals done.
 					topic.cmdDuct <- tc
+				} else if tc.signalDone {
+					// No topic. Signal done.
+					tc.wg.Done()
 				}
 
 				// Update subscriptions.
-				if _, ok := topics.subscriptions[skey]; ok {
-					delete(topics.subscriptions[skey], tc.uri)
+				if _, ok := ts.subscriptions[skey]; ok {
+					if ts.subscriptions[skey][tc.uri] {
+						releaseSubs(skey, 1)
+					}
+					delete(ts.subscriptions[skey], tc.uri)
 
-					if len(topics.subscriptions[skey]) == 0 {
-						delete(topics.subscriptions, skey)
+					if len(ts.subscriptions[skey]) == 0 {
+						delete(ts.subscriptions, skey)
 					}
 				}
 
-				// Unlock topics.
-				topics.Unlock()
+				// Unlock ts.
+				ts.Unlock()
 
 			case CLEAR:
-				// Lock topics.
-				topics.Lock()
-
-				for uri, _ := range topics.subscriptions[skey] {
-					if topic, exists := topics.topics[uri]; exists {
-						// Send unsubscribe command to topic.
+				// Lock ts.
+				ts.Lock()
+
+				releaseSubs(skey, len(ts.subscriptions[skey]))
+				for uri, _ := range ts.subscriptions[skey] {
+					if topic, exists := ts.topics[uri]; exists {
+						// Send unsubscribe command to topic. Each topic signals done.
+						if tc.signalDone {
+							tc.wg.Add(1)
+						}
 						topic.cmdDuct <- tc
 					}
 
-					delete(topics.subscriptions[skey], uri)
+					delete(ts.subscriptions[skey], uri)
 				}
 
 				// Clear session.
-				delete(topics.subscriptions, skey)
+				delete(ts.subscriptions, skey)
+
+				// Unlock ts.
+				ts.Unlock()
+
+				// Signal done.
+				if tc.signalDone {
+					tc.wg.Done()
+				}
+
+			case STOP:
+				// Lock ts.
+				ts.Lock()
+
+				// Stop ts.
+				for uri, topic := range ts.topics {
+					topic.cmdDuct <- &TopicCmd{
+						cmd: STOP,
+					}
+					delete(ts.topics, uri)
+					removeWildcardTopic(uri)
+					unsubscribeTopic(uri)
+					metrics.Set(METRIC_TOPICS, numTopics.Add(-1))
+				}
+				ts.subscriptions = make(map[SessionKey]map[string]bool)
+
+				// Unlock ts.
+				ts.Unlock()
+
+				log.Debugf(MODULE, "Stop topic manager")
+
+				// Signal done.
+				tc.wg.Done()
+				return
+
+			case LIST:
+				// Lock ts.
+				ts.RLock()
 
-				// Unlock topics.
-				topics.Unlock()
+				for uri := range ts.subscriptions[skey] {
+					tc.uris = append(tc.uris, uri)
+				}
+
+				// Unlock ts.
+				ts.RUnlock()
+
+				// Signal done.
+				tc.wg.Done()
+
+			case CLEANUP:
+				ts.cleanup()
+
+				// Signal done.
+				tc.wg.Done()
 
 			default:
 				log.Errorf("Invalid command %d", tc.cmd)
 			}
 
 		case <-cleanupTicker.C:
-			// Lock topics.
-			topics.Lock()
+			ts.cleanup()
+		}
+	}
+}
 
-			for uri, topic := range topics.topics {
-				topic.RLock()
-				if len(topic.subscribers) == 0 {
-					// No more subscribers. Stop the topic.
-					topic.cmdDuct <- &TopicCmd{
-						cmd: STOP,
-					}
+// Add subscription of session to topic, starting the topic if it doesn't exist.
+// Returns the topic to forward the subscribe command to, or nil if the session
+// is not online, already subscribed or a limit is reached, with
+// util.ErrResourceLimit. Sessions not online are not recorded, so that they are
+// not taken as subscribed once online. Shard must be locked.
+func (ts *topicShard) addSubscription(uri, userId, sessionId string) (*Topic, error) {
+	skey := SessionKey(userId + ":" + sessionId)
+
+	if ts.subscriptions[skey][uri] {
+		// Already subscribed. Nothing to forward.
+		log.Debugf(MODULE, "Session %s already subscribed to %s", skey, uri)
+		return nil, nil
+	}
+
+	if lookupSession(userId, sessionId) == nil {
+		// Not online. Nothing to subscribe.
+		log.Errorf("Session %s not found", skey)
+		return nil, nil
+	}
+
+	if !reserveSub(skey) {
+		// Subscription limit reached. Reject subscription.
+		log.Errorf("Subscription limit %d reached: session %s, uri %s", MaxSubs, skey, uri)
+		return nil, util.ErrResourceLimit
+	}
+
+	// Start topic worker if it doesn't exist.
+	topic, exists := ts.topics[uri]
+	if !exists {
+		if n := numTopics.Add(1); MaxTopics > 0 && n > int64(MaxTopics) {
+			// Topic limit reached. Reject new topic.
+			numTopics.Add(-1)
+			releaseSubs(skey, 1)
 
-					// Delete topic.
-					delete(topics.topics, uri)
+			log.Errorf("Topic limit %d reached: session %s, uri %s", MaxTopics, skey, uri)
+			return nil, util.ErrResourceLimit
+		}
+
+		topic = startTopic(uri)
+
+		ts.topics[uri] = topic
+		addWildcardTopic(uri, topic)
+		subscribeTopic(uri)
+		metrics.Set(METRIC_TOPICS, numTopics.Load())
+	}
+
+	// Update subscriptions.
+	if _, ok := ts.subscriptions[skey]; !ok {
+		ts.subscriptions[skey] = make(map[string]bool)
+	}
+	ts.subscriptions[skey][uri] = true
+
+	return topic, nil
+}
+
+// Stop topics without subscribers. Topics with commands queued, e.g. a
+// subscription not yet added, are left to the next cleanup. Subscriptions to
+// stopped topics, e.g. of sessions closed before the topic added them, are
+// dropped.
+func (ts *topicShard) cleanup() {
+	// Lock ts.
+	ts.Lock()
+
+	for uri, topic := range ts.topics {
+		if topic.pending.Load() > 0 || len(topic.cmdDuct) > 0 {
+			continue
+		}
+
+		topic.RLock()
+		if len(topic.subscribers) == 0 {
+			// No more subscribers. Stop the topic.
+			topic.cmdDuct <- &TopicCmd{
+				cmd: STOP,
+			}
+
+			// Delete topic.
+			delete(ts.topics, uri)
+			removeWildcardTopic(uri)
+			unsubscribeTopic(uri)
+			metrics.Set(METRIC_TOPICS, numTopics.Add(-1))
+
+			// Drop subscriptions.
+			for skey, uris := range ts.subscriptions {
+				if uris[uri] {
+					releaseSubs(skey, 1)
+					delete(uris, uri)
+					if len(uris) == 0 {
+						delete(ts.subscriptions, skey)
+					}
 				}
-				topic.RUnlock()
 			}
+		}
+		topic.RUnlock()
+	}
 
-			log.Debugf(MODULE, "Cleanup: %d active topics", len(topics.topics))
+	log.Debugf(MODULE, "Cleanup: %d active topics", len(ts.topics))
 
-			// Unlock topics.
-			topics.Unlock()
+	// Unlock ts.
+	ts.Unlock()
+}
+
+// Start topic manager with given number of shards. Topics are partitioned
+// across shards by URI, each managed by its own loop, so that commands of
+// different topics are processed in parallel.
+func startTopicMgr(numShards int) {
+	if numShards < 1 {
+		numShards = 1
+	}
+
+	// Read cleanup interval.
+	if secs := config.Base.GetInt(MODULE, "cleanup-interval-seconds", int(CleanupInterval/time.Second)); secs > 0 {
+		CleanupInterval = time.Duration(secs) * time.Second
+	} else {
+		log.Errorf("Invalid cleanup interval %d seconds: using %v", secs, CleanupInterval)
+	}
+
+	// Reset topic count, e.g. on restart after stop.
+	numTopics.Store(0)
+
+	// Initialize subscription counts.
+	subCounts.Lock()
+	subCounts.counts = make(map[SessionKey]int)
+	subCounts.Unlock()
+
+	// Initialize wildcard topics.
+	wildcards.Lock()
+	wildcards.topics = make(map[string]*Topic)
+	wildcards.Unlock()
+
+	// Initialize shards.
+	topicShards = make([]*topicShard, numShards)
+	for i := range topicShards {
+		topicShards[i] = &topicShard{
+			topics:        make(map[string]*Topic),
+			subscriptions: make(map[SessionKey]map[string]bool),
+			cmdDuct:       make(chan *TopicCmd, CMD_DUCT_BUFFER_MAX),
 		}
+
+		// Start topic manager loop.
+		go topicShards[i].mgrLoop()
+	}
+}
+
+// Stop topics without subscribers now, rather than at the next cleanup
+// interval. Returns after all topic manager shards are swept.
+func TriggerCleanup() {
+	cmd := &TopicCmd{
+		cmd:        CLEANUP,
+		signalDone: true,
 	}
+	cmd.wg.Add(len(topicShards))
+
+	for _, ts := range topicShards {
+		ts.cmdDuct <- cmd
+	}
+
+	cmd.wg.Wait()
 }
 
-// Start topic manager.
-func startTopicMgr() {
-	// Initialize sessions.
-	topics.topics = make(map[string]*Topic)
-	topics.subscriptions = make(map[SessionKey]map[string]bool)
-	topics.cmdDuct = make(chan *TopicCmd, CMD_DUCT_BUFFER_MAX)
+// Stop topic manager and all topics.
+func stopTopicMgr(ctx context.Context) error {
+	cmd := &TopicCmd{
+		cmd:        STOP,
+		signalDone: true,
+	}
+	cmd.wg.Add(len(topicShards))
 
-	// Start topic manager loop.
-	go topicMgrLoop()
+	for _, ts := range topicShards {
+		select {
+		case ts.cmdDuct <- cmd:
+		case <-ctx.Done():
+			return util.ErrTimeout
+		}
+	}
+
+	return waitCtx(ctx, &cmd.wg)
 }
 
-func Subscribe(uri string, userId string, sessionId string, wait bool) {
+// Subscribe session to topic. A URI ending with WILDCARD subscribes to all topics
+// with its prefix. If wait is set, returns after the subscription is complete,
+// with util.ErrResourceLimit if the topic limit prevented creating the topic.
+func Subscribe(uri string, userId string, sessionId string, wait bool) error {
 	cmd := &TopicCmd{
 		cmd:       SUBSCRIBE,
 		uri:       uri,
@@ -260,46 +614,192 @@ func Subscribe(uri string, userId string, sessionId string, wait bool) {
 	}
 
 	// Send subscribe command to topic manager.
-	topics.cmdDuct <- cmd
+	shardOf(uri).cmdDuct <- cmd
 
 	if wait {
 		// Wait for command completion.
 		cmd.wg.Wait()
 	}
+
+	return cmd.err
 }
 
-func Unsubscribe(uri string, userId string, sessionId string) {
-	// Send unsubscribe command to topic manager.
-	topics.cmdDuct <- &TopicCmd{
+// Subscribe session to several topics, with one command per topic manager shard
+// rather than per topic. If wait is set, returns after all subscriptions are
+// complete, with util.ErrResourceLimit if a limit prevented any of them. Other
+// subscriptions are made regardless.
+func SubscribeMulti(uris []string, userId, sessionId string, wait bool) error {
+	// Group URIs by shard.
+	shardUris := make(map[*topicShard][]string)
+	for _, uri := range uris {
+		ts := shardOf(uri)
+		shardUris[ts] = append(shardUris[ts], uri)
+	}
+
+	// Send subscribe command to each shard of topic manager.
+	cmds := make([]*TopicCmd, 0, len(shardUris))
+	for ts, uris := range shardUris {
+		cmd := &TopicCmd{
+			cmd:       SUBSCRIBE_MULTI,
+			uris:      uris,
+			userId:    userId,
+			sessionId: sessionId,
+		}
+
+		if wait {
+			cmd.signalDone = true
+			cmd.wg.Add(1)
+		}
+
+		ts.cmdDuct <- cmd
+		cmds = append(cmds, cmd)
+	}
+
+	if !wait {
+		return nil
+	}
+
+	// Wait for command completion.
+	var err error
+	for _, cmd := range cmds {
+		cmd.wg.Wait()
+		if err == nil {
+			err = cmd.err
+		}
+	}
+
+	return err
+}
+
+// Unsubscribe session from topic. A wildcard URI removes the wildcard
+// subscription only, not subscriptions to topics it matches. If wait is set,
+// returns after the topic has removed the session, so that no payload reaches
+// the session afterwards.
+func Unsubscribe(uri string, userId string, sessionId string, wait bool) {
+	cmd := &TopicCmd{
 		cmd:       UNSUBSCRIBE,
 		uri:       uri,
 		userId:    userId,
 		sessionId: sessionId,
 	}
+
+	if wait {
+		cmd.signalDone = true
+		cmd.wg.Add(1)
+	}
+
+	// Send unsubscribe command to topic manager.
+	shardOf(uri).cmdDuct <- cmd
+
+	if wait {
+		// Wait for command completion.
+		cmd.wg.Wait()
+	}
 }
 
-func unsubscribeAll(userId string, sessionId string) {
-	// Send clear command to topic manager.
-	topics.cmdDuct <- &TopicCmd{
+// Subscribe target session of user to all topics subscribed by source session,
+// e.g. when moving a session to a new device. Target session must be open.
+func CopySubscriptions(userId, fromSessionId, toSessionId string) error {
+	if lookupSession(userId, toSessionId) == nil {
+		log.Errorf("Session %s:%s not found", userId, toSessionId)
+		return util.ErrInvalidSession
+	}
+
+	// Get subscriptions of source session from topic manager.
+	uris := listSubscriptions(userId, fromSessionId)
+
+	// Subscribe target session.
+	for _, uri := range uris {
+		if err := Subscribe(uri, userId, toSessionId, true); err != nil {
+			return err
+		}
+	}
+
+	log.Debugf(MODULE, "Copied %d subscriptions of %s:%s to session %s", len(uris), userId, fromSessionId, toSessionId)
+
+	return nil
+}
+
+// List topics subscribed by session.
+func listSubscriptions(userId string, sessionId string) (uris []string) {
+	// Each shard lists its own topics.
+	cmds := make([]*TopicCmd, len(topicShards))
+	for i, ts := range topicShards {
+		cmds[i] = &TopicCmd{
+			cmd:        LIST,
+			userId:     userId,
+			sessionId:  sessionId,
+			signalDone: true,
+		}
+		cmds[i].wg.Add(1)
+		ts.cmdDuct <- cmds[i]
+	}
+
+	for _, cmd := range cmds {
+		cmd.wg.Wait()
+		uris = append(uris, cmd.uris...)
+	}
+
+	return uris
+}
+
+// Unsubscribe session from all topics. If wait is set, returns after all topics
+// have removed the session, so that they no longer send to its duct.
+func unsubscribeAll(userId string, sessionId string, wait bool) {
+	cmd := &TopicCmd{
 		cmd:       CLEAR,
 		userId:    userId,
 		sessionId: sessionId,
 	}
+
+	if wait {
+		cmd.signalDone = true
+		cmd.wg.Add(len(topicShards))
+	}
+
+	// Send clear command to all shards of topic manager.
+	for _, ts := range topicShards {
+		ts.cmdDuct <- cmd
+	}
+
+	if wait {
+		// Wait for command completion.
+		cmd.wg.Wait()
+	}
 }
 
 func processEgress(p *Payload) error {
-	if !CasMode {
+	return egressTopics(p, true, true)
+}
+
+// Send payload to topic of its URI, if exact, and to wildcard topics matching
+// the URI, if wildcard.
+func egressTopics(p *Payload, exact, wildcard bool) error {
+	if !CasMode || kindRoute(p.Kind) == ROUTE_BROKER {
 		return nil
 	}
 
-	// Get topic.
-	topics.RLock()
-	topic, ok := topics.topics[p.Uri]
-	topics.RUnlock()
+	// Get topic, and wildcard topics matching URI.
+	var topics []*Topic
+	if wildcard {
+		topics = matchWildcardTopics(p.Uri)
+	}
+	if exact && !isWildcard(p.Uri) {
+		ts := shardOf(p.Uri)
+		ts.RLock()
+		if topic, ok := ts.topics[p.Uri]; ok {
+			topics = append(topics, topic)
+		}
+		ts.RUnlock()
+	}
 
-	if ok {
-		// Topic exists. Send to topic worker.
-		topic.payloadDuct <- p
+	if len(topics) > 0 {
+		// Topics exist. Send to topic workers.
+		p.stamp()
+		for _, topic := range topics {
+			topic.send(p)
+		}
+		metrics.Add(METRIC_MESSAGES, int64(len(topics)))
 	}
 
 	return nil
@@ -312,7 +812,7 @@ func Publish(obj Pushable) error {
 		return err
 	}
 
-	if DisableBroker {
+	if DisableBroker || kindRoute(p.Kind) == ROUTE_LOCAL {
 		return processEgress(p)
 	} else {
 		return doPublishToBroker(p)
@@ -0,0 +1,357 @@
+package push
+
+import (
+	"context"
+	"github.com/sath33sh/infra/config"
+	"github.com/sath33sh/infra/log"
+	"github.com/sath33sh/infra/util"
+	"strings"
+	"sync"
+)
+
+// Transport carries payloads between nodes through a broker. Payloads are
+// published to subjects derived from their kind, or kind and URI (see
+// SubjectPerTopic), and every node subscribed to a subject receives them for
+// delivery to its local subscribers.
+type Transport interface {
+	Publish(subject string, p *Payload) error                  // Publish payload to subject.
+	Subscribe(subjects []string, handler func(*Payload)) error // Receive payloads of subjects.
+	Close() error                                              // Flush pending payloads and close.
+}
+
+// Transport names.
+const (
+	TRANSPORT_NATS   = "nats"   // NATS broker. Default.
+	TRANSPORT_MEMORY = "memory" // In-process broker, for tests and single node deployments.
+	TRANSPORT_NONE   = "none"   // No broker. Publish delivers to local subscribers only.
+)
+
+// Variables.
+var (
+	transport     Transport // Broker transport.
+	subjectPrefix string    // Subject prefix, including separator.
+)
+
+// Initialize broker transport selected by config.
+func initTransport() (err error) {
+	// Read subject prefix from config.
+	if subjectPrefix, err = validateSubjectPrefix(config.Base.GetString("push-nats", "subject-prefix", "")); err != nil {
+		log.Errorf("Invalid subject prefix: %v", err)
+		return err
+	}
+	if subjectPrefix != "" {
+		log.Infof("Push broker subject prefix %s", subjectPrefix)
+	}
+
+	// Read whether subjects are per topic.
+	SubjectPerTopic = config.Base.GetBool("push-nats", "subject-per-topic", false)
+
+	name := config.Base.GetString(MODULE, "transport", TRANSPORT_NATS)
+	if config.Base.GetBool("push-nats", "disable", false) {
+		name = TRANSPORT_NONE
+	}
+
+	switch name {
+	case TRANSPORT_NATS:
+		var t *natsTransport
+		if t, err = newNatsTransport(); err != nil {
+			return err
+		}
+		SetTransport(t)
+	case TRANSPORT_MEMORY:
+		SetTransport(NewMemTransport())
+	case TRANSPORT_NONE:
+		SetTransport(nil)
+	default:
+		log.Errorf("Invalid push transport %s", name)
+		return util.ErrInvalidInput
+	}
+
+	log.Infof("Push transport %s", name)
+
+	return nil
+}
+
+// Set broker transport, e.g. for alternative brokers. Nil transport disables the broker.
+func SetTransport(t Transport) {
+	transport = t
+	DisableBroker = t == nil
+}
+
+// Validate subject prefix and append separator.
+//
+// The prefix isolates environments (e.g. "prod", "staging") sharing a broker:
+// every subject published or subscribed is prefixed, e.g. "prod.<kind>". A prefix
+// is one or more tokens separated by '.', and may not contain wildcards. Wildcard
+// subscriptions made outside this package, e.g. for monitoring, must include the
+// prefix: "prod.>" receives all payloads of prod, whereas ">" receives all
+// environments.
+func validateSubjectPrefix(prefix string) (string, error) {
+	prefix = strings.TrimSuffix(prefix, ".")
+	if prefix == "" {
+		return "", nil
+	}
+
+	for _, token := range strings.Split(prefix, ".") {
+		if token == "" {
+			return "", util.ErrInvalidInput
+		}
+		for _, c := range token {
+			if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') &&
+				c != '-' && c != '_' {
+				return "", util.ErrInvalidInput
+			}
+		}
+	}
+
+	return prefix + ".", nil
+}
+
+// Get broker subject of payload kind.
+func brokerSubject(kind string) string {
+	return subjectPrefix + kind
+}
+
+// Decompress payload received from broker. Returns nil if invalid.
+func payloadFromBroker(p *Payload) *Payload {
+	// log.Debugf(MODULE, "Rx from broker: Kind %s, Uri %s, Op %s", p.Kind, p.Uri, p.Op)
+
+	dp, err := decompressPayload(p)
+	if err != nil {
+		log.Errorf("Invalid payload from broker: kind %s, uri %s: %v", p.Kind, p.Uri, err)
+		return nil
+	}
+
+	return dp
+}
+
+func processPayloadFromBroker(p *Payload) {
+	if p = payloadFromBroker(p); p != nil {
+		processEgress(p)
+	}
+}
+
+// Subscribe to payloads of kinds from broker. With SubjectPerTopic, payloads
+// of topics hosted by this node only are received: topics subscribe when they
+// start, so call this at startup, before sessions subscribe.
+func SubscribeFromBroker(kinds []string) {
+	if DisableBroker {
+		return
+	}
+
+	if subjectPerTopic() {
+		addTopicKinds(kinds)
+		return
+	}
+
+	subjects := make([]string, len(kinds))
+	for i, kind := range kinds {
+		subjects[i] = brokerSubject(kind)
+		if SubjectPerTopic {
+			// Transport cannot unsubscribe topics. Receive all topics of kind.
+			subjects[i] += ".*"
+		}
+	}
+	if SubjectPerTopic {
+		log.Errorf("Push transport cannot unsubscribe: subscribing to all topics of %v", kinds)
+	}
+
+	if err := transport.Subscribe(subjects, processPayloadFromBroker); err != nil {
+		log.Errorf("Failed to subscribe to %v: %v", subjects, err)
+	}
+}
+
+func doPublishToBroker(p *Payload) error {
+	// Compress large payloads.
+	cp, err := compressPayload(p)
+	if err != nil {
+		return err
+	}
+
+	if SubjectPerTopic {
+		return transport.Publish(topicSubject(p.Kind, p.Uri), cp)
+	}
+
+	return transport.Publish(brokerSubject(p.Kind), cp)
+}
+
+func PublishToBroker(p *Payload) error {
+	if DisableBroker {
+		// Broker is disabled. Mock success.
+		return nil
+	}
+
+	return doPublishToBroker(p)
+}
+
+// Get broker health. Returns util.ErrNetAccess if the broker is unreachable.
+// Transports without status report are healthy.
+func BrokerStatus() error {
+	if DisableBroker {
+		return nil
+	}
+
+	if s, ok := transport.(interface{ Status() error }); ok {
+		return s.Status()
+	}
+
+	return nil
+}
+
+// Get number of messages dropped by broker subscriptions, as slow consumers.
+// Transports without drop report drop none.
+func BrokerDropped() int64 {
+	if DisableBroker {
+		return 0
+	}
+
+	if d, ok := transport.(interface{ Dropped() int64 }); ok {
+		return d.Dropped()
+	}
+
+	return 0
+}
+
+// Check whether connected to broker, e.g. for health checks. A disabled broker,
+// or transport without status report, is connected.
+func BrokerConnected() bool {
+	return BrokerStatus() == nil
+}
+
+// Get number of reconnects to broker and last connection error, if any, e.g.
+// to report broker flaps. Transports without connection report have none.
+func BrokerStats() (reconnects uint64, lastError string) {
+	if DisableBroker {
+		return 0, ""
+	}
+
+	if s, ok := transport.(interface{ Stats() (uint64, string) }); ok {
+		return s.Stats()
+	}
+
+	return 0, ""
+}
+
+// Close broker transport.
+func closeTransport(ctx context.Context) error {
+	if DisableBroker {
+		return nil
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- transport.Close()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		log.Errorf("Push broker close timed out")
+		return util.ErrTimeout
+	}
+}
+
+// In-memory transport. Payloads are delivered synchronously to handlers
+// subscribed in the same process, encoded and decoded as by a broker, so that
+// each handler receives its own copy. Subjects may contain NATS wildcards: "*"
+// matches a token, and a trailing ">" the remaining tokens.
+type MemTransport struct {
+	sync.RWMutex                             // Mutex for accessing handlers.
+	handlers     map[string][]func(*Payload) // Handlers by subject.
+	closed       bool                        // Transport is closed.
+}
+
+func NewMemTransport() *MemTransport {
+	return &MemTransport{handlers: make(map[string][]func(*Payload))}
+}
+
+func (m *MemTransport) Publish(subject string, p *Payload) error {
+	m.RLock()
+	var handlers []func(*Payload)
+	for pattern, hs := range m.handlers {
+		if matchSubject(pattern, subject) {
+			handlers = append(handlers, hs...)
+		}
+	}
+	closed := m.closed
+	m.RUnlock()
+
+	if closed {
+		return util.ErrNetAccess
+	}
+
+	// Encode.
+	data, err := encodeBrokerMsg(p)
+	if err != nil {
+		log.Errorf("Failed to encode payload: Kind %s, Uri %s: %v", p.Kind, p.Uri, err)
+		return util.ErrInvalidObject
+	}
+
+	for _, handler := range handlers {
+		// Decode copy for handler.
+		hp, err := decodeBrokerMsg(data)
+		if err != nil {
+			log.Errorf("Invalid message on %s: %v", subject, err)
+			return err
+		}
+
+		handler(hp)
+	}
+
+	return nil
+}
+
+func (m *MemTransport) Subscribe(subjects []string, handler func(*Payload)) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.closed {
+		return util.ErrNetAccess
+	}
+
+	for _, subject := range subjects {
+		m.handlers[subject] = append(m.handlers[subject], handler)
+	}
+
+	return nil
+}
+
+// Remove handlers of subjects.
+func (m *MemTransport) Unsubscribe(subjects []string) error {
+	m.Lock()
+	for _, subject := range subjects {
+		delete(m.handlers, subject)
+	}
+	m.Unlock()
+
+	return nil
+}
+
+// Check whether subject matches subscription pattern, with NATS wildcards.
+func matchSubject(pattern, subject string) bool {
+	if !strings.ContainsAny(pattern, "*>") {
+		return pattern == subject
+	}
+
+	pt, st := strings.Split(pattern, "."), strings.Split(subject, ".")
+	for i, token := range pt {
+		if token == ">" && i == len(pt)-1 {
+			return len(st) > i
+		}
+		if i >= len(st) || token != "*" && token != st[i] {
+			return false
+		}
+	}
+
+	return len(pt) == len(st)
+}
+
+func (m *MemTransport) Close() error {
+	m.Lock()
+	m.closed = true
+	m.handlers = make(map[string][]func(*Payload))
+	m.Unlock()
+
+	return nil
+}
@@ -0,0 +1,61 @@
+package push
+
+import (
+	"strings"
+	"sync"
+)
+
+// Wildcard ending URIs of prefix subscriptions. E.g. a session subscribed to
+// "user:123:*" gets payloads of "user:123:notifications", "user:123:messages",
+// etc. Payloads keep their own URI. A session subscribed to both a wildcard
+// and a matching URI gets such payloads twice.
+const WILDCARD = "*"
+
+// Check whether URI is a wildcard.
+func isWildcard(uri string) bool {
+	return strings.HasSuffix(uri, WILDCARD)
+}
+
+// Wildcard topics. Wildcard topics are managed by topic manager shards like
+// other topics, and are also indexed here by prefix, for matching payloads.
+var wildcards struct {
+	sync.RWMutex                   // Mutex for accessing wildcard topics.
+	topics       map[string]*Topic // Map of URI prefix to wildcard topic.
+}
+
+// Index wildcard topic, if URI is a wildcard.
+func addWildcardTopic(uri string, t *Topic) {
+	if !isWildcard(uri) {
+		return
+	}
+
+	wildcards.Lock()
+	wildcards.topics[strings.TrimSuffix(uri, WILDCARD)] = t
+	wildcards.Unlock()
+}
+
+// Remove wildcard topic from index, if URI is a wildcard.
+func removeWildcardTopic(uri string) {
+	if !isWildcard(uri) {
+		return
+	}
+
+	wildcards.Lock()
+	delete(wildcards.topics, strings.TrimSuffix(uri, WILDCARD))
+	wildcards.Unlock()
+}
+
+// Get wildcard topics matching URI.
+func matchWildcardTopics(uri string) []*Topic {
+	var matches []*Topic
+
+	wildcards.RLock()
+	for prefix, t := range wildcards.topics {
+		if strings.HasPrefix(uri, prefix) {
+			matches = append(matches, t)
+		}
+	}
+	wildcards.RUnlock()
+
+	return matches
+}
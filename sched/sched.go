@@ -0,0 +1,208 @@
+// This package runs periodic background jobs, e.g. cleanup and aggregation.
+//
+// Each job runs every interval in its own goroutine. A run that is still in
+// progress when the next tick fires is not overlapped: the tick is skipped and
+// counted. Panics in jobs are recovered and logged, so a failing job does not
+// take down the service or stop later runs. Stop cancels the context passed to
+// jobs and waits for runs in progress; the service package calls it during
+// shutdown.
+package sched
+
+import (
+	"context"
+	"github.com/sath33sh/infra/log"
+	"github.com/sath33sh/infra/metrics"
+	"github.com/sath33sh/infra/util"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Module name.
+const MODULE = "sched"
+
+// Metric names.
+const (
+	METRIC_RUNS     = "sched_job_runs_total"       // Job runs, by job.
+	METRIC_SKIPPED  = "sched_job_skipped_total"    // Runs skipped due to overlap, by job.
+	METRIC_PANICS   = "sched_job_panics_total"     // Runs that panicked, by job.
+	METRIC_DURATION = "sched_job_duration_seconds" // Run duration, by job.
+)
+
+// Scheduled job.
+type job struct {
+	name     string                // Job name.
+	interval time.Duration         // Run interval.
+	fn       func(context.Context) // Job function.
+	running  atomic.Bool           // Run in progress.
+	runs     atomic.Uint64         // Completed runs.
+	skipped  atomic.Uint64         // Runs skipped due to overlap.
+	panics   atomic.Uint64         // Runs that panicked.
+	lastRun  atomic.Int64          // Start of last run, in Unix nanoseconds.
+	wg       *sync.WaitGroup       // Wait group of job loops and runs.
+}
+
+// Job info.
+type JobInfo struct {
+	Name     string        `json:"name"`     // Job name.
+	Interval time.Duration `json:"interval"` // Run interval.
+	Running  bool          `json:"running"`  // Run in progress.
+	Runs     uint64        `json:"runs"`     // Completed runs.
+	Skipped  uint64        `json:"skipped"`  // Runs skipped due to overlap.
+	Panics   uint64        `json:"panics"`   // Runs that panicked.
+	LastRun  time.Time     `json:"lastRun"`  // Start of last run. Zero if never run.
+}
+
+// Scheduler state.
+var jobs struct {
+	sync.Mutex                    // Mutex for accessing jobs.
+	list       map[string]*job    // Jobs, by name.
+	ctx        context.Context    // Context passed to jobs, cancelled by Stop.
+	cancel     context.CancelFunc // Cancel function of ctx.
+	wg         *sync.WaitGroup    // Job loops and runs in progress.
+}
+
+// Schedule fn to run every interval, starting one interval from now. The
+// context passed to fn is cancelled on Stop; long running jobs should return
+// when it is done. Job names must be unique.
+func Schedule(name string, interval time.Duration, fn func(context.Context)) error {
+	if name == "" || interval <= 0 || fn == nil {
+		log.Errorf("Invalid job %s: interval %v", name, interval)
+		return util.ErrInvalidInput
+	}
+
+	jobs.Lock()
+	defer jobs.Unlock()
+
+	if _, ok := jobs.list[name]; ok {
+		log.Errorf("Job %s already scheduled", name)
+		return util.ErrAlreadyExists
+	}
+
+	if jobs.list == nil {
+		jobs.list = make(map[string]*job)
+		jobs.ctx, jobs.cancel = context.WithCancel(context.Background())
+		jobs.wg = new(sync.WaitGroup)
+	}
+
+	j := &job{name: name, interval: interval, fn: fn, wg: jobs.wg}
+	jobs.list[name] = j
+	j.wg.Add(1)
+	go j.loop(jobs.ctx)
+
+	log.Debugf(MODULE, "Scheduled job %s every %v", name, interval)
+
+	return nil
+}
+
+// Job loop. Fires a run every interval until ctx is done.
+func (j *job) loop(ctx context.Context) {
+	defer j.wg.Done()
+
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			j.tick(ctx)
+		}
+	}
+}
+
+// Start a run, unless the previous run is still in progress.
+func (j *job) tick(ctx context.Context) {
+	if !j.running.CompareAndSwap(false, true) {
+		j.skipped.Add(1)
+		metrics.Add(METRIC_SKIPPED, 1, "job", j.name)
+		log.Debugf(MODULE, "Job %s still running, skipped run", j.name)
+		return
+	}
+
+	// The loop holds a count on the wait group, so Add does not race with Wait.
+	j.wg.Add(1)
+	go func() {
+		defer j.wg.Done()
+		defer j.running.Store(false)
+		j.run(ctx)
+	}()
+}
+
+// Run job function, recovering from panics.
+func (j *job) run(ctx context.Context) {
+	start := time.Now()
+	j.lastRun.Store(start.UnixNano())
+
+	defer func() {
+		j.runs.Add(1)
+		metrics.Add(METRIC_RUNS, 1, "job", j.name)
+		metrics.Since(METRIC_DURATION, start, "job", j.name)
+
+		if r := recover(); r != nil {
+			j.panics.Add(1)
+			metrics.Add(METRIC_PANICS, 1, "job", j.name)
+			log.Errorf("Job %s panicked: %v\n%s", j.name, r, debug.Stack())
+		}
+	}()
+
+	j.fn(ctx)
+}
+
+// Info of scheduled jobs, sorted by name.
+func Jobs() []JobInfo {
+	jobs.Lock()
+	defer jobs.Unlock()
+
+	list := make([]JobInfo, 0, len(jobs.list))
+	for _, j := range jobs.list {
+		info := JobInfo{
+			Name:     j.name,
+			Interval: j.interval,
+			Running:  j.running.Load(),
+			Runs:     j.runs.Load(),
+			Skipped:  j.skipped.Load(),
+			Panics:   j.panics.Load(),
+		}
+		if ns := j.lastRun.Load(); ns != 0 {
+			info.LastRun = time.Unix(0, ns)
+		}
+		list = append(list, info)
+	}
+
+	sort.Slice(list, func(i, k int) bool { return list[i].Name < list[k].Name })
+
+	return list
+}
+
+// Stop all jobs: cancel their context and wait for runs in progress within the
+// deadline of ctx. Returns util.ErrTimeout if runs are still in progress at the
+// deadline. Jobs may be scheduled again after Stop.
+func Stop(ctx context.Context) error {
+	jobs.Lock()
+	if jobs.list == nil {
+		jobs.Unlock()
+		return nil
+	}
+	jobs.cancel()
+	wg := jobs.wg
+	jobs.list = nil
+	jobs.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		log.Errorf("Timed out waiting for jobs: %v", ctx.Err())
+		return util.ErrTimeout
+	}
+}
@@ -0,0 +1,170 @@
+package sched
+
+import (
+	"context"
+	"github.com/sath33sh/infra/log"
+	"github.com/sath33sh/infra/util"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Info of scheduled job by name.
+func jobInfo(t *testing.T, name string) JobInfo {
+	for _, info := range Jobs() {
+		if info.Name == name {
+			return info
+		}
+	}
+	t.Fatalf("Job %s not scheduled", name)
+	return JobInfo{}
+}
+
+func TestScheduleInterval(t *testing.T) {
+	defer Stop(context.Background())
+
+	var runs atomic.Int64
+	if err := Schedule("interval", 10*time.Millisecond, func(context.Context) { runs.Add(1) }); err != nil {
+		t.Fatalf("Schedule failed: %v", err)
+	}
+
+	if err := Schedule("interval", time.Second, func(context.Context) {}); err != util.ErrAlreadyExists {
+		t.Errorf("Expected ErrAlreadyExists for duplicate job, got %v", err)
+	}
+	if err := Schedule("zero", 0, func(context.Context) {}); err != util.ErrInvalidInput {
+		t.Errorf("Expected ErrInvalidInput for zero interval, got %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for runs.Load() < 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := runs.Load(); n < 3 {
+		t.Fatalf("Expected at least 3 runs, got %d", n)
+	}
+
+	if info := jobInfo(t, "interval"); info.Runs < 3 || info.LastRun.IsZero() {
+		t.Errorf("Unexpected job info %+v", info)
+	}
+}
+
+func TestSkipOverlap(t *testing.T) {
+	defer Stop(context.Background())
+
+	var active, maxActive, runs atomic.Int64
+	if err := Schedule("overlap", 5*time.Millisecond, func(context.Context) {
+		n := active.Add(1)
+		if n > maxActive.Load() {
+			maxActive.Store(n)
+		}
+		time.Sleep(30 * time.Millisecond)
+		active.Add(-1)
+		runs.Add(1)
+	}); err != nil {
+		t.Fatalf("Schedule failed: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for runs.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if n := maxActive.Load(); n != 1 {
+		t.Errorf("Expected no overlapping runs, got %d concurrent", n)
+	}
+	if info := jobInfo(t, "overlap"); info.Skipped == 0 {
+		t.Errorf("Expected skipped runs, got %+v", info)
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	defer Stop(context.Background())
+
+	var runs atomic.Int64
+	if err := Schedule("panic", 5*time.Millisecond, func(context.Context) {
+		runs.Add(1)
+		panic("job failed")
+	}); err != nil {
+		t.Fatalf("Schedule failed: %v", err)
+	}
+
+	// Job keeps running after panics.
+	deadline := time.Now().Add(2 * time.Second)
+	for runs.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := runs.Load(); n < 2 {
+		t.Fatalf("Expected at least 2 runs after panic, got %d", n)
+	}
+
+	if info := jobInfo(t, "panic"); info.Panics == 0 {
+		t.Errorf("Expected panics to be counted, got %+v", info)
+	}
+}
+
+func TestStop(t *testing.T) {
+	started := make(chan struct{})
+	var cancelled atomic.Bool
+	if err := Schedule("graceful", 5*time.Millisecond, func(ctx context.Context) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-ctx.Done()
+		time.Sleep(20 * time.Millisecond)
+		cancelled.Store(true)
+	}); err != nil {
+		t.Fatalf("Schedule failed: %v", err)
+	}
+
+	select {
+	case <-started:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Job did not start")
+	}
+
+	// Stop cancels the job context and waits for the run in progress.
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := Stop(ctx); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+	if !cancelled.Load() {
+		t.Errorf("Stop returned before run completed")
+	}
+	if n := len(Jobs()); n != 0 {
+		t.Errorf("Expected no jobs after Stop, got %d", n)
+	}
+
+	// Stop times out on a run that ignores cancellation.
+	release := make(chan struct{})
+	defer close(release)
+	if err := Schedule("stuck", 5*time.Millisecond, func(context.Context) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+	}); err != nil {
+		t.Fatalf("Schedule failed: %v", err)
+	}
+
+	select {
+	case <-started:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Job did not start")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := Stop(ctx); err != util.ErrTimeout {
+		t.Errorf("Expected ErrTimeout, got %v", err)
+	}
+}
+
+func TestMain(m *testing.M) {
+	log.Init("", "error", false)
+
+	os.Exit(m.Run())
+}
@@ -0,0 +1,144 @@
+// This package ties the infra modules together into a service.
+package service
+
+import (
+	"context"
+	"github.com/sath33sh/infra/db"
+	"github.com/sath33sh/infra/log"
+	"github.com/sath33sh/infra/metrics"
+	"github.com/sath33sh/infra/push"
+	"github.com/sath33sh/infra/sched"
+	"github.com/sath33sh/infra/wapi"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Module name.
+const MODULE = "service"
+
+// Shutdown hook.
+type ShutdownHook struct {
+	Name string                          // Hook name, for logging.
+	Fn   func(ctx context.Context) error // Hook function.
+}
+
+// Registered shutdown hooks.
+var hooks struct {
+	sync.Mutex                // Mutex for accessing hooks.
+	list       []ShutdownHook // Hooks in registration order.
+}
+
+// Register a shutdown hook, e.g. for stopping background jobs. Hooks run in
+// registration order, after the API server is drained and before push and db
+// are shut down, so they may still use push and db.
+func OnShutdown(name string, fn func(ctx context.Context) error) {
+	hooks.Lock()
+	hooks.list = append(hooks.list, ShutdownHook{Name: name, Fn: fn})
+	hooks.Unlock()
+}
+
+// Gracefully shut down the service within the deadline of ctx.
+//
+// Shutdown runs in dependency order, from the edge inwards:
+//  1. API server: reject new requests, stop listening, wait for in-flight
+//     requests and close websocket connections. Closing websockets closes
+//     their push sessions, so nothing depends on push after this step.
+//  2. Scheduler: cancel background jobs and wait for runs in progress, which
+//     may still use push and db.
+//  3. Shutdown hooks: application work that may still use push and db.
+//  4. Push: stop topic and session managers, flush and close the broker
+//     connection, so published payloads are not lost.
+//  5. Db: close buckets last, since every step above may write to db.
+//  6. Metrics: flush pending metrics to the backend.
+//
+// A failed step is logged and the remaining steps still run, so resources are
+// released even when the deadline is exceeded. Returns the first error.
+func Shutdown(ctx context.Context) (err error) {
+	step := func(name string, fn func(ctx context.Context) error) {
+		log.Infof("Shutdown: %s", name)
+		if stepErr := fn(ctx); stepErr != nil {
+			log.Errorf("Shutdown: %s failed: %v", name, stepErr)
+			if err == nil {
+				err = stepErr
+			}
+		}
+	}
+
+	step("wapi", wapi.Shutdown)
+
+	step("sched", sched.Stop)
+
+	hooks.Lock()
+	list := append([]ShutdownHook(nil), hooks.list...)
+	hooks.Unlock()
+	for _, h := range list {
+		step(h.Name, h.Fn)
+	}
+
+	step("push", push.Shutdown)
+
+	step("db", func(context.Context) error {
+		db.Close()
+		return nil
+	})
+
+	step("metrics", metrics.Shutdown)
+
+	log.Infof("Shutdown complete")
+
+	return err
+}
+
+// Upsert object, then publish notification through push system only if the
+// upsert succeeded. Returns the db error if the upsert failed, without
+// publishing. If publishing fails, the object is still written and the publish
+// error is returned.
+func UpsertAndPublish(obj db.Object, expiry uint32, p push.Pushable) error {
+	if err := db.Upsert(obj, expiry); err != nil {
+		return err
+	}
+
+	if err := push.Publish(p); err != nil {
+		log.Errorf("Key %s not published: %v", obj.GetMeta().Key(), err)
+		return err
+	}
+
+	return nil
+}
+
+// Document change observed by the db change feed, as push notification. The
+// payload URI is the document key, e.g. "user:123", so that sessions subscribe
+// to a document, or to documents of a type with a wildcard, e.g. "user:*". The
+// payload kind is the key part before the first separator.
+type changeNotification db.Change
+
+func (c changeNotification) BuildPushPayload() (*push.Payload, error) {
+	kind, _, _ := strings.Cut(c.Key, ":")
+	return &push.Payload{Kind: kind, Op: push.UPSERT, Uri: c.Key, Data: c.Doc}, nil
+}
+
+// Publish document change through push system.
+func publishChange(c db.Change) {
+	if err := push.Publish(changeNotification(c)); err != nil {
+		log.Errorf("Change %s not published: %v", c.Key, err)
+	}
+}
+
+// Stream result rows of N1QL query to response as JSON array, without
+// buffering the result. See wapi.StreamJSONArray for error handling.
+func StreamQuery(w http.ResponseWriter, r *http.Request, bIndex db.BucketIndex, queryStmt string) {
+	wapi.StreamJSONArray(w, r, func(write func(row []byte) error) error {
+		_, err := db.ExecQueryStream(bIndex, queryStmt, write)
+		return err
+	})
+}
+
+func init() {
+	// Publish changes observed by the db change feed, if enabled.
+	db.SetChangeHandler(publishChange)
+
+	// Dependency health checks, for health gating of API server.
+	wapi.RegisterHealthCheck("db", db.PingBuckets)
+	wapi.RegisterHealthCheck("push", push.BrokerStatus)
+}
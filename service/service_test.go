@@ -0,0 +1,181 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"github.com/sath33sh/infra/config"
+	"github.com/sath33sh/infra/db"
+	"github.com/sath33sh/infra/log"
+	"github.com/sath33sh/infra/push"
+	"github.com/sath33sh/infra/util"
+	"github.com/sath33sh/infra/wapi"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// Get a free local port.
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestPublishChange(t *testing.T) {
+	duct := push.OpenSession("changes", "s1", true)
+	defer push.CloseSession("changes", "s1", duct)
+	if err := push.Subscribe("user:*", "changes", "s1", true); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	publishChange(db.Change{Key: "user:1", Modified: 1, Doc: json.RawMessage(`{"name":"a"}`)})
+
+	select {
+	case p := <-duct:
+		if p.Kind != "user" || p.Op != push.UPSERT || p.Uri != "user:1" || string(p.Data) != `{"name":"a"}` {
+			t.Errorf("Unexpected payload %+v", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Change not pushed")
+	}
+}
+
+// Db object notified through push system.
+type testObject struct {
+	Type db.ObjType `json:"type"`
+	Id   string     `json:"id"`
+}
+
+func (obj *testObject) GetMeta() db.ObjMeta {
+	return db.ObjMeta{Bucket: db.DEFAULT_BUCKET, Type: obj.Type, Id: obj.Id}
+}
+
+func (obj *testObject) SetType() {
+	obj.Type = "test"
+}
+
+func (obj *testObject) BuildPushPayload() (*push.Payload, error) {
+	return &push.Payload{Kind: "test", Op: push.UPSERT, Uri: "test:" + obj.Id}, nil
+}
+
+func TestUpsertAndPublish(t *testing.T) {
+	duct := push.OpenSession("upsert", "s1", true)
+	defer push.CloseSession("upsert", "s1", duct)
+	if err := push.Subscribe("test:", "upsert", "s1", true); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	// Db failure: nothing is published.
+	obj := &testObject{}
+	if err := UpsertAndPublish(obj, 0, obj); err != util.ErrInvalidObject {
+		t.Errorf("Expected error %v, got %v", util.ErrInvalidObject, err)
+	}
+
+	select {
+	case p := <-duct:
+		t.Errorf("Published on db failure: %+v", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	wapi.GET("/test/slow", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		time.Sleep(200 * time.Millisecond)
+		wapi.ReturnOk(w, r, "ok")
+	})
+
+	wapi.GET("/ws", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		cr, err := wapi.ParseCredentials(r)
+		if err != nil {
+			wapi.ReturnError(w, r, err)
+			return
+		}
+		if c, err := wapi.NewConn(w, r, "test: "); err == nil {
+			c.StartLoop(w, r, cr.UserId, cr.SessionId)
+		}
+	})
+
+	hookRan := false
+	OnShutdown("test", func(context.Context) error {
+		hookRan = true
+		return nil
+	})
+
+	// Start server.
+	port := freePort(t)
+	host := fmt.Sprintf("localhost:%d", port)
+	go wapi.StartServer(port, false, "", "")
+
+	var c *wapi.Client
+	var err error
+	os.Setenv("WAPI_SECURE", "false")
+	for i := 0; i < 50; i++ {
+		if c, err = wapi.NewClient(host, "1", "s1", "token", false, false, wapi.NopOnConnError); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	pushes := c.Pushes()
+
+	// Start an in-flight request.
+	status := make(chan int, 1)
+	go func() {
+		resp, err := http.Get("http://" + host + "/test/slow")
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+
+	if code := <-status; code != http.StatusOK {
+		t.Errorf("In-flight request: expected status %d, got %d", http.StatusOK, code)
+	}
+
+	if !hookRan {
+		t.Errorf("Shutdown hook not run")
+	}
+
+	// Websocket connection is closed.
+	select {
+	case _, ok := <-pushes:
+		if ok {
+			t.Errorf("Unexpected push")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Websocket connection not closed")
+	}
+
+	// Server no longer accepts connections.
+	if _, err := http.Get("http://" + host + "/ping"); err == nil {
+		t.Errorf("Request served after shutdown")
+	}
+}
+
+func TestMain(m *testing.M) {
+	// Init.
+	config.Init("testdata/config.json")
+	log.Init("", "error", false)
+	push.Init(true)
+
+	os.Exit(m.Run())
+}
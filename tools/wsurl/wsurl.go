@@ -8,9 +8,13 @@ import (
 	"github.com/GeertJohan/go.linenoise"
 	"github.com/sath33sh/infra/wapi"
 	"github.com/sath33sh/infra/util"
+	"log"
 	"os"
+	"os/signal"
 	"regexp"
 	"strings"
+	"syscall"
+	"time"
 )
 
 type env struct {
@@ -42,7 +46,13 @@ func newClient(host, credStr string, once bool) (*wapi.Client, error) {
 	// Parse credentials string.
 	creds := strings.SplitN(credStr, ":", 3)
 
-	return wapi.NewClient(host, creds[0], creds[1], creds[2], once, e.verbose, wapi.NopOnConnError)
+	c, err := wapi.NewClient(host, creds[0], creds[1], creds[2], once, e.verbose, wapi.NopOnConnError)
+	if err == nil && e.verbose {
+		// Timestamp and locate verbose output.
+		c.SetLogger(log.New(os.Stdout, "", log.Ltime|log.Lmicroseconds|log.Lshortfile))
+	}
+
+	return c, err
 }
 
 func exec(c *wapi.Client, rid, method, uri, reqJsonStr string) error {
@@ -148,6 +158,53 @@ func execSingleCommand(method, uri, data *string) {
 	exec(c, "single", *method, *uri, *data)
 }
 
+func execTail(subUri string, topics []string) {
+	// Create new client.
+	c, err := newClient(e.host, e.credStr, false)
+	if err != nil {
+		fmt.Printf("Failed to connect to %s: %s\n", e.host, err)
+		os.Exit(-2)
+	}
+
+	pushes := c.Pushes()
+
+	// Subscribe to topics.
+	for _, topic := range topics {
+		req, _ := json.Marshal(map[string]string{"uri": topic})
+		vPrintf("Subscribe %s", topic)
+		if err = exec(c, "tail", "POST", subUri, string(req)); err != nil {
+			fmt.Printf("Failed to subscribe to %s: %s\n", topic, err)
+			c.Close()
+			os.Exit(-3)
+		}
+	}
+
+	// Quit on signal.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	for {
+		select {
+		case p, ok := <-pushes:
+			if !ok {
+				fmt.Println("Connection closed")
+				quit(-2)
+			}
+			ts := time.Unix(0, p.Timestamp*int64(time.Millisecond))
+			fmt.Printf("%s %s %s %s\n", ts.Format("15:04:05.000"), p.Method, p.Rid, p.Uri)
+			if len(p.ContentType) > 0 {
+				fmt.Printf("<%s, %d bytes>\n", p.ContentType, len(p.Binary))
+			} else if len(p.Data) > 0 {
+				printRawJson(p.Data, nil)
+			}
+
+		case <-sigs:
+			c.Close()
+			quit(0)
+		}
+	}
+}
+
 func parseEnv() {
 	e.host = os.Getenv("WSURL_HOST")
 	e.credStr = os.Getenv("WSURL_CREDENTIALS")
@@ -162,6 +219,8 @@ func main() {
 	method := flag.String("m", "", "Method: get, post")
 	uri := flag.String("u", "/ping", "URI")
 	data := flag.String("d", "", "Data: JSON string")
+	tail := flag.Bool("tail", false, "Tail pushes")
+	subUri := flag.String("s", "/subscribe", "Subscribe URI")
 	flag.BoolVar(&e.verbose, "v", false, "Verbose output")
 	help := flag.Bool("h", false, "Print help")
 	flag.Parse()
@@ -171,22 +230,30 @@ func main() {
 		e.host = flag.Arg(0)
 	}
 
+	var topics []string
+	if flag.NArg() > 1 {
+		topics = flag.Args()[1:]
+	}
+
 	if len(*cred) > 0 {
 		e.credStr = *cred
 	}
 
 	if *help || len(e.host) == 0 || len(e.credStr) == 0 {
 		fmt.Print(
-			"Usage: [options...] <host-url>\n",
+			"Usage: [options...] <host-url> [<topic-uri>...]\n",
 			"Options:\n",
 			" -c CREDENTIALS  <user-id>:<session-id>:<access-token>\n",
 			" -m METHOD       Method: get, post, etc\n",
 			" -u URI          URI endpoint\n",
 			" -d DATA         Data: JSON string\n",
+			" -tail           Print pushes, subscribing to topic URIs, until interrupted\n",
+			" -s URI          Subscribe URI endpoint for tail mode (default /subscribe)\n",
 			" -v              Enable verbose output\n",
 			" -h              Print this help message\n",
 			"\n",
-			"Example: wsurl -c 1:ae727ec1:8B730fusiro= -m get -u /ping localhost:8080\n")
+			"Example: wsurl -c 1:ae727ec1:8B730fusiro= -m get -u /ping localhost:8080\n",
+			"         wsurl -c 1:ae727ec1:8B730fusiro= -tail localhost:8080 channel:5\n")
 		os.Exit(-1)
 	}
 
@@ -199,7 +266,10 @@ func main() {
 
 	// Start connection routine.
 
-	if len(*method) == 0 {
+	if *tail {
+		// Tail pushes.
+		execTail(*subUri, topics)
+	} else if len(*method) == 0 {
 		// Execute shell.
 		execShell()
 	} else {
@@ -0,0 +1,127 @@
+package util
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Cache entry.
+type cacheEntry[K comparable, V any] struct {
+	key    K         // Key.
+	val    V         // Value.
+	expiry time.Time // Expiry time. Zero means no expiry.
+}
+
+// Size-bounded LRU cache with per-entry TTL, safe for concurrent use.
+// Expired entries are removed lazily on access and preferentially on eviction.
+type Cache[K comparable, V any] struct {
+	sync.Mutex                     // Mutex for accessing cache.
+	maxSize    int                 // Maximum number of entries.
+	lru        *list.List          // Entries in most recently used order.
+	entries    map[K]*list.Element // Map of key to LRU list element.
+}
+
+// Create a cache holding up to maxSize entries.
+func NewCache[K comparable, V any](maxSize int) *Cache[K, V] {
+	if maxSize < 1 {
+		maxSize = 1
+	}
+
+	return &Cache[K, V]{
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[K]*list.Element),
+	}
+}
+
+func (e *cacheEntry[K, V]) expired(now time.Time) bool {
+	return !e.expiry.IsZero() && now.After(e.expiry)
+}
+
+// Remove element. Caller must hold the mutex.
+func (c *Cache[K, V]) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry[K, V]).key)
+}
+
+// Get value. Returns false if key is not present or has expired.
+func (c *Cache[K, V]) Get(key K) (val V, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return val, false
+	}
+
+	entry := elem.Value.(*cacheEntry[K, V])
+	if entry.expired(time.Now()) {
+		c.remove(elem)
+		return val, false
+	}
+
+	c.lru.MoveToFront(elem)
+
+	return entry.val, true
+}
+
+// Set value with TTL. Zero TTL means no expiry.
+func (c *Cache[K, V]) Set(key K, val V, ttl time.Duration) {
+	var expiry time.Time
+	if ttl > 0 {
+		expiry = time.Now().Add(ttl)
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		// Update existing entry.
+		entry := elem.Value.(*cacheEntry[K, V])
+		entry.val = val
+		entry.expiry = expiry
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	if c.lru.Len() >= c.maxSize {
+		c.evict()
+	}
+
+	c.entries[key] = c.lru.PushFront(&cacheEntry[K, V]{key: key, val: val, expiry: expiry})
+}
+
+// Evict expired entries, or the least recently used entry if none expired.
+// Caller must hold the mutex.
+func (c *Cache[K, V]) evict() {
+	now := time.Now()
+	for elem := c.lru.Back(); elem != nil; {
+		prev := elem.Prev()
+		if elem.Value.(*cacheEntry[K, V]).expired(now) {
+			c.remove(elem)
+		}
+		elem = prev
+	}
+
+	if c.lru.Len() >= c.maxSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Delete key.
+func (c *Cache[K, V]) Delete(key K) {
+	c.Lock()
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	c.Unlock()
+}
+
+// Get number of entries, including expired entries not yet removed.
+func (c *Cache[K, V]) Len() int {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.lru.Len()
+}
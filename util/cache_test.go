@@ -0,0 +1,85 @@
+package util
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCacheEviction(t *testing.T) {
+	c := NewCache[string, int](2)
+
+	c.Set("a", 1, 0)
+	c.Set("b", 2, 0)
+
+	// Touch "a" so that "b" is least recently used.
+	if v, ok := c.Get("a"); !ok || v != 1 {
+		t.Fatalf("Get a: %d, %v", v, ok)
+	}
+
+	c.Set("c", 3, 0)
+
+	if _, ok := c.Get("b"); ok {
+		t.Errorf("LRU entry b not evicted")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Errorf("Entry a evicted")
+	}
+	if c.Len() != 2 {
+		t.Errorf("Expected 2 entries, got %d", c.Len())
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	c := NewCache[string, string](10)
+
+	c.Set("short", "x", 10*time.Millisecond)
+	c.Set("long", "y", time.Hour)
+
+	time.Sleep(20 * time.Millisecond)
+
+	if _, ok := c.Get("short"); ok {
+		t.Errorf("Expired entry returned")
+	}
+	if v, ok := c.Get("long"); !ok || v != "y" {
+		t.Errorf("Unexpired entry lost")
+	}
+
+	// Expired entries are evicted before live ones.
+	c = NewCache[string, string](2)
+	c.Set("live", "x", 0)
+	c.Set("stale", "y", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	c.Set("new", "z", 0)
+	if _, ok := c.Get("live"); !ok {
+		t.Errorf("Live entry evicted instead of expired entry")
+	}
+}
+
+func TestCacheConcurrent(t *testing.T) {
+	c := NewCache[int, string](100)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := (g*1000 + i) % 150
+				c.Set(key, fmt.Sprint(key), time.Millisecond*time.Duration(i%5))
+				if v, ok := c.Get(key); ok && v != fmt.Sprint(key) {
+					t.Errorf("Key %d: unexpected value %s", key, v)
+				}
+				if i%10 == 0 {
+					c.Delete(key)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if c.Len() > 100 {
+		t.Errorf("Cache exceeded size: %d", c.Len())
+	}
+}
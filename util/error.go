@@ -2,6 +2,8 @@ package util
 
 import (
 	"encoding/json"
+	"net/http"
+	"strings"
 )
 
 // Error type.
@@ -29,6 +31,9 @@ const (
 	ErrTimeout
 	ErrResourceLimit
 	ErrRateLimit
+	ErrAlreadyExists
+	ErrUnauthorized
+	ErrUnavailable
 )
 
 // Error messages.
@@ -50,6 +55,18 @@ var messages = map[Err]string{
 	ErrTimeout:        "Operation timed out",
 	ErrResourceLimit:  "Resource limit exceeded",
 	ErrRateLimit:      "Rate limit exceeded",
+	ErrAlreadyExists:  "Object already exists",
+	ErrUnauthorized:   "Unauthorized",
+	ErrUnavailable:    "Service unavailable",
+}
+
+// HTTP status codes. Errors not listed here map to 400 Bad Request.
+var statuses = map[Err]int{
+	ErrInvalidPerm:   http.StatusForbidden,
+	ErrRateLimit:     http.StatusTooManyRequests,
+	ErrAlreadyExists: http.StatusConflict,
+	ErrUnauthorized:  http.StatusUnauthorized,
+	ErrUnavailable:   http.StatusServiceUnavailable,
 }
 
 // Stringer.
@@ -57,6 +74,20 @@ func (e Err) Error() string {
 	return messages[e]
 }
 
+// Get numeric error code.
+func (e Err) Code() int {
+	return int(e)
+}
+
+// Get HTTP status code.
+func (e Err) HttpStatus() int {
+	if status, ok := statuses[e]; ok {
+		return status
+	}
+
+	return http.StatusBadRequest
+}
+
 // JSON marshaler.
 func (e Err) MarshalJSON() ([]byte, error) {
 	return json.Marshal(ErrJson{Code: int(e), Message: messages[e]})
@@ -64,6 +95,60 @@ func (e Err) MarshalJSON() ([]byte, error) {
 
 // Error in JSON format.
 type ErrJson struct {
+	Code    int            `json:"code"`             // Error code.
+	Message string         `json:"message"`          // Error message.
+	Fields  []FieldErrJson `json:"fields,omitempty"` // Errors of input fields, if any.
+}
+
+// Error of input field in JSON format.
+type FieldErrJson struct {
+	Field   string `json:"field"`   // Field name.
 	Code    int    `json:"code"`    // Error code.
 	Message string `json:"message"` // Error message.
 }
+
+// Error of input field, e.g. from form validation.
+type FieldErr struct {
+	Field string // Field name, as in the input.
+	Err   Err    // Error.
+}
+
+// Errors of input fields. As a whole, the error is ErrInvalidInput.
+type FieldErrs []FieldErr
+
+// Stringer.
+func (fe FieldErrs) Error() string {
+	var b strings.Builder
+
+	b.WriteString(ErrInvalidInput.Error())
+	for i, f := range fe {
+		if i == 0 {
+			b.WriteString(": ")
+		} else {
+			b.WriteString(", ")
+		}
+		b.WriteString(f.Field + ": " + f.Err.Error())
+	}
+
+	return b.String()
+}
+
+// Get numeric error code.
+func (fe FieldErrs) Code() int {
+	return ErrInvalidInput.Code()
+}
+
+// Get HTTP status code.
+func (fe FieldErrs) HttpStatus() int {
+	return ErrInvalidInput.HttpStatus()
+}
+
+// JSON marshaler. Field errors are listed in the fields of ErrInvalidInput.
+func (fe FieldErrs) MarshalJSON() ([]byte, error) {
+	ej := ErrJson{Code: ErrInvalidInput.Code(), Message: ErrInvalidInput.Error()}
+	for _, f := range fe {
+		ej.Fields = append(ej.Fields, FieldErrJson{Field: f.Field, Code: f.Err.Code(), Message: f.Err.Error()})
+	}
+
+	return json.Marshal(ej)
+}
@@ -0,0 +1,75 @@
+package util
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestErrMessages(t *testing.T) {
+	for e := ErrInvalidInput; e <= ErrUnavailable; e++ {
+		if len(e.Error()) == 0 {
+			t.Errorf("Error code %d has no message", e)
+		}
+
+		data, err := json.Marshal(e)
+		if err != nil {
+			t.Fatalf("Marshal error code %d: %v", e, err)
+		}
+
+		var ej ErrJson
+		if err = json.Unmarshal(data, &ej); err != nil || ej.Code != int(e) || ej.Message != e.Error() {
+			t.Errorf("Error code %d: unexpected JSON %s", e, data)
+		}
+	}
+}
+
+func TestErrHttpStatus(t *testing.T) {
+	tests := map[Err]int{
+		ErrInvalidInput:  http.StatusBadRequest,
+		ErrInvalidPerm:   http.StatusForbidden,
+		ErrAlreadyExists: http.StatusConflict,
+		ErrUnauthorized:  http.StatusUnauthorized,
+		ErrUnavailable:   http.StatusServiceUnavailable,
+	}
+
+	for e, status := range tests {
+		if e.HttpStatus() != status {
+			t.Errorf("%s: expected status %d, got %d", e, status, e.HttpStatus())
+		}
+	}
+
+	// Existing codes must keep their values.
+	if ErrRateLimit != 16 || ErrAlreadyExists != 17 || ErrUnauthorized != 18 {
+		t.Errorf("Error code values changed")
+	}
+}
+
+func TestFieldErrsJSON(t *testing.T) {
+	// Simple errors have no fields.
+	data, _ := json.Marshal(ErrNotFound)
+	if string(data) != `{"code":8,"message":"Object not found"}` {
+		t.Errorf("Unexpected JSON %s", data)
+	}
+
+	fe := FieldErrs{{Field: "email", Err: ErrInvalidInput}, {Field: "name", Err: ErrAlreadyExists}}
+	data, err := json.Marshal(fe)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	var ej ErrJson
+	if err = json.Unmarshal(data, &ej); err != nil || ej.Code != ErrInvalidInput.Code() || ej.Message != ErrInvalidInput.Error() {
+		t.Errorf("Unexpected JSON %s", data)
+	}
+	if len(ej.Fields) != 2 || ej.Fields[1] != (FieldErrJson{Field: "name", Code: ErrAlreadyExists.Code(), Message: ErrAlreadyExists.Error()}) {
+		t.Errorf("Unexpected fields %+v", ej.Fields)
+	}
+
+	if fe.HttpStatus() != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, fe.HttpStatus())
+	}
+	if msg := fe.Error(); msg != "Invalid input: email: Invalid input, name: Object already exists" {
+		t.Errorf("Unexpected message %q", msg)
+	}
+}
@@ -0,0 +1,57 @@
+package util
+
+import (
+	"encoding/binary"
+	"encoding/json"
+)
+
+// Binary frame: a JSON header followed by raw body bytes.
+//
+//	+----------------------+-------------+------------+
+//	| header length uint32 | JSON header | body bytes |
+//	+----------------------+-------------+------------+
+//
+// Header length is big endian. Since a JSON object starts with '{', a frame is
+// distinguishable from a plain JSON message by its first byte, as long as the
+// header is shorter than 2 GB.
+const FRAME_HEADER_LEN_SIZE = 4
+
+// Encode header and body into a binary frame.
+func EncodeFrame(header interface{}, body []byte) ([]byte, error) {
+	hdr, err := json.Marshal(header)
+	if err != nil {
+		return nil, ErrInvalidInput
+	}
+
+	frame := make([]byte, FRAME_HEADER_LEN_SIZE, FRAME_HEADER_LEN_SIZE+len(hdr)+len(body))
+	binary.BigEndian.PutUint32(frame, uint32(len(hdr)))
+	frame = append(frame, hdr...)
+	frame = append(frame, body...)
+
+	return frame, nil
+}
+
+// Decode binary frame. Header is unmarshaled into header. Returned body
+// references frame.
+func DecodeFrame(frame []byte, header interface{}) (body []byte, err error) {
+	if len(frame) < FRAME_HEADER_LEN_SIZE {
+		return nil, ErrJsonDecode
+	}
+
+	hdrLen := binary.BigEndian.Uint32(frame)
+	if uint64(hdrLen) > uint64(len(frame)-FRAME_HEADER_LEN_SIZE) {
+		return nil, ErrJsonDecode
+	}
+
+	hdrEnd := FRAME_HEADER_LEN_SIZE + int(hdrLen)
+	if err = json.Unmarshal(frame[FRAME_HEADER_LEN_SIZE:hdrEnd], header); err != nil {
+		return nil, ErrJsonDecode
+	}
+
+	return frame[hdrEnd:], nil
+}
+
+// Check whether message is a binary frame rather than plain JSON.
+func IsFrame(msg []byte) bool {
+	return len(msg) > 0 && msg[0] != '{'
+}
@@ -0,0 +1,38 @@
+package util
+
+import (
+	"bytes"
+	"testing"
+)
+
+type frameHeader struct {
+	Kind string `json:"kind"`
+}
+
+func TestFrame(t *testing.T) {
+	body := []byte{0x00, 0xff, '{', 0x10}
+
+	frame, err := EncodeFrame(&frameHeader{Kind: "image"}, body)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	if !IsFrame(frame) {
+		t.Errorf("Frame not detected")
+	}
+	if IsFrame([]byte(`{"kind":"image"}`)) {
+		t.Errorf("JSON detected as frame")
+	}
+
+	var hdr frameHeader
+	decoded, err := DecodeFrame(frame, &hdr)
+	if err != nil || hdr.Kind != "image" || !bytes.Equal(decoded, body) {
+		t.Errorf("Unexpected decode: header %+v, body %v, error %v", hdr, decoded, err)
+	}
+
+	// Truncated frames.
+	for _, n := range []int{0, 3, 10} {
+		if _, err := DecodeFrame(frame[:n], &hdr); err != ErrJsonDecode {
+			t.Errorf("Truncated frame of %d bytes: expected error, got %v", n, err)
+		}
+	}
+}
@@ -1,7 +1,6 @@
 package util
 
 import (
-	"fmt"
 	"github.com/sath33sh/infra/log"
 	"sync"
 	"time"
@@ -13,11 +12,54 @@ const (
 )
 
 // Geometry in GeoJSON format: http://geojson.org.
+//
+// Note that coordinates are [lat, lng], with latitude at index 0 and longitude
+// at index 1, unlike GeoJSON's [lng, lat]. Use Lat and Lng rather than indexing
+// Coordinates, and NewPoint to build points.
 type Geometry struct {
 	Type        string     `json:"type,omitempty"`        // Geometry type: "Point", etc.
-	Coordinates [2]float64 `json:"coordinates,omitempty"` // Coordinates: [lat, lon]
+	Coordinates [2]float64 `json:"coordinates,omitempty"` // Coordinates: [lat, lng]
 }
 
+// Make point geometry. Returns ErrInvalidInput if coordinates are out of range.
+func NewPoint(lat, lng float64) (Geometry, error) {
+	if err := ValidateCoordinates(lat, lng); err != nil {
+		return Geometry{}, err
+	}
+
+	return Geometry{Type: POINT, Coordinates: [2]float64{lat, lng}}, nil
+}
+
+// Get latitude.
+func (g *Geometry) Lat() float64 {
+	return g.Coordinates[0]
+}
+
+// Get longitude.
+func (g *Geometry) Lng() float64 {
+	return g.Coordinates[1]
+}
+
+// Check whether geometry has valid coordinates.
+func (g *Geometry) Valid() bool {
+	return ValidateCoordinates(g.Lat(), g.Lng()) == nil
+}
+
+// Validate coordinates: latitude within [-90, 90] and longitude within [-180, 180].
+// Swapped coordinates with latitude beyond 90 are caught; others are not
+// distinguishable.
+func ValidateCoordinates(lat, lng float64) error {
+	// Comparisons are false for NaN.
+	if !(lat >= -90 && lat <= 90) || !(lng >= -180 && lng <= 180) {
+		return ErrInvalidInput
+	}
+
+	return nil
+}
+
+// Google Geocode API URL.
+var geocodeUrl = "http://maps.googleapis.com/maps/api/geocode/json"
+
 // Rate limit for Google Geocode API calls.
 var rateLimit struct {
 	sync.Mutex           // Lock.
@@ -83,7 +125,10 @@ func LookupAddress(address string) (geo Geometry, err error) {
 			time.Sleep(500 * time.Millisecond)
 		}
 
-		url := fmt.Sprintf("http://maps.googleapis.com/maps/api/geocode/json?address=%s", address)
+		var url string
+		if url, err = JoinURL(geocodeUrl, "", map[string]string{"address": address}); err != nil {
+			return geo, err
+		}
 		err = HttpJsonGet(url, &gr)
 		rateLimit.lastCall = time.Now()
 		if err != nil {
@@ -93,6 +138,8 @@ func LookupAddress(address string) (geo Geometry, err error) {
 		if gr.Status != "OK" {
 			if gr.Status == "OVER_QUERY_LIMIT" {
 				time.Sleep(time.Second)
+			} else if gr.Status == "ZERO_RESULTS" {
+				return geo, ErrNotFound
 			} else {
 				log.Errorf("Invalid status %s", gr.Status)
 				return geo, ErrInternal
@@ -104,9 +151,22 @@ func LookupAddress(address string) (geo Geometry, err error) {
 		retry++
 	}
 
-	geo.Type = POINT
-	geo.Coordinates[0] = gr.Results[0].Geometry.Location.Lat
-	geo.Coordinates[1] = gr.Results[0].Geometry.Location.Lng
+	if gr.Status != "OK" {
+		// Retries exhausted.
+		log.Errorf("Geocode rate limit: status %s", gr.Status)
+		return geo, ErrRateLimit
+	}
+
+	if len(gr.Results) == 0 {
+		log.Errorf("No geocode results for %s", address)
+		return geo, ErrNotFound
+	}
+
+	location := gr.Results[0].Geometry.Location
+	if geo, err = NewPoint(location.Lat, location.Lng); err != nil {
+		log.Errorf("Invalid geocode location of %s: %v, %v", address, location.Lat, location.Lng)
+		return geo, ErrInternal
+	}
 
 	return geo, nil
 }
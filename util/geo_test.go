@@ -0,0 +1,108 @@
+package util
+
+import (
+	"github.com/sath33sh/infra/log"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	log.Init("", "error", false)
+
+	os.Exit(m.Run())
+}
+
+func TestLookupAddressNoResults(t *testing.T) {
+	for status, expected := range map[string]error{
+		"OK":           ErrNotFound,
+		"ZERO_RESULTS": ErrNotFound,
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"results": [], "status": "` + status + `"}`))
+		}))
+
+		geocodeUrl = srv.URL + "/"
+		_, err := LookupAddress("nowhere")
+		srv.Close()
+
+		if err != expected {
+			t.Errorf("Status %s: expected error %v, got %v", status, expected, err)
+		}
+	}
+}
+
+func TestLookupAddressEncoding(t *testing.T) {
+	const address = "1 Main St, Zürich & Co"
+
+	var received string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.URL.Query().Get("address")
+		w.Write([]byte(`{"results": [], "status": "ZERO_RESULTS"}`))
+	}))
+	defer srv.Close()
+
+	geocodeUrl = srv.URL + "/"
+	if _, err := LookupAddress(address); err != ErrNotFound {
+		t.Errorf("Expected error %v, got %v", ErrNotFound, err)
+	}
+
+	if received != address {
+		t.Errorf("Expected address %q, got %q", address, received)
+	}
+}
+
+func TestValidateCoordinates(t *testing.T) {
+	tests := []struct {
+		lat, lng float64
+		err      error
+	}{
+		{0, 0, nil},
+		{90, 180, nil},
+		{-90, -180, nil},
+		{47.3769, 8.5417, nil},
+		{90.0001, 0, ErrInvalidInput},
+		{-90.0001, 0, ErrInvalidInput},
+		{0, 180.0001, ErrInvalidInput},
+		{0, -180.0001, ErrInvalidInput},
+		{122.4194, 37.7749, ErrInvalidInput}, // Swapped.
+		{math.NaN(), 0, ErrInvalidInput},
+		{0, math.Inf(1), ErrInvalidInput},
+	}
+
+	for i, tt := range tests {
+		if err := ValidateCoordinates(tt.lat, tt.lng); err != tt.err {
+			t.Errorf("Test %d: expected error %v, got %v", i, tt.err, err)
+		}
+
+		geo := Geometry{Type: POINT, Coordinates: [2]float64{tt.lat, tt.lng}}
+		if geo.Valid() != (tt.err == nil) {
+			t.Errorf("Test %d: unexpected validity %v", i, geo.Valid())
+		}
+
+		if geo, err := NewPoint(tt.lat, tt.lng); err != tt.err || (err == nil && (geo.Lat() != tt.lat || geo.Lng() != tt.lng)) {
+			t.Errorf("Test %d: unexpected point %v, error %v", i, geo, err)
+		}
+	}
+}
+
+func TestLookupAddressCoordinates(t *testing.T) {
+	for location, expected := range map[string]error{
+		`{"lat": 47.3769, "lng": 8.5417}`:  nil,
+		`{"lat": 8.5417, "lng": 247.3769}`: ErrInternal,
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"results": [{"geometry": {"location": ` + location + `}}], "status": "OK"}`))
+		}))
+
+		geocodeUrl = srv.URL + "/"
+		geo, err := LookupAddress("Zürich")
+		srv.Close()
+
+		if err != expected || (err == nil && (geo.Type != POINT || geo.Lat() != 47.3769 || geo.Lng() != 8.5417)) {
+			t.Errorf("Location %s: unexpected geometry %v, error %v", location, geo, err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package util
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// ID length.
+const ID_LEN = 26
+
+// Crockford base32 alphabet. Sorts in ASCII order and avoids I, L, O and U.
+const idAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ID generator state.
+var idGen struct {
+	sync.Mutex          // Mutex for accessing state.
+	ms         uint64   // Timestamp of last ID.
+	entropy    [10]byte // Random part of last ID.
+}
+
+// Generate a new ID: a ULID, i.e. 26 Crockford base32 characters encoding a
+// 48-bit millisecond timestamp followed by 80 random bits.
+//
+// IDs sort lexicographically in generation order: IDs of later milliseconds
+// sort after earlier ones, and IDs generated by this process within the same
+// millisecond increment the random part, so they are strictly increasing.
+// Across processes, order within a millisecond is arbitrary and follows clock
+// skew. Time-ordered keys built from IDs, e.g. "type:<id>", suit range view
+// queries over creation time.
+func NewID() string {
+	idGen.Lock()
+	defer idGen.Unlock()
+
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	if ms <= idGen.ms {
+		// Same millisecond, or clock went back. Increment random part.
+		ms = idGen.ms
+		incEntropy(&idGen.entropy)
+	} else {
+		idGen.ms = ms
+		readRandom(idGen.entropy[:])
+	}
+
+	var id [16]byte
+	binary.BigEndian.PutUint16(id[0:], uint16(ms>>32))
+	binary.BigEndian.PutUint32(id[2:], uint32(ms))
+	copy(id[6:], idGen.entropy[:])
+
+	return encodeID(id)
+}
+
+// Increment 80-bit big endian integer. Overflow wraps around, which takes 2^80
+// IDs within a millisecond.
+func incEntropy(e *[10]byte) {
+	for i := len(e) - 1; i >= 0; i-- {
+		e[i]++
+		if e[i] != 0 {
+			return
+		}
+	}
+}
+
+// Encode 128-bit ID in base32, 5 bits per character, most significant first.
+// The first character encodes the 3 most significant bits.
+func encodeID(id [16]byte) string {
+	hi := binary.BigEndian.Uint64(id[0:])
+	lo := binary.BigEndian.Uint64(id[8:])
+
+	var s [ID_LEN]byte
+	for i := ID_LEN - 1; i >= 0; i-- {
+		s[i] = idAlphabet[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+
+	return string(s[:])
+}
+
+// Fill buffer with random bytes.
+func readRandom(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		// Random source failed. Nothing sensible to fall back to.
+		panic(err)
+	}
+}
+
+// Generate a random hex ID of n characters, e.g. "ae727ec1" for session IDs.
+// Short IDs are not sortable. Collisions are likely after about 2^(2n) IDs,
+// e.g. 65536 IDs of 8 characters.
+func NewShortID(n int) string {
+	if n <= 0 {
+		return ""
+	}
+
+	b := make([]byte, (n+1)/2)
+	readRandom(b)
+
+	return hex.EncodeToString(b)[:n]
+}
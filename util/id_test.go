@@ -0,0 +1,91 @@
+package util
+
+import (
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestNewIDMonotonic(t *testing.T) {
+	prev := NewID()
+	for i := 0; i < 100000; i++ {
+		id := NewID()
+		if len(id) != ID_LEN {
+			t.Fatalf("Invalid ID length %d: %s", len(id), id)
+		}
+		if id <= prev {
+			t.Fatalf("ID %s not greater than %s", id, prev)
+		}
+		prev = id
+	}
+}
+
+func TestNewIDConcurrent(t *testing.T) {
+	const numWorkers, numIds = 8, 10000
+
+	ids := make([][]string, numWorkers)
+	var wg sync.WaitGroup
+	for w := 0; w < numWorkers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < numIds; i++ {
+				ids[w] = append(ids[w], NewID())
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	for _, list := range ids {
+		// Each worker sees increasing IDs.
+		if !sort.StringsAreSorted(list) {
+			t.Errorf("IDs of worker not sorted")
+		}
+		for _, id := range list {
+			if seen[id] {
+				t.Fatalf("Duplicate ID %s", id)
+			}
+			seen[id] = true
+		}
+	}
+}
+
+func TestEncodeID(t *testing.T) {
+	var max [16]byte
+	for i := range max {
+		max[i] = 0xff
+	}
+
+	// Largest 128-bit value encodes to the largest ULID.
+	if s := encodeID(max); s != "7ZZZZZZZZZZZZZZZZZZZZZZZZZ" {
+		t.Errorf("Unexpected encoding %s", s)
+	}
+	if s := encodeID([16]byte{}); s != "00000000000000000000000000" {
+		t.Errorf("Unexpected encoding %s", s)
+	}
+
+	// Carry propagates across bytes.
+	e := [10]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff}
+	incEntropy(&e)
+	if e[8] != 1 || e[9] != 0 {
+		t.Errorf("Unexpected increment %v", e)
+	}
+}
+
+func TestNewShortID(t *testing.T) {
+	for _, n := range []int{0, 1, 7, 8, 16} {
+		if id := NewShortID(n); len(id) != n {
+			t.Errorf("Expected length %d, got %q", n, id)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		id := NewShortID(16)
+		if seen[id] {
+			t.Fatalf("Duplicate short ID %s", id)
+		}
+		seen[id] = true
+	}
+}
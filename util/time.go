@@ -0,0 +1,55 @@
+package util
+
+import (
+	"time"
+)
+
+// RFC 3339 layout with millisecond precision, matching millisecond timestamps.
+const RFC3339_MILLI = "2006-01-02T15:04:05.000Z07:00"
+
+// Convert unix time in milliseconds, e.g. from NowMilli, to UTC time. Zero
+// milliseconds is the zero time, i.e. unset. Negative milliseconds are times
+// before 1970.
+func MilliToTime(ms int64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+
+	return time.UnixMilli(ms).UTC()
+}
+
+// Convert time to unix time in milliseconds, truncating sub-millisecond
+// precision towards the past. The zero time is zero milliseconds.
+func TimeToMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.UnixMilli()
+}
+
+// Format time as RFC 3339 in UTC with millisecond precision, e.g.
+// "2024-05-01T12:30:00.000Z". The zero time is the empty string.
+func FormatRFC3339(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.UTC().Format(RFC3339_MILLI)
+}
+
+// Parse RFC 3339 time, with optional fractional seconds and any UTC offset,
+// to UTC time. The empty string is the zero time. Returns ErrInvalidInput if
+// the string is not RFC 3339.
+func ParseRFC3339(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, ErrInvalidInput
+	}
+
+	return t.UTC(), nil
+}
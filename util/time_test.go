@@ -0,0 +1,77 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMilliRoundTrip(t *testing.T) {
+	for _, ms := range []int64{0, 1, -1, 1714566600123, -86400000, NowMilli()} {
+		tm := MilliToTime(ms)
+		if ms != 0 && tm.Location() != time.UTC {
+			t.Errorf("%d: time %v not in UTC", ms, tm)
+		}
+		if got := TimeToMilli(tm); got != ms {
+			t.Errorf("%d: round trip got %d", ms, got)
+		}
+	}
+
+	// Zero is unset.
+	if !MilliToTime(0).IsZero() || TimeToMilli(time.Time{}) != 0 {
+		t.Errorf("Zero not mapped to zero time")
+	}
+
+	// Negative is before 1970.
+	if tm := MilliToTime(-1); !tm.Equal(time.Date(1969, 12, 31, 23, 59, 59, 999e6, time.UTC)) {
+		t.Errorf("Unexpected time %v for -1", tm)
+	}
+
+	// Sub-millisecond precision truncates towards the past.
+	tm := time.Date(1969, 12, 31, 23, 59, 59, 999999999, time.UTC)
+	if ms := TimeToMilli(tm); ms != -1 {
+		t.Errorf("Expected -1, got %d", ms)
+	}
+
+	// Time zone does not matter.
+	local := time.Date(2024, 5, 1, 14, 30, 0, 0, time.FixedZone("CEST", 2*3600))
+	if ms := TimeToMilli(local); ms != 1714566600000 {
+		t.Errorf("Expected 1714566600000, got %d", ms)
+	}
+}
+
+func TestRFC3339(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+		err error
+	}{
+		{"2024-05-01T12:30:00Z", "2024-05-01T12:30:00.000Z", nil},
+		{"2024-05-01T14:30:00.123+02:00", "2024-05-01T12:30:00.123Z", nil},
+		{"2024-05-01T12:30:00.123456789Z", "2024-05-01T12:30:00.123Z", nil},
+		{"1969-12-31T23:59:59.999Z", "1969-12-31T23:59:59.999Z", nil},
+		{"", "", nil},
+		{"2024-05-01 12:30:00", "", ErrInvalidInput},
+		{"2024-05-01", "", ErrInvalidInput},
+	}
+
+	for _, tt := range tests {
+		tm, err := ParseRFC3339(tt.in)
+		if err != tt.err {
+			t.Errorf("%q: expected error %v, got %v", tt.in, tt.err, err)
+			continue
+		}
+		if err == nil && tm.Location() != time.UTC {
+			t.Errorf("%q: time %v not in UTC", tt.in, tm)
+		}
+		if out := FormatRFC3339(tm); out != tt.out {
+			t.Errorf("%q: expected %q, got %q", tt.in, tt.out, out)
+		}
+	}
+
+	// Round trip through milliseconds.
+	ms := NowMilli()
+	tm, err := ParseRFC3339(FormatRFC3339(MilliToTime(ms)))
+	if err != nil || TimeToMilli(tm) != ms {
+		t.Errorf("Round trip of %d: got %d, error %v", ms, TimeToMilli(tm), err)
+	}
+}
@@ -0,0 +1,44 @@
+package util
+
+import (
+	"github.com/sath33sh/infra/log"
+	"net/url"
+	"strings"
+)
+
+// Encode query parameters, percent-encoding keys and values. Parameters are
+// sorted by key.
+func EncodeQuery(values map[string]string) string {
+	q := url.Values{}
+	for k, v := range values {
+		q.Set(k, v)
+	}
+
+	return q.Encode()
+}
+
+// Build URL from base, unescaped path and query parameters. Path is appended to
+// the path of base, and query parameters are added to its query. Build URLs
+// through this function rather than by formatting user input into strings.
+func JoinURL(base string, path string, query map[string]string) (string, error) {
+	u, err := url.Parse(base)
+	if err != nil || len(u.Scheme) == 0 || len(u.Host) == 0 {
+		log.Errorf("Invalid base URL %s: %v", base, err)
+		return "", ErrInvalidInput
+	}
+
+	if len(path) > 0 {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + strings.TrimPrefix(path, "/")
+		u.RawPath = ""
+	}
+
+	if len(query) > 0 {
+		q := u.Query()
+		for k, v := range query {
+			q.Set(k, v)
+		}
+		u.RawQuery = q.Encode()
+	}
+
+	return u.String(), nil
+}
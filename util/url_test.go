@@ -0,0 +1,49 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestEncodeQuery(t *testing.T) {
+	q := EncodeQuery(map[string]string{
+		"address": "1600 Amphitheatre Pkwy, Mountain View",
+		"name":    "Zürich & co=1?#",
+	})
+
+	expected := "address=1600+Amphitheatre+Pkwy%2C+Mountain+View&name=Z%C3%BCrich+%26+co%3D1%3F%23"
+	if q != expected {
+		t.Errorf("Expected %s, got %s", expected, q)
+	}
+
+	if q := EncodeQuery(nil); q != "" {
+		t.Errorf("Expected empty query, got %s", q)
+	}
+}
+
+func TestJoinURL(t *testing.T) {
+	tests := []struct {
+		base     string
+		path     string
+		query    map[string]string
+		expected string
+	}{
+		{"http://example.com", "", nil, "http://example.com"},
+		{"http://example.com/api/", "/users/a b", nil, "http://example.com/api/users/a%20b"},
+		{"http://example.com/api", "café/x?y#z", nil, "http://example.com/api/caf%C3%A9/x%3Fy%23z"},
+		{"http://example.com/geo?key=k", "", map[string]string{"address": "a b&c"}, "http://example.com/geo?address=a+b%26c&key=k"},
+		{"https://example.com:8080", "p", map[string]string{"q": "日本"}, "https://example.com:8080/p?q=%E6%97%A5%E6%9C%AC"},
+	}
+
+	for _, tt := range tests {
+		u, err := JoinURL(tt.base, tt.path, tt.query)
+		if err != nil || u != tt.expected {
+			t.Errorf("JoinURL(%q, %q, %v): expected %s, got %s, error %v", tt.base, tt.path, tt.query, tt.expected, u, err)
+		}
+	}
+
+	for _, base := range []string{"", "example.com/path", "http://%zz"} {
+		if _, err := JoinURL(base, "p", nil); err != ErrInvalidInput {
+			t.Errorf("Base %q: expected error %v, got %v", base, ErrInvalidInput, err)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+// This package provides build version information.
+//
+// Version, BuildTime and GitCommit are set at link time, e.g.:
+//
+//	go build -ldflags "-X github.com/sath33sh/infra/version.Version=1.2.0 \
+//	    -X github.com/sath33sh/infra/version.BuildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ) \
+//	    -X github.com/sath33sh/infra/version.GitCommit=$(git rev-parse --short HEAD)"
+package version
+
+import (
+	"runtime"
+)
+
+// Build variables set via linker flags.
+var (
+	Version   = "dev" // Release version.
+	BuildTime = ""    // Build timestamp.
+	GitCommit = ""    // Git commit hash.
+)
+
+// Build information.
+type Info struct {
+	Version   string `json:"version"`             // Release version.
+	BuildTime string `json:"buildTime,omitempty"` // Build timestamp.
+	GitCommit string `json:"gitCommit,omitempty"` // Git commit hash.
+	GoVersion string `json:"goVersion"`           // Go runtime version.
+}
+
+// Get build information.
+func BuildInfo() Info {
+	return Info{
+		Version:   Version,
+		BuildTime: BuildTime,
+		GitCommit: GitCommit,
+		GoVersion: runtime.Version(),
+	}
+}
+
+// Get one line startup banner.
+func Banner(name string) string {
+	info := BuildInfo()
+
+	s := name + " " + info.Version
+	if info.GitCommit != "" {
+		s += " (" + info.GitCommit + ")"
+	}
+	if info.BuildTime != "" {
+		s += " built " + info.BuildTime
+	}
+
+	return s + " " + info.GoVersion
+}
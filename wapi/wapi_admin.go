@@ -0,0 +1,68 @@
+package wapi
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"github.com/sath33sh/infra/push"
+	"github.com/sath33sh/infra/util"
+	"net/http"
+)
+
+// Admin API prefix.
+const ADMIN_PREFIX = "/admin"
+
+// Default permission required for admin API.
+const ADMIN_PERM = "admin"
+
+// Register admin API for inspecting the push system, guarded by permission:
+//
+//	GET    /admin/topics                             Active topic URIs.
+//	GET    /admin/topic?uri=<uri>                    Topic details.
+//	GET    /admin/stats                              Online counts.
+//	GET    /admin/sessions[?user=<userId>]           Online sessions.
+//	DELETE /admin/sessions/:userId/:sessionId        Kick session.
+func registerAdmin(perm string) {
+	opt := RequirePerm(perm)
+
+	GET(ADMIN_PREFIX+"/topics", adminTopics, opt)
+	GET(ADMIN_PREFIX+"/topic", adminTopic, opt)
+	GET(ADMIN_PREFIX+"/stats", adminStats, opt)
+	GET(ADMIN_PREFIX+"/sessions", adminSessions, opt)
+	DELETE(ADMIN_PREFIX+"/sessions/:userId/:sessionId", adminKick, opt)
+}
+
+func adminTopics(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ReturnOk(w, r, push.ActiveTopics())
+}
+
+func adminTopic(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	uri := r.URL.Query().Get("uri")
+	if uri == "" {
+		ReturnError(w, r, util.ErrInvalidInput)
+		return
+	}
+
+	td, err := push.TopicInfo(uri)
+	if err != nil {
+		ReturnError(w, r, err)
+		return
+	}
+
+	ReturnOk(w, r, td)
+}
+
+func adminStats(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ReturnOk(w, r, push.OnlineStats())
+}
+
+func adminSessions(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ReturnOk(w, r, push.Sessions(r.URL.Query().Get("user")))
+}
+
+func adminKick(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if err := push.KickSession(params.ByName("userId"), params.ByName("sessionId")); err != nil {
+		ReturnError(w, r, err)
+		return
+	}
+
+	ReturnOk(w, r, struct{}{})
+}
@@ -0,0 +1,86 @@
+package wapi
+
+import (
+	"github.com/sath33sh/infra/push"
+	"github.com/sath33sh/infra/util"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestIntegrationAdmin(t *testing.T) {
+	defer SetPermFunc(nil)
+	SetPermFunc(testPermFunc)
+
+	admin := newHarnessClient(t, "admin", "s1")
+	target := newHarnessClient(t, "20", "s20")
+	pushes := target.Pushes()
+
+	// Wait for target session.
+	var sessions []push.SessionInfo
+	var err error
+	for i := 0; i < 50; i++ {
+		if sessions, err = Call[struct{}, []push.SessionInfo](admin, "GET", "/admin/sessions?user=20", struct{}{}); err == nil && len(sessions) > 0 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if len(sessions) != 1 || sessions[0].UserId != "20" || sessions[0].SessionId != "s20" {
+		t.Fatalf("Unexpected sessions %v, error %v", sessions, err)
+	}
+
+	const uri = "admin/test/topic"
+	if err := push.Subscribe(uri, "20", "s20", true); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	topics, err := Call[struct{}, []string](admin, "GET", "/admin/topics", struct{}{})
+	if err != nil || !contains(topics, uri) {
+		t.Errorf("Topic %s not listed: %v, error %v", uri, topics, err)
+	}
+
+	td, err := Call[struct{}, push.TopicDetail](admin, "GET", "/admin/topic?uri="+url.QueryEscape(uri), struct{}{})
+	if err != nil || td.Uri != uri || !contains(td.Subscribers, "20:s20") {
+		t.Errorf("Unexpected topic %v, error %v", td, err)
+	}
+
+	if _, err := Call[struct{}, push.TopicDetail](admin, "GET", "/admin/topic?uri=missing", struct{}{}); err != util.ErrNotFound {
+		t.Errorf("Missing topic: expected error %v, got %v", util.ErrNotFound, err)
+	}
+
+	stat, err := Call[struct{}, push.OnlineStat](admin, "GET", "/admin/stats", struct{}{})
+	if err != nil || stat.Users < 2 || stat.Sessions < 2 || stat.Topics < 1 {
+		t.Errorf("Unexpected stats %v, error %v", stat, err)
+	}
+
+	// Non-admin users are denied.
+	if _, err := Call[struct{}, []string](target, "GET", "/admin/topics", struct{}{}); err != util.ErrInvalidPerm {
+		t.Errorf("Guest: expected error %v, got %v", util.ErrInvalidPerm, err)
+	}
+
+	// Kick closes the target's connection.
+	if _, err := Call[struct{}, struct{}](admin, "DELETE", "/admin/sessions/20/s20", struct{}{}); err != nil {
+		t.Fatalf("Kick failed: %v", err)
+	}
+	select {
+	case _, ok := <-pushes:
+		if ok {
+			t.Errorf("Unexpected push")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Kicked connection not closed")
+	}
+
+	if _, err := Call[struct{}, struct{}](admin, "DELETE", "/admin/sessions/20/missing", struct{}{}); err != util.ErrNotFound {
+		t.Errorf("Missing session: expected error %v, got %v", util.ErrNotFound, err)
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package wapi
+
+import (
+	"github.com/sath33sh/infra/util"
+	"net/http"
+)
+
+// Credentials headers.
+const (
+	HeaderUserId      = "X-UserId"
+	HeaderSessionId   = "X-SessionId"
+	HeaderAccessToken = "X-AccessToken"
+)
+
+// Credentials length limits.
+const (
+	MaxUserIdLen      = 128
+	MaxSessionIdLen   = 128
+	MaxAccessTokenLen = 1024
+)
+
+// Credentials.
+type Credentials struct {
+	UserId      string // User ID.
+	SessionId   string // Session ID.
+	AccessToken string // Access token.
+}
+
+// Check whether character is allowed in user and session IDs.
+func isIdChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') ||
+		(c >= 'A' && c <= 'Z') ||
+		(c >= '0' && c <= '9') ||
+		c == '-' || c == '_' || c == '.' || c == '@'
+}
+
+// Check whether character is allowed in access token (base64 and base64url alphabets).
+func isTokenChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') ||
+		(c >= 'A' && c <= 'Z') ||
+		(c >= '0' && c <= '9') ||
+		c == '-' || c == '_' || c == '.' || c == '+' || c == '/' || c == '='
+}
+
+func validateField(s string, maxLen int, valid func(byte) bool) bool {
+	if len(s) == 0 || len(s) > maxLen {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		if !valid(s[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Validate user ID and session ID format.
+func ValidateSession(userId, sessionId string) error {
+	if !validateField(userId, MaxUserIdLen, isIdChar) ||
+		!validateField(sessionId, MaxSessionIdLen, isIdChar) {
+		return util.ErrInvalidSession
+	}
+
+	return nil
+}
+
+// Validate credentials format.
+func (cr *Credentials) Validate() error {
+	if err := ValidateSession(cr.UserId, cr.SessionId); err != nil {
+		return err
+	}
+
+	if !validateField(cr.AccessToken, MaxAccessTokenLen, isTokenChar) {
+		return util.ErrInvalidToken
+	}
+
+	return nil
+}
+
+// Parse and validate credentials headers from request.
+func ParseCredentials(r *http.Request) (cr Credentials, err error) {
+	cr.UserId = r.Header.Get(HeaderUserId)
+	cr.SessionId = r.Header.Get(HeaderSessionId)
+	cr.AccessToken = r.Header.Get(HeaderAccessToken)
+
+	if err = cr.Validate(); err != nil {
+		return Credentials{}, err
+	}
+
+	return cr, nil
+}
+
+// Check format of credentials headers present in request, before dispatch.
+// Absent headers are left to authentication of the route.
+func checkCredentialHeaders(r *http.Request) error {
+	if userId := r.Header.Get(HeaderUserId); userId != "" && !validateField(userId, MaxUserIdLen, isIdChar) {
+		return util.ErrInvalidSession
+	}
+
+	if sessionId := r.Header.Get(HeaderSessionId); sessionId != "" && !validateField(sessionId, MaxSessionIdLen, isIdChar) {
+		return util.ErrInvalidSession
+	}
+
+	if token := r.Header.Get(HeaderAccessToken); token != "" && !validateField(token, MaxAccessTokenLen, isTokenChar) {
+		return util.ErrInvalidToken
+	}
+
+	return nil
+}
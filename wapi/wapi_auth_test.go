@@ -0,0 +1,89 @@
+package wapi
+
+import (
+	"encoding/json"
+	"github.com/sath33sh/infra/util"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseCredentials(t *testing.T) {
+	tests := []struct {
+		userId, sessionId, accessToken string
+		err                            error
+	}{
+		{"1", "ae727ec1", "8B730fusiro=", nil},
+		{"", "ae727ec1", "8B730fusiro=", util.ErrInvalidSession},
+		{"1", "", "8B730fusiro=", util.ErrInvalidSession},
+		{"1", "ae727ec1", "", util.ErrInvalidToken},
+		{"1 OR 1=1", "ae727ec1", "8B730fusiro=", util.ErrInvalidSession},
+		{"1", "ae72:7ec1", "8B730fusiro=", util.ErrInvalidSession},
+		{"1", "ae727ec1", "8B73 0fusiro=", util.ErrInvalidToken},
+		{strings.Repeat("u", MaxUserIdLen+1), "ae727ec1", "8B730fusiro=", util.ErrInvalidSession},
+		{"1", "ae727ec1", strings.Repeat("t", MaxAccessTokenLen+1), util.ErrInvalidToken},
+	}
+
+	for i, tt := range tests {
+		r, _ := http.NewRequest("GET", "/ping", nil)
+		if tt.userId != "" {
+			r.Header.Set(HeaderUserId, tt.userId)
+		}
+		if tt.sessionId != "" {
+			r.Header.Set(HeaderSessionId, tt.sessionId)
+		}
+		if tt.accessToken != "" {
+			r.Header.Set(HeaderAccessToken, tt.accessToken)
+		}
+
+		cr, err := ParseCredentials(r)
+		if err != tt.err {
+			t.Errorf("Test %d: expected error %v, got %v", i, tt.err, err)
+			continue
+		}
+
+		if err == nil && (cr.UserId != tt.userId || cr.SessionId != tt.sessionId || cr.AccessToken != tt.accessToken) {
+			t.Errorf("Test %d: credentials mismatch: %+v", i, cr)
+		}
+	}
+}
+
+func TestServeHTTPCredentials(t *testing.T) {
+	tests := []struct {
+		header, value string
+		err           error
+	}{
+		{"", "", nil},
+		{HeaderUserId, "1", nil},
+		{HeaderAccessToken, "8B730fusiro=", nil},
+		{HeaderUserId, "1 OR 1=1", util.ErrInvalidSession},
+		{HeaderSessionId, "ae72:7ec1", util.ErrInvalidSession},
+		{HeaderSessionId, strings.Repeat("s", MaxSessionIdLen+1), util.ErrInvalidSession},
+		{HeaderAccessToken, "8B73 0fusiro=", util.ErrInvalidToken},
+	}
+
+	for i, tt := range tests {
+		r := httptest.NewRequest("POST", "/test/optional", nil)
+		if tt.header != "" {
+			r.Header.Set(tt.header, tt.value)
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		if tt.err == nil {
+			if w.Code != http.StatusOK {
+				t.Errorf("Test %d: unexpected response %d: %s", i, w.Code, w.Body.String())
+			}
+			continue
+		}
+
+		var resp struct {
+			Error util.ErrJson `json:"error"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Error.Code != tt.err.(util.Err).Code() {
+			t.Errorf("Test %d: expected error %v, got %d: %s", i, tt.err, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package wapi
+
+import (
+	"github.com/sath33sh/infra/log"
+	"github.com/sath33sh/infra/metrics"
+	"github.com/sath33sh/infra/push"
+)
+
+// Backpressure metrics.
+const (
+	METRIC_PUSH_BACKLOGS  = "wapi_push_backlogs_total"
+	METRIC_PUSH_COALESCED = "wapi_push_coalesced_total"
+	METRIC_PUSH_EXPIRED   = "wapi_push_expired_total"
+)
+
+// Push duct depth at which a session is considered slow. Its backlog is then
+// coalesced before writing.
+var PushBacklogThreshold = push.DATA_DUCT_BUFFER_MAX * 3 / 4
+
+// Coalescing key of payload. Coalescing payloads with equal keys are updates
+// of the same object, so only the latest one matters.
+type coalesceKey struct {
+	kind string
+	uri  string
+	key  string
+}
+
+// Coalesce payloads. Of coalescing upserts (see push.Payload) with the same
+// kind, URI and key, only the latest is kept, at the position of the latest.
+// Other payloads are never dropped, and an upsert is never moved across
+// another payload of the same key.
+func coalesce(batch []*push.Payload) []*push.Payload {
+	latest := make(map[coalesceKey]int, len(batch))
+	keep := make([]bool, len(batch))
+
+	// Walk backwards, keeping the latest upsert of each key.
+	for i := len(batch) - 1; i >= 0; i-- {
+		p := batch[i]
+		k := coalesceKey{kind: p.Kind, uri: p.Uri, key: p.Key}
+
+		if p.Op != push.UPSERT || !p.Coalesce {
+			// Other payload separates upserts before and after it.
+			delete(latest, k)
+			keep[i] = true
+			continue
+		}
+
+		if _, ok := latest[k]; !ok {
+			latest[k] = i
+			keep[i] = true
+		}
+	}
+
+	out := batch[:0]
+	for i, p := range batch {
+		if keep[i] {
+			out = append(out, p)
+		}
+	}
+
+	return out
+}
+
+// Relieve backlog of slow client. If the duct is backed up beyond threshold,
+// drain it and coalesce the drained payloads. Returns payloads to write, in order.
+func (c *Conn) relieveBacklog(first *push.Payload, duct chan *push.Payload, userId, sessionId string) []*push.Payload {
+	batch := []*push.Payload{first}
+
+	depth := len(duct)
+	if depth < PushBacklogThreshold {
+		return batch
+	}
+
+	// Drain backlog.
+drain:
+	for i := 0; i < depth; i++ {
+		select {
+		case p := <-duct:
+			if p != nil {
+				batch = append(batch, p)
+			}
+		default:
+			break drain
+		}
+	}
+
+	drained := len(batch)
+	batch = coalesce(batch)
+
+	log.Infof("Slow session %s:%s: backlog of %d payloads coalesced to %d", userId, sessionId, drained, len(batch))
+	metrics.Add(METRIC_PUSH_BACKLOGS, 1)
+	metrics.Add(METRIC_PUSH_COALESCED, int64(drained-len(batch)))
+
+	return batch
+}
@@ -0,0 +1,103 @@
+package wapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/sath33sh/infra/push"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Pushable test object, coalescing if state.
+type backlogObject struct {
+	uri   string
+	seq   int
+	state bool
+}
+
+func (obj *backlogObject) BuildPushPayload() (*push.Payload, error) {
+	return &push.Payload{
+		Kind:     "test",
+		Op:       push.UPSERT,
+		Uri:      obj.uri,
+		Data:     json.RawMessage(fmt.Sprintf("%d", obj.seq)),
+		Coalesce: obj.state,
+	}, nil
+}
+
+func TestPushBacklog(t *testing.T) {
+	const numMsgs = 180
+	const numStates = 10
+
+	// Server handing over its connection.
+	conns := make(chan *Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := NewConn(w, r, "test: ")
+		if err != nil {
+			t.Errorf("NewConn failed: %v", err)
+			return
+		}
+		conns <- c
+		c.StartLoop(w, r, "backlog", "s1")
+	}))
+	defer srv.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+strings.TrimPrefix(srv.URL, "http://"), nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer ws.Close()
+	c := <-conns
+
+	for deadline := time.Now().Add(time.Second); len(push.Sessions("backlog")) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Push session not opened")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Stall writes, so that pushes back up as for a slow reader: distinct
+	// messages, then updates of an object state.
+	c.wmu.Lock()
+	for i := 0; i < numMsgs; i++ {
+		push.PushToUser("backlog", &backlogObject{uri: "chat:1", seq: i})
+	}
+	for i := 0; i < numStates; i++ {
+		push.PushToUser("backlog", &backlogObject{uri: "state:1", seq: i, state: true})
+	}
+	c.wmu.Unlock()
+
+	// All messages arrive in order. Superseded states are skipped.
+	var msgs, states []string
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(states) == 0 || states[len(states)-1] != fmt.Sprint(numStates-1) {
+		var e Envelope
+		if err := ws.ReadJSON(&e); err != nil {
+			t.Fatalf("Read failed after %d messages, %d states: %v", len(msgs), len(states), err)
+		}
+		if !e.Push {
+			continue
+		}
+		if e.Uri == "chat:1" {
+			msgs = append(msgs, string(e.Data))
+		} else {
+			states = append(states, string(e.Data))
+		}
+	}
+
+	if len(msgs) != numMsgs {
+		t.Fatalf("Expected %d messages, got %d", numMsgs, len(msgs))
+	}
+	for i, m := range msgs {
+		if m != fmt.Sprint(i) {
+			t.Fatalf("Message %d: expected %d, got %s", i, i, m)
+		}
+	}
+	if len(states) >= numStates {
+		t.Errorf("States not coalesced: %v", states)
+	}
+}
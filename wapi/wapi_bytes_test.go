@@ -0,0 +1,56 @@
+package wapi
+
+import (
+	"bytes"
+	"github.com/julienschmidt/httprouter"
+	"github.com/sath33sh/infra/util"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// PNG signature and start of IHDR chunk.
+var pngData = []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n', 0x00, 0x00, 0x00, 0x0d, 'I', 'H', 'D', 'R'}
+
+func pngImage(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if r.URL.Query().Get("size") == "large" {
+		ReturnBytes(w, r, "image/png", make([]byte, MaxMessageSize+1))
+		return
+	}
+
+	ReturnBytes(w, r, "image/png", pngData)
+}
+
+func TestReturnBytesRest(t *testing.T) {
+	r := httptest.NewRequest("GET", "/test/png", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" || !bytes.Equal(w.Body.Bytes(), pngData) {
+		t.Errorf("Unexpected response %d, content type %s: %v", w.Code, w.Header().Get("Content-Type"), w.Body.Bytes())
+	}
+}
+
+func TestReturnBytesWebsocket(t *testing.T) {
+	c := newHarnessClient(t, "15", "s15")
+
+	data, err := Call[struct{}, []byte](c, "GET", "/test/png", struct{}{})
+	if err != nil || !bytes.Equal(data, pngData) {
+		t.Errorf("Unexpected response %v, error %v", data, err)
+	}
+
+	// Binary response into JSON result fails.
+	if _, err := Call[struct{}, map[string]string](c, "GET", "/test/png", struct{}{}); err != util.ErrJsonDecode {
+		t.Errorf("Expected error %v, got %v", util.ErrJsonDecode, err)
+	}
+
+	// Responses beyond message size are rejected.
+	if _, err := Call[struct{}, []byte](c, "GET", "/test/png?size=large", struct{}{}); err != util.ErrResourceLimit {
+		t.Errorf("Expected error %v, got %v", util.ErrResourceLimit, err)
+	}
+
+	// Connection still works.
+	if _, err := Call[struct{}, map[string]string](c, "GET", "/test/whoami", struct{}{}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
@@ -8,10 +8,13 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/sath33sh/infra/util"
 	"io"
+	stdlog "log"
 	"net"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,13 +23,57 @@ type ConnErrorHandler func(c *Client, err error)
 
 // Client context.
 type Client struct {
-	ws           *websocket.Conn  // Websocket connection.
-	envelope     Envelope         // Message envelope.
-	readLoopSync chan Envelope    // Read loop synchronizer.
-	connErrorCb  ConnErrorHandler // Connection error handler.
-	debug        bool             // Enable debug.
+	ws           *websocket.Conn               // Websocket connection.
+	envelope     Envelope                      // Message envelope.
+	readLoopSync chan Envelope                 // Read loop synchronizer.
+	connErrorCb  ConnErrorHandler              // Connection error handler.
+	debug        bool                          // Enable debug.
+	logger       atomic.Pointer[stdlog.Logger] // Output logger.
+	pushDuct     chan Envelope                 // Push channel.
+	pushEnable   atomic.Bool                   // Deliver pushes to push channel.
+	execMu       sync.Mutex                    // Mutex serializing request/response exchanges.
+	wmu          sync.Mutex                    // Mutex serializing writes.
+	version      int                           // Negotiated protocol version.
+	pingInterval time.Duration                 // Client ping interval. Zero relies on server pings.
+	done         chan struct{}                 // Closed when read loop exits.
+	cache        map[string]*cachedResponse    // GET responses by URI, if caching is enabled.
 }
 
+// Cached GET response.
+type cachedResponse struct {
+	etag string          // Entity tag.
+	data json.RawMessage // Response data.
+}
+
+// Client option, given to NewClient.
+type ClientOption func(c *Client)
+
+// Send pings to server with interval, for networks where server pings do not
+// reach the client reliably, e.g. some proxies. The connection is considered
+// dead when neither pongs nor server pings arrive for three intervals. By
+// default the client only answers server pings.
+func WithPingInterval(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.pingInterval = d
+	}
+}
+
+// Cache GET responses carrying an entity tag, and make them conditional with
+// If-None-Match. On 304 Not Modified, RestExec decodes the cached response
+// data into each caller's value, so results do not share maps or slices.
+func WithCache() ClientOption {
+	return func(c *Client) {
+		c.cache = make(map[string]*cachedResponse)
+	}
+}
+
+// Maximum number of buffered pushes in push channel.
+const PushDuctBufferMax = 100
+
+// Latest protocol version offered by clients. Servers not supporting it
+// negotiate a lower version.
+var ClientProtocolVersion = ProtocolVersion
+
 // Global variables.
 var (
 	httpUrl string // HTTP server URL.
@@ -112,16 +159,21 @@ var wsTlsDialer = websocket.Dialer{
 
 func NewClient(host, userId, sessionId, accessToken string,
 	once, debug bool,
-	connErrorCb ConnErrorHandler) (*Client, error) {
+	connErrorCb ConnErrorHandler, opts ...ClientOption) (*Client, error) {
 
 	c := &Client{debug: debug}
 	var err error
 
+	// Apply options.
+	for _, opt := range opts {
+		opt(c)
+	}
+
 	// Construct header.
 	hdr := http.Header{
-		"X-UserId":                 {userId},
-		"X-SessionId":              {sessionId},
-		"X-AccessToken":            {accessToken},
+		HeaderUserId:               {userId},
+		HeaderSessionId:            {sessionId},
+		HeaderAccessToken:          {accessToken},
 		"Sec-WebSocket-Extensions": {"permessage-deflate; client_max_window_bits, x-webkit-deflate-frame"},
 	}
 
@@ -131,6 +183,9 @@ func NewClient(host, userId, sessionId, accessToken string,
 		return c, err
 	}
 
+	// Offer protocol versions.
+	hdr["Sec-WebSocket-Protocol"] = []string{strings.Join(subprotocols(ClientProtocolVersion), ", ")}
+
 	// Connect to server.
 	if secure {
 		c.ws, _, err = wsTlsDialer.Dial(url, hdr)
@@ -144,8 +199,13 @@ func NewClient(host, userId, sessionId, accessToken string,
 		}
 	}
 
-	// Create sync channel.
+	// Negotiated protocol version. Servers predating negotiation select none.
+	c.version = subprotocolVersion(c.ws.Subprotocol())
+
+	// Create sync channels.
 	c.readLoopSync = make(chan Envelope)
+	c.pushDuct = make(chan Envelope, PushDuctBufferMax)
+	c.done = make(chan struct{})
 
 	// Save handlers.
 	c.connErrorCb = connErrorCb
@@ -153,19 +213,115 @@ func NewClient(host, userId, sessionId, accessToken string,
 	// Start read loop.
 	go c.readLoop(once)
 
+	// Start ping loop, if enabled.
+	if c.pingInterval > 0 {
+		go c.pingLoop()
+	}
+
 	return c, err
 }
 
+// Get negotiated protocol version.
+func (c *Client) Version() int {
+	return c.version
+}
+
+// Set logger for client output. By default output is printed to stdout.
+func (c *Client) SetLogger(l *stdlog.Logger) {
+	c.logger.Store(l)
+}
+
+func (c *Client) output(calldepth int, s string) {
+	if l := c.logger.Load(); l != nil {
+		l.Output(calldepth+1, s)
+	} else {
+		fmt.Print(s)
+	}
+}
+
+func (c *Client) Printf(format string, v ...interface{}) {
+	c.output(2, fmt.Sprintf(format, v...))
+}
+
 func (c *Client) Debugf(format string, v ...interface{}) {
 	if c.debug {
-		fmt.Printf(format+"\n", v...)
+		c.output(2, fmt.Sprintf(format+"\n", v...))
 	}
 }
 
+// Return channel of pushes received from server. Once called, pushes are delivered
+// to the channel instead of being printed. Pushes are dropped if the channel is full.
+// The channel is closed when the connection is closed.
+func (c *Client) Pushes() <-chan Envelope {
+	c.pushEnable.Store(true)
+	return c.pushDuct
+}
+
+// Close connection. Read loop exits and closes the channels.
 func (c *Client) Close() {
 	c.Debugf("Closing connection")
 	c.ws.Close()
-	close(c.readLoopSync)
+}
+
+// Write JSON message.
+func (c *Client) writeJSON(v interface{}) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.ws.SetWriteDeadline(time.Now().Add(WriteWait))
+	return c.ws.WriteJSON(v)
+}
+
+// Write message of given type.
+func (c *Client) writeMessage(msgType int, data []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.ws.SetWriteDeadline(time.Now().Add(WriteWait))
+	return c.ws.WriteMessage(msgType, data)
+}
+
+// Read envelope from server. Binary frames carry an envelope followed by binary data.
+func (c *Client) readEnvelope(e *Envelope) error {
+	msgType, msg, err := c.ws.ReadMessage()
+	if err != nil {
+		return err
+	}
+
+	if msgType == websocket.BinaryMessage {
+		e.Binary, err = util.DecodeFrame(msg, e)
+		return err
+	}
+
+	return json.Unmarshal(msg, e)
+}
+
+// Get time to wait for pings or pongs before considering the connection dead.
+func (c *Client) pingTimeout() time.Duration {
+	if c.pingInterval > 0 {
+		return 3 * c.pingInterval
+	}
+
+	return PingTimeout
+}
+
+// Send pings to server until read loop exits.
+func (c *Client) pingLoop() {
+	ticker := time.NewTicker(c.pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.writeMessage(websocket.PingMessage, []byte{}); err != nil {
+				c.Debugf("Ping send error: %v\n", err)
+				return
+			}
+
+		case <-c.done:
+			return
+		}
+	}
 }
 
 func (c *Client) readLoop(once bool) {
@@ -173,20 +329,27 @@ func (c *Client) readLoop(once bool) {
 
 	defer func() {
 		c.ws.Close()
+		close(c.done)
 		close(c.readLoopSync)
+		close(c.pushDuct)
 	}()
 
 	// Set message size limit.
 	c.ws.SetReadLimit(MaxMessageSize)
 
 	// Set read deadline to ping timeout interval.
-	c.ws.SetReadDeadline(time.Now().Add(PingTimeout))
+	c.ws.SetReadDeadline(time.Now().Add(c.pingTimeout()))
+
+	// Set pong handler for refreshing read deadline on pongs to client pings.
+	c.ws.SetPongHandler(func(string) error {
+		c.ws.SetReadDeadline(time.Now().Add(c.pingTimeout()))
+		return nil
+	})
 
 	// Set ping handler for refreshing read deadline.
 	c.ws.SetPingHandler(func(string) error {
 		// fmt.Printf("Ping\n")
-		c.ws.SetWriteDeadline(time.Now().Add(WriteWait))
-		if err := c.ws.WriteMessage(websocket.PongMessage, []byte{}); err != nil {
+		if err := c.writeMessage(websocket.PongMessage, []byte{}); err != nil {
 			if err == io.EOF {
 				// Connection closed.
 				return err
@@ -196,7 +359,7 @@ func (c *Client) readLoop(once bool) {
 		}
 
 		// Reset read deadline.
-		c.ws.SetReadDeadline(time.Now().Add(PingTimeout))
+		c.ws.SetReadDeadline(time.Now().Add(c.pingTimeout()))
 		return nil
 	})
 
@@ -206,9 +369,15 @@ func (c *Client) readLoop(once bool) {
 		resp.Error = nil
 		resp.Rid = ""
 		resp.Method = ""
+		resp.ContentType = ""
+		resp.Binary = nil
+		resp.Location = ""
+		resp.ETag = ""
+		resp.Version = 0
+		resp.Status = 0
 
 		// Read from server.
-		if err := c.ws.ReadJSON(&resp); err != nil {
+		if err := c.readEnvelope(&resp); err != nil {
 			if err == io.EOF {
 				// Connection closed.
 				return
@@ -217,20 +386,33 @@ func (c *Client) readLoop(once bool) {
 			if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
 				// Read timed out. Server is not responding.
 				// Close the connection and move on.
-				fmt.Printf("Connection timed out\n")
+				c.Printf("Connection timed out\n")
 				c.connErrorCb(c, util.ErrNetAccess)
 				return
 			}
 
 			// Read error.
-			fmt.Printf("Read error: %v\n", err)
+			c.Printf("Read error: %v\n", err)
 			c.connErrorCb(c, util.ErrNetAccess)
 			return
 		}
 
+		if resp.Push && resp.Method == KeepaliveMethod {
+			// Keepalive. Discard.
+			continue
+		}
+
 		if resp.Push {
 			// Received a push message. Not a response.
-			fmt.Printf("PUSH: Rid %s, Uri %s\n", resp.Rid, resp.Uri)
+			if c.pushEnable.Load() {
+				select {
+				case c.pushDuct <- resp:
+				default:
+					c.Printf("PUSH dropped: Rid %s, Uri %s\n", resp.Rid, resp.Uri)
+				}
+			} else {
+				c.Printf("PUSH: Rid %s, Uri %s\n", resp.Rid, resp.Uri)
+			}
 			continue
 		} else {
 			// Received a response.
@@ -256,20 +438,31 @@ func (c *Client) RestExec(rid, method, uri string, reqData, respData, respErr in
 	// Marshal request data.
 	if reqData != nil {
 		if req.Data, err = json.Marshal(reqData); err != nil {
-			fmt.Printf("Request JSON marshal error: %v\n", err)
+			c.Printf("Request JSON marshal error: %v\n", err)
 			return util.ErrInvalidInput
 		}
 	}
 
+	// Responses are matched in order. Allow one outstanding request.
+	c.execMu.Lock()
+	defer c.execMu.Unlock()
+
+	// Make GET conditional on cached response.
+	var cached *cachedResponse
+	if c.cache != nil && req.Method == "GET" {
+		if cached = c.cache[uri]; cached != nil {
+			req.IfNoneMatch = cached.etag
+		}
+	}
+
 	c.Debugf("RID: %s", req.Rid)
 	c.Debugf("Method: %s", req.Method)
 	c.Debugf("URI: %s", req.Uri)
 	c.Debugf("Data: %s", req.Data)
 
 	// Send request.
-	c.ws.SetWriteDeadline(time.Now().Add(WriteWait))
-	if err := c.ws.WriteJSON(&req); err != nil {
-		fmt.Printf("Request write error: %s\n", err)
+	if err := c.writeJSON(&req); err != nil {
+		c.Printf("Request write error: %s\n", err)
 		return util.ErrNetAccess
 	}
 
@@ -300,17 +493,44 @@ func (c *Client) RestExec(rid, method, uri string, reqData, respData, respErr in
 			}
 
 			if req.Rid != resp.Rid {
-				fmt.Printf("Response does not match: %s, %s\n", resp.Method, resp.Rid)
+				c.Printf("Response does not match: %s, %s\n", resp.Method, resp.Rid)
 				return util.ErrNotFound
 			}
 
+			if len(resp.ContentType) > 0 {
+				// Binary response. Data is returned as is.
+				c.Debugf("Binary response: %s, %d bytes", resp.ContentType, len(resp.Binary))
+				if b, ok := respData.(*[]byte); ok {
+					*b = resp.Binary
+				} else if respData != nil {
+					c.Printf("Unexpected binary response %s\n", resp.ContentType)
+					return util.ErrJsonDecode
+				}
+				return nil
+			}
+
+			if resp.Status == http.StatusNotModified && cached != nil {
+				// Serve cached response.
+				c.Debugf("Not modified: %s", uri)
+				return cached.load(respData)
+			}
+
 			if respData != nil {
-				if err = json.Unmarshal(resp.Data, respData); err != nil {
-					fmt.Printf("Response JSON marshal error: %v\n", err)
+				if err = unmarshalJSON(resp.Data, respData); err != nil {
+					c.Printf("Response JSON marshal error: %v\n", err)
 					return util.ErrJsonDecode
 				}
 			}
 
+			// Update cache.
+			if c.cache != nil && req.Method == "GET" {
+				if len(resp.ETag) > 0 {
+					c.cache[uri] = &cachedResponse{etag: resp.ETag, data: resp.Data}
+				} else {
+					delete(c.cache, uri)
+				}
+			}
+
 			return nil
 		} else {
 			c.Debugf("Error in synchronizing")
@@ -318,7 +538,35 @@ func (c *Client) RestExec(rid, method, uri string, reqData, respData, respErr in
 		}
 
 	case <-wait.C:
-		fmt.Printf("Response timed out [%d]\n", ResponseTimeout)
+		c.Printf("Response timed out [%d]\n", ResponseTimeout)
 		return util.ErrTimeout
 	}
 }
+
+// Load cached response into respData. Cached data is decoded for every caller,
+// so that callers do not share memory of the response.
+func (cr *cachedResponse) load(respData interface{}) error {
+	if respData == nil {
+		return nil
+	}
+
+	if err := unmarshalJSON(cr.data, respData); err != nil {
+		return util.ErrJsonDecode
+	}
+
+	return nil
+}
+
+// Execute a typed request. Marshals req, executes method on uri and unmarshals the
+// response into Resp. An error response from server is returned as util.Err.
+func Call[Req, Resp any](c *Client, method, uri string, req Req) (resp Resp, err error) {
+	var respErr util.ErrJson
+
+	err = c.RestExec(uri, method, uri, req, &resp, &respErr)
+	if err == util.ErrInternal && len(respErr.Message) > 0 {
+		// Decode error returned by server.
+		return resp, util.Err(respErr.Code)
+	}
+
+	return resp, err
+}
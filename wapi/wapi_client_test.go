@@ -0,0 +1,108 @@
+package wapi
+
+import (
+	"encoding/json"
+	"github.com/sath33sh/infra/util"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Start a test websocket server which answers each request envelope using respond.
+func newTestWsServer(t *testing.T, respond func(req *Envelope)) (host string, close func()) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Upgrade failed: %v", err)
+			return
+		}
+		defer ws.Close()
+
+		for {
+			var env Envelope
+			if err := ws.ReadJSON(&env); err != nil {
+				return
+			}
+
+			respond(&env)
+			if err := ws.WriteJSON(&env); err != nil {
+				return
+			}
+		}
+	}))
+
+	// Reset cached URLs and connect without TLS.
+	os.Setenv("WAPI_SECURE", "false")
+	httpUrl, wsUrl = "", ""
+
+	return strings.TrimPrefix(srv.URL, "http://"), srv.Close
+}
+
+func newTestClient(t *testing.T, host string) *Client {
+	c, err := NewClient(host, "1", "test", "token", false, false, NopOnConnError)
+	if err != nil {
+		t.Fatalf("Failed to connect to %s: %v", host, err)
+	}
+
+	return c
+}
+
+type echoReq struct {
+	Text string `json:"text"`
+}
+
+type echoResp struct {
+	Echo string `json:"echo"`
+}
+
+func TestCall(t *testing.T) {
+	host, closeServer := newTestWsServer(t, func(req *Envelope) {
+		switch req.Uri {
+		case "/echo":
+			var er echoReq
+			json.Unmarshal(req.Data, &er)
+			req.Data, _ = json.Marshal(echoResp{Echo: er.Text})
+		default:
+			req.Data = nil
+			req.Error, _ = util.ErrNotFound.MarshalJSON()
+		}
+	})
+	defer closeServer()
+
+	c := newTestClient(t, host)
+	defer c.ws.Close()
+
+	resp, err := Call[echoReq, echoResp](c, "POST", "/echo", echoReq{Text: "hello"})
+	if err != nil || resp.Echo != "hello" {
+		t.Errorf("Echo: unexpected response %+v, error %v", resp, err)
+	}
+
+	_, err = Call[echoReq, echoResp](c, "GET", "/missing", echoReq{})
+	if err != util.ErrNotFound {
+		t.Errorf("Missing: expected %v, got %v", util.ErrNotFound, err)
+	}
+}
+
+func TestClientPings(t *testing.T) {
+	host := harnessHost(t)
+	os.Setenv("WAPI_SECURE", "false")
+	httpUrl, wsUrl = "", ""
+
+	// Server pings are far apart. Pongs to client pings keep the connection
+	// alive past the client's ping timeout.
+	const interval = 50 * time.Millisecond
+	c, err := NewClient(host, "16", "s16", "token", false, false, NopOnConnError, WithPingInterval(interval))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer c.Close()
+
+	time.Sleep(10 * interval)
+
+	if resp, err := Call[struct{}, map[string]string](c, "GET", "/test/whoami", struct{}{}); err != nil || resp["user"] != "16" {
+		t.Errorf("Connection not alive: response %v, error %v", resp, err)
+	}
+}
@@ -0,0 +1,115 @@
+package wapi
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"github.com/sath33sh/infra/config"
+	"github.com/sath33sh/infra/log"
+	"github.com/sath33sh/infra/metrics"
+	"github.com/sath33sh/infra/util"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Metric counting requests shed by route concurrency limits.
+const METRIC_CONCURRENCY_SHED = "wapi_concurrency_shed_total"
+
+// Concurrency limit of route.
+type routeLimit struct {
+	limit  int64        // Maximum handlers running concurrently.
+	active atomic.Int64 // Handlers running.
+}
+
+// Take a slot if available.
+func (rl *routeLimit) acquire() bool {
+	if rl.active.Add(1) > rl.limit {
+		rl.active.Add(-1)
+		return false
+	}
+	return true
+}
+
+// Release slot.
+func (rl *routeLimit) release() {
+	rl.active.Add(-1)
+}
+
+// Per-route concurrency limits, keyed by "<method> <path>".
+var concurrency struct {
+	sync.RWMutex
+	routes map[string]*routeLimit
+}
+
+// Set maximum number of handlers of a route running concurrently. Path is the
+// pattern the handler was registered with. Requests over the limit are shed
+// with util.ErrResourceLimit, status 503, instead of queueing. Zero disables
+// the limit.
+func SetRouteConcurrency(method, path string, n int) {
+	route := routeKey(method, path)
+
+	concurrency.Lock()
+	defer concurrency.Unlock()
+
+	if n <= 0 {
+		delete(concurrency.routes, route)
+		return
+	}
+
+	if concurrency.routes == nil {
+		concurrency.routes = make(map[string]*routeLimit)
+	}
+	concurrency.routes[route] = &routeLimit{limit: int64(n)}
+}
+
+// Get concurrency limit of route. Nil if unlimited.
+func concurrencyLimit(route string) *routeLimit {
+	concurrency.RLock()
+	defer concurrency.RUnlock()
+
+	return concurrency.routes[route]
+}
+
+// Read route concurrency limits from config, as "<method> <path> <limit>"
+// entries.
+func initRouteConcurrency() {
+	for _, entry := range config.Base.GetStringSlice(MODULE, "route-concurrency", nil) {
+		fields := strings.Fields(entry)
+		if len(fields) != 3 {
+			log.Fatalf("Invalid route concurrency %q", entry)
+		}
+
+		n, err := strconv.Atoi(fields[2])
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid route concurrency %q", entry)
+		}
+
+		SetRouteConcurrency(strings.ToUpper(fields[0]), fields[1], n)
+		log.Infof("Route concurrency: %s %s, limit %d", strings.ToUpper(fields[0]), fields[1], n)
+	}
+}
+
+// Wrap handler with concurrency limit of route, looked up per request so that
+// limits may be set after registration.
+func limitConcurrency(method, path string, h Handler) Handler {
+	route := routeKey(method, path)
+
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		rl := concurrencyLimit(route)
+		if rl == nil {
+			h(w, r, params)
+			return
+		}
+
+		if !rl.acquire() {
+			log.Debugf(MODULE, "Concurrency limit: %s %s shed", method, r.URL.Path)
+			metrics.Add(METRIC_CONCURRENCY_SHED, 1, "route", route)
+			returnErrorStatus(w, r, http.StatusServiceUnavailable, util.ErrResourceLimit)
+			return
+		}
+		defer rl.release()
+
+		h(w, r, params)
+	}
+}
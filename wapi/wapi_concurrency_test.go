@@ -0,0 +1,93 @@
+package wapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"github.com/sath33sh/infra/metrics"
+	"github.com/sath33sh/infra/util"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRouteConcurrency(t *testing.T) {
+	release := make(chan struct{})
+	GET("/test/busy", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		<-release
+		ReturnOk(w, r, "ok")
+	})
+	SetRouteConcurrency("GET", "/test/busy", 2)
+	defer SetRouteConcurrency("GET", "/test/busy", 0)
+
+	busy := func() int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/test/busy", nil))
+		return w.Code
+	}
+
+	// Saturate route.
+	var wg sync.WaitGroup
+	codes := make([]int, 2)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = busy()
+		}(i)
+	}
+
+	rl := concurrencyLimit(routeKey("GET", "/test/busy"))
+	for deadline := time.Now().Add(time.Second); rl.active.Load() < 2; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Handlers not running: %d active", rl.active.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Request over the limit is shed, not queued.
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/test/busy", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	var resp struct {
+		Error util.ErrJson `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Error.Code != util.ErrResourceLimit.Code() {
+		t.Errorf("Unexpected response: %s", w.Body.String())
+	}
+
+	// Running handlers complete, and slots are released.
+	close(release)
+	wg.Wait()
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("Request %d: expected status %d, got %d", i, http.StatusOK, code)
+		}
+	}
+	if code := busy(); code != http.StatusOK {
+		t.Errorf("Expected status %d after release, got %d", http.StatusOK, code)
+	}
+
+	var buf bytes.Buffer
+	metrics.WritePrometheus(&buf)
+	if out := buf.String(); !strings.Contains(out, METRIC_CONCURRENCY_SHED+`{route="GET /test/busy"} 1`) {
+		t.Errorf("Shed request not counted:\n%s", out)
+	}
+}
+
+func TestRouteConcurrencyDisabled(t *testing.T) {
+	SetRouteConcurrency("GET", "/test/whoami", 1)
+	if concurrencyLimit(routeKey("GET", "/test/whoami")) == nil {
+		t.Fatalf("Limit not set")
+	}
+
+	SetRouteConcurrency("GET", "/test/whoami", 0)
+	if concurrencyLimit(routeKey("GET", "/test/whoami")) != nil {
+		t.Errorf("Limit not removed")
+	}
+}
@@ -0,0 +1,54 @@
+package wapi
+
+import (
+	"github.com/nbio/httpcontext"
+	"net/http"
+)
+
+// Request context keys. Unexported type avoids collisions with other packages.
+type contextKey int
+
+const (
+	userKey contextKey = iota
+	tenantKey
+	traceIdKey
+)
+
+// Authenticated user.
+type UserInfo struct {
+	Id        string // User ID.
+	SessionId string // Session ID.
+}
+
+// Set authenticated user of request.
+func SetUser(r *http.Request, user UserInfo) {
+	httpcontext.Set(r, userKey, user)
+}
+
+// Get authenticated user of request.
+func User(r *http.Request) (UserInfo, bool) {
+	user, ok := httpcontext.Get(r, userKey).(UserInfo)
+	return user, ok
+}
+
+// Set tenant of request.
+func SetTenant(r *http.Request, tenant string) {
+	httpcontext.Set(r, tenantKey, tenant)
+}
+
+// Get tenant of request.
+func Tenant(r *http.Request) (string, bool) {
+	tenant, ok := httpcontext.Get(r, tenantKey).(string)
+	return tenant, ok
+}
+
+// Set trace ID of request.
+func SetTraceId(r *http.Request, traceId string) {
+	httpcontext.Set(r, traceIdKey, traceId)
+}
+
+// Get trace ID of request.
+func TraceId(r *http.Request) (string, bool) {
+	traceId, ok := httpcontext.Get(r, traceIdKey).(string)
+	return traceId, ok
+}
@@ -0,0 +1,80 @@
+package wapi
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"github.com/sath33sh/infra/util"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Start a test server which runs the websocket loop for every connection.
+func newTestServer(t *testing.T, userId, sessionId string) (host string, close func()) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := NewConn(w, r, "test: ")
+		if err != nil {
+			t.Errorf("NewConn failed: %v", err)
+			return
+		}
+		c.StartLoop(w, r, userId, sessionId)
+	}))
+
+	// Reset cached URLs and connect without TLS.
+	os.Setenv("WAPI_SECURE", "false")
+	httpUrl, wsUrl = "", ""
+
+	return strings.TrimPrefix(srv.URL, "http://"), srv.Close
+}
+
+func whoami(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user, ok := User(r)
+	if !ok {
+		ReturnError(w, r, util.ErrInvalidSession)
+		return
+	}
+	traceId, _ := TraceId(r)
+	ReturnOk(w, r, map[string]string{"user": user.Id, "session": user.SessionId, "trace": traceId})
+}
+
+func TestContextRest(t *testing.T) {
+	r := httptest.NewRequest("GET", "/test/whoami", nil)
+	SetUser(r, UserInfo{Id: "1", SessionId: "s1"})
+	SetTraceId(r, "t1")
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"user":"1"`) ||
+		!strings.Contains(w.Body.String(), `"trace":"t1"`) {
+		t.Errorf("Unexpected response %d: %s", w.Code, w.Body.String())
+	}
+
+	// Context is released after the request.
+	if _, ok := User(r); ok {
+		t.Errorf("User found after request")
+	}
+
+	// Values not set.
+	r = httptest.NewRequest("GET", "/test/whoami", nil)
+	if _, ok := User(r); ok {
+		t.Errorf("User found in empty context")
+	}
+	if _, ok := Tenant(r); ok {
+		t.Errorf("Tenant found in empty context")
+	}
+}
+
+func TestContextWebsocket(t *testing.T) {
+	host, closeServer := newTestServer(t, "2", "s2")
+	defer closeServer()
+
+	c := newTestClient(t, host)
+	defer c.ws.Close()
+
+	resp, err := Call[struct{}, map[string]string](c, "GET", "/test/whoami", struct{}{})
+	if err != nil || resp["user"] != "2" || resp["session"] != "s2" {
+		t.Errorf("Unexpected response %v, error %v", resp, err)
+	}
+}
@@ -0,0 +1,75 @@
+package wapi
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type item struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+func createItem(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var it item
+	if err := DecodeJSON(r, &it); err != nil {
+		ReturnError(w, r, err)
+		return
+	}
+
+	it.Id = "item:" + it.Name
+	ReturnCreated(w, r, "/test/items/"+it.Id, &it)
+}
+
+func TestReturnCreatedRest(t *testing.T) {
+	r := httptest.NewRequest("POST", "/test/items", strings.NewReader(`{"name":"a"}`))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	if w.Code != http.StatusCreated || w.Header().Get("Location") != "/test/items/item:a" ||
+		!strings.Contains(w.Body.String(), `"id":"item:a"`) {
+		t.Errorf("Unexpected response %d, location %q: %s", w.Code, w.Header().Get("Location"), w.Body.String())
+	}
+}
+
+func TestReturnCreatedWebsocket(t *testing.T) {
+	host, closeServer := newTestServer(t, "3", "s3")
+	defer closeServer()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+host+"/", nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer ws.Close()
+
+	// Location is set only on created response.
+	tests := []struct {
+		method   string
+		uri      string
+		location string
+	}{
+		{"POST", "/test/items", "/test/items/item:b"},
+		{"GET", "/test/whoami", ""},
+	}
+
+	for _, tt := range tests {
+		req := Envelope{Rid: tt.uri, Method: tt.method, Uri: tt.uri, Data: json.RawMessage(`{"name":"b"}`)}
+		if err = ws.WriteJSON(&req); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+
+		var resp Envelope
+		if err = ws.ReadJSON(&resp); err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+
+		if resp.Error != nil || resp.Location != tt.location {
+			t.Errorf("%s: unexpected response %+v", tt.uri, resp)
+		}
+	}
+}
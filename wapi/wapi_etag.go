@@ -0,0 +1,64 @@
+package wapi
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/nbio/httpcontext"
+	"net/http"
+	"strings"
+)
+
+// Conditional request headers.
+const (
+	HeaderETag        = "ETag"
+	HeaderIfNoneMatch = "If-None-Match"
+)
+
+// Compute strong entity tag of data, e.g. of the encoded resource.
+func ComputeETag(data []byte) string {
+	sum := sha1.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// Check whether entity tag matches If-None-Match value, a list of tags or "*".
+// Comparison is weak, i.e. ignores the W/ prefix.
+func etagMatch(ifNoneMatch, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Handle conditional GET. Sets entity tag of the response, in the ETag header
+// (REST) or the envelope (websocket). If the request's If-None-Match matches
+// it, responds 304 Not Modified and returns true: the handler must then return
+// without writing a response. Websocket clients of protocol version 1 always
+// get full responses.
+func NotModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	if c, ok := httpcontext.GetOk(r, WS); ok {
+		// Websocket request.
+		conn := c.(*Conn)
+		conn.envelope.ETag = etag
+
+		if conn.version < ProtocolVersion2 || !etagMatch(conn.envelope.IfNoneMatch, etag) {
+			return false
+		}
+
+		conn.wsReturnNotModified()
+		return true
+	}
+
+	// REST request.
+	w.Header().Set(HeaderETag, etag)
+
+	if !etagMatch(r.Header.Get(HeaderIfNoneMatch), etag) {
+		return false
+	}
+
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
@@ -0,0 +1,91 @@
+package wapi
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// Number of full responses of etagItem.
+var etagServed atomic.Int32
+
+// Conditional GET test handler.
+func etagItem(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	etag := ComputeETag([]byte("item-v1"))
+	if NotModified(w, r, etag) {
+		return
+	}
+
+	etagServed.Add(1)
+	ReturnOk(w, r, map[string]string{"name": "item", "version": "1"})
+}
+
+func TestNotModifiedRest(t *testing.T) {
+	etag := ComputeETag([]byte("item-v1"))
+
+	tests := []struct {
+		ifNoneMatch string
+		status      int
+	}{
+		{"", http.StatusOK},
+		{`"other"`, http.StatusOK},
+		{etag, http.StatusNotModified},
+		{`"other", W/` + etag, http.StatusNotModified},
+		{"*", http.StatusNotModified},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/test/etag", nil)
+		if tt.ifNoneMatch != "" {
+			r.Header.Set(HeaderIfNoneMatch, tt.ifNoneMatch)
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		if w.Code != tt.status || w.Header().Get(HeaderETag) != etag {
+			t.Errorf("If-None-Match %q: expected status %d, got %d, ETag %s", tt.ifNoneMatch, tt.status, w.Code, w.Header().Get(HeaderETag))
+		}
+		if tt.status == http.StatusNotModified && w.Body.Len() > 0 {
+			t.Errorf("If-None-Match %q: unexpected body %s", tt.ifNoneMatch, w.Body.String())
+		}
+	}
+}
+
+func TestClientCache(t *testing.T) {
+	c := newHarnessClient(t, "30", "s30", WithCache())
+	served := etagServed.Load()
+
+	for i := 0; i < 3; i++ {
+		resp, err := Call[struct{}, map[string]string](c, "GET", "/test/etag", struct{}{})
+		if err != nil || resp["name"] != "item" || resp["version"] != "1" {
+			t.Fatalf("Call %d: unexpected response %v, error %v", i, resp, err)
+		}
+	}
+
+	// Only the first call got a full response. Later calls were served from cache.
+	if n := etagServed.Load() - served; n != 1 {
+		t.Errorf("Expected 1 full response, got %d", n)
+	}
+
+	// Callers modifying their response do not modify the cache.
+	resp, _ := Call[struct{}, map[string]string](c, "GET", "/test/etag", struct{}{})
+	resp["name"] = "modified"
+	if resp, err := Call[struct{}, map[string]string](c, "GET", "/test/etag", struct{}{}); err != nil || resp["name"] != "item" {
+		t.Errorf("Cached response modified by caller: %v, error %v", resp, err)
+	}
+
+	// Without cache, every call gets a full response.
+	nc := newHarnessClient(t, "31", "s31")
+	served = etagServed.Load()
+	for i := 0; i < 2; i++ {
+		if _, err := Call[struct{}, map[string]string](nc, "GET", "/test/etag", struct{}{}); err != nil {
+			t.Fatalf("Call %d: unexpected error %v", i, err)
+		}
+	}
+	if n := etagServed.Load() - served; n != 2 {
+		t.Errorf("Expected 2 full responses, got %d", n)
+	}
+}
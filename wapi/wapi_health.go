@@ -0,0 +1,115 @@
+package wapi
+
+import (
+	"github.com/sath33sh/infra/config"
+	"github.com/sath33sh/infra/log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Health check of a dependency, e.g. db or push broker. Returns error if unhealthy.
+type HealthCheck func() error
+
+// Health gating. While a gating dependency is unhealthy, new requests are shed
+// with util.ErrUnavailable instead of queueing up behind failing dependencies,
+// and pings fail so that load balancers take the node out of rotation.
+var health struct {
+	sync.Mutex                        // Mutex for accessing checks.
+	checks     map[string]HealthCheck // Registered checks by dependency name.
+	gates      []string               // Dependencies gating traffic.
+	unhealthy  atomic.Bool            // A gating dependency is unhealthy.
+}
+
+// Default interval of health checks.
+const HEALTH_CHECK_INTERVAL = 5 * time.Second
+
+// Register health check of dependency. Checks only gate traffic when enabled
+// with config "health-gates".
+func RegisterHealthCheck(name string, check HealthCheck) {
+	health.Lock()
+	if health.checks == nil {
+		health.checks = make(map[string]HealthCheck)
+	}
+	health.checks[name] = check
+	health.Unlock()
+}
+
+// Check whether requests are shed due to unhealthy dependencies.
+func Unhealthy() bool {
+	return health.unhealthy.Load()
+}
+
+// Run gating health checks and update health state.
+func checkHealth() {
+	// Copy gating checks, run unlocked.
+	health.Lock()
+	names := make([]string, 0, len(health.gates))
+	checks := make([]HealthCheck, 0, len(health.gates))
+	for _, name := range health.gates {
+		if check, ok := health.checks[name]; ok {
+			names = append(names, name)
+			checks = append(checks, check)
+		}
+	}
+	health.Unlock()
+
+	unhealthy := false
+	for i, check := range checks {
+		if err := check(); err != nil {
+			log.Errorf("Health check %s failed: %v", names[i], err)
+			unhealthy = true
+		}
+	}
+
+	if health.unhealthy.Swap(unhealthy) != unhealthy {
+		if unhealthy {
+			log.Errorf("Dependencies unhealthy: shedding requests")
+		} else {
+			log.Infof("Dependencies healthy: accepting requests")
+		}
+	}
+}
+
+// Set dependencies gating traffic.
+func setHealthGates(gates []string) {
+	health.Lock()
+	health.gates = gates
+	health.Unlock()
+}
+
+// Start health gating, if enabled in config. Opt-in: "health-gates" lists the
+// dependencies gating traffic, e.g. ["db", "push"], checked every
+// "health-check-seconds".
+func initHealthGates() {
+	gates := config.Base.GetStringSlice(MODULE, "health-gates", nil)
+	if len(gates) == 0 {
+		return
+	}
+
+	interval := HEALTH_CHECK_INTERVAL
+	if secs := config.Base.GetInt(MODULE, "health-check-seconds", 0); secs > 0 {
+		interval = time.Duration(secs) * time.Second
+	}
+
+	health.Lock()
+	for _, name := range gates {
+		if _, ok := health.checks[name]; !ok {
+			log.Errorf("No health check registered for %s", name)
+		}
+	}
+	health.Unlock()
+
+	setHealthGates(gates)
+	log.Infof("Health gates %v, checked every %v", gates, interval)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for !draining.Load() {
+			checkHealth()
+			<-ticker.C
+		}
+	}()
+}
@@ -0,0 +1,76 @@
+package wapi
+
+import (
+	"github.com/sath33sh/infra/util"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHealthGates(t *testing.T) {
+	var dbDown atomic.Bool
+	RegisterHealthCheck("fakedb", func() error {
+		if dbDown.Load() {
+			return util.ErrDbAccess
+		}
+		return nil
+	})
+	RegisterHealthCheck("ungated", func() error { return util.ErrNetAccess })
+
+	setHealthGates([]string{"fakedb"})
+	defer func() {
+		setHealthGates(nil)
+		checkHealth()
+	}()
+
+	status := func() int {
+		r := httptest.NewRequest("GET", "/test/whoami", nil)
+		SetUser(r, UserInfo{Id: "1", SessionId: "s1"})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	pingStatus := func() int {
+		w := httptest.NewRecorder()
+		Ping(w, httptest.NewRequest("GET", "/ping", nil), nil)
+		return w.Code
+	}
+
+	// Connect while healthy. New connections are shed too while unhealthy.
+	c := newHarnessClient(t, "15", "s15")
+
+	// Healthy, despite failing ungated check.
+	checkHealth()
+	if Unhealthy() || status() != http.StatusOK {
+		t.Errorf("Expected requests accepted while healthy")
+	}
+
+	// Dependency fails: requests are shed, over both transports.
+	dbDown.Store(true)
+	checkHealth()
+	if code := status(); !Unhealthy() || code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d while unhealthy, got %d", http.StatusServiceUnavailable, code)
+	}
+	if code := pingStatus(); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected ping status %d while unhealthy, got %d", http.StatusServiceUnavailable, code)
+	}
+
+	if _, err := Call[struct{}, map[string]string](c, "GET", "/test/whoami", struct{}{}); err != util.ErrUnavailable {
+		t.Errorf("Expected error %v, got %v", util.ErrUnavailable, err)
+	}
+
+	// Dependency recovers.
+	dbDown.Store(false)
+	checkHealth()
+	if Unhealthy() || status() != http.StatusOK {
+		t.Errorf("Expected requests accepted after recovery")
+	}
+	if code := pingStatus(); code != http.StatusOK {
+		t.Errorf("Expected ping status %d after recovery, got %d", http.StatusOK, code)
+	}
+	if _, err := Call[struct{}, map[string]string](c, "GET", "/test/whoami", struct{}{}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
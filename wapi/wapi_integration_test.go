@@ -0,0 +1,220 @@
+package wapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"github.com/sath33sh/infra/push"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// In-process server for integration tests. The server is started once per test
+// binary, on the real router with the handlers registered in TestMain, and shut
+// down gracefully by stopHarness.
+var harness struct {
+	once    sync.Once // Start server once.
+	host    string    // Server host.
+	started bool      // Server started.
+}
+
+// Websocket handler of harness server.
+func harnessWs(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	cr, err := ParseCredentials(r)
+	if err != nil {
+		ReturnError(w, r, err)
+		return
+	}
+
+	if c, err := NewConn(w, r, "harness: "); err == nil {
+		c.StartLoop(w, r, cr.UserId, cr.SessionId)
+	}
+}
+
+// Get host of harness server, starting it if needed.
+func harnessHost(t *testing.T) string {
+	harness.once.Do(func() {
+		l, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatalf("Listen failed: %v", err)
+		}
+		port := l.Addr().(*net.TCPAddr).Port
+		l.Close()
+
+		GET("/ws", harnessWs)
+		go StartServer(port, false, "", "")
+
+		// Wait for server.
+		host := fmt.Sprintf("localhost:%d", port)
+		for i := 0; i < 50; i++ {
+			if conn, err := net.Dial("tcp", host); err == nil {
+				conn.Close()
+				harness.host = host
+				harness.started = true
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	})
+
+	if harness.host == "" {
+		t.Fatalf("Harness server not started")
+	}
+
+	return harness.host
+}
+
+// Connect client of user session to harness server. Client is closed when the
+// test completes.
+func newHarnessClient(t *testing.T, userId, sessionId string, opts ...ClientOption) *Client {
+	host := harnessHost(t)
+
+	// Reset cached URLs, which other tests point to their own servers.
+	os.Setenv("WAPI_SECURE", "false")
+	httpUrl, wsUrl = "", ""
+
+	c, err := NewClient(host, userId, sessionId, "token", false, false, NopOnConnError, opts...)
+	if err != nil {
+		t.Fatalf("Failed to connect to %s: %v", host, err)
+	}
+	t.Cleanup(c.Close)
+
+	return c
+}
+
+// Push object to user once the server has opened the user's push session.
+func pushWhenOnline(t *testing.T, userId string, obj push.Pushable) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		if delivered, _ := push.PushToUsers([]string{userId}, obj); delivered > 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Push session of %s not opened", userId)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Shut down harness server, if started. Fails if connections do not close.
+func stopHarness() error {
+	if !harness.started {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return Shutdown(ctx)
+}
+
+func TestIntegrationCall(t *testing.T) {
+	c := newHarnessClient(t, "10", "s10")
+
+	resp, err := Call[json.RawMessage, map[string]interface{}](c, "POST", "/test/echomap", json.RawMessage(`{"a":"b"}`))
+	if err != nil || resp["a"] != "b" {
+		t.Errorf("Unexpected response %v, error %v", resp, err)
+	}
+
+	// Handler context carries the connection's user.
+	who, err := Call[struct{}, map[string]string](c, "GET", "/test/whoami", struct{}{})
+	if err != nil || who["user"] != "10" || who["session"] != "s10" {
+		t.Errorf("Unexpected response %v, error %v", who, err)
+	}
+
+	// Unknown route.
+	if _, err = Call[struct{}, struct{}](c, "GET", "/test/missing", struct{}{}); err == nil {
+		t.Errorf("Expected error for unknown route")
+	}
+}
+
+func TestIntegrationConcurrentCalls(t *testing.T) {
+	c := newHarnessClient(t, "11", "s11")
+
+	// Concurrent calls each get their own response, while pushes are written to
+	// the same connection.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			push.PushToUsers([]string{"11"}, &binaryObject{data: []byte{byte(i)}})
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			text := fmt.Sprintf("call%d", i)
+			resp, err := Call[map[string]string, map[string]interface{}](c, "POST", "/test/echomap",
+				map[string]string{"text": text})
+			if err != nil || resp["text"] != text {
+				t.Errorf("Call %d: unexpected response %v, error %v", i, resp, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	<-done
+}
+
+func TestIntegrationPush(t *testing.T) {
+	c := newHarnessClient(t, "12", "s12")
+	pushes := c.Pushes()
+
+	data := []byte("payload")
+	pushWhenOnline(t, "12", &binaryObject{data: data})
+
+	select {
+	case e := <-pushes:
+		if !e.Push || e.Uri != "/test/binary" || string(e.Binary) != string(data) {
+			t.Errorf("Unexpected push %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Push not received")
+	}
+}
+
+func TestIntegrationSlowHeaders(t *testing.T) {
+	conn, err := net.Dial("tcp", harnessHost(t))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	// Send incomplete headers. Server closes connection after read header timeout.
+	start := time.Now()
+	fmt.Fprintf(conn, "GET /test/whoami HTTP/1.1\r\nHost: localhost\r\n")
+	conn.SetReadDeadline(time.Now().Add(5 * HttpLimits.ReadHeaderTimeout))
+	buf := make([]byte, 1024)
+	for {
+		if _, err = conn.Read(buf); err != nil {
+			break
+		}
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatalf("Connection not closed after %v", time.Since(start))
+	}
+}
+
+func TestIntegrationMaxHeaderBytes(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://"+harnessHost(t)+"/test/whoami", nil)
+	req.Header.Set("X-Large", strings.Repeat("x", 4*HttpLimits.MaxHeaderBytes))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("Expected status %d, got %d", http.StatusRequestHeaderFieldsTooLarge, resp.StatusCode)
+	}
+}
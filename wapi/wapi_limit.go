@@ -0,0 +1,79 @@
+package wapi
+
+import (
+	"github.com/sath33sh/infra/config"
+	"github.com/sath33sh/infra/log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Token bucket rate limiter.
+type tokenBucket struct {
+	sync.Mutex           // Mutex for accessing bucket.
+	rate       float64   // Tokens added per second.
+	burst      float64   // Bucket capacity.
+	tokens     float64   // Available tokens.
+	last       time.Time // Last refill time.
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Take a token if available. A nil bucket never limits.
+func (tb *tokenBucket) Allow() bool {
+	if tb == nil {
+		return true
+	}
+
+	tb.Lock()
+	defer tb.Unlock()
+
+	// Refill.
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+
+	if tb.tokens < 1 {
+		return false
+	}
+
+	tb.tokens--
+	return true
+}
+
+// Global request rate limiter. Disabled when nil.
+var globalLimiter atomic.Pointer[tokenBucket]
+
+// Set global request rate limit. Zero rate disables the limiter.
+// Requests exceeding the limit are shed with util.ErrRateLimit.
+func SetGlobalRateLimit(rate float64, burst int) {
+	if rate <= 0 {
+		globalLimiter.Store(nil)
+		return
+	}
+
+	if burst < 1 {
+		burst = 1
+	}
+
+	globalLimiter.Store(newTokenBucket(rate, burst))
+	log.Infof("Global rate limit: %v requests/sec, burst %d", rate, burst)
+}
+
+// Read global rate limit from config.
+func initGlobalRateLimit() {
+	rate := config.Base.GetInt(MODULE, "global-rate", 0)
+	burst := config.Base.GetInt(MODULE, "global-burst", rate)
+
+	SetGlobalRateLimit(float64(rate), burst)
+}
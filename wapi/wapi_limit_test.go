@@ -0,0 +1,47 @@
+package wapi
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTokenBucket(t *testing.T) {
+	tb := newTokenBucket(0.001, 5)
+
+	for i := 0; i < 5; i++ {
+		if !tb.Allow() {
+			t.Fatalf("Request %d denied within burst", i)
+		}
+	}
+
+	if tb.Allow() {
+		t.Errorf("Request allowed beyond burst")
+	}
+
+	// Nil bucket never limits.
+	var nilBucket *tokenBucket
+	if !nilBucket.Allow() {
+		t.Errorf("Nil bucket denied request")
+	}
+}
+
+func TestGlobalRateLimit(t *testing.T) {
+	GET("/test/limit", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		ReturnOk(w, r, "ok")
+	})
+
+	SetGlobalRateLimit(0.001, 2)
+	defer SetGlobalRateLimit(0, 0)
+
+	for i, expected := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		req := httptest.NewRequest("GET", "/test/limit", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != expected {
+			t.Errorf("Request %d: expected status %d, got %d", i, expected, w.Code)
+		}
+	}
+}
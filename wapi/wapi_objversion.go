@@ -0,0 +1,37 @@
+package wapi
+
+import (
+	"github.com/nbio/httpcontext"
+	"net/http"
+)
+
+// Object version header. Carries opaque version tokens of objects, for
+// optimistic concurrency: responses carry the version of the object read, and
+// clients send it back with updates of the object, which fail with 409
+// Conflict (util.ErrAlreadyExists) if the object changed in between. Websocket
+// envelopes carry the token in ObjVersion.
+const HeaderObjVersion = "X-Obj-Version"
+
+// Set version token of object in response, e.g. of db.Lock.Token of the CAS
+// got by db.GetCas.
+func SetObjVersion(w http.ResponseWriter, r *http.Request, token string) {
+	if c, ok := httpcontext.GetOk(r, WS); ok {
+		// Websocket request.
+		c.(*Conn).envelope.ObjVersion = token
+	} else {
+		// REST request.
+		w.Header().Set(HeaderObjVersion, token)
+	}
+}
+
+// Get version token of object sent with request, empty if none. Handlers check
+// it on write, e.g. with db.ParseLockToken and db.ReplaceCas.
+func ObjVersion(r *http.Request) string {
+	if c, ok := httpcontext.GetOk(r, WS); ok {
+		// Websocket request.
+		return c.(*Conn).objVersion
+	}
+
+	// REST request.
+	return r.Header.Get(HeaderObjVersion)
+}
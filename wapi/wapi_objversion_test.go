@@ -0,0 +1,150 @@
+package wapi
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"github.com/julienschmidt/httprouter"
+	"github.com/sath33sh/infra/util"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Versioned document, standing in for a database object and its CAS.
+var versionedDoc struct {
+	sync.Mutex
+	value string
+	cas   uint64
+}
+
+type docValue struct {
+	Value string `json:"value"`
+}
+
+func getDoc(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	versionedDoc.Lock()
+	defer versionedDoc.Unlock()
+
+	SetObjVersion(w, r, strconv.FormatUint(versionedDoc.cas, 36))
+	ReturnOk(w, r, docValue{Value: versionedDoc.value})
+}
+
+func updateDoc(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req docValue
+	if err := DecodeJSON(r, &req); err != nil {
+		ReturnError(w, r, err)
+		return
+	}
+
+	versionedDoc.Lock()
+	defer versionedDoc.Unlock()
+
+	cas, err := strconv.ParseUint(ObjVersion(r), 36, 64)
+	if err != nil {
+		ReturnError(w, r, util.ErrInvalidInput)
+		return
+	}
+	if cas != versionedDoc.cas {
+		ReturnError(w, r, util.ErrAlreadyExists)
+		return
+	}
+
+	versionedDoc.value = req.Value
+	versionedDoc.cas++
+
+	SetObjVersion(w, r, strconv.FormatUint(versionedDoc.cas, 36))
+	ReturnOk(w, r, req)
+}
+
+func TestObjVersionRest(t *testing.T) {
+	exec := func(method, token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/test/doc", strings.NewReader(body))
+		if token != "" {
+			r.Header.Set(HeaderObjVersion, token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	// Two clients read the document.
+	a, b := exec("GET", "", ""), exec("GET", "", "")
+	token := a.Header().Get(HeaderObjVersion)
+	if a.Code != http.StatusOK || token == "" || b.Header().Get(HeaderObjVersion) != token {
+		t.Fatalf("Unexpected responses %d %v, %d %v", a.Code, a.Header(), b.Code, b.Header())
+	}
+
+	// First update wins, and gets the new version.
+	w := exec("POST", token, `{"value": "a"}`)
+	if w.Code != http.StatusOK || w.Header().Get(HeaderObjVersion) == token {
+		t.Fatalf("First update: unexpected response %d %v", w.Code, w.Header())
+	}
+	newToken := w.Header().Get(HeaderObjVersion)
+
+	// Second update conflicts.
+	if w = exec("POST", token, `{"value": "b"}`); w.Code != http.StatusConflict {
+		t.Errorf("Second update: expected %d, got %d", http.StatusConflict, w.Code)
+	}
+
+	// Update without version is rejected.
+	if w = exec("POST", "", `{"value": "b"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Update without version: expected %d, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	if w = exec("GET", "", ""); w.Header().Get(HeaderObjVersion) != newToken || !strings.Contains(w.Body.String(), `"a"`) {
+		t.Errorf("Unexpected document %s, version %s", w.Body.String(), w.Header().Get(HeaderObjVersion))
+	}
+}
+
+func TestObjVersionWebsocket(t *testing.T) {
+	host := harnessHost(t)
+
+	hdr := http.Header{
+		HeaderUserId:      {"objversion"},
+		HeaderSessionId:   {"s1"},
+		HeaderAccessToken: {"token"},
+	}
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+host+"/ws", hdr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer ws.Close()
+
+	exec := func(method, token, body string) Envelope {
+		req := Envelope{Method: method, Uri: "/test/doc", ObjVersion: token}
+		if body != "" {
+			req.Data = json.RawMessage(body)
+		}
+		if err := ws.WriteJSON(&req); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		for {
+			var resp Envelope
+			if err := ws.ReadJSON(&resp); err != nil {
+				t.Fatalf("Read failed: %v", err)
+			}
+			if !resp.Push {
+				return resp
+			}
+		}
+	}
+
+	token := exec("GET", "", "").ObjVersion
+	if token == "" {
+		t.Fatalf("Version token missing")
+	}
+
+	resp := exec("POST", token, `{"value": "ws"}`)
+	if resp.Error != nil || resp.ObjVersion == "" || resp.ObjVersion == token {
+		t.Fatalf("First update: unexpected response %+v", resp)
+	}
+
+	var respErr util.ErrJson
+	resp = exec("POST", token, `{"value": "stale"}`)
+	if json.Unmarshal(resp.Error, &respErr); respErr.Code != int(util.ErrAlreadyExists) || resp.ObjVersion != "" {
+		t.Errorf("Second update: expected error %v, got %+v", util.ErrAlreadyExists, resp)
+	}
+}
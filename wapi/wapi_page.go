@@ -0,0 +1,71 @@
+package wapi
+
+import (
+	"fmt"
+	"github.com/nbio/httpcontext"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Pagination headers.
+const (
+	HeaderTotalCount = "X-Total-Count"
+	HeaderLink       = "Link"
+)
+
+// Page metadata of a list response.
+type PageInfo struct {
+	Total   int  `json:"total"`   // Total number of items. Negative if unknown.
+	Limit   int  `json:"limit"`   // Page size.
+	Offset  int  `json:"offset"`  // Offset of this page.
+	HasMore bool `json:"hasMore"` // More items follow this page.
+}
+
+// Build link to page at offset, preserving other query parameters.
+func pageLink(u *url.URL, limit, offset int, rel string) string {
+	q := u.Query()
+	q.Set("limit", strconv.Itoa(limit))
+	q.Set("offset", strconv.Itoa(offset))
+
+	link := url.URL{Path: u.Path, RawQuery: q.Encode()}
+
+	return fmt.Sprintf(`<%s>; rel="%s"`, link.String(), rel)
+}
+
+// Set page metadata on response. Must be called before ReturnOk.
+// REST responses get X-Total-Count and Link (rel="next"/"prev") headers.
+// Websocket responses carry the metadata in the envelope.
+func SetPageInfo(w http.ResponseWriter, r *http.Request, pi PageInfo) {
+	if pi.Total >= 0 && pi.Offset+pi.Limit < pi.Total {
+		pi.HasMore = true
+	}
+
+	if c, ok := httpcontext.GetOk(r, WS); ok {
+		// Websocket request.
+		c.(*Conn).envelope.Page = &pi
+		return
+	}
+
+	// REST request.
+	if pi.Total >= 0 {
+		w.Header().Set(HeaderTotalCount, strconv.Itoa(pi.Total))
+	}
+
+	var links []string
+	if pi.HasMore {
+		links = append(links, pageLink(r.URL, pi.Limit, pi.Offset+pi.Limit, "next"))
+	}
+	if pi.Offset > 0 {
+		prev := pi.Offset - pi.Limit
+		if prev < 0 {
+			prev = 0
+		}
+		links = append(links, pageLink(r.URL, pi.Limit, prev, "prev"))
+	}
+
+	if len(links) > 0 {
+		w.Header().Set(HeaderLink, strings.Join(links, ", "))
+	}
+}
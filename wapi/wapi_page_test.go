@@ -0,0 +1,49 @@
+package wapi
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSetPageInfo(t *testing.T) {
+	tests := []struct {
+		pi    PageInfo
+		total string
+		link  string
+	}{
+		{
+			PageInfo{Total: 45, Limit: 20, Offset: 0},
+			"45",
+			`</items?filter=a&limit=20&offset=20>; rel="next"`,
+		},
+		{
+			PageInfo{Total: 45, Limit: 20, Offset: 20},
+			"45",
+			`</items?filter=a&limit=20&offset=40>; rel="next", </items?filter=a&limit=20&offset=0>; rel="prev"`,
+		},
+		{
+			PageInfo{Total: 45, Limit: 20, Offset: 40},
+			"45",
+			`</items?filter=a&limit=20&offset=20>; rel="prev"`,
+		},
+		{
+			PageInfo{Total: -1, Limit: 20, Offset: 10, HasMore: true},
+			"",
+			`</items?filter=a&limit=20&offset=30>; rel="next", </items?filter=a&limit=20&offset=0>; rel="prev"`,
+		},
+	}
+
+	for i, tt := range tests {
+		r := httptest.NewRequest("GET", "/items?filter=a&offset=5", nil)
+		w := httptest.NewRecorder()
+
+		SetPageInfo(w, r, tt.pi)
+
+		if got := w.Header().Get(HeaderTotalCount); got != tt.total {
+			t.Errorf("Test %d: expected total %q, got %q", i, tt.total, got)
+		}
+		if got := w.Header().Get(HeaderLink); got != tt.link {
+			t.Errorf("Test %d: expected link %q, got %q", i, tt.link, got)
+		}
+	}
+}
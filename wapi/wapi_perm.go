@@ -0,0 +1,122 @@
+package wapi
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"github.com/sath33sh/infra/log"
+	"github.com/sath33sh/infra/util"
+	"net/http"
+	"sync/atomic"
+)
+
+// Permission check. Returns true if user has permission.
+type PermFunc func(userId string, perm string) bool
+
+// Registered permission check.
+var permFunc atomic.Pointer[PermFunc]
+
+// Register permission check consulted for routes requiring a permission.
+// Without a registered check, such routes deny all requests.
+func SetPermFunc(f PermFunc) {
+	permFunc.Store(&f)
+}
+
+// Authentication of REST request. Returns the authenticated user.
+type AuthFunc func(r *http.Request) (UserInfo, error)
+
+// Registered authentication.
+var authFunc atomic.Pointer[AuthFunc]
+
+// Register authentication of REST requests to routes requiring a permission.
+// Websocket requests are authenticated when the connection starts. Without a
+// registered authentication, REST requests to such routes are unauthorized.
+func SetAuthFunc(f AuthFunc) {
+	authFunc.Store(&f)
+}
+
+// Authenticate request and save its user, unless already authenticated.
+func authenticate(r *http.Request) (user UserInfo, ok bool) {
+	if user, ok = User(r); ok {
+		return user, true
+	}
+
+	f := authFunc.Load()
+	if f == nil || *f == nil {
+		return UserInfo{}, false
+	}
+
+	user, err := (*f)(r)
+	if err != nil {
+		log.Debugf(MODULE, "%s %s: authentication failed: %v", r.Method, r.URL.Path, err)
+		return UserInfo{}, false
+	}
+	SetUser(r, user)
+
+	return user, true
+}
+
+// Route options, given at registration.
+type RouteOption func(ro *routeOptions)
+
+type routeOptions struct {
+	perm   string // Required permission.
+	tenant bool   // Tenant required.
+}
+
+// Require permission for route. Authenticated user (see SetUser and
+// SetAuthFunc) must have the permission, else the request fails with
+// util.ErrInvalidPerm. Unauthenticated requests fail with util.ErrUnauthorized.
+func RequirePerm(perm string) RouteOption {
+	return func(ro *routeOptions) {
+		ro.perm = perm
+	}
+}
+
+// Check whether user has permission.
+func permitted(userId, perm string) bool {
+	f := permFunc.Load()
+	if f == nil || *f == nil {
+		log.Errorf("No permission check registered: denying %s to user %s", perm, userId)
+		return false
+	}
+
+	return (*f)(userId, perm)
+}
+
+// Wrap handler with route options.
+func withOptions(h Handler, opts []RouteOption) Handler {
+	var ro routeOptions
+	for _, opt := range opts {
+		opt(&ro)
+	}
+
+	if ro.perm == "" && !ro.tenant {
+		return h
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		if ro.perm != "" {
+			user, ok := authenticate(r)
+			if !ok {
+				ReturnError(w, r, util.ErrUnauthorized)
+				return
+			}
+
+			if !permitted(user.Id, ro.perm) {
+				log.Debugf(MODULE, "%s %s: user %s lacks permission %s", r.Method, r.URL.Path, user.Id, ro.perm)
+				ReturnError(w, r, util.ErrInvalidPerm)
+				return
+			}
+		}
+
+		if ro.tenant {
+			tenant, err := extractTenant(r)
+			if err != nil {
+				ReturnError(w, r, err)
+				return
+			}
+			SetTenant(r, tenant)
+		}
+
+		h(w, r, params)
+	}
+}
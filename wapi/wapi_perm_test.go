@@ -0,0 +1,122 @@
+package wapi
+
+import (
+	"github.com/sath33sh/infra/util"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Grant admin permission to user "admin".
+func testPermFunc(userId, perm string) bool {
+	return perm == "admin" && userId == "admin"
+}
+
+func TestRequirePermRest(t *testing.T) {
+	defer SetPermFunc(nil)
+	SetPermFunc(testPermFunc)
+
+	tests := []struct {
+		user   string
+		status int
+	}{
+		{"admin", http.StatusOK},
+		{"guest", http.StatusForbidden},
+		{"", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/test/admin", nil)
+		if tt.user != "" {
+			SetUser(r, UserInfo{Id: tt.user, SessionId: "s1"})
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		if w.Code != tt.status {
+			t.Errorf("User %q: expected status %d, got %d: %s", tt.user, tt.status, w.Code, w.Body.String())
+		}
+	}
+
+	// Without permission check, access is denied.
+	SetPermFunc(nil)
+	r := httptest.NewRequest("GET", "/test/admin", nil)
+	SetUser(r, UserInfo{Id: "admin", SessionId: "s1"})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d, got %d", http.StatusForbidden, w.Code)
+	}
+}
+
+// Authenticate user of credentials headers.
+func testAuthFunc(r *http.Request) (UserInfo, error) {
+	cr, err := ParseCredentials(r)
+	if err != nil {
+		return UserInfo{}, err
+	}
+
+	return UserInfo{Id: cr.UserId, SessionId: cr.SessionId}, nil
+}
+
+func TestRequirePermAuth(t *testing.T) {
+	defer SetPermFunc(nil)
+	SetPermFunc(testPermFunc)
+
+	tests := []struct {
+		user   string
+		status int
+	}{
+		{"admin", http.StatusOK},
+		{"guest", http.StatusForbidden},
+		{"", http.StatusUnauthorized},
+	}
+
+	request := func(user string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/test/admin", nil)
+		if user != "" {
+			r.Header.Set(HeaderUserId, user)
+			r.Header.Set(HeaderSessionId, "s1")
+			r.Header.Set(HeaderAccessToken, "token")
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	// Without authentication, requests are unauthorized.
+	if w := request("admin"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	defer SetAuthFunc(nil)
+	SetAuthFunc(testAuthFunc)
+
+	for _, tt := range tests {
+		if w := request(tt.user); w.Code != tt.status {
+			t.Errorf("User %q: expected status %d, got %d: %s", tt.user, tt.status, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestRequirePermWebsocket(t *testing.T) {
+	defer SetPermFunc(nil)
+	SetPermFunc(testPermFunc)
+
+	admin := newHarnessClient(t, "admin", "s1")
+	if resp, err := Call[struct{}, map[string]string](admin, "GET", "/test/admin", struct{}{}); err != nil || resp["user"] != "admin" {
+		t.Errorf("Admin: unexpected response %v, error %v", resp, err)
+	}
+
+	guest := newHarnessClient(t, "guest", "s1")
+	if _, err := Call[struct{}, map[string]string](guest, "GET", "/test/admin", struct{}{}); err != util.ErrInvalidPerm {
+		t.Errorf("Guest: expected error %v, got %v", util.ErrInvalidPerm, err)
+	}
+
+	// Routes without permission are unaffected.
+	if _, err := Call[struct{}, map[string]string](guest, "GET", "/test/whoami", struct{}{}); err != nil {
+		t.Errorf("Guest: unexpected error %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+package wapi
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Envelope protocol versions. Clients negotiate the version with websocket
+// subprotocol "wapi.v<version>" when connecting. Clients not requesting a
+// subprotocol get version 1.
+//
+// Version 1: original envelope.
+// Version 2: envelopes carry "version", and responses carry "status", the HTTP
+// status code of the result (e.g. 201 for ReturnCreated).
+const (
+	ProtocolVersion1 = 1
+	ProtocolVersion2 = 2
+
+	// Minimum supported protocol version.
+	MinProtocolVersion = ProtocolVersion1
+
+	// Subprotocol name prefix.
+	subprotocolPrefix = "wapi.v"
+)
+
+// Get subprotocol name of version.
+func subprotocol(version int) string {
+	return subprotocolPrefix + strconv.Itoa(version)
+}
+
+// Get version of subprotocol name. Unknown names map to version 1.
+func subprotocolVersion(name string) int {
+	if v, err := strconv.Atoi(strings.TrimPrefix(name, subprotocolPrefix)); err == nil &&
+		strings.HasPrefix(name, subprotocolPrefix) && v >= MinProtocolVersion && v <= ProtocolVersion {
+		return v
+	}
+
+	return ProtocolVersion1
+}
+
+// Get subprotocols of versions from max down to the minimum, in preference order.
+func subprotocols(max int) (names []string) {
+	for v := max; v >= MinProtocolVersion; v-- {
+		names = append(names, subprotocol(v))
+	}
+
+	return names
+}
+
+// Set version fields of response envelope. Version 1 envelopes omit them.
+func (c *Conn) setVersion(e *Envelope, status int) {
+	if c.version < ProtocolVersion2 {
+		e.Version, e.Status = 0, 0
+		return
+	}
+
+	e.Version = c.version
+	if e.Status == 0 {
+		e.Status = status
+	}
+}
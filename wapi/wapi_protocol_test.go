@@ -0,0 +1,95 @@
+package wapi
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"testing"
+)
+
+func TestSubprotocolVersion(t *testing.T) {
+	for name, expected := range map[string]int{
+		"":        ProtocolVersion1,
+		"wapi.v1": ProtocolVersion1,
+		"wapi.v2": ProtocolVersion2,
+		"wapi.v9": ProtocolVersion1,
+		"other.2": ProtocolVersion1,
+	} {
+		if v := subprotocolVersion(name); v != expected {
+			t.Errorf("Subprotocol %q: expected version %d, got %d", name, expected, v)
+		}
+	}
+}
+
+// Dial harness server offering subprotocols, and execute a request.
+func rawCall(t *testing.T, subprotocols []string, method, uri string, data string) (version int, resp map[string]json.RawMessage) {
+	hdr := http.Header{
+		HeaderUserId:      {"20"},
+		HeaderSessionId:   {"s20"},
+		HeaderAccessToken: {"token"},
+	}
+	dialer := websocket.Dialer{Subprotocols: subprotocols}
+	ws, _, err := dialer.Dial("ws://"+harnessHost(t)+"/ws", hdr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer ws.Close()
+
+	if err = ws.WriteJSON(&Envelope{Rid: uri, Method: method, Uri: uri, Data: json.RawMessage(data)}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err = ws.ReadJSON(&resp); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+
+	return subprotocolVersion(ws.Subprotocol()), resp
+}
+
+func TestProtocolVersions(t *testing.T) {
+	tests := []struct {
+		subprotocols []string
+		method       string
+		uri          string
+		version      int
+		status       string
+	}{
+		// Version 1 envelopes keep the original shape.
+		{nil, "POST", "/test/items", ProtocolVersion1, ""},
+		{[]string{"wapi.v1"}, "GET", "/test/missing", ProtocolVersion1, ""},
+		// Version 2 envelopes carry version and status.
+		{[]string{"wapi.v2", "wapi.v1"}, "POST", "/test/items", ProtocolVersion2, "201"},
+		{[]string{"wapi.v2"}, "GET", "/test/whoami", ProtocolVersion2, "200"},
+		{[]string{"wapi.v2"}, "GET", "/test/missing", ProtocolVersion2, "400"},
+	}
+
+	for _, tt := range tests {
+		version, resp := rawCall(t, tt.subprotocols, tt.method, tt.uri, `{"name":"v"}`)
+		if version != tt.version {
+			t.Errorf("%v %s: expected version %d, got %d", tt.subprotocols, tt.uri, tt.version, version)
+		}
+
+		_, hasVersion := resp["version"]
+		if hasVersion != (tt.version > ProtocolVersion1) || string(resp["status"]) != tt.status {
+			t.Errorf("%v %s: unexpected response %s %s", tt.subprotocols, tt.uri, resp["version"], resp["status"])
+		}
+	}
+}
+
+func TestClientProtocolVersion(t *testing.T) {
+	defer func() { ClientProtocolVersion = ProtocolVersion }()
+
+	for _, v := range []int{ProtocolVersion1, ProtocolVersion2} {
+		ClientProtocolVersion = v
+
+		c := newHarnessClient(t, "21", "s21")
+		if c.Version() != v {
+			t.Errorf("Expected version %d, got %d", v, c.Version())
+		}
+
+		// Requests work in either version.
+		if resp, err := Call[struct{}, map[string]string](c, "GET", "/test/whoami", struct{}{}); err != nil || resp["user"] != "21" {
+			t.Errorf("Version %d: unexpected response %v, error %v", v, resp, err)
+		}
+		c.Close()
+	}
+}
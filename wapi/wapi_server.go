@@ -1,16 +1,30 @@
 package wapi
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/julienschmidt/httprouter"
 	"github.com/nbio/httpcontext"
+	"github.com/sath33sh/infra/config"
 	"github.com/sath33sh/infra/log"
+	"github.com/sath33sh/infra/metrics"
+	"github.com/sath33sh/infra/util"
+	"github.com/sath33sh/infra/version"
+	"io"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 )
 
 const MODULE = "wapi"
 
+// Latest protocol version of the websocket envelope. See ProtocolVersion1.
+const ProtocolVersion = ProtocolVersion2
+
 type Router struct {
 	mux *httprouter.Router
 }
@@ -24,30 +38,66 @@ type Handler httprouter.Handle
 type Param httprouter.Param
 type Params httprouter.Params
 
-func GET(path string, h Handler) {
-	router.mux.GET(path, httprouter.Handle(h))
+func GET(path string, h Handler, opts ...RouteOption) {
+	router.mux.GET(path, watch("GET", path, limitConcurrency("GET", path, withOptions(h, opts))))
 }
 
-func POST(path string, h Handler) {
-	router.mux.POST(path, httprouter.Handle(h))
+func POST(path string, h Handler, opts ...RouteOption) {
+	router.mux.POST(path, watch("POST", path, limitConcurrency("POST", path, withOptions(h, opts))))
 }
 
-func DELETE(path string, h Handler) {
-	router.mux.DELETE(path, httprouter.Handle(h))
+func DELETE(path string, h Handler, opts ...RouteOption) {
+	router.mux.DELETE(path, watch("DELETE", path, limitConcurrency("DELETE", path, withOptions(h, opts))))
 }
 
 func ServeFiles(path, root string) {
 	router.mux.ServeFiles(path, http.Dir(root))
 }
 
+// Serve files like ServeFiles, with caching headers. Responses may be cached
+// for maxAge (Cache-Control and Expires), and are revalidated by entity tag
+// (ETag, of file modification time and size) or by If-Modified-Since, getting
+// 304 Not Modified while the file is unchanged. Path must end with /*filepath.
+func ServeFilesCached(path, root string, maxAge time.Duration) {
+	if !strings.HasSuffix(path, "/*filepath") {
+		panic("path must end with /*filepath in path '" + path + "'")
+	}
+
+	fs := http.Dir(root)
+	fileServer := http.FileServer(fs)
+	cacheControl := "public, max-age=" + strconv.Itoa(int(maxAge.Seconds()))
+
+	router.mux.GET(path, func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		name := ps.ByName("filepath")
+
+		// Set caching headers of existing files. The file server checks
+		// conditional headers against the entity tag and modification time.
+		if f, err := fs.Open(name); err == nil {
+			if fi, err := f.Stat(); err == nil && !fi.IsDir() {
+				w.Header().Set("Cache-Control", cacheControl)
+				w.Header().Set("Expires", time.Now().Add(maxAge).UTC().Format(http.TimeFormat))
+				w.Header().Set(HeaderETag, fmt.Sprintf(`W/"%x-%x"`, fi.ModTime().UnixNano(), fi.Size()))
+			}
+			f.Close()
+		}
+
+		req.URL.Path = name
+		fileServer.ServeHTTP(w, req)
+	})
+}
+
 func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// Release request context once handled.
+	defer httpcontext.Clear(req)
+
 	if origin := req.Header.Get("Origin"); origin != "" {
 		// log.Debugf(MODULE, "Origin %s: %s", origin, req.URL)
 
 		w.Header().Set("Access-Control-Allow-Origin", origin)
 		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers",
-			"Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-UserId, X-AccessToken, X-SessionId, X-AppVersion")
+			"Accept, Content-Type, Content-Length, Content-Encoding, Accept-Encoding, X-CSRF-Token, Authorization, X-UserId, X-AccessToken, X-SessionId, X-AppVersion, If-None-Match, X-Obj-Version, X-Tenant-Id")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Total-Count, Link, Location, ETag, X-Obj-Version")
 	}
 
 	if req.Method == "OPTIONS" {
@@ -55,18 +105,256 @@ func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if draining.Load() {
+		// Shutting down. Reject new requests.
+		ReturnError(w, req, util.ErrUnavailable)
+		return
+	}
+
+	if health.unhealthy.Load() {
+		// Dependencies unhealthy. Shed load until they recover.
+		ReturnError(w, req, util.ErrUnavailable)
+		return
+	}
+
+	if !globalLimiter.Load().Allow() {
+		// Global request budget exhausted. Shed load.
+		ReturnError(w, req, util.ErrRateLimit)
+		return
+	}
+
+	if err := checkCredentialHeaders(req); err != nil {
+		// Malformed credentials.
+		log.Debugf(MODULE, "%s %s: malformed credentials", req.Method, req.URL.Path)
+		ReturnError(w, req, err)
+		return
+	}
+
 	r.mux.ServeHTTP(w, req)
 }
 
-// Get JSON data from request.
-func DecodeJSON(r *http.Request, v interface{}) error {
+// Validator interface. Request data types implementing this interface are
+// validated by DecodeJSON after decoding.
+type Validator interface {
+	Validate() error
+}
+
+// Validate decoded request data. Validation failures are returned as
+// util.ErrInvalidInput unless the validator returns a util.Err or
+// util.FieldErrs.
+func validate(r *http.Request, v interface{}) error {
+	vd, ok := v.(Validator)
+	if !ok {
+		return nil
+	}
+
+	if err := vd.Validate(); err != nil {
+		switch e := err.(type) {
+		case util.Err:
+			return e
+		case util.FieldErrs:
+			return e
+		}
+
+		log.Debugf(MODULE, "%s %s: invalid input: %v", r.Method, r.URL.Path, err)
+		return util.ErrInvalidInput
+	}
+
+	return nil
+}
+
+// Maximum size of REST request body. Websocket requests are limited by MaxMessageSize.
+var MaxBodySize int64 = 1024 * 1024
+
+// Decompress gzip encoded REST request bodies (Content-Encoding: gzip).
+var DecompressBody = true
+
+// Read body size limit and decompression from config.
+func initBodyLimit() {
+	MaxBodySize = int64(config.Base.GetInt(MODULE, "max-body-bytes", int(MaxBodySize)))
+	DecompressBody = config.Base.GetBool(MODULE, "decompress-body", DecompressBody)
+}
+
+// Gzip encoded request body. The gzip reader is created on first read, so
+// that header errors surface from reads. Malformed data fails with
+// util.ErrInvalidInput.
+type gzipBody struct {
+	src io.Reader    // Compressed body.
+	gz  *gzip.Reader // Decompressor.
+}
+
+func (b *gzipBody) Read(p []byte) (n int, err error) {
+	if b.gz == nil {
+		if b.gz, err = gzip.NewReader(b.src); err != nil {
+			return 0, b.mapErr(err)
+		}
+	}
+
+	n, err = b.gz.Read(p)
+	return n, b.mapErr(err)
+}
+
+// Map decompression errors to util.ErrInvalidInput. Body size limit errors and
+// EOF pass through.
+func (b *gzipBody) mapErr(err error) error {
+	var mbe *http.MaxBytesError
+	if err == nil || err == io.EOF || errors.As(err, &mbe) {
+		return err
+	}
+
+	return util.ErrInvalidInput
+}
+
+// Get REST request body, limited to MaxBodySize. Gzip encoded bodies are
+// decompressed, with the limit applying to both the compressed and the
+// decompressed body, so that small bodies cannot inflate without bound.
+func limitBody(r *http.Request) io.Reader {
+	body := http.MaxBytesReader(nil, r.Body, MaxBodySize)
+	if !DecompressBody || !strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		return body
+	}
+
+	return http.MaxBytesReader(nil, io.NopCloser(&gzipBody{src: body}), MaxBodySize)
+}
+
+// Decode JSON data from request, without validation. Returns io.EOF if there
+// is no data, or util.ErrResourceLimit if REST body exceeds MaxBodySize.
+func decodeJSON(r *http.Request, v interface{}) error {
 	if c, ok := httpcontext.GetOk(r, WS); ok {
 		// Websocket request.
 		return c.(*Conn).wsGetData(v)
-	} else {
-		// REST request.
-		return json.NewDecoder(r.Body).Decode(v)
 	}
+
+	// REST request.
+	err := newJSONDecoder(limitBody(r)).Decode(v)
+
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		log.Debugf(MODULE, "%s %s: body exceeds %d bytes", r.Method, r.URL.Path, MaxBodySize)
+		return util.ErrResourceLimit
+	}
+
+	return err
+}
+
+// Get JSON data from request.
+func DecodeJSON(r *http.Request, v interface{}) (err error) {
+	if err = decodeJSON(r, v); err != nil {
+		return err
+	}
+
+	return validate(r, v)
+}
+
+// Get optional JSON data from request, for endpoints accepting no data, e.g.
+// POST with query parameters only. An empty REST body or missing websocket data
+// leaves v at its zero value, without error nor validation. Malformed data is
+// still an error.
+func DecodeOptionalJSON(r *http.Request, v interface{}) (err error) {
+	if err = decodeJSON(r, v); err == io.EOF {
+		// No data.
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return validate(r, v)
+}
+
+// Get JSON object from request as a map, for handlers accepting arbitrary data,
+// e.g. webhooks and relays. Returns util.ErrJsonDecode if data is not a JSON
+// object, or util.ErrResourceLimit if REST body exceeds MaxBodySize.
+func DecodeJSONMap(r *http.Request) (m map[string]interface{}, err error) {
+	if err = decodeJSON(r, &m); err != nil {
+		if err == util.ErrResourceLimit {
+			return nil, err
+		}
+
+		if err == util.ErrInvalidInput {
+			log.Debugf(MODULE, "%s %s: malformed gzip body", r.Method, r.URL.Path)
+			return nil, err
+		}
+
+		log.Debugf(MODULE, "%s %s: JSON decode error: %v", r.Method, r.URL.Path, err)
+		return nil, util.ErrJsonDecode
+	}
+
+	if m == nil {
+		// JSON null.
+		return nil, util.ErrJsonDecode
+	}
+
+	return m, nil
+}
+
+// JSON encoder settings, applied to REST and websocket responses.
+var (
+	JSONEscapeHTML = true // Escape <, > and & in strings.
+	JSONIndent     = ""   // Indentation, e.g. for debugging. Empty disables.
+)
+
+// JSON decoder settings, applied to requests (DecodeJSON, DecodeJSONMap) and
+// client responses.
+//
+// By default numbers decoded into interface{} become float64, which is exact
+// only up to 2^53. Larger integers, e.g. 64-bit IDs, counters and nanosecond
+// timestamps, lose precision. With JSONUseNumber they are decoded as
+// json.Number, preserving their text. Struct fields of integer types are
+// decoded exactly either way.
+var JSONUseNumber = false
+
+// Read JSON encoder and decoder settings from config.
+func initJSONEncoder() {
+	JSONEscapeHTML = config.Base.GetBool(MODULE, "json-escape-html", JSONEscapeHTML)
+	JSONIndent = config.Base.GetString(MODULE, "json-indent", JSONIndent)
+	JSONUseNumber = config.Base.GetBool(MODULE, "json-use-number", JSONUseNumber)
+}
+
+// Create JSON decoder with configured settings.
+func newJSONDecoder(r io.Reader) *json.Decoder {
+	dec := json.NewDecoder(r)
+	if JSONUseNumber {
+		dec.UseNumber()
+	}
+
+	return dec
+}
+
+// Unmarshal JSON with configured settings.
+func unmarshalJSON(data []byte, v interface{}) error {
+	dec := newJSONDecoder(bytes.NewReader(data))
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+
+	// Reject trailing data, as json.Unmarshal does.
+	if _, err := dec.Token(); err != io.EOF {
+		return util.ErrJsonDecode
+	}
+
+	return nil
+}
+
+// Create JSON encoder with configured settings.
+func newJSONEncoder(w io.Writer) *json.Encoder {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(JSONEscapeHTML)
+	if JSONIndent != "" {
+		enc.SetIndent("", JSONIndent)
+	}
+
+	return enc
+}
+
+// Marshal JSON with configured settings.
+func marshalJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := newJSONEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+
+	// Strip newline appended by encoder.
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
 }
 
 // Return success.
@@ -78,32 +366,168 @@ func ReturnOk(w http.ResponseWriter, r *http.Request, v interface{}) {
 		// REST request.
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(v)
+		newJSONEncoder(w).Encode(v)
 	}
 }
 
-// Return error.
-func ReturnError(w http.ResponseWriter, r *http.Request, err error) {
+// Return created resource with HTTP status 201. Location is the key or URI of
+// the created resource, returned in the Location header (REST) or the envelope
+// (websocket).
+func ReturnCreated(w http.ResponseWriter, r *http.Request, location string, v interface{}) {
 	if c, ok := httpcontext.GetOk(r, WS); ok {
 		// Websocket request.
-		c.(*Conn).wsReturnError(err)
+		c.(*Conn).envelope.Location = location
+		c.(*Conn).envelope.Status = http.StatusCreated
+		c.(*Conn).wsReturnOk(v)
 	} else {
 		// REST request.
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]error{"error": err})
+		w.Header().Set("Location", location)
+		w.WriteHeader(http.StatusCreated)
+		newJSONEncoder(w).Encode(v)
 	}
 }
 
+// Return raw bytes of content type, e.g. images, files or CSV. REST responses
+// carry the bytes as body. Websocket responses are binary frames: the envelope,
+// with ContentType set, followed by the bytes. Websocket responses larger than
+// MaxMessageSize fail with util.ErrResourceLimit, since clients cannot read them.
+func ReturnBytes(w http.ResponseWriter, r *http.Request, contentType string, data []byte) {
+	if c, ok := httpcontext.GetOk(r, WS); ok {
+		// Websocket request.
+		if len(data) > MaxMessageSize {
+			log.Errorf("%s %s: response of %d bytes exceeds message size", r.Method, r.URL.Path, len(data))
+			c.(*Conn).wsReturnError(util.ErrResourceLimit)
+			return
+		}
+		c.(*Conn).wsReturnBytes(util.MediaType(contentType), data)
+	} else {
+		// REST request.
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(data)
+	}
+}
+
+// Return error.
+func ReturnError(w http.ResponseWriter, r *http.Request, err error) {
+	returnErrorStatus(w, r, errorStatus(err), err)
+}
+
+// Return errors of input fields, as util.ErrInvalidInput listing the fields.
+func ReturnErrors(w http.ResponseWriter, r *http.Request, errs ...util.FieldErr) {
+	ReturnError(w, r, util.FieldErrs(errs))
+}
+
+// Get HTTP status of error. Errors without status are bad requests.
+func errorStatus(err error) int {
+	if e, ok := err.(interface{ HttpStatus() int }); ok {
+		return e.HttpStatus()
+	}
+
+	return http.StatusBadRequest
+}
+
+// Return error with HTTP status overriding the status of the error. Websocket
+// requests carry no status.
+func returnErrorStatus(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if c, ok := httpcontext.GetOk(r, WS); ok {
+		// Websocket request.
+		c.(*Conn).wsReturnError(err)
+		return
+	}
+
+	// REST request.
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	newJSONEncoder(w).Encode(map[string]error{"error": err})
+}
+
 func Ping(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if draining.Load() || health.unhealthy.Load() {
+		// Shutting down or dependencies unhealthy. Fail health checks of the
+		// ping server too.
+		ReturnError(w, r, util.ErrUnavailable)
+		return
+	}
+
 	ReturnOk(w, r, "pong")
 }
 
+// Version information.
+type VersionInfo struct {
+	version.Info
+	Protocol int `json:"protocol"` // Latest websocket envelope protocol version.
+}
+
+func Version(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	ReturnOk(w, r, VersionInfo{Info: version.BuildInfo(), Protocol: ProtocolVersion})
+}
+
 func init() {
 	// Create HTTP mux for REST APIs.
 	router.mux = httprouter.New()
 }
 
+// HTTP server limits, protecting against slow clients holding connections open
+// (slowloris) and oversized headers. Websocket connections are not affected
+// once upgraded: their loops set their own read and write deadlines.
+var HttpLimits = struct {
+	// Time allowed to read request headers. Slowloris clients send headers
+	// slowly to exhaust connections; without this they can hold a connection
+	// open indefinitely.
+	ReadHeaderTimeout time.Duration
+
+	// Time allowed to read the whole request, including body. Bounds slow
+	// body uploads. Keep it above the time needed for the largest expected
+	// body (see MaxBodySize) on slow networks.
+	ReadTimeout time.Duration
+
+	// Time a keep-alive connection may stay idle between requests.
+	IdleTimeout time.Duration
+
+	// Maximum size of request headers.
+	MaxHeaderBytes int
+}{
+	ReadHeaderTimeout: 10 * time.Second,
+	ReadTimeout:       30 * time.Second,
+	IdleTimeout:       120 * time.Second,
+	MaxHeaderBytes:    64 * 1024,
+}
+
+// Read HTTP server limits from config.
+func initHttpLimits() {
+	seconds := func(key string, dflt time.Duration) time.Duration {
+		secs := config.Base.GetInt(MODULE, key, int(dflt/time.Second))
+		if secs <= 0 {
+			log.Fatalf("Invalid %s %d", key, secs)
+		}
+		return time.Duration(secs) * time.Second
+	}
+
+	HttpLimits.ReadHeaderTimeout = seconds("read-header-timeout-seconds", HttpLimits.ReadHeaderTimeout)
+	HttpLimits.ReadTimeout = seconds("read-timeout-seconds", HttpLimits.ReadTimeout)
+	HttpLimits.IdleTimeout = seconds("idle-timeout-seconds", HttpLimits.IdleTimeout)
+	HttpLimits.MaxHeaderBytes = config.Base.GetInt(MODULE, "max-header-bytes", HttpLimits.MaxHeaderBytes)
+
+	log.Infof("HTTP limits: read header timeout %v, read timeout %v, idle timeout %v, max header bytes %d",
+		HttpLimits.ReadHeaderTimeout, HttpLimits.ReadTimeout, HttpLimits.IdleTimeout, HttpLimits.MaxHeaderBytes)
+}
+
+// Create HTTP server with configured limits. Write timeout is not set, so that
+// long running handlers and streamed responses are not cut off.
+func newHttpServer(port int, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              ":" + strconv.Itoa(port),
+		Handler:           handler,
+		ReadHeaderTimeout: HttpLimits.ReadHeaderTimeout,
+		ReadTimeout:       HttpLimits.ReadTimeout,
+		IdleTimeout:       HttpLimits.IdleTimeout,
+		MaxHeaderBytes:    HttpLimits.MaxHeaderBytes,
+	}
+}
+
 func runPing(port int) {
 	// Create a separate router for ping.
 	pingRouter := httprouter.New()
@@ -111,8 +535,10 @@ func runPing(port int) {
 	pingRouter.GET("/ping", httprouter.Handle(Ping))
 
 	// Listen and serve ping.
-	err := http.ListenAndServe(":"+strconv.Itoa(port), pingRouter)
-	if err != nil {
+	srv := newHttpServer(port, pingRouter)
+	pingServer.Store(srv)
+	err := srv.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatalf("HTTP serve failed for ping: %v", err)
 	}
 }
@@ -120,25 +546,75 @@ func runPing(port int) {
 func StartServer(port int, secure bool, certFile, keyFile string) {
 	var err error
 
+	log.Infof("Starting %s", version.Banner(MODULE))
+
+	// Initialize global rate limit.
+	initGlobalRateLimit()
+
+	// Initialize keepalive.
+	initKeepalive()
+
+	// Initialize websocket write timeout.
+	initWriteTimeout()
+
+	// Initialize JSON encoder settings.
+	initJSONEncoder()
+
+	// Initialize request body size limit.
+	initBodyLimit()
+
+	// Initialize slow handler watchdog.
+	initWatchdog()
+
+	// Initialize route concurrency limits.
+	initRouteConcurrency()
+
+	// Initialize HTTP server limits.
+	initHttpLimits()
+
+	// Initialize health gating.
+	initHealthGates()
+
+	// Register ping and version handlers.
+	GET("/ping", Ping)
+	GET("/version", Version)
+
+	// Register metrics handler for Prometheus scraping, if enabled.
+	if config.Base.GetBool(MODULE, "metrics-endpoint", false) {
+		router.mux.HandlerFunc("GET", "/metrics", metrics.Handler)
+	}
+
+	// Register admin API, if enabled.
+	if config.Base.GetBool(MODULE, "admin-endpoints", false) {
+		registerAdmin(config.Base.GetString(MODULE, "admin-perm", ADMIN_PERM))
+	}
+
 	if secure {
 		// GCE health check does not support HTTPS.
-		// As a workaround, start a separate ping service on the next port.
-		go runPing(port + 1)
+		// As a workaround, also serve ping on a separate port, the next one.
+		// Note that the ping port is unencrypted. It serves only /ping, but it is
+		// still an extra open port; disable it where health checks support HTTPS.
+		if config.Base.GetBool(MODULE, "ping-server", true) {
+			pingPort := config.Base.GetInt(MODULE, "ping-port", port+1)
+			log.Infof("Unencrypted ping server on port %d", pingPort)
+			go runPing(pingPort)
+		}
 
 		// Start HTTP service in TLS mode.
-		err = http.ListenAndServeTLS(":"+strconv.Itoa(port), certFile, keyFile, &router)
-		if err != nil {
+		srv := newHttpServer(port, &router)
+		server.Store(srv)
+		err = srv.ListenAndServeTLS(certFile, keyFile)
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatalf("HTTP TLS serve failed: %v", err)
 		}
 	} else {
 		log.Infof("Port %d is not secure", port)
 
-		// Register ping handler.
-		GET("/ping", Ping)
-
 		// Start HTTP service in unencrypted mode.
-		err = http.ListenAndServe(":"+strconv.Itoa(port), &router)
-		if err != nil {
+		srv := newHttpServer(port, &router)
+		server.Store(srv)
+		err = srv.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatalf("HTTP serve failed: %v", err)
 		}
 	}
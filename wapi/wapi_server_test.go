@@ -0,0 +1,476 @@
+package wapi
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"github.com/julienschmidt/httprouter"
+	"github.com/sath33sh/infra/config"
+	"github.com/sath33sh/infra/log"
+	"github.com/sath33sh/infra/push"
+	"github.com/sath33sh/infra/util"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type validatedReq struct {
+	Name string `json:"name"`
+	Age  int    `json:"age"`
+}
+
+func (vr *validatedReq) Validate() error {
+	if len(vr.Name) == 0 {
+		return errors.New("name is required")
+	}
+	if vr.Age < 0 {
+		return util.ErrInvalidObject
+	}
+	return nil
+}
+
+func TestDecodeJSONValidate(t *testing.T) {
+	tests := []struct {
+		body string
+		err  error
+	}{
+		{`{"name": "alice", "age": 30}`, nil},
+		{`{"age": 30}`, util.ErrInvalidInput},
+		{`{"name": "bob", "age": -1}`, util.ErrInvalidObject},
+	}
+
+	for i, tt := range tests {
+		r := httptest.NewRequest("POST", "/test/validate", strings.NewReader(tt.body))
+
+		var vr validatedReq
+		if err := DecodeJSON(r, &vr); err != tt.err {
+			t.Errorf("Test %d: expected error %v, got %v", i, tt.err, err)
+		}
+	}
+}
+
+// Form with field validation.
+type formReq struct {
+	Email string `json:"email"`
+	Age   int    `json:"age"`
+}
+
+func (fr *formReq) Validate() error {
+	var errs util.FieldErrs
+	if !strings.Contains(fr.Email, "@") {
+		errs = append(errs, util.FieldErr{Field: "email", Err: util.ErrInvalidInput})
+	}
+	if fr.Age < 0 {
+		errs = append(errs, util.FieldErr{Field: "age", Err: util.ErrInvalidObject})
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func submitForm(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req formReq
+	if err := DecodeJSON(r, &req); err != nil {
+		ReturnError(w, r, err)
+		return
+	}
+
+	if req.Email == "taken@example.com" {
+		ReturnErrors(w, r, util.FieldErr{Field: "email", Err: util.ErrAlreadyExists})
+		return
+	}
+
+	ReturnOk(w, r, req)
+}
+
+func TestFieldErrors(t *testing.T) {
+	tests := []struct {
+		body   string
+		fields []util.FieldErrJson
+	}{
+		{`{"email": "a@example.com"}`, nil},
+		{`{"email": "a", "age": -1}`, []util.FieldErrJson{
+			{Field: "email", Code: util.ErrInvalidInput.Code(), Message: util.ErrInvalidInput.Error()},
+			{Field: "age", Code: util.ErrInvalidObject.Code(), Message: util.ErrInvalidObject.Error()},
+		}},
+		{`{"email": "taken@example.com"}`, []util.FieldErrJson{
+			{Field: "email", Code: util.ErrAlreadyExists.Code(), Message: util.ErrAlreadyExists.Error()},
+		}},
+	}
+
+	c := newHarnessClient(t, "form", "s1")
+
+	for i, tt := range tests {
+		// REST.
+		r := httptest.NewRequest("POST", "/test/form", strings.NewReader(tt.body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		var resp struct {
+			Error util.ErrJson `json:"error"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if tt.fields == nil {
+			if w.Code != http.StatusOK {
+				t.Errorf("Test %d: unexpected response %d: %s", i, w.Code, w.Body.String())
+			}
+		} else if w.Code != http.StatusBadRequest || resp.Error.Code != util.ErrInvalidInput.Code() ||
+			!reflect.DeepEqual(resp.Error.Fields, tt.fields) {
+			t.Errorf("Test %d: unexpected response %d: %s", i, w.Code, w.Body.String())
+		}
+
+		// Websocket.
+		var respData formReq
+		var respErr util.ErrJson
+		err := c.RestExec("form", "POST", "/test/form", json.RawMessage(tt.body), &respData, &respErr)
+		if tt.fields == nil {
+			if err != nil {
+				t.Errorf("Test %d: unexpected error %v %v", i, err, respErr)
+			}
+		} else if respErr.Code != util.ErrInvalidInput.Code() || !reflect.DeepEqual(respErr.Fields, tt.fields) {
+			t.Errorf("Test %d: unexpected error %v %+v", i, err, respErr)
+		}
+	}
+}
+
+func echoMap(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	m, err := DecodeJSONMap(r)
+	if err != nil {
+		ReturnError(w, r, err)
+		return
+	}
+
+	ReturnOk(w, r, m)
+}
+
+// Handler accepting optional data.
+func optionalItem(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := DecodeOptionalJSON(r, &req); err != nil {
+		ReturnError(w, r, err)
+		return
+	}
+
+	ReturnOk(w, r, req)
+}
+
+func TestDecodeOptionalJSONRest(t *testing.T) {
+	tests := []struct {
+		body     string
+		status   int
+		expected string
+	}{
+		{``, http.StatusOK, `{"name":""}`},
+		{"  \n", http.StatusOK, `{"name":""}`},
+		{`{}`, http.StatusOK, `{"name":""}`},
+		{`{"name": "alice"}`, http.StatusOK, `{"name":"alice"}`},
+		{`{"name": `, http.StatusBadRequest, ``},
+	}
+
+	for i, tt := range tests {
+		r := httptest.NewRequest("POST", "/test/optional", strings.NewReader(tt.body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		if w.Code != tt.status || (tt.expected != "" && strings.TrimSpace(w.Body.String()) != tt.expected) {
+			t.Errorf("Test %d: expected %d %s, got %d %s", i, tt.status, tt.expected, w.Code, w.Body.String())
+		}
+	}
+
+	// Data stays required for DecodeJSON.
+	var vr validatedReq
+	if err := DecodeJSON(httptest.NewRequest("POST", "/test/validate", strings.NewReader("")), &vr); err == nil {
+		t.Errorf("Expected error for empty body")
+	}
+}
+
+func TestDecodeOptionalJSONWebsocket(t *testing.T) {
+	c := newHarnessClient(t, "14", "s14")
+
+	for _, data := range []interface{}{nil, json.RawMessage(`{}`)} {
+		var resp map[string]string
+		var respErr util.ErrJson
+		if err := c.RestExec("optional", "POST", "/test/optional", data, &resp, &respErr); err != nil || resp["name"] != "" {
+			t.Errorf("Data %s: unexpected response %v, error %v %v", data, resp, err, respErr)
+		}
+	}
+
+	resp, err := Call[json.RawMessage, map[string]string](c, "POST", "/test/optional", json.RawMessage(`{"name": "bob"}`))
+	if err != nil || resp["name"] != "bob" {
+		t.Errorf("Unexpected response %v, error %v", resp, err)
+	}
+}
+
+func TestDecodeJSONMapRest(t *testing.T) {
+	defer func(size int64) { MaxBodySize = size }(MaxBodySize)
+	MaxBodySize = 64
+
+	tests := []struct {
+		body string
+		err  error
+	}{
+		{`{"event": "push", "count": 2, "tags": ["a"]}`, nil},
+		{`["a", "b"]`, util.ErrJsonDecode},
+		{`null`, util.ErrJsonDecode},
+		{`{"event": `, util.ErrJsonDecode},
+		{`{"data": "` + strings.Repeat("x", 64) + `"}`, util.ErrResourceLimit},
+	}
+
+	for i, tt := range tests {
+		r := httptest.NewRequest("POST", "/test/echomap", strings.NewReader(tt.body))
+
+		m, err := DecodeJSONMap(r)
+		if err != tt.err {
+			t.Errorf("Test %d: expected error %v, got %v", i, tt.err, err)
+		} else if err == nil && (m["event"] != "push" || m["count"] != float64(2)) {
+			t.Errorf("Test %d: unexpected map %v", i, m)
+		}
+	}
+}
+
+func TestDecodeJSONBodyLimit(t *testing.T) {
+	defer func(size int64) { MaxBodySize = size }(MaxBodySize)
+	MaxBodySize = 64
+
+	body := `{"name": "` + strings.Repeat("x", 64) + `"}`
+
+	var vr validatedReq
+	if err := DecodeJSON(httptest.NewRequest("POST", "/test/validate", strings.NewReader(body)), &vr); err != util.ErrResourceLimit {
+		t.Errorf("DecodeJSON: expected error %v, got %v", util.ErrResourceLimit, err)
+	}
+	if err := DecodeOptionalJSON(httptest.NewRequest("POST", "/test/optional", strings.NewReader(body)), &vr); err != util.ErrResourceLimit {
+		t.Errorf("DecodeOptionalJSON: expected error %v, got %v", util.ErrResourceLimit, err)
+	}
+}
+
+func TestRestErrorJSONSettings(t *testing.T) {
+	defer func() { JSONIndent = "" }()
+	JSONIndent = "  "
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/test/echomap", strings.NewReader(`["a"]`)))
+
+	if w.Code != http.StatusBadRequest || !strings.HasPrefix(w.Body.String(), "{\n  \"error\"") {
+		t.Errorf("Expected indented error, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+// Gzip data.
+func gzipData(t *testing.T, data string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write([]byte(data)); err != nil {
+		t.Fatalf("Gzip failed: %v", err)
+	}
+	gz.Close()
+
+	return buf.Bytes()
+}
+
+func TestGzipBody(t *testing.T) {
+	defer func(size int64) { MaxBodySize = size }(MaxBodySize)
+	MaxBodySize = 1024
+
+	// Decompressed body exceeding the limit, compressed well below it.
+	bomb := `{"data": "` + strings.Repeat("x", 64*1024) + `"}`
+
+	tests := []struct {
+		body []byte
+		err  error
+	}{
+		{gzipData(t, `{"event": "push", "count": 2}`), nil},
+		{[]byte("not gzip"), util.ErrInvalidInput},
+		{gzipData(t, `{"event": "push", "count": 2}`)[:20], util.ErrInvalidInput},
+		{gzipData(t, bomb), util.ErrResourceLimit},
+	}
+
+	for i, tt := range tests {
+		r := httptest.NewRequest("POST", "/test/echomap", bytes.NewReader(tt.body))
+		r.Header.Set("Content-Encoding", "gzip")
+
+		m, err := DecodeJSONMap(r)
+		if err != tt.err {
+			t.Errorf("Test %d: expected error %v, got %v", i, tt.err, err)
+		} else if err == nil && (m["event"] != "push" || m["count"] != float64(2)) {
+			t.Errorf("Test %d: unexpected map %v", i, m)
+		}
+	}
+
+	// Gzipped JSON body through the router.
+	r := httptest.NewRequest("POST", "/test/items", bytes.NewReader(gzipData(t, `{"name":"gz"}`)))
+	r.Header.Set("Content-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), `"id":"item:gz"`) {
+		t.Errorf("Unexpected response %d: %s", w.Code, w.Body.String())
+	}
+
+	// Malformed gzip body through the router.
+	r = httptest.NewRequest("POST", "/test/items", strings.NewReader("not gzip"))
+	r.Header.Set("Content-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != util.ErrInvalidInput.HttpStatus() {
+		t.Errorf("Expected status %d, got %d: %s", util.ErrInvalidInput.HttpStatus(), w.Code, w.Body.String())
+	}
+}
+
+func TestDecodeJSONMapWebsocket(t *testing.T) {
+	host, closeServer := newTestServer(t, "4", "s4")
+	defer closeServer()
+
+	c := newTestClient(t, host)
+	defer c.ws.Close()
+
+	resp, err := Call[json.RawMessage, map[string]interface{}](c, "POST", "/test/echomap",
+		json.RawMessage(`{"event": "push", "nested": {"a": 1}}`))
+	if err != nil || resp["event"] != "push" || resp["nested"].(map[string]interface{})["a"] != float64(1) {
+		t.Errorf("Unexpected response %v, error %v", resp, err)
+	}
+
+	if _, err = Call[json.RawMessage, map[string]interface{}](c, "POST", "/test/echomap",
+		json.RawMessage(`[1, 2]`)); err != util.ErrJsonDecode {
+		t.Errorf("Expected error %v, got %v", util.ErrJsonDecode, err)
+	}
+}
+
+func TestJSONUseNumber(t *testing.T) {
+	defer func() { JSONUseNumber = false }()
+
+	// 2^53 + 1 is not representable as float64.
+	const id = "9007199254740993"
+	body := `{"id": ` + id + `}`
+
+	// Float64 loses precision.
+	r := httptest.NewRequest("POST", "/test/echomap", strings.NewReader(body))
+	m, err := DecodeJSONMap(r)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if f, ok := m["id"].(float64); !ok || strconv.FormatFloat(f, 'f', -1, 64) == id {
+		t.Errorf("Expected float64 losing precision, got %v", m["id"])
+	}
+
+	// Number preserves it, over both transports.
+	JSONUseNumber = true
+	r = httptest.NewRequest("POST", "/test/echomap", strings.NewReader(body))
+	if m, err = DecodeJSONMap(r); err != nil || m["id"] != json.Number(id) {
+		t.Errorf("Expected json.Number %s, got %#v, error %v", id, m["id"], err)
+	}
+
+	c := newHarnessClient(t, "13", "s13")
+	resp, err := Call[json.RawMessage, map[string]interface{}](c, "POST", "/test/echomap", json.RawMessage(body))
+	if err != nil || resp["id"] != json.Number(id) {
+		t.Errorf("Expected json.Number %s, got %#v, error %v", id, resp["id"], err)
+	}
+
+	// Trailing data is rejected.
+	var v interface{}
+	if err = unmarshalJSON([]byte(`{"a": 1}}`), &v); err == nil {
+		t.Errorf("Expected error for trailing data")
+	}
+}
+
+func TestJSONEscapeHTML(t *testing.T) {
+	defer func() { JSONEscapeHTML = true }()
+
+	for _, escape := range []bool{true, false} {
+		JSONEscapeHTML = escape
+
+		r := httptest.NewRequest("GET", "/test/json", nil)
+		w := httptest.NewRecorder()
+		ReturnOk(w, r, map[string]string{"url": "/a?b=1&c=2"})
+
+		unescaped := strings.Contains(w.Body.String(), "b=1&c=2")
+		if unescaped == escape {
+			t.Errorf("Escape %v: unexpected output %s", escape, w.Body.String())
+		}
+
+		data, _ := marshalJSON("a&b")
+		if (string(data) == `"a&b"`) == escape {
+			t.Errorf("Escape %v: unexpected websocket output %s", escape, data)
+		}
+	}
+}
+
+func TestServeFilesCached(t *testing.T) {
+	r := httptest.NewRequest("GET", "/test/static/app.js", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	etag := w.Header().Get(HeaderETag)
+	if w.Code != http.StatusOK || w.Body.String() != "console.log(\"app\");\n" {
+		t.Fatalf("Unexpected response %d %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Cache-Control") != "public, max-age=3600" || etag == "" {
+		t.Errorf("Unexpected cache headers %v", w.Header())
+	}
+	if expires, err := http.ParseTime(w.Header().Get("Expires")); err != nil || time.Until(expires) < 59*time.Minute {
+		t.Errorf("Unexpected Expires %s", w.Header().Get("Expires"))
+	}
+
+	// Conditional requests.
+	for header, value := range map[string]string{
+		HeaderIfNoneMatch:   etag,
+		"If-Modified-Since": w.Header().Get("Last-Modified"),
+	} {
+		r = httptest.NewRequest("GET", "/test/static/app.js", nil)
+		r.Header.Set(header, value)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+			t.Errorf("%s: expected %d, got %d", header, http.StatusNotModified, w.Code)
+		}
+	}
+
+	// Missing files are not cached.
+	r = httptest.NewRequest("GET", "/test/static/missing.js", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound || w.Header().Get("Cache-Control") != "" {
+		t.Errorf("Unexpected response %d, headers %v", w.Code, w.Header())
+	}
+}
+
+func TestMain(m *testing.M) {
+	// Init.
+	config.Init("testdata/config.json")
+	log.Init("", "error", false)
+	push.Init(true)
+
+	// Register test handlers.
+	GET("/test/whoami", whoami)
+	POST("/test/items", createItem)
+	POST("/test/echomap", echoMap)
+	GET("/test/admin", whoami, RequirePerm("admin"))
+	GET("/test/stream", streamRows)
+	GET("/test/etag", etagItem)
+	POST("/test/optional", optionalItem)
+	POST("/test/form", submitForm)
+	GET("/test/png", pngImage)
+	GET("/test/doc", getDoc)
+	POST("/test/doc", updateDoc)
+	GET("/test/tenant", getTenantDoc, RequireTenant())
+	POST("/test/tenant", putTenantDoc, RequireTenant())
+	ServeFilesCached("/test/static/*filepath", "testdata/static", time.Hour)
+
+	code := m.Run()
+
+	// Shut down integration test server.
+	if err := stopHarness(); err != nil {
+		log.Errorf("Harness shutdown failed: %v", err)
+		code = 1
+	}
+
+	os.Exit(code)
+}
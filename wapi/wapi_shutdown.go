@@ -0,0 +1,116 @@
+package wapi
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"github.com/sath33sh/infra/log"
+	"github.com/sath33sh/infra/util"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Server state for graceful shutdown.
+var (
+	server     atomic.Pointer[http.Server] // Running HTTP server.
+	pingServer atomic.Pointer[http.Server] // Running ping server, if any.
+	draining   atomic.Bool                 // Server is shutting down.
+)
+
+// Open websocket connections. Hijacked connections are not tracked by http.Server.
+var wsConns struct {
+	sync.Mutex                    // Mutex for accessing connections.
+	conns      map[*Conn]struct{} // Set of open connections.
+	wg         sync.WaitGroup     // Waitgroup for connection loops.
+}
+
+// Track websocket connection. Returns false if server is draining.
+func trackConn(c *Conn) bool {
+	wsConns.Lock()
+	defer wsConns.Unlock()
+
+	if draining.Load() {
+		return false
+	}
+
+	if wsConns.conns == nil {
+		wsConns.conns = make(map[*Conn]struct{})
+	}
+	wsConns.conns[c] = struct{}{}
+	wsConns.wg.Add(1)
+
+	return true
+}
+
+func untrackConn(c *Conn) {
+	wsConns.Lock()
+	delete(wsConns.conns, c)
+	wsConns.Unlock()
+
+	wsConns.wg.Done()
+}
+
+// Close open websocket connections with close code and reason.
+// Close frames are sent concurrently, as stuck clients delay them.
+func closeConns(code int, reason string) {
+	wsConns.Lock()
+	conns := make([]*Conn, 0, len(wsConns.conns))
+	for c := range wsConns.conns {
+		conns = append(conns, c)
+	}
+	wsConns.Unlock()
+
+	log.Infof("Closing %d websocket connections", len(conns))
+	for _, c := range conns {
+		go c.closeWith(code, reason)
+	}
+}
+
+// Check whether server is draining. Draining server rejects new requests with
+// util.ErrUnavailable.
+func Draining() bool {
+	return draining.Load()
+}
+
+// Gracefully shut down server: reject new requests, stop listening, wait for
+// in-flight REST requests and close websocket connections, waiting for their
+// loops to exit. Returns util.ErrTimeout if ctx expires first.
+func Shutdown(ctx context.Context) error {
+	// Reject new requests and websocket connections.
+	wsConns.Lock()
+	draining.Store(true)
+	wsConns.Unlock()
+
+	// Stop serving ping, failing health checks.
+	if srv := pingServer.Load(); srv != nil {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Errorf("Ping server shutdown error: %v", err)
+			return util.ErrTimeout
+		}
+	}
+
+	// Stop listening and wait for in-flight REST requests.
+	if srv := server.Load(); srv != nil {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Errorf("HTTP server shutdown error: %v", err)
+			return util.ErrTimeout
+		}
+	}
+
+	// Close websocket connections. Loops exit on read and write errors.
+	closeConns(websocket.CloseGoingAway, "server shutdown")
+
+	done := make(chan struct{})
+	go func() {
+		wsConns.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		log.Errorf("Websocket shutdown timed out")
+		return util.ErrTimeout
+	}
+}
@@ -0,0 +1,66 @@
+package wapi
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPingServerDraining(t *testing.T) {
+	// Pick a free port.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	go runPing(port)
+	defer pingServer.Store(nil)
+
+	// Connections are not reused, so that none is left open on shutdown.
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	url := "http://127.0.0.1:" + strconv.Itoa(port) + "/ping"
+	status := func() (int, error) {
+		resp, err := client.Get(url)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	for deadline := time.Now().Add(time.Second); ; {
+		if code, err := status(); err == nil {
+			if code != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d", http.StatusOK, code)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Ping server not started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Ping fails while draining.
+	draining.Store(true)
+	code, err := status()
+	draining.Store(false)
+	if err != nil || code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d while draining, got %d, error %v", http.StatusServiceUnavailable, code, err)
+	}
+
+	// Ping server stops on shutdown.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := pingServer.Load().Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	if _, err := status(); err == nil {
+		t.Errorf("Ping served after shutdown")
+	}
+}
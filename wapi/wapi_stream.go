@@ -0,0 +1,117 @@
+package wapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/nbio/httpcontext"
+	"github.com/sath33sh/infra/log"
+	"github.com/sath33sh/infra/util"
+	"net/http"
+	"strconv"
+)
+
+// Trailer carrying the error code of a REST stream that failed after the
+// response was started.
+const HeaderStreamError = "X-Stream-Error"
+
+// Rows written between flushes of a REST stream.
+const STREAM_FLUSH_ROWS = 100
+
+// Return JSON array of rows produced by produce, which calls write with each
+// row, raw JSON, in order. REST responses are streamed without buffering the
+// rows, for large exports. Websocket responses are buffered into a single
+// envelope, limited by the client's message size.
+//
+// An error returned by produce before any row was written is returned to the
+// client as usual. Once streaming has started, the status can no longer change:
+// the array is left unterminated, so that clients fail to parse it rather than
+// take it as complete, and the error code is set in the X-Stream-Error trailer.
+func StreamJSONArray(w http.ResponseWriter, r *http.Request, produce func(write func(row []byte) error) error) {
+	if c, ok := httpcontext.GetOk(r, WS); ok {
+		// Websocket request.
+		c.(*Conn).wsStreamJSONArray(produce)
+		return
+	}
+
+	// REST request.
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Trailer", HeaderStreamError)
+
+	flusher, _ := w.(http.Flusher)
+	rows := 0
+	write := func(row []byte) error {
+		if rows == 0 {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("["))
+		} else {
+			w.Write([]byte(","))
+		}
+		if _, err := w.Write(row); err != nil {
+			// Client went away.
+			return util.ErrNetAccess
+		}
+
+		rows++
+		if flusher != nil && rows%STREAM_FLUSH_ROWS == 0 {
+			flusher.Flush()
+		}
+
+		return nil
+	}
+
+	err := produce(write)
+	if err == nil {
+		if rows == 0 {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("[]"))
+		} else {
+			w.Write([]byte("]"))
+		}
+		return
+	}
+
+	if rows == 0 {
+		// Nothing written yet. Return error as usual.
+		w.Header().Del("Trailer")
+		ReturnError(w, r, err)
+		return
+	}
+
+	// Failed mid-stream. Leave array unterminated and report error in trailer.
+	code := util.ErrInternal
+	if e, ok := err.(util.Err); ok {
+		code = e
+	}
+	log.Errorf("%s %s: stream failed after %d rows: %v", r.Method, r.URL.Path, rows, err)
+	w.Header().Set(HeaderStreamError, strconv.Itoa(int(code)))
+}
+
+// Return JSON array of produced rows in a websocket response.
+func (c *Conn) wsStreamJSONArray(produce func(write func(row []byte) error) error) {
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+
+	err := produce(func(row []byte) error {
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		buf.Write(row)
+
+		if buf.Len() > MaxMessageSize {
+			return util.ErrResourceLimit
+		}
+
+		return nil
+	})
+	if err != nil {
+		if _, ok := err.(util.Err); !ok {
+			c.Errorf("Stream failed: %v", err)
+			err = util.ErrInternal
+		}
+		c.wsReturnError(err)
+		return
+	}
+
+	buf.WriteByte(']')
+	c.wsReturnOk(json.RawMessage(buf.Bytes()))
+}
@@ -0,0 +1,86 @@
+package wapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"github.com/sath33sh/infra/util"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// Stream "n" rows, failing after "fail" rows if given.
+func streamRows(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+	fail, err := strconv.Atoi(r.URL.Query().Get("fail"))
+	if err != nil {
+		fail = -1
+	}
+
+	StreamJSONArray(w, r, func(write func(row []byte) error) error {
+		for i := 0; i < n; i++ {
+			if i == fail {
+				return util.ErrDbAccess
+			}
+			if err := write([]byte(fmt.Sprintf(`{"id":%d}`, i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func TestStreamJSONArrayRest(t *testing.T) {
+	tests := []struct {
+		query  string
+		status int
+		rows   int
+		err    string
+	}{
+		{"n=10000", http.StatusOK, 10000, ""},
+		{"n=0", http.StatusOK, 0, ""},
+		{"n=10&fail=0", http.StatusBadRequest, -1, ""},
+		{"n=1000&fail=500", http.StatusOK, -1, strconv.Itoa(int(util.ErrDbAccess))},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/test/stream?"+tt.query, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		resp := w.Result()
+
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: expected status %d, got %d", tt.query, tt.status, resp.StatusCode)
+		}
+
+		var rows []map[string]int
+		err := json.Unmarshal(w.Body.Bytes(), &rows)
+		if tt.rows >= 0 && (err != nil || len(rows) != tt.rows) {
+			t.Errorf("%s: expected %d rows, got %d, error %v", tt.query, tt.rows, len(rows), err)
+		}
+		if tt.err != "" && (err == nil || resp.Trailer.Get(HeaderStreamError) != tt.err) {
+			t.Errorf("%s: expected unterminated array and error %s, got error %v, trailer %q",
+				tt.query, tt.err, err, resp.Trailer.Get(HeaderStreamError))
+		}
+	}
+}
+
+func TestStreamJSONArrayWebsocket(t *testing.T) {
+	c := newHarnessClient(t, "14", "s14")
+
+	rows, err := Call[struct{}, []map[string]int](c, "GET", "/test/stream?n=100", struct{}{})
+	if err != nil || len(rows) != 100 || rows[99]["id"] != 99 {
+		t.Errorf("Unexpected response %d rows, error %v", len(rows), err)
+	}
+
+	if _, err = Call[struct{}, []map[string]int](c, "GET", "/test/stream?n=10&fail=5", struct{}{}); err != util.ErrDbAccess {
+		t.Errorf("Expected error %v, got %v", util.ErrDbAccess, err)
+	}
+
+	// Result exceeding message size.
+	if _, err = Call[struct{}, []map[string]int](c, "GET", "/test/stream?n=100000", struct{}{}); err != util.ErrResourceLimit {
+		t.Errorf("Expected error %v, got %v", util.ErrResourceLimit, err)
+	}
+}
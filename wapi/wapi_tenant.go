@@ -0,0 +1,66 @@
+package wapi
+
+import (
+	"context"
+	"github.com/sath33sh/infra/db"
+	"github.com/sath33sh/infra/log"
+	"github.com/sath33sh/infra/util"
+	"net/http"
+	"sync/atomic"
+)
+
+// Tenant header, read when no tenant function is registered.
+const HeaderTenantId = "X-Tenant-Id"
+
+// Tenant extraction, e.g. from claims of the access token. Returns the tenant
+// ID of the request, or an error if it has none.
+type TenantFunc func(r *http.Request) (string, error)
+
+// Registered tenant extraction.
+var tenantFunc atomic.Pointer[TenantFunc]
+
+// Register tenant extraction for routes requiring a tenant. Without a
+// registered function, the tenant is read from the X-Tenant-Id header.
+func SetTenantFunc(f TenantFunc) {
+	tenantFunc.Store(&f)
+}
+
+// Require tenant for route. The tenant is extracted from the request (see
+// SetTenantFunc) and saved in the request context (see Tenant and
+// TenantContext), else the request fails with util.ErrInvalidInput.
+func RequireTenant() RouteOption {
+	return func(ro *routeOptions) {
+		ro.tenant = true
+	}
+}
+
+// Extract and validate tenant of request.
+func extractTenant(r *http.Request) (string, error) {
+	var tenant string
+	if f := tenantFunc.Load(); f != nil && *f != nil {
+		var err error
+		if tenant, err = (*f)(r); err != nil {
+			log.Debugf(MODULE, "%s %s: no tenant: %v", r.Method, r.URL.Path, err)
+			return "", util.ErrInvalidInput
+		}
+	} else {
+		tenant = r.Header.Get(HeaderTenantId)
+	}
+
+	if err := db.ValidateTenant(tenant); err != nil {
+		log.Debugf(MODULE, "%s %s: invalid tenant %q", r.Method, r.URL.Path, tenant)
+		return "", err
+	}
+
+	return tenant, nil
+}
+
+// Get context of request carrying its tenant, for building tenant scoped db
+// keys with db.TenantMeta.
+func TenantContext(r *http.Request) context.Context {
+	ctx := r.Context()
+	if tenant, ok := Tenant(r); ok {
+		ctx = db.WithTenant(ctx, tenant)
+	}
+	return ctx
+}
@@ -0,0 +1,142 @@
+package wapi
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/julienschmidt/httprouter"
+	"github.com/sath33sh/infra/db"
+	"github.com/sath33sh/infra/util"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Tenant scoped documents, standing in for the database, by key.
+var tenantDocs struct {
+	sync.Mutex
+	values map[string]string
+}
+
+// Get metadata of tenant scoped test document.
+func tenantDocMeta(r *http.Request) (db.ObjMeta, error) {
+	return db.TenantMeta(TenantContext(r), db.DEFAULT_BUCKET, "doc", "1")
+}
+
+func getTenantDoc(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	meta, err := tenantDocMeta(r)
+	if err != nil {
+		ReturnError(w, r, err)
+		return
+	}
+
+	tenantDocs.Lock()
+	defer tenantDocs.Unlock()
+
+	value, ok := tenantDocs.values[meta.Key()]
+	if !ok {
+		ReturnError(w, r, util.ErrNotFound)
+		return
+	}
+	ReturnOk(w, r, docValue{Value: value})
+}
+
+func putTenantDoc(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req docValue
+	if err := DecodeJSON(r, &req); err != nil {
+		ReturnError(w, r, err)
+		return
+	}
+
+	meta, err := tenantDocMeta(r)
+	if err != nil {
+		ReturnError(w, r, err)
+		return
+	}
+
+	tenantDocs.Lock()
+	if tenantDocs.values == nil {
+		tenantDocs.values = make(map[string]string)
+	}
+	tenantDocs.values[meta.Key()] = req.Value
+	tenantDocs.Unlock()
+
+	ReturnOk(w, r, req)
+}
+
+// Send tenant document request. Empty tenant omits the header.
+func tenantRequest(t *testing.T, method, tenant, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/test/tenant", strings.NewReader(body))
+	if tenant != "" {
+		r.Header.Set(HeaderTenantId, tenant)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	return w
+}
+
+func TestRequireTenant(t *testing.T) {
+	// Same document in two tenants does not collide.
+	for _, tenant := range []string{"acme", "globex"} {
+		if w := tenantRequest(t, "POST", tenant, `{"value":"`+tenant+`"}`); w.Code != http.StatusOK {
+			t.Fatalf("Tenant %s: unexpected response %d: %s", tenant, w.Code, w.Body.String())
+		}
+	}
+	for _, tenant := range []string{"acme", "globex"} {
+		w := tenantRequest(t, "GET", tenant, "")
+		var doc docValue
+		if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil || doc.Value != tenant {
+			t.Errorf("Tenant %s: unexpected response %d: %s", tenant, w.Code, w.Body.String())
+		}
+	}
+
+	// Missing and invalid tenants are rejected.
+	for _, tenant := range []string{"", "a:b"} {
+		if w := tenantRequest(t, "GET", tenant, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("Tenant %q: expected status %d, got %d", tenant, http.StatusBadRequest, w.Code)
+		}
+	}
+}
+
+func TestTenantFunc(t *testing.T) {
+	defer SetTenantFunc(nil)
+	SetTenantFunc(func(r *http.Request) (string, error) {
+		if r.Header.Get(HeaderAccessToken) == "" {
+			return "", errors.New("no token")
+		}
+		return "token-" + r.Header.Get(HeaderAccessToken), nil
+	})
+
+	r := httptest.NewRequest("POST", "/test/tenant", strings.NewReader(`{"value":"claims"}`))
+	r.Header.Set(HeaderAccessToken, "t1")
+	r.Header.Set(HeaderTenantId, "acme")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected response %d: %s", w.Code, w.Body.String())
+	}
+
+	// Tenant comes from the function, not the header.
+	tenantDocs.Lock()
+	value := tenantDocs.values["token-t1:doc:1"]
+	tenantDocs.Unlock()
+	if value != "claims" {
+		t.Errorf("Document not stored under tenant of token: %q", value)
+	}
+
+	if w := tenantRequest(t, "GET", "acme", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d without token, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestRequireTenantWebsocket(t *testing.T) {
+	c := newHarnessClient(t, "tenant", "s1")
+
+	// Harness client sends no tenant header.
+	if _, err := Call[docValue, docValue](c, "POST", "/test/tenant", docValue{Value: "ws"}); err != util.ErrInvalidInput {
+		t.Errorf("Expected error %v, got %v", util.ErrInvalidInput, err)
+	}
+}
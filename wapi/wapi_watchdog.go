@@ -0,0 +1,96 @@
+package wapi
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"github.com/sath33sh/infra/config"
+	"github.com/sath33sh/infra/log"
+	"github.com/sath33sh/infra/metrics"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Metric counting handlers that exceeded their slow threshold.
+const METRIC_SLOW_HANDLERS = "wapi_slow_handlers_total"
+
+// Slow handler thresholds. A slow handler is reported, not aborted.
+var watchdog struct {
+	sync.RWMutex
+	threshold time.Duration            // Default threshold. Zero disables the watchdog.
+	routes    map[string]time.Duration // Per-route thresholds, keyed by "<method> <path>".
+}
+
+func routeKey(method, path string) string {
+	return method + " " + path
+}
+
+// Set default slow handler threshold. Zero disables reporting of routes
+// without their own threshold.
+func SetSlowThreshold(d time.Duration) {
+	watchdog.Lock()
+	watchdog.threshold = d
+	watchdog.Unlock()
+}
+
+// Set slow handler threshold of a route, overriding the default. Path is the
+// pattern the handler was registered with. A negative threshold disables
+// reporting for the route.
+func SetRouteSlowThreshold(method, path string, d time.Duration) {
+	watchdog.Lock()
+	if watchdog.routes == nil {
+		watchdog.routes = make(map[string]time.Duration)
+	}
+	watchdog.routes[routeKey(method, path)] = d
+	watchdog.Unlock()
+}
+
+// Get slow handler threshold of route.
+func slowThreshold(route string) time.Duration {
+	watchdog.RLock()
+	defer watchdog.RUnlock()
+
+	if d, ok := watchdog.routes[route]; ok {
+		return d
+	}
+
+	return watchdog.threshold
+}
+
+// Read default slow handler threshold from config.
+func initWatchdog() {
+	if ms := config.Base.GetInt(MODULE, "slow-handler-ms", 0); ms > 0 {
+		SetSlowThreshold(time.Duration(ms) * time.Millisecond)
+		log.Infof("Slow handler threshold %v", watchdog.threshold)
+	}
+}
+
+// Wrap handler with watchdog. A handler still running after its threshold is
+// reported once when the threshold passes and again with its total duration
+// when it completes.
+func watch(method, path string, h Handler) httprouter.Handle {
+	route := routeKey(method, path)
+
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		threshold := slowThreshold(route)
+		if threshold <= 0 {
+			h(w, r, params)
+			return
+		}
+
+		// Capture request details. Websocket requests are reused after handler returns.
+		uri := r.URL.RequestURI()
+		user, _ := User(r)
+		start := time.Now()
+
+		timer := time.AfterFunc(threshold, func() {
+			log.Infof("Slow handler: %s %s, user %s: running over %v", method, uri, user.Id, threshold)
+			metrics.Add(METRIC_SLOW_HANDLERS, 1, "route", route)
+		})
+
+		h(w, r, params)
+
+		if !timer.Stop() {
+			log.Infof("Slow handler: %s %s, user %s: completed in %v", method, uri, user.Id, time.Since(start))
+		}
+	}
+}
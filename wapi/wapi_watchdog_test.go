@@ -0,0 +1,60 @@
+package wapi
+
+import (
+	"bytes"
+	"github.com/julienschmidt/httprouter"
+	"github.com/sath33sh/infra/metrics"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlowThreshold(t *testing.T) {
+	SetSlowThreshold(time.Second)
+	SetRouteSlowThreshold("GET", "/test/threshold", 5*time.Second)
+	SetRouteSlowThreshold("POST", "/test/threshold", -1)
+	defer SetSlowThreshold(0)
+
+	for route, expected := range map[string]time.Duration{
+		"GET /test/threshold":  5 * time.Second,
+		"POST /test/threshold": -1,
+		"GET /test/other":      time.Second,
+	} {
+		if d := slowThreshold(route); d != expected {
+			t.Errorf("Route %s: expected threshold %v, got %v", route, expected, d)
+		}
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	GET("/test/slow", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		time.Sleep(50 * time.Millisecond)
+		ReturnOk(w, r, "ok")
+	})
+	GET("/test/fast", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		ReturnOk(w, r, "ok")
+	})
+	SetRouteSlowThreshold("GET", "/test/slow", 5*time.Millisecond)
+	SetRouteSlowThreshold("GET", "/test/fast", 5*time.Millisecond)
+
+	for _, uri := range []string{"/test/slow", "/test/fast"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", uri, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected status %d, got %d", uri, http.StatusOK, w.Code)
+		}
+	}
+
+	var buf bytes.Buffer
+	metrics.WritePrometheus(&buf)
+	out := buf.String()
+
+	if !strings.Contains(out, METRIC_SLOW_HANDLERS+`{route="GET /test/slow"} 1`) {
+		t.Errorf("Slow handler not reported:\n%s", out)
+	}
+	if strings.Contains(out, `route="GET /test/fast"`) {
+		t.Errorf("Fast handler reported:\n%s", out)
+	}
+}
@@ -4,13 +4,17 @@ import (
 	"encoding/json"
 	"github.com/gorilla/websocket"
 	"github.com/nbio/httpcontext"
+	"github.com/sath33sh/infra/config"
 	"github.com/sath33sh/infra/log"
+	"github.com/sath33sh/infra/metrics"
 	"github.com/sath33sh/infra/push"
 	"github.com/sath33sh/infra/util"
 	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -31,31 +35,111 @@ const (
 
 	// Maximum message size allowed.
 	MaxMessageSize = 32 * 1024
+
+	// Method of application-level keepalive push. Clients must ignore it.
+	KeepaliveMethod = "KEEPALIVE"
 )
 
+// Interval for sending application-level keepalive pushes, in addition to
+// websocket pings. Some proxies and mobile networks drop connections that
+// carry no data frames. Zero disables keepalive pushes.
+var KeepaliveInterval time.Duration
+
+// Maximum idle time of websocket connection, without requests from client nor
+// pushes to it, after which the connection is closed. Unlike PingTimeout, it
+// recycles live but dormant connections. Pings and keepalive pushes are not
+// activity. Zero disables the idle timeout.
+var ConnIdleTimeout time.Duration
+
+// Read keepalive interval and idle timeout from config.
+func initKeepalive() {
+	if secs := config.Base.GetInt(MODULE, "keepalive-seconds", 0); secs > 0 {
+		KeepaliveInterval = time.Duration(secs) * time.Second
+		log.Infof("Keepalive interval %v", KeepaliveInterval)
+	}
+
+	if secs := config.Base.GetInt(MODULE, "conn-idle-seconds", 0); secs > 0 {
+		ConnIdleTimeout = time.Duration(secs) * time.Second
+		log.Infof("Connection idle timeout %v", ConnIdleTimeout)
+	}
+}
+
+// Time allowed to write a message to client, separate from the read deadline.
+// A write exceeding it fails, which closes the connection. Defaults to WriteWait.
+var WriteTimeout = WriteWait
+
+// Number of consecutive slow writes, each taking more than half of WriteTimeout,
+// after which the connection is closed as unhealthy. A client that barely keeps
+// up would otherwise hold its push loop for up to WriteTimeout per write.
+var MaxSlowWrites = 3
+
+// Slow write metric.
+const METRIC_SLOW_WRITE_CLOSES = "wapi_slow_write_closes_total"
+
+// Read write timeout from config.
+func initWriteTimeout() {
+	if ms := config.Base.GetInt(MODULE, "write-timeout-ms", 0); ms > 0 {
+		WriteTimeout = time.Duration(ms) * time.Millisecond
+		log.Infof("Write timeout %v", WriteTimeout)
+	}
+	MaxSlowWrites = config.Base.GetInt(MODULE, "max-slow-writes", MaxSlowWrites)
+}
+
 // Websocket upgrader.
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  2 * MaxMessageSize,
 	WriteBufferSize: 2 * MaxMessageSize,
 	CheckOrigin:     func(r *http.Request) bool { return true },
+	Subprotocols:    subprotocols(ProtocolVersion),
 }
 
 // Websocket message envelope.
+//
+// Envelopes are sent as JSON text frames. Pushes of binary payloads are sent as
+// binary frames instead: the envelope, with ContentType set, followed by the
+// raw data (see util.EncodeFrame).
 type Envelope struct {
-	Rid       string          `json:"rid,omitempty"`   // Resource identifier.
-	Timestamp int64           `json:"timestamp"`       // UTC timestamp in milliseconds.
-	Method    string          `json:"method"`          // Method: "GET", "POST" or "PUSH".
-	Uri       string          `json:"uri"`             // URI endpoint.
-	Push      bool            `json:"push"`            // Message pushed from server.
-	Data      json.RawMessage `json:"data,omitempty"`  // Data.
-	Error     json.RawMessage `json:"error,omitempty"` // Error.
+	Version     int             `json:"version,omitempty"`     // Protocol version, from version 2.
+	Rid         string          `json:"rid,omitempty"`         // Resource identifier.
+	Timestamp   int64           `json:"timestamp"`             // UTC timestamp in milliseconds.
+	Method      string          `json:"method"`                // Method: "GET", "POST" or "PUSH".
+	Uri         string          `json:"uri"`                   // URI endpoint.
+	Push        bool            `json:"push"`                  // Message pushed from server.
+	Page        *PageInfo       `json:"page,omitempty"`        // Page metadata of list response.
+	Location    string          `json:"location,omitempty"`    // Location of created resource.
+	ETag        string          `json:"etag,omitempty"`        // Entity tag of response.
+	IfNoneMatch string          `json:"ifNoneMatch,omitempty"` // Entity tags of conditional request.
+	ObjVersion  string          `json:"objVersion,omitempty"`  // Version token of object.
+	ContentType util.MediaType  `json:"contentType,omitempty"` // Content type of binary data.
+	Data        json.RawMessage `json:"data,omitempty"`        // Data.
+	Error       json.RawMessage `json:"error,omitempty"`       // Error.
+	Status      int             `json:"status,omitempty"`      // HTTP status of response, from version 2.
+	Binary      []byte          `json:"-"`                     // Binary data.
 }
 
 // Websocket connection.
 type Conn struct {
-	ws        *websocket.Conn // Websocket connection.
-	envelope  Envelope        // Message envelope.
-	LogPrefix string          // Log prefix.
+	ws         *websocket.Conn // Websocket connection.
+	wmu        sync.Mutex      // Mutex serializing writes from API and push loops.
+	slowWrite  int             // Number of consecutive slow writes, guarded by wmu.
+	done       chan struct{}   // Closed when API loop exits.
+	version    int             // Negotiated protocol version.
+	idle       time.Duration   // Idle timeout, from ConnIdleTimeout.
+	active     atomic.Int64    // Time of last activity, in Unix nanoseconds.
+	envelope   Envelope        // Message envelope.
+	objVersion string          // Version token of object in request.
+	closeOnce  sync.Once       // Close connection once.
+	LogPrefix  string          // Log prefix.
+}
+
+// Note activity on connection, resetting its idle timeout.
+func (c *Conn) touch() {
+	c.active.Store(time.Now().UnixNano())
+}
+
+// Get time left until connection is idle.
+func (c *Conn) idleLeft() time.Duration {
+	return c.idle - time.Since(time.Unix(0, c.active.Load()))
 }
 
 func (c *Conn) Errorf(format string, v ...interface{}) {
@@ -68,7 +152,7 @@ func (c *Conn) Debugf(format string, v ...interface{}) {
 
 // Get JSON data from envelope.
 func (c *Conn) wsGetData(v interface{}) error {
-	return json.Unmarshal(c.envelope.Data, v)
+	return unmarshalJSON(c.envelope.Data, v)
 }
 
 // Return success.
@@ -76,7 +160,7 @@ func (c *Conn) wsReturnOk(v interface{}) {
 	var err error
 
 	// Encode data.
-	if c.envelope.Data, err = json.Marshal(v); err != nil {
+	if c.envelope.Data, err = marshalJSON(v); err != nil {
 		c.Errorf("JSON data encode failed: %s", err)
 		c.envelope.Data = nil
 		c.envelope.Error, _ = util.ErrInternal.MarshalJSON()
@@ -84,12 +168,12 @@ func (c *Conn) wsReturnOk(v interface{}) {
 		c.envelope.Error = nil
 	}
 
-	// Set timestamp.
+	// Set timestamp and version.
 	c.envelope.Timestamp = util.NowMilli()
+	c.setVersion(&c.envelope, http.StatusOK)
 
 	// Write response.
-	c.ws.SetWriteDeadline(time.Now().Add(WriteWait))
-	if err = c.ws.WriteJSON(&c.envelope); err != nil {
+	if err = c.writeJSON(&c.envelope); err != nil {
 		c.Errorf("OK: write envelope error: %s", err)
 		return
 	}
@@ -97,28 +181,141 @@ func (c *Conn) wsReturnOk(v interface{}) {
 	return
 }
 
+// Return bytes as binary frame.
+func (c *Conn) wsReturnBytes(contentType util.MediaType, data []byte) {
+	c.envelope.Data = nil
+	c.envelope.Error = nil
+	c.envelope.ContentType = contentType
+
+	// Set timestamp and version.
+	c.envelope.Timestamp = util.NowMilli()
+	c.setVersion(&c.envelope, http.StatusOK)
+
+	// Write response.
+	if err := c.writeFrame(&c.envelope, data); err != nil {
+		c.Errorf("Bytes: write frame error: %s", err)
+	}
+}
+
+// Return not modified, without data.
+func (c *Conn) wsReturnNotModified() {
+	c.envelope.Data = nil
+	c.envelope.Error = nil
+
+	// Set timestamp and version.
+	c.envelope.Timestamp = util.NowMilli()
+	c.envelope.Status = 0
+	c.setVersion(&c.envelope, http.StatusNotModified)
+
+	// Write response.
+	if err := c.writeJSON(&c.envelope); err != nil {
+		c.Errorf("Not modified: write envelope error: %s", err)
+	}
+}
+
 // Return error.
 func (c *Conn) wsReturnError(err error) {
-	c.envelope.Error, _ = err.(util.Err).MarshalJSON()
+	c.envelope.Error, _ = json.Marshal(err)
 	c.envelope.Data = nil
+	c.envelope.Location = ""
+	c.envelope.ETag = ""
+	c.envelope.ObjVersion = ""
 
-	// Set timestamp.
+	// Set timestamp and version.
 	c.envelope.Timestamp = util.NowMilli()
+	c.envelope.Status = 0
+	c.setVersion(&c.envelope, errorStatus(err))
 
 	// Write response.
-	c.ws.SetWriteDeadline(time.Now().Add(WriteWait))
-	if err = c.ws.WriteJSON(&c.envelope); err != nil {
+	if err = c.writeJSON(&c.envelope); err != nil {
 		c.Errorf("Error: write envelope error: %s", err)
 		return
 	}
 }
 
+// Write JSON message, encoded with configured settings.
+func (c *Conn) writeJSON(v interface{}) error {
+	data, err := marshalJSON(v)
+	if err != nil {
+		return err
+	}
+
+	return c.writeMessage(websocket.TextMessage, data)
+}
+
+// Write message of given type.
+func (c *Conn) writeMessage(msgType int, data []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	return c.timedWrite(func() error {
+		return c.ws.WriteMessage(msgType, data)
+	})
+}
+
+// Write with write deadline, tracking slow writes. Returns util.ErrTimeout once
+// the client is considered unhealthy: on write deadline exceeded, or after
+// MaxSlowWrites consecutive slow writes. Caller must hold wmu.
+func (c *Conn) timedWrite(write func() error) error {
+	start := time.Now()
+	c.ws.SetWriteDeadline(start.Add(WriteTimeout))
+
+	err := write()
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		c.Errorf("Write timeout %v exceeded: closing unhealthy connection", WriteTimeout)
+		metrics.Add(METRIC_SLOW_WRITE_CLOSES, 1)
+		return util.ErrTimeout
+	} else if err != nil {
+		return err
+	}
+
+	if time.Since(start) <= WriteTimeout/2 {
+		c.slowWrite = 0
+		return nil
+	}
+
+	if c.slowWrite++; MaxSlowWrites > 0 && c.slowWrite >= MaxSlowWrites {
+		c.Errorf("%d consecutive slow writes: closing unhealthy connection", c.slowWrite)
+		metrics.Add(METRIC_SLOW_WRITE_CLOSES, 1)
+		return util.ErrTimeout
+	}
+
+	return nil
+}
+
+// Write envelope and binary data as a binary frame.
+func (c *Conn) writeFrame(e *Envelope, data []byte) error {
+	frame, err := util.EncodeFrame(e, data)
+	if err != nil {
+		return err
+	}
+
+	return c.writeMessage(websocket.BinaryMessage, frame)
+}
+
+// Close connection, sending a close frame with status code and reason first,
+// so that clients can tell terminations to recover from, e.g. going away on
+// shutdown, from those to give up on, e.g. policy violation on auth failure.
+// Only the first call sends a close frame.
+func (c *Conn) closeWith(code int, reason string) {
+	c.closeOnce.Do(func() {
+		msg := websocket.FormatCloseMessage(code, reason)
+		err := c.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(WriteTimeout))
+		if err != nil && err != websocket.ErrCloseSent {
+			c.Debugf("Close %d send error: %v", code, err)
+		}
+		c.ws.Close()
+	})
+}
+
 func (c *Conn) apiLoop(w http.ResponseWriter, r *http.Request) {
 	var err error
+	code, reason := websocket.CloseNormalClosure, ""
 
 	defer func() {
 		httpcontext.Clear(r)
-		c.ws.Close()
+		c.closeWith(code, reason)
+		close(c.done)
 	}()
 
 	// Configure websocket connection.
@@ -129,9 +326,26 @@ func (c *Conn) apiLoop(w http.ResponseWriter, r *http.Request) {
 		return nil
 	})
 
+	// Answer client-initiated pings, which also show the client is alive.
+	c.ws.SetPingHandler(func(data string) error {
+		c.ws.SetReadDeadline(time.Now().Add(PingTimeout))
+		err := c.ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(WriteTimeout))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		return err
+	})
+
 	for {
 		// Read API request from client.
 		c.envelope.Data = nil
+		c.envelope.Page = nil
+		c.envelope.Location = ""
+		c.envelope.ETag = ""
+		c.envelope.IfNoneMatch = ""
+		c.envelope.ObjVersion = ""
+		c.envelope.ContentType = ""
+		c.envelope.Status = 0
 		c.ws.SetReadDeadline(time.Now().Add(PingTimeout))
 		if err := c.ws.ReadJSON(&c.envelope); err != nil {
 			if err == io.EOF {
@@ -139,20 +353,38 @@ func (c *Conn) apiLoop(w http.ResponseWriter, r *http.Request) {
 				break
 			}
 
+			if _, ok := err.(*websocket.CloseError); ok {
+				// Closed by client. Close frame is answered already.
+				break
+			}
+
+			if err == websocket.ErrReadLimit {
+				// Message too big. Close frame is sent already.
+				c.Debugf("Read envelope: %s", err)
+				break
+			}
+
 			if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
 				// Read timed out. Client is not responding to ping.
 				// Close the connection and move on.
 				c.Debugf("Read envelope timed out: %s", err)
+				code, reason = websocket.CloseGoingAway, "ping timeout"
 				break
 			}
 
 			// Read error, possibly due to wrong JSON format.
 			// c.Errorf("Read envelope error: %s", err)
 			c.wsReturnError(util.ErrJsonDecode)
+			code, reason = websocket.CloseInvalidFramePayloadData, "invalid envelope"
 			break
 		}
 
 		c.Debugf("Method %s, URI %s, Data %s", c.envelope.Method, c.envelope.Uri, string(c.envelope.Data))
+		c.touch()
+
+		// Take version token of request, so that it is not echoed in response.
+		c.objVersion = c.envelope.ObjVersion
+		c.envelope.ObjVersion = ""
 
 		if r.URL, err = url.ParseRequestURI(c.envelope.Uri); err != nil {
 			c.Errorf("Invalid URI %s: %v", c.envelope.Uri, err)
@@ -160,6 +392,18 @@ func (c *Conn) apiLoop(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
+		if health.unhealthy.Load() {
+			// Dependencies unhealthy. Shed load until they recover.
+			c.wsReturnError(util.ErrUnavailable)
+			continue
+		}
+
+		if !globalLimiter.Load().Allow() {
+			// Global request budget exhausted. Shed load.
+			c.wsReturnError(util.ErrRateLimit)
+			continue
+		}
+
 		if handler, params, _ := router.mux.Lookup(c.envelope.Method, r.URL.Path); handler != nil {
 			handler(w, r, params)
 		} else {
@@ -169,8 +413,32 @@ func (c *Conn) apiLoop(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Write push payload.
+func (c *Conn) writePush(pe *Envelope, payload *push.Payload) error {
+	c.Debugf("Kind %s, Op %s, URI %s, Data %s", payload.Kind, payload.Op, payload.Uri, string(payload.Data))
+
+	// Copy payload content.
+	pe.Rid = payload.Kind
+	pe.Method = string(payload.Op)
+	pe.Uri = payload.Uri
+	pe.ContentType = payload.ContentType
+	pe.Data = payload.Data
+
+	// Set timestamp and version.
+	pe.Timestamp = util.NowMilli()
+	c.setVersion(pe, 0)
+
+	// Push.
+	if payload.IsBinary() {
+		return c.writeFrame(pe, payload.Binary)
+	}
+
+	return c.writeJSON(pe)
+}
+
 func (c *Conn) pushLoop(userId, sessionId string) {
 	var err error
+	code, reason := websocket.CloseNormalClosure, ""
 	pe := Envelope{
 		Push: true,
 	}
@@ -178,13 +446,33 @@ func (c *Conn) pushLoop(userId, sessionId string) {
 	// Open push session.
 	duct := push.OpenSession(userId, sessionId, true)
 
+	// Watch for session kicked by admin.
+	kicked := push.Kicked(userId, sessionId)
+
 	// Create ticker for sending ping messages.
 	ticker := time.NewTicker(PingInterval)
 
+	// Create ticker for sending keepalive pushes, if enabled.
+	var keepalive <-chan time.Time
+	if KeepaliveInterval > 0 {
+		keepaliveTicker := time.NewTicker(KeepaliveInterval)
+		defer keepaliveTicker.Stop()
+		keepalive = keepaliveTicker.C
+	}
+
+	// Create timer for closing idle connection, if enabled.
+	var idleTimer *time.Timer
+	var idle <-chan time.Time
+	if c.idle > 0 {
+		idleTimer = time.NewTimer(c.idle)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
 	defer func() {
 		ticker.Stop()
 		push.CloseSession(userId, sessionId, duct)
-		c.ws.Close()
+		c.closeWith(code, reason)
 	}()
 
 	for {
@@ -194,37 +482,71 @@ func (c *Conn) pushLoop(userId, sessionId string) {
 				continue
 			}
 
-			c.Debugf("Kind %s, Op %s, URI %s, Data %s", payload.Kind, payload.Op, payload.Uri, string(payload.Data))
-
-			// Copy payload content.
-			pe.Rid = payload.Kind
-			pe.Method = string(payload.Op)
-			pe.Uri = payload.Uri
-			pe.Data = payload.Data
+			// Relieve backlog of slow client, then push.
+			for _, p := range c.relieveBacklog(payload, duct, userId, sessionId) {
+				if p.Expired() {
+					// Stale: drop it.
+					metrics.Add(METRIC_PUSH_EXPIRED, 1)
+					continue
+				}
+				if err = c.writePush(&pe, p); err != nil {
+					if err == io.EOF {
+						// Connection closed.
+						return
+					}
+					c.Errorf("Push: write envelope error: %v", err)
+					code, reason = websocket.CloseInternalServerErr, "write error"
+					return
+				}
+			}
+			c.touch()
 
-			// Set timestamp.
-			pe.Timestamp = util.NowMilli()
+		case <-keepalive:
+			ke := Envelope{
+				Timestamp: util.NowMilli(),
+				Method:    KeepaliveMethod,
+				Push:      true,
+			}
+			c.setVersion(&ke, 0)
 
-			// Push.
-			c.ws.SetWriteDeadline(time.Now().Add(WriteWait))
-			if err = c.ws.WriteJSON(&pe); err != nil {
+			if err = c.writeJSON(&ke); err != nil {
 				if err == io.EOF {
 					// Connection closed.
 					return
 				}
-				c.Errorf("Push: write envelope error: %v", err)
+				c.Errorf("Keepalive send error: %s", err)
+				code, reason = websocket.CloseInternalServerErr, "write error"
 				return
 			}
 
+		case <-c.done:
+			// API loop exited.
+			return
+
+		case <-kicked:
+			c.Debugf("Session %s:%s kicked", userId, sessionId)
+			code, reason = websocket.ClosePolicyViolation, "session kicked"
+			return
+
+		case <-idle:
+			// Timer was armed at last check. Re-arm it if there was activity since.
+			if left := c.idleLeft(); left > 0 {
+				idleTimer.Reset(left)
+				continue
+			}
+			c.Debugf("Connection idle for %v: closing", c.idle)
+			reason = "idle timeout"
+			return
+
 		case <-ticker.C:
 			//c.Debugf("Ping")
-			c.ws.SetWriteDeadline(time.Now().Add(WriteWait))
-			if err = c.ws.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
+			if err = c.writeMessage(websocket.PingMessage, []byte{}); err != nil {
 				if err == io.EOF {
 					// Connection closed.
 					return
 				}
 				c.Errorf("Ping send error: %s", err)
+				code, reason = websocket.CloseInternalServerErr, "write error"
 				return
 			}
 		}
@@ -232,7 +554,8 @@ func (c *Conn) pushLoop(userId, sessionId string) {
 }
 
 func NewConn(w http.ResponseWriter, r *http.Request, logPrefix string) (c *Conn, err error) {
-	c = &Conn{LogPrefix: logPrefix}
+	c = &Conn{LogPrefix: logPrefix, done: make(chan struct{}), idle: ConnIdleTimeout}
+	c.touch()
 
 	// Upgrade to websocket.
 	c.ws, err = upgrader.Upgrade(w, r, nil)
@@ -241,6 +564,9 @@ func NewConn(w http.ResponseWriter, r *http.Request, logPrefix string) (c *Conn,
 		return c, util.ErrInternal
 	}
 
+	// Negotiated protocol version.
+	c.version = subprotocolVersion(c.ws.Subprotocol())
+
 	// Save context in request.
 	httpcontext.Set(r, WS, c)
 
@@ -248,9 +574,34 @@ func NewConn(w http.ResponseWriter, r *http.Request, logPrefix string) (c *Conn,
 }
 
 func (c *Conn) StartLoop(w http.ResponseWriter, r *http.Request, userId, sessionId string) {
-	// Start the websocket loop.
-	go c.pushLoop(userId, sessionId)
+	// Validate session before dispatching any request.
+	if err := ValidateSession(userId, sessionId); err != nil {
+		c.Errorf("Invalid session: user %q, session %q", userId, sessionId)
+		httpcontext.Clear(r)
+		c.closeWith(websocket.ClosePolicyViolation, "invalid session")
+		return
+	}
+
+	// Track connection for graceful shutdown.
+	if !trackConn(c) {
+		c.Debugf("Server draining: closing connection")
+		httpcontext.Clear(r)
+		c.closeWith(websocket.CloseGoingAway, "server shutdown")
+		return
+	}
+	defer untrackConn(c)
+
+	// Save user in request context for handlers.
+	SetUser(r, UserInfo{Id: userId, SessionId: sessionId})
+
+	// Start the websocket loop. Wait for push loop to close its session.
+	pushDone := make(chan struct{})
+	go func() {
+		c.pushLoop(userId, sessionId)
+		close(pushDone)
+	}()
 	c.apiLoop(w, r)
+	<-pushDone
 }
 
 func init() {
@@ -0,0 +1,375 @@
+package wapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/sath33sh/infra/push"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Pushable binary test object.
+type binaryObject struct {
+	data []byte
+}
+
+func (obj *binaryObject) BuildPushPayload() (*push.Payload, error) {
+	p := &push.Payload{
+		Kind:        "test",
+		Op:          push.UPSERT,
+		Uri:         "/test/binary",
+		ContentType: "application/octet-stream",
+		Binary:      obj.data,
+	}
+
+	return p, nil
+}
+
+func TestBinaryPush(t *testing.T) {
+	host, closeServer := newTestServer(t, "binary", "s1")
+	defer closeServer()
+
+	c := newTestClient(t, host)
+	defer c.ws.Close()
+	pushes := c.Pushes()
+
+	// Push once the server has opened the push session.
+	data := []byte{0x00, '{', 0x80, 0xff}
+	deadline := time.Now().Add(time.Second)
+	for {
+		if delivered, _ := push.PushToUsers([]string{"binary"}, &binaryObject{data: data}); delivered > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Push session not opened")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case e := <-pushes:
+		if !e.Push || e.ContentType != "application/octet-stream" || e.Uri != "/test/binary" ||
+			!bytes.Equal(e.Binary, data) {
+			t.Errorf("Unexpected push %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Push not received")
+	}
+}
+
+func TestBinaryPushBroker(t *testing.T) {
+	// Route publishes through in-memory broker. Broker is disabled in tests.
+	defer push.SetTransport(nil)
+	push.SetTransport(push.NewMemTransport())
+	push.SubscribeFromBroker([]string{"test"})
+
+	host, closeServer := newTestServer(t, "binarybroker", "s1")
+	defer closeServer()
+
+	c := newTestClient(t, host)
+	defer c.ws.Close()
+	pushes := c.Pushes()
+
+	// Subscribe once the server has opened the push session.
+	for deadline := time.Now().Add(time.Second); len(push.Sessions("binarybroker")) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Push session not opened")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := push.Subscribe("/test/binary", "binarybroker", "s1", true); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	data := []byte{0x00, '{', 0x80, 0xff}
+	if err := push.Publish(&binaryObject{data: data}); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+
+	select {
+	case e := <-pushes:
+		if !e.Push || e.ContentType != "application/octet-stream" || e.Uri != "/test/binary" ||
+			!bytes.Equal(e.Binary, data) {
+			t.Errorf("Unexpected push %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Push not received")
+	}
+}
+
+func TestWebsocketJSONSettings(t *testing.T) {
+	defer func() { JSONEscapeHTML, JSONIndent = true, "" }()
+
+	host := harnessHost(t)
+	hdr := http.Header{
+		HeaderUserId:      {"jsonsettings"},
+		HeaderSessionId:   {"s1"},
+		HeaderAccessToken: {"token"},
+	}
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+host+"/ws", hdr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer ws.Close()
+
+	tests := []struct {
+		escape bool
+		indent string
+		expect string
+	}{
+		{true, "", `"url":"/a?b=1\u0026c=2"`},
+		{false, "", `"url":"/a?b=1&c=2"`},
+		{false, "  ", "\n    \"url\": \"/a?b=1&c=2\""},
+	}
+
+	for i, tt := range tests {
+		JSONEscapeHTML, JSONIndent = tt.escape, tt.indent
+
+		req := Envelope{Rid: fmt.Sprint(i), Method: "POST", Uri: "/test/echomap", Data: json.RawMessage(`{"url":"/a?b=1&c=2"}`)}
+		if err := ws.WriteJSON(&req); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+
+		// Check raw frame, skipping pushes.
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		for {
+			msgType, data, err := ws.ReadMessage()
+			if err != nil {
+				t.Fatalf("Read failed: %v", err)
+			}
+
+			var e Envelope
+			if msgType != websocket.TextMessage || json.Unmarshal(data, &e) != nil || e.Push {
+				continue
+			}
+
+			if !strings.Contains(string(data), tt.expect) {
+				t.Errorf("Escape %v, indent %q: expected %s in frame %s", tt.escape, tt.indent, tt.expect, data)
+			}
+			break
+		}
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	// Push loops take the keepalive interval on start.
+	defer func() { KeepaliveInterval = 0 }()
+	KeepaliveInterval = 50 * time.Millisecond
+
+	// Keepalive pushes arrive on the wire.
+	host := harnessHost(t)
+	hdr := http.Header{
+		HeaderUserId:      {"keepalive"},
+		HeaderSessionId:   {"s1"},
+		HeaderAccessToken: {"token"},
+	}
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+host+"/ws", hdr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer ws.Close()
+
+	for n := 0; n < 2; {
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		var e Envelope
+		if err := ws.ReadJSON(&e); err != nil {
+			t.Fatalf("Keepalive not received: %v", err)
+		}
+		if e.Push && e.Method == KeepaliveMethod {
+			n++
+		}
+	}
+
+	// Client discards them: neither pushes nor responses.
+	c := newHarnessClient(t, "keepalive", "s2")
+	pushes := c.Pushes()
+	time.Sleep(4 * KeepaliveInterval)
+
+	resp, err := Call[map[string]string, map[string]string](c, "POST", "/test/echomap", map[string]string{"event": "echo"})
+	if err != nil || resp["event"] != "echo" {
+		t.Errorf("Unexpected response %v, error %v", resp, err)
+	}
+
+	select {
+	case e := <-pushes:
+		t.Errorf("Unexpected push %+v", e)
+	default:
+	}
+}
+
+func TestIntegrationStuckClient(t *testing.T) {
+	// Harness server write timeout is configured below WriteWait.
+	host := harnessHost(t)
+
+	// Connect client that never reads.
+	hdr := http.Header{
+		HeaderUserId:      {"stuck"},
+		HeaderSessionId:   {"s1"},
+		HeaderAccessToken: {"token"},
+	}
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+host+"/ws", hdr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer ws.Close()
+
+	// Push until socket buffers fill up and the server closes the session.
+	data := make([]byte, 64*1024)
+	start := time.Now()
+	for online := false; ; {
+		n := len(push.Sessions("stuck"))
+		if n > 0 {
+			online = true
+		} else if online {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("Stuck client not closed")
+		}
+		push.PushToUsers([]string{"stuck"}, &binaryObject{data: data})
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Logf("Stuck client closed after %v", time.Since(start))
+}
+
+func TestConnIdleTimeout(t *testing.T) {
+	const idle = 300 * time.Millisecond
+
+	// Connections take the idle timeout on creation.
+	defer func() { ConnIdleTimeout = 0 }()
+	ConnIdleTimeout = idle
+	host, closeServer := newTestServer(t, "idle", "s1")
+	defer closeServer()
+
+	c := newTestClient(t, host)
+	defer c.ws.Close()
+	pushes := c.Pushes()
+
+	// Requests keep the connection open past the idle timeout.
+	for i := 0; i < 4; i++ {
+		time.Sleep(idle / 2)
+		if _, err := Call[struct{}, map[string]string](c, "GET", "/test/whoami", struct{}{}); err != nil {
+			t.Fatalf("Call %d failed: %v", i, err)
+		}
+	}
+
+	// Idle connection is closed.
+	start := time.Now()
+	select {
+	case _, ok := <-pushes:
+		if ok {
+			t.Errorf("Unexpected push")
+		}
+	case <-time.After(5 * idle):
+		t.Fatalf("Idle connection not closed")
+	}
+
+	if d := time.Since(start); d < idle/2 {
+		t.Errorf("Connection closed after %v, before idle timeout", d)
+	}
+}
+
+// Pushable test object with TTL.
+type ttlObject struct {
+	uri string
+	ttl time.Duration
+}
+
+func (obj *ttlObject) BuildPushPayload() (*push.Payload, error) {
+	p := &push.Payload{
+		Kind: "test",
+		Op:   push.UPSERT,
+		Uri:  obj.uri,
+		Data: []byte(`{}`),
+		TTL:  obj.ttl,
+	}
+
+	return p, nil
+}
+
+func TestPushTTL(t *testing.T) {
+	c := newHarnessClient(t, "16", "s16")
+	pushes := c.Pushes()
+
+	// Payload expires before push loop gets to it, and is dropped.
+	pushWhenOnline(t, "16", &ttlObject{uri: "/test/stale", ttl: time.Nanosecond})
+	pushWhenOnline(t, "16", &ttlObject{uri: "/test/fresh", ttl: time.Minute})
+
+	select {
+	case e := <-pushes:
+		if e.Uri != "/test/fresh" {
+			t.Errorf("Expected fresh push, got %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Push not received")
+	}
+}
+
+// Read from websocket until closed. Returns close code sent by server.
+func readCloseCode(t *testing.T, ws *websocket.Conn) int {
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			ce, ok := err.(*websocket.CloseError)
+			if !ok {
+				t.Fatalf("Expected close error, got %v", err)
+			}
+			return ce.Code
+		}
+	}
+}
+
+func TestCloseCodes(t *testing.T) {
+	// Wait for push session of user, before terminating it.
+	waitOnline := func(userId string) {
+		deadline := time.Now().Add(time.Second)
+		for len(push.Sessions(userId)) == 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("Push session of %s not opened", userId)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		userId    string
+		terminate func(ws *websocket.Conn)
+		code      int
+	}{
+		{"invalid session", "bad user", func(*websocket.Conn) {}, websocket.ClosePolicyViolation},
+		{"kicked", "closekick", func(*websocket.Conn) {
+			waitOnline("closekick")
+			push.KickSession("closekick", "s1")
+		}, websocket.ClosePolicyViolation},
+		{"invalid envelope", "closejson", func(ws *websocket.Conn) {
+			ws.WriteMessage(websocket.TextMessage, []byte("not json"))
+		}, websocket.CloseInvalidFramePayloadData},
+		{"shutdown", "closeshutdown", func(*websocket.Conn) {
+			waitOnline("closeshutdown")
+			closeConns(websocket.CloseGoingAway, "server shutdown")
+		}, websocket.CloseGoingAway},
+	}
+
+	for _, tt := range tests {
+		host, closeServer := newTestServer(t, tt.userId, "s1")
+
+		ws, _, err := websocket.DefaultDialer.Dial("ws://"+host+"/", nil)
+		if err != nil {
+			t.Fatalf("%s: dial failed: %v", tt.name, err)
+		}
+
+		tt.terminate(ws)
+		if code := readCloseCode(t, ws); code != tt.code {
+			t.Errorf("%s: expected close code %d, got %d", tt.name, tt.code, code)
+		}
+
+		ws.Close()
+		closeServer()
+	}
+}